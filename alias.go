@@ -0,0 +1,94 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"unicode/utf8"
+)
+
+// 备注名：本机给其他用户设置的显示名称，保存在 AppConfig.PeerAliases（key 为用户稳定标识，同屏蔽列表）。
+// 只影响本机的界面显示，不发送给对方，消息的 Sender、会话ID 等仍使用对方的真实用户名
+const maxPeerAliasLen = 32
+
+// aliasForKey 返回用户标识对应的备注名，没有时为空
+func (node *P2PNode) aliasForKey(userKey string) string {
+	if node.Config == nil || userKey == "" {
+		return ""
+	}
+	node.ConfigMutex.RLock()
+	defer node.ConfigMutex.RUnlock()
+	return node.Config.PeerAliases[userKey]
+}
+
+// aliasForName 按用户名查找备注名（先解析为稳定标识）
+func (node *P2PNode) aliasForName(name string) string {
+	if node.Config == nil || name == "" || name == "all" || name == node.Name {
+		return ""
+	}
+	node.ConfigMutex.RLock()
+	empty := len(node.Config.PeerAliases) == 0
+	node.ConfigMutex.RUnlock()
+	if empty {
+		return ""
+	}
+	return node.aliasForKey(node.lookupUserKey(name))
+}
+
+// labelForName 界面上显示的用户名称：有备注时为 "备注 (用户名)"
+func (node *P2PNode) labelForName(name string) string {
+	if alias := node.aliasForName(name); alias != "" {
+		return fmt.Sprintf("%s (%s)", alias, name)
+	}
+	return name
+}
+
+// setPeerAlias 设置或清除（alias 为空）用户的备注名并保存配置
+func (node *P2PNode) setPeerAlias(target, alias string) error {
+	if node.Config == nil {
+		return fmt.Errorf("配置不可用")
+	}
+	alias = strings.TrimSpace(alias)
+	if utf8.RuneCountInString(alias) > maxPeerAliasLen {
+		return fmt.Errorf("备注名不能超过 %d 个字符", maxPeerAliasLen)
+	}
+	key := node.resolveUserKey(target)
+	if key == "" || target == node.Name {
+		return fmt.Errorf("未找到用户 %s", target)
+	}
+
+	node.ConfigMutex.Lock()
+	if alias == "" {
+		delete(node.Config.PeerAliases, key)
+	} else {
+		if node.Config.PeerAliases == nil {
+			node.Config.PeerAliases = make(map[string]string)
+		}
+		node.Config.PeerAliases[key] = alias
+	}
+	node.ConfigMutex.Unlock()
+
+	if err := node.saveConfig(); err != nil {
+		Log.Error("保存备注名失败", "key", key, "error", err)
+		return err
+	}
+	Log.Info("备注名已更新", "name", node.nameForUserKey(key), "key", key, "alias", alias)
+	return nil
+}
+
+// peerAliasList 返回所有备注（用户显示名 -> 备注名）
+func (node *P2PNode) peerAliasList() map[string]string {
+	list := make(map[string]string)
+	if node.Config == nil {
+		return list
+	}
+	node.ConfigMutex.RLock()
+	aliases := make(map[string]string, len(node.Config.PeerAliases))
+	for key, alias := range node.Config.PeerAliases {
+		aliases[key] = alias
+	}
+	node.ConfigMutex.RUnlock()
+	for key, alias := range aliases {
+		list[node.nameForUserKey(key)] = alias
+	}
+	return list
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// 供脚本调用的 HTTP API（/api/ 前缀，与界面使用的内部端点分开维护）：
+//
+//	POST /api/message {"to": "用户名|all", "content": "..."}  发送文字消息，to 为空或 all 时为公聊
+//	POST /api/file    {"to": "用户名", "path": "本机文件路径"}  向在线用户发起文件传输
+//	GET  /api/peers                                             在线用户列表
+//
+// 所有请求（含 GET）都需携带本次运行的 API 令牌：X-LANShare-Token 或 Authorization: Bearer。
+// 令牌启动时写入数据目录下的 api_token 文件（仅当前用户可读），供本机脚本读取。
+// 响应统一为 {"ok": true, "data": ...} 或 {"ok": false, "error": "..."}
+const apiTokenFileName = "api_token"
+
+// apiResponse /api/ 端点的统一响应结构
+type apiResponse struct {
+	OK    bool        `json:"ok"`
+	Data  interface{} `json:"data,omitempty"`
+	Error string      `json:"error,omitempty"`
+}
+
+// apiPeer GET /api/peers 返回的用户信息
+type apiPeer struct {
+	Name string `json:"name"`
+	ID   string `json:"id"`
+	UUID string `json:"uuid,omitempty"`
+	IP   string `json:"ip"`
+}
+
+func writeAPIData(w http.ResponseWriter, data interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(apiResponse{OK: true, Data: data})
+}
+
+func writeAPIError(w http.ResponseWriter, status int, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(apiResponse{Error: message})
+}
+
+// writeAPITokenFile 将本次运行的 API 令牌写入数据目录，供本机脚本读取
+func (node *P2PNode) writeAPITokenFile() {
+	os.MkdirAll(AppDataDir(), 0755)
+	if err := writePrivateFile(DataPath(apiTokenFileName), []byte(node.APIToken)); err != nil {
+		Log.Warn("写入API令牌文件失败", "error", err)
+	}
+}
+
+// writePrivateFile 经临时文件写入后改名替换 path。CreateTemp 以 0600 创建，
+// 已存在的旧文件即使权限较宽也会被整体替换，令牌不会短暂出现在其他用户可读的文件里
+func writePrivateFile(path string, data []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	tmpPath := tmp.Name()
+	defer os.Remove(tmpPath)
+
+	_, writeErr := tmp.Write(data)
+	if err := tmp.Close(); err != nil && writeErr == nil {
+		writeErr = err
+	}
+	if writeErr != nil {
+		return writeErr
+	}
+	return os.Rename(tmpPath, path)
+}
+
+// requireScriptToken 校验 /api/ 请求的令牌
+func (node *P2PNode) requireScriptToken(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		token := r.Header.Get(apiTokenHeader)
+		if token == "" {
+			token = strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		}
+		if token == "" || subtle.ConstantTimeCompare([]byte(token), []byte(node.APIToken)) != 1 {
+			Log.Warn("拒绝未授权的API请求", "path", r.URL.Path, "remote", r.RemoteAddr)
+			writeAPIError(w, http.StatusUnauthorized, "令牌无效")
+			return
+		}
+		next(w, r)
+	}
+}
+
+// registerScriptAPI 注册 /api/ 端点；本机UI的 handler 与桌面模式的局域网 handler 都注册，
+// 使 CLI 和桌面模式下都能通过 Web 端口调用
+func (node *P2PNode) registerScriptAPI(mux *http.ServeMux) {
+	mux.HandleFunc("/api/message", node.requireScriptToken(node.handleAPIMessage))
+	mux.HandleFunc("/api/file", node.requireScriptToken(node.handleAPIFile))
+	mux.HandleFunc("/api/peers", node.requireScriptToken(node.handleAPIPeers))
+	mux.HandleFunc("/api/", node.requireScriptToken(func(w http.ResponseWriter, r *http.Request) {
+		writeAPIError(w, http.StatusNotFound, "未知的API")
+	}))
+}
+
+// handleAPIMessage 发送文字消息；内容不按命令解析
+func (node *P2PNode) handleAPIMessage(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		writeAPIError(w, http.StatusMethodNotAllowed, "Method not allowed")
+		return
+	}
+	var req struct {
+		To      string `json:"to"`
+		Content string `json:"content"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeAPIError(w, http.StatusBadRequest, "请求格式错误")
+		return
+	}
+	if strings.TrimSpace(req.Content) == "" {
+		writeAPIError(w, http.StatusBadRequest, "消息不能为空")
+		return
+	}
+
+	if req.To == "" || req.To == "all" {
+		writeAPIData(w, map[string]string{"messageId": node.sendPublicText(req.Content, "")})
+		return
+	}
+	messageID, err := node.sendPrivateText(req.To, req.Content, "")
+	if err != nil {
+		status := http.StatusNotFound
+		if err == errPrivateTargetBlocked {
+			status = http.StatusForbidden
+		}
+		writeAPIError(w, status, err.Error())
+		return
+	}
+	writeAPIData(w, map[string]string{"messageId": messageID})
+}
+
+// handleAPIFile 向在线用户发起文件传输，文件须在本机；对方接受后开始发送
+func (node *P2PNode) handleAPIFile(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		writeAPIError(w, http.StatusMethodNotAllowed, "Method not allowed")
+		return
+	}
+	var req struct {
+		To   string `json:"to"`
+		Path string `json:"path"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeAPIError(w, http.StatusBadRequest, "请求格式错误")
+		return
+	}
+	if req.To == "" || req.To == "all" {
+		writeAPIError(w, http.StatusBadRequest, "请指定接收文件的用户")
+		return
+	}
+	info, err := os.Stat(req.Path)
+	if err != nil || info.IsDir() {
+		writeAPIError(w, http.StatusBadRequest, "文件不存在或无法访问")
+		return
+	}
+	peer := node.findPeer(req.To)
+	if peer == nil {
+		writeAPIError(w, http.StatusNotFound, errPrivateTargetNotFound.Error())
+		return
+	}
+	if node.isPeerBlocked(peer) {
+		writeAPIError(w, http.StatusForbidden, "用户已被屏蔽，无法发送文件")
+		return
+	}
+
+	fileID := node.sendFileTransferRequest(req.Path, peer.Name)
+	if fileID == "" {
+		writeAPIError(w, http.StatusInternalServerError, "发起文件传输失败")
+		return
+	}
+	writeAPIData(w, map[string]string{"fileId": fileID})
+}
+
+// handleAPIPeers 返回在线用户列表
+func (node *P2PNode) handleAPIPeers(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		writeAPIError(w, http.StatusMethodNotAllowed, "Method not allowed")
+		return
+	}
+	peers := []apiPeer{}
+	node.PeersMutex.RLock()
+	for _, peer := range node.Peers {
+		if peer.IsActive {
+			peers = append(peers, apiPeer{Name: peer.Name, ID: peer.ID, UUID: peer.UUID, IP: peer.IP})
+		}
+	}
+	node.PeersMutex.RUnlock()
+	writeAPIData(w, peers)
+}
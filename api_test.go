@@ -0,0 +1,40 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+)
+
+// 旧的令牌文件权限过宽时，重写后应替换为仅当前用户可读的新文件
+func TestWritePrivateFileReplacesLoosePermissions(t *testing.T) {
+	path := filepath.Join(t.TempDir(), apiTokenFileName)
+	if err := os.WriteFile(path, []byte("旧令牌"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	os.Chmod(path, 0644)
+
+	if err := writePrivateFile(path, []byte("新令牌")); err != nil {
+		t.Fatalf("写入失败: %v", err)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "新令牌" {
+		t.Fatalf("文件内容 = %q，期望 %q", data, "新令牌")
+	}
+	if runtime.GOOS != "windows" {
+		info, err := os.Stat(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if perm := info.Mode().Perm(); perm != 0600 {
+			t.Fatalf("文件权限 = %o，期望 600", perm)
+		}
+	}
+	if matches, _ := filepath.Glob(path + ".*.tmp"); len(matches) > 0 {
+		t.Fatalf("残留临时文件: %v", matches)
+	}
+}
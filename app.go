@@ -5,6 +5,7 @@ import (
 	"context"
 	_ "embed"
 	"encoding/base64"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
@@ -12,7 +13,8 @@ import (
 	"os/exec"
 	"path/filepath"
 	goruntime "runtime"
-	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/gen2brain/beeep"
@@ -31,6 +33,13 @@ type DesktopApp struct {
 	cfg                *AppConfig
 	sharingServer      *http.Server
 	lastNotifiedChatId string
+
+	// 托盘未读计数：窗口未聚焦或不在对应会话时收到的消息
+	unreadMu     sync.Mutex
+	unreadCount  int
+	activeChatId string // 前端聚焦时正在查看的会话，失焦时为空
+
+	quitting atomic.Bool // 已主动请求退出（托盘菜单等），关闭窗口时不再隐藏到托盘
 }
 
 // NewDesktopApp creates a new DesktopApp instance.
@@ -53,15 +62,49 @@ func (a *DesktopApp) startup(ctx context.Context) {
 	// Default notification app name (JS updates via SetNotificationAppName on theme change)
 	beeep.AppName = "LS Messager"
 
+	if a.node.DBCorruptBackup != "" {
+		beeep.Notify("聊天记录数据库已损坏", "已备份为 "+filepath.Base(a.node.DBCorruptBackup)+" 并重建，之前的聊天记录暂不可见", "")
+	}
+
 	// Set up event callbacks to push real-time events to frontend
 	a.node.OnNewMessage = func(msg ChatMessage) {
 		wailsRuntime.EventsEmit(a.ctx, EventNewMessage, msg)
+		if !msg.IsOwn && !msg.Muted {
+			a.countUnread(chatIDForMessage(msg.Sender, msg.Recipient, msg.IsOwn, msg.IsPrivate))
+		}
+		// @提及直接由Go侧通知，窗口最小化/未聚焦时前端可能被挂起
+		if msg.Mentioned && !msg.Muted {
+			chatId := "all"
+			if msg.IsPrivate {
+				chatId = msg.Sender
+			}
+			preview := []rune(msg.Content)
+			if len(preview) > 100 {
+				preview = preview[:100]
+			}
+			a.ShowNotification("你被提到了 - "+a.node.labelForName(msg.Sender), string(preview), chatId)
+		}
+	}
+	a.node.OnUserOnline = func(name string, seq uint64) {
+		wailsRuntime.EventsEmit(a.ctx, EventUserOnline, name, seq)
+	}
+	a.node.OnUserOffline = func(name string, seq uint64) {
+		wailsRuntime.EventsEmit(a.ctx, EventUserOffline, name, seq)
+	}
+	a.node.OnMessageFailed = func(messageID string) {
+		wailsRuntime.EventsEmit(a.ctx, EventMessageFailed, messageID)
+	}
+	a.node.OnMessageStatus = func(messageID, status string) {
+		wailsRuntime.EventsEmit(a.ctx, EventMessageStatus, messageID, status)
 	}
-	a.node.OnUserOnline = func(name string) {
-		wailsRuntime.EventsEmit(a.ctx, EventUserOnline, name)
+	a.node.OnNameConflict = func(name, displayName string) {
+		wailsRuntime.EventsEmit(a.ctx, EventNameConflict, name, displayName)
 	}
-	a.node.OnUserOffline = func(name string) {
-		wailsRuntime.EventsEmit(a.ctx, EventUserOffline, name)
+	a.node.OnHistoryChanged = func(chatID string) {
+		wailsRuntime.EventsEmit(a.ctx, EventHistoryChanged, chatID)
+	}
+	a.node.OnPinnedMessagesChanged = func(chatID string) {
+		wailsRuntime.EventsEmit(a.ctx, EventPinnedMessages, chatID)
 	}
 	a.node.OnUpdateAvailable = func(source updateSource) {
 		wailsRuntime.EventsEmit(a.ctx, EventUpdateAvailable, source)
@@ -73,11 +116,16 @@ func (a *DesktopApp) startup(ctx context.Context) {
 			a.sharingServer.Shutdown(shutCtx)
 		}
 	}
-	a.node.OnQuitApp = func() {
-		wailsRuntime.Quit(a.ctx)
-	}
+	a.node.OnQuitApp = a.quit
 	Log.Debug("Wails OnStartup: 事件回调注册完成", "耗时", time.Since(tStartup))
 
+	// 程序更新或移动后路径可能变化，按保存的设置刷新启动项
+	if a.cfg.AutoStart {
+		if err := setAutoStart(true); err != nil {
+			Log.Warn("刷新开机自启动项失败", "error", err)
+		}
+	}
+
 	// Start P2P node (TCP listener, discovery, message handling)
 	tStep := time.Now()
 	if err := a.node.Start(); err != nil {
@@ -85,7 +133,7 @@ func (a *DesktopApp) startup(ctx context.Context) {
 	}
 	Log.Debug("Wails OnStartup: node.Start() 完成", "耗时", time.Since(tStep), "tcpPort", a.node.LocalPort, "ip", a.node.LocalIP)
 
-	// Start LAN sharing server (serves Web UI and WebView2 runtime to LAN peers)
+	// Start LAN sharing server (serves version info, update binary and WebView2 runtime to LAN peers)
 	tStep = time.Now()
 	a.startSharingServer()
 	Log.Debug("Wails OnStartup: startSharingServer 调度完成", "耗时", time.Since(tStep), "webPort", a.node.WebPort)
@@ -96,13 +144,23 @@ func (a *DesktopApp) startup(ctx context.Context) {
 // onDomReady is called when the WebView2 DOM is fully loaded.
 func (a *DesktopApp) onDomReady(ctx context.Context) {
 	Log.Debug("Wails OnDomReady 回调触发 — 界面已可交互")
+
+	// macOS/Linux 在 Go 侧接收拖放路径并转交前端选择目标发送；Windows 由前端直接处理
+	if registerFileDrop(ctx, func(x, y int, paths []string) {
+		Log.Debug("收到文件拖放", "count", len(paths))
+		wailsRuntime.EventsEmit(ctx, EventFilesDropped, x, y, paths)
+	}) {
+		Log.Debug("已注册原生文件拖放回调")
+	}
 }
 
 // shutdown is called when the Wails app is closing.
 func (a *DesktopApp) shutdown(ctx context.Context) {
 	// Save current settings to config before exit
 	a.cfg.Name = a.node.Name
-	a.cfg.WebPort = a.node.WebPort
+	if !a.node.WebPortChangePending {
+		a.cfg.WebPort = a.node.WebPort
+	}
 	a.cfg.BlockedUsers = collectBlockedUsers(a.node)
 
 	// Save window size
@@ -118,9 +176,13 @@ func (a *DesktopApp) shutdown(ctx context.Context) {
 		Log.Error("保存配置失败", "error", err)
 	}
 
+	// Stop batching first so queued messages are not written after the clear below
+	a.node.closeMessageWriter()
+
 	// Clear chat history if save-history is disabled
 	if !a.cfg.IsSaveHistory() && a.node.DB != nil {
 		a.node.DB.Exec("DELETE FROM messages")
+		a.node.DB.Exec("DELETE FROM chat_state")
 		Log.Info("已清空聊天记录（保存聊天记录已关闭）")
 	}
 
@@ -135,10 +197,137 @@ func (a *DesktopApp) shutdown(ctx context.Context) {
 	a.node.Stop()
 }
 
+// quit exits the application through the normal Wails shutdown path (OnShutdown cleanup).
+func (a *DesktopApp) quit() {
+	a.quitting.Store(true)
+	wailsRuntime.Quit(a.ctx)
+}
+
+// beforeClose is the Wails OnBeforeClose hook. Clicking the window's close button
+// hides it to the tray when CloseToTray is on; otherwise (or after quit) the app exits
+// and shutdown runs.
+func (a *DesktopApp) beforeClose(ctx context.Context) (prevent bool) {
+	if !a.quitting.Load() && a.cfg.IsCloseToTray() {
+		wailsRuntime.Hide(ctx)
+		return true
+	}
+	if !a.confirmQuit(ctx) {
+		// 取消退出：之后点关闭按钮仍按设置隐藏到托盘
+		a.quitting.Store(false)
+		return true
+	}
+	return false
+}
+
+// confirmQuit asks before exiting while file transfers are in progress, since quitting
+// interrupts them. Returns false if the user cancels.
+func (a *DesktopApp) confirmQuit(ctx context.Context) bool {
+	n := a.node.activeTransferCount()
+	if n == 0 {
+		return true
+	}
+	// 从托盘退出时窗口可能处于隐藏状态
+	a.showWindow()
+	result, err := wailsRuntime.MessageDialog(ctx, wailsRuntime.MessageDialogOptions{
+		Type:          wailsRuntime.QuestionDialog,
+		Title:         "确认退出",
+		Message:       fmt.Sprintf("还有 %d 个文件正在传输，退出将中断传输。\n确定要退出吗？", n),
+		DefaultButton: "No",
+	})
+	if err != nil {
+		Log.Warn("退出确认对话框失败", "error", err)
+		return true
+	}
+	if result != "Yes" {
+		Log.Info("有进行中的传输，用户取消退出", "active", n)
+		return false
+	}
+	return true
+}
+
+// SetCloseToTray saves whether closing the window hides it to the tray. Takes effect immediately.
+func (a *DesktopApp) SetCloseToTray(enabled bool) error {
+	a.cfg.CloseToTray = &enabled
+	if err := SaveConfig(a.cfg); err != nil {
+		Log.Error("保存关闭行为设置失败", "error", err)
+		return err
+	}
+	Log.Info("关闭窗口行为已更新", "closeToTray", enabled)
+	return nil
+}
+
+// SetAutoStart enables or disables launching LANShare at login and saves the choice.
+func (a *DesktopApp) SetAutoStart(enabled bool) error {
+	if err := setAutoStart(enabled); err != nil {
+		Log.Error("设置开机自启动失败", "enabled", enabled, "error", err)
+		return err
+	}
+	a.cfg.AutoStart = enabled
+	if err := SaveConfig(a.cfg); err != nil {
+		Log.Error("保存开机自启动设置失败", "error", err)
+		return err
+	}
+	Log.Info("开机自启动已更新", "enabled", enabled)
+	return nil
+}
+
+// autoStartExecutable 返回写入启动项的可执行文件绝对路径（解析符号链接）
+func autoStartExecutable() (string, error) {
+	exePath, err := os.Executable()
+	if err != nil {
+		return "", fmt.Errorf("无法确定程序路径: %v", err)
+	}
+	if resolved, err := filepath.EvalSymlinks(exePath); err == nil {
+		exePath = resolved
+	}
+	return exePath, nil
+}
+
 // showWindow brings the application window to the foreground.
 func (a *DesktopApp) showWindow() {
 	wailsRuntime.Show(a.ctx)
 	wailsRuntime.WindowUnminimise(a.ctx)
+	a.ClearTrayUnread()
+}
+
+// trayTooltip 返回托盘提示文字，有未读消息时显示未读数
+func (a *DesktopApp) trayTooltip(unread int) string {
+	if unread > 0 {
+		return fmt.Sprintf("域信 - %d 条未读", unread)
+	}
+	return fmt.Sprintf("域信 v%s - %s", AppVersion, a.node.Name)
+}
+
+// countUnread 收到消息时调用：不是正在查看的会话则未读数加一并更新托盘提示
+func (a *DesktopApp) countUnread(chatId string) {
+	a.unreadMu.Lock()
+	if a.activeChatId != "" && a.activeChatId == chatId {
+		a.unreadMu.Unlock()
+		return
+	}
+	a.unreadCount++
+	unread := a.unreadCount
+	a.unreadMu.Unlock()
+	systray.SetTooltip(a.trayTooltip(unread))
+}
+
+// ClearTrayUnread resets the tray unread count. Called when the window is shown or gains focus.
+func (a *DesktopApp) ClearTrayUnread() {
+	a.unreadMu.Lock()
+	changed := a.unreadCount > 0
+	a.unreadCount = 0
+	a.unreadMu.Unlock()
+	if changed {
+		systray.SetTooltip(a.trayTooltip(0))
+	}
+}
+
+// SetActiveChat records the chat the user is looking at while the window has focus
+// ("" when the window loses focus), so its messages are not counted as unread.
+func (a *DesktopApp) SetActiveChat(chatId string) {
+	a.unreadMu.Lock()
+	a.activeChatId = chatId
+	a.unreadMu.Unlock()
 }
 
 // GetAndClearLastNotifiedChat returns the chatId from the last notification
@@ -165,7 +354,7 @@ func (a *DesktopApp) toggleWindow() {
 func (a *DesktopApp) initSystray() {
 	systray.Register(func() {
 		systray.SetIcon(trayIcon())
-		systray.SetTooltip(fmt.Sprintf("域信 v%s - %s", AppVersion, a.node.Name))
+		systray.SetTooltip(a.trayTooltip(0))
 
 		mShow := systray.AddMenuItem("打开界面", "打开域信主窗口")
 		mQuit := systray.AddMenuItem("退出", "退出域信")
@@ -180,7 +369,7 @@ func (a *DesktopApp) initSystray() {
 				case <-mShow.ClickedCh:
 					a.showWindow()
 				case <-mQuit.ClickedCh:
-					wailsRuntime.Quit(a.ctx)
+					a.quit()
 					return
 				}
 			}
@@ -195,7 +384,12 @@ func (a *DesktopApp) SetNotificationAppName(name string) {
 }
 
 // ShowNotification sends a system notification and tracks which chat triggered it.
+// Silent when notifications are turned off or during the do-not-disturb period (unread counts still update).
 func (a *DesktopApp) ShowNotification(title, body, chatId string) {
+	if a.node.notificationsSilenced(time.Now()) {
+		Log.Debug("通知已静默", "chatId", chatId)
+		return
+	}
 	a.lastNotifiedChatId = chatId
 	beeep.Notify(title, body, "")
 }
@@ -225,38 +419,116 @@ func (a *DesktopApp) SaveFileDialog(defaultFilename string) (string, error) {
 	})
 }
 
+// AcceptFileTransfer asks where to save an incoming file, then accepts the transfer.
+// Returns false if the dialog was cancelled; the request stays pending.
+func (a *DesktopApp) AcceptFileTransfer(fileID string) (bool, error) {
+	a.node.FileTransfersMutex.RLock()
+	transfer, exists := a.node.FileTransfers[fileID]
+	var fileName, peerName string
+	if exists {
+		fileName, peerName = transfer.FileName, transfer.PeerName
+	}
+	a.node.FileTransfersMutex.RUnlock()
+	if !exists {
+		return false, fmt.Errorf("无效的文件传输ID")
+	}
+
+	dir := a.node.downloadDirFor(peerName, fileName)
+	os.MkdirAll(dir, 0755)
+	path, err := wailsRuntime.SaveFileDialog(a.ctx, wailsRuntime.SaveDialogOptions{
+		Title:            "接收文件另存为",
+		DefaultDirectory: dir,
+		DefaultFilename:  fileName,
+	})
+	if err != nil || path == "" {
+		return false, err
+	}
+	a.node.respondToFileTransfer(fileID, true, path)
+	return true, nil
+}
+
+// ExportConfig saves the current settings to a JSON file chosen by the user.
+// Returns the saved path, or "" if the dialog was cancelled.
+func (a *DesktopApp) ExportConfig() (string, error) {
+	data, err := a.node.exportCurrentConfig()
+	if err != nil {
+		return "", err
+	}
+	path, err := wailsRuntime.SaveFileDialog(a.ctx, wailsRuntime.SaveDialogOptions{
+		Title:           "导出设置",
+		DefaultFilename: "lanshare-config.json",
+		Filters: []wailsRuntime.FileFilter{
+			{DisplayName: "配置文件", Pattern: "*.json"},
+		},
+	})
+	if err != nil || path == "" {
+		return "", err
+	}
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		Log.Error("导出配置失败", "path", path, "error", err)
+		return "", err
+	}
+	Log.Info("配置已导出", "path", path)
+	return path, nil
+}
+
+// ImportConfig merges settings from a JSON file chosen by the user and returns
+// applied/restartRequired/warnings (same as /import-config). Returns nil if the dialog was cancelled.
+func (a *DesktopApp) ImportConfig() (map[string]interface{}, error) {
+	path, err := wailsRuntime.OpenFileDialog(a.ctx, wailsRuntime.OpenDialogOptions{
+		Title: "导入设置",
+		Filters: []wailsRuntime.FileFilter{
+			{DisplayName: "配置文件", Pattern: "*.json"},
+		},
+	})
+	if err != nil || path == "" {
+		return nil, err
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	result, err := a.node.importConfig(data)
+	if err != nil {
+		Log.Warn("导入配置失败", "path", path, "error", err)
+		return nil, err
+	}
+	return map[string]interface{}{
+		"applied":         result.Applied,
+		"restartRequired": result.RestartRequired,
+		"warnings":        result.Warnings,
+	}, nil
+}
+
 // RevealInExplorer opens the system file explorer at the given file path.
 func (a *DesktopApp) RevealInExplorer(filePath string) error {
-	switch goruntime.GOOS {
-	case "windows":
-		return exec.Command("explorer", "/select,", filePath).Start()
-	case "darwin":
-		return exec.Command("open", "-R", filePath).Start()
-	case "linux":
-		return exec.Command("xdg-open", filepath.Dir(filePath)).Start()
-	default:
-		return fmt.Errorf("unsupported OS: %s", goruntime.GOOS)
+	path, err := a.node.resolveOpenableFile(filePath)
+	if err != nil {
+		Log.Warn("拒绝打开文件夹", "path", filePath, "error", err)
+		return err
 	}
+	return revealInFileManager(path)
 }
 
 // OpenFile opens a file with its default application.
-func (a *DesktopApp) OpenFile(filePath string) error {
-	switch goruntime.GOOS {
-	case "windows":
-		return exec.Command("cmd", "/c", "start", "", filePath).Start()
-	case "darwin":
-		return exec.Command("open", filePath).Start()
-	case "linux":
-		return exec.Command("xdg-open", filePath).Start()
-	default:
-		return fmt.Errorf("unsupported OS: %s", goruntime.GOOS)
+func (a *DesktopApp) OpenFile(filePath string, confirmed bool) error {
+	path, err := a.node.resolveOpenableFile(filePath)
+	if err != nil {
+		Log.Warn("拒绝打开文件", "path", filePath, "error", err)
+		return err
+	}
+	// 可执行文件需前端二次确认后以 confirmed=true 再次调用
+	if isExecutableFile(path) && !confirmed {
+		return errors.New(openConfirmRequired)
 	}
+	return openWithDefaultApp(path)
 }
 
 // startSharingServer starts an HTTP server on the LAN for P2P sharing.
-// This serves the WebView2 runtime and Web UI to other devices on the network.
+// This serves version info, the update binary and the WebView2 runtime to other devices on the network.
 func (a *DesktopApp) startSharingServer() {
-	handler := a.node.createHTTPHandler()
+	// 只暴露对外安全的端点，本机UI通过 Wails AssetServer 使用完整 handler
+	handler := a.node.createLANHandler()
 	basePort := a.node.WebPort
 	go func() {
 		// Retry same port with backoff (port may not be released immediately after restart)
@@ -374,6 +646,49 @@ func (a *DesktopApp) SendFilePath(filePath, targetName string) (map[string]strin
 	}, nil
 }
 
+// SendMultipleFilePaths starts a separate transfer for each dropped path.
+// A failure on one path does not stop the others; each result carries
+// "path" and "status" ("success" or "error"), plus the SendFilePath fields
+// on success or "error" on failure.
+func (a *DesktopApp) SendMultipleFilePaths(paths []string, targetName string) ([]map[string]string, error) {
+	if len(paths) == 0 {
+		return nil, fmt.Errorf("没有要发送的文件")
+	}
+
+	results := make([]map[string]string, 0, len(paths))
+	for _, p := range paths {
+		result, err := a.SendFilePath(p, targetName)
+		if err != nil {
+			Log.Warn("批量发送文件失败", "path", p, "target", targetName, "error", err)
+			results = append(results, map[string]string{
+				"path":   p,
+				"status": "error",
+				"error":  err.Error(),
+			})
+			continue
+		}
+		result["path"] = p
+		result["status"] = "success"
+		results = append(results, result)
+	}
+	return results, nil
+}
+
+// SendClipboardFiles sends the files currently on the system clipboard (e.g. copied
+// in Explorer) to targetName, one transfer per file. Results have the same shape
+// as SendMultipleFilePaths.
+func (a *DesktopApp) SendClipboardFiles(targetName string) ([]map[string]string, error) {
+	paths, err := readClipboardFiles()
+	if err != nil {
+		return nil, err
+	}
+	if len(paths) == 0 {
+		return nil, fmt.Errorf("剪贴板中没有文件")
+	}
+	Log.Info("粘贴发送文件", "count", len(paths), "target", targetName)
+	return a.SendMultipleFilePaths(paths, targetName)
+}
+
 // zipDirectory compresses a directory into a temporary .zip file.
 // Returns the path to the zip file.
 func zipDirectory(dirPath string) (string, error) {
@@ -441,91 +756,10 @@ func zipDirectory(dirPath string) (string, error) {
 // SendImagePath sends an image from a local file path without going through WebView2.
 // Reads the image from disk, saves a copy, and broadcasts/sends to the target peer.
 func (a *DesktopApp) SendImagePath(filePath, targetName string) (map[string]string, error) {
-	imageData, err := os.ReadFile(filePath)
+	imageURL, messageID, err := a.node.sendImageFile(filePath, targetName)
 	if err != nil {
-		return nil, fmt.Errorf("读取图片失败: %v", err)
-	}
-
-	fileName := filepath.Base(filePath)
-	ext := strings.ToLower(filepath.Ext(fileName))
-	if ext == "" {
-		ext = ".jpg"
-	}
-
-	// Determine MIME type from extension
-	contentType := "image/jpeg"
-	switch ext {
-	case ".png":
-		contentType = "image/png"
-	case ".gif":
-		contentType = "image/gif"
-	case ".bmp":
-		contentType = "image/bmp"
-	case ".webp":
-		contentType = "image/webp"
-	}
-
-	if len(imageData) > 5<<20 {
-		return nil, fmt.Errorf("图片文件不能超过5MB")
-	}
-
-	// Save to images directory
-	imageDir := DataPath("images")
-	os.MkdirAll(imageDir, 0755)
-	imageFileName := fmt.Sprintf("%s_%d%s", generateMessageID(), time.Now().Unix(), ext)
-	imagePath := filepath.Join(imageDir, imageFileName)
-	if err := os.WriteFile(imagePath, imageData, 0644); err != nil {
-		return nil, fmt.Errorf("保存图片失败: %v", err)
-	}
-
-	imageBase64 := base64.StdEncoding.EncodeToString(imageData)
-	imageURL := fmt.Sprintf("/images/%s", imageFileName)
-	messageID := generateMessageID()
-
-	imageMsg := Message{
-		Type:        "chat",
-		From:        a.node.ID,
-		Content:     fmt.Sprintf("发送了图片: %s", fileName),
-		Timestamp:   time.Now(),
-		MessageType: MessageTypeImage,
-		MessageID:   messageID,
-		FileName:    fileName,
-		FileSize:    int64(len(imageData)),
-		FileType:    contentType,
-		FileURL:     imageURL,
-		FileData:    imageBase64,
-	}
-
-	if targetName == "all" {
-		imageMsg.To = "all"
-		a.node.broadcastMessage(imageMsg)
-	} else {
-		var targetID string
-		a.node.PeersMutex.RLock()
-		for id, peer := range a.node.Peers {
-			if peer.Name == targetName && peer.IsActive {
-				targetID = id
-				break
-			}
-		}
-		a.node.PeersMutex.RUnlock()
-
-		if targetID == "" {
-			return nil, fmt.Errorf("目标用户不在线")
-		}
-
-		imageMsg.To = targetID
-		if peer, exists := a.node.Peers[targetID]; exists {
-			a.node.sendMessageToPeer(peer, imageMsg)
-		}
+		return nil, err
 	}
-
-	isPrivate := targetName != "all"
-	a.node.addChatMessageWithType(
-		a.node.Name, targetName, imageMsg.Content, true, isPrivate,
-		MessageTypeImage, messageID, "", "", "", fileName, int64(len(imageData)), contentType, imageURL, "",
-	)
-
 	return map[string]string{
 		"status":    "success",
 		"imageUrl":  imageURL,
@@ -594,32 +828,30 @@ func (a *DesktopApp) SendImageBase64(base64Data, fileName, fileType, targetName
 
 	if targetName == "all" {
 		imageMsg.To = "all"
-		a.node.broadcastMessage(imageMsg)
+		a.node.broadcastImage(imageMsg)
 	} else {
 		var targetID string
-		a.node.PeersMutex.RLock()
-		for id, peer := range a.node.Peers {
-			if peer.Name == targetName && peer.IsActive {
-				targetID = id
-				break
-			}
+		if peer := a.node.findPeer(targetName); peer != nil {
+			targetID = peer.ID
 		}
-		a.node.PeersMutex.RUnlock()
 
 		if targetID == "" {
-			return nil, fmt.Errorf("目标用户不在线")
-		}
-
-		imageMsg.To = targetID
-		if peer, exists := a.node.Peers[targetID]; exists {
-			a.node.sendMessageToPeer(peer, imageMsg)
+			// 对方离线：暂存，待其上线后投递
+			if err := a.node.queueOfflineMessage(targetName, imageMsg); err != nil {
+				return nil, fmt.Errorf("目标用户不在线")
+			}
+		} else {
+			imageMsg.To = targetID
+			if peer, exists := a.node.Peers[targetID]; exists {
+				a.node.sendMessageToPeer(peer, imageMsg)
+			}
 		}
 	}
 
 	isPrivate := targetName != "all"
 	a.node.addChatMessageWithType(
 		a.node.Name, targetName, imageMsg.Content, true, isPrivate,
-		MessageTypeImage, messageID, "", "", "", fileName, int64(len(imageData)), fileType, imageURL, "",
+		MessageTypeImage, messageID, "", "", "", fileName, int64(len(imageData)), fileType, imageURL, "", "",
 	)
 
 	return map[string]string{
@@ -670,7 +902,7 @@ func (a *DesktopApp) SendFileFromBase64(base64Data, fileName, targetName string)
 
 // SaveWindowSize saves the current window dimensions to config.
 // Called from JS on window resize events — more reliable than saving only on shutdown,
-// because HideWindowOnClose means the window often hides without triggering shutdown.
+// because close-to-tray means the window often hides without triggering shutdown.
 func (a *DesktopApp) SaveWindowSize() {
 	w, h := wailsRuntime.WindowGetSize(a.ctx)
 	if w > 0 && h > 0 {
@@ -689,6 +921,28 @@ func (a *DesktopApp) SetWindowTheme(theme string) {
 	}
 }
 
+// SetTheme persists the skin and accent colour chosen in the settings page.
+// The title bar colour derived from them is applied on the next launch
+// (Wails cannot change CustomTheme at runtime).
+func (a *DesktopApp) SetTheme(skinId, accentColor string) error {
+	if skinId != "telegram" && skinId != "wisetalk" {
+		return fmt.Errorf("未知的皮肤: %s", skinId)
+	}
+	if accentColor != "" {
+		if _, _, _, ok := parseHexColor(accentColor); !ok {
+			return fmt.Errorf("无效的颜色: %s", accentColor)
+		}
+	}
+	a.cfg.Theme = skinId
+	a.cfg.AccentColor = accentColor
+	if err := SaveConfig(a.cfg); err != nil {
+		Log.Error("保存主题设置失败", "error", err)
+		return err
+	}
+	Log.Info("主题设置已保存", "theme", skinId, "accentColor", accentColor)
+	return nil
+}
+
 // SetWindowIcon changes the native window icon to match the active skin.
 func (a *DesktopApp) SetWindowIcon(skinId string) {
 	setWindowIcon(skinId)
@@ -697,12 +951,16 @@ func (a *DesktopApp) SetWindowIcon(skinId string) {
 // GetAppInfo returns application info for the frontend.
 func (a *DesktopApp) GetAppInfo() map[string]interface{} {
 	return map[string]interface{}{
-		"name":      a.node.Name,
-		"localIP":   a.node.LocalIP,
-		"localPort": a.node.LocalPort,
-		"webPort":   a.node.WebPort,
-		"id":        a.node.ID,
-		"version":   AppVersion,
-		"channel":   AppChannel(),
+		"name":        a.node.Name,
+		"localIP":     a.node.LocalIP,
+		"localPort":   a.node.LocalPort,
+		"webPort":     a.node.WebPort,
+		"id":          a.node.ID,
+		"version":     AppVersion,
+		"channel":     AppChannel(),
+		"theme":       a.cfg.GetTheme(),
+		"accentColor": a.cfg.AccentColor,
+		"closeToTray": a.cfg.IsCloseToTray(),
+		"autoStart":   isAutoStartEnabled(),
 	}
 }
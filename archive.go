@@ -0,0 +1,109 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+)
+
+// 会话归档：不删除记录，只从会话列表（/chatpartners、/users）中隐藏，归档列表保存在 AppConfig.ArchivedChats，
+// 取值同 PinnedChats（公聊不能归档）。归档会话收到新消息时自动取消归档；
+// AppConfig.KeepArchivedOnMessage 为 true 时保持归档，新消息照常计入未读数，由 /archived 返回
+
+// isChatArchived 判断会话是否已归档
+func (node *P2PNode) isChatArchived(chatID string) bool {
+	if node.Config == nil {
+		return false
+	}
+	node.ConfigMutex.RLock()
+	defer node.ConfigMutex.RUnlock()
+	return slices.Contains(node.Config.ArchivedChats, chatID)
+}
+
+// archivedChats 返回归档会话列表的副本
+func (node *P2PNode) archivedChats() []string {
+	if node.Config == nil {
+		return []string{}
+	}
+	node.ConfigMutex.RLock()
+	defer node.ConfigMutex.RUnlock()
+	return append([]string{}, node.Config.ArchivedChats...)
+}
+
+// withoutArchived 过滤掉已归档的会话
+func (node *P2PNode) withoutArchived(chatIDs []string) []string {
+	list := make([]string, 0, len(chatIDs))
+	for _, id := range chatIDs {
+		if !node.isChatArchived(id) {
+			list = append(list, id)
+		}
+	}
+	return list
+}
+
+// archivedActivities 返回归档会话的置顶状态、最近活跃时间和未读数
+func (node *P2PNode) archivedActivities() []ChatActivity {
+	active := node.chatLastActive()
+	chats := []ChatActivity{}
+	for _, id := range node.archivedChats() {
+		chats = append(chats, ChatActivity{ChatID: id, Pinned: node.isChatPinned(id), LastActive: active[id], Unread: node.unreadCount(id)})
+	}
+	return chats
+}
+
+// setChatArchived 归档或取消归档会话并保存配置
+func (node *P2PNode) setChatArchived(chatID string, archived bool) error {
+	if node.Config == nil {
+		return fmt.Errorf("配置不可用")
+	}
+	if chatID == "" {
+		return fmt.Errorf("会话不能为空")
+	}
+	if chatID == "all" && archived {
+		return fmt.Errorf("公聊不能归档")
+	}
+
+	node.ConfigMutex.Lock()
+	list := make([]string, 0, len(node.Config.ArchivedChats)+1)
+	for _, id := range node.Config.ArchivedChats {
+		if id != chatID {
+			list = append(list, id)
+		}
+	}
+	if archived {
+		list = append(list, chatID)
+	}
+	node.Config.ArchivedChats = list
+	node.ConfigMutex.Unlock()
+
+	if err := node.saveConfig(); err != nil {
+		Log.Error("保存归档设置失败", "chatId", chatID, "error", err)
+		return err
+	}
+	Log.Info("归档设置已更新", "chatId", chatID, "archived", archived)
+	return nil
+}
+
+// unarchiveOnMessage 归档会话收到新消息时取消归档，除非设置为保持归档
+func (node *P2PNode) unarchiveOnMessage(chatID string) {
+	if !node.isChatArchived(chatID) {
+		return
+	}
+	node.ConfigMutex.RLock()
+	keep := node.Config.KeepArchivedOnMessage
+	node.ConfigMutex.RUnlock()
+	if keep {
+		return
+	}
+	node.setChatArchived(chatID, false)
+}
+
+// setKeepArchivedOnMessage 设置归档会话收到新消息时是否保持归档并保存配置
+func (node *P2PNode) setKeepArchivedOnMessage(keep bool) error {
+	if node.Config == nil {
+		return fmt.Errorf("配置不可用")
+	}
+	node.ConfigMutex.Lock()
+	node.Config.KeepArchivedOnMessage = keep
+	node.ConfigMutex.Unlock()
+	return node.saveConfig()
+}
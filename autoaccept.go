@@ -0,0 +1,157 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+	"sync"
+	"time"
+)
+
+// 受信任用户的文件自动接受：AppConfig.AutoAcceptFrom 保存用户稳定标识（同屏蔽列表，UUID，旧版本为用户名），
+// 来自这些用户、不超过 AutoAcceptMaxSize 的文件请求直接接受。可执行文件始终需要手动确认。
+// 为防止被滥用塞满磁盘，一段时间内自动接受的文件数和总大小有上限，超出后回到手动确认
+const (
+	defaultAutoAcceptMaxSize = 100 << 20 // 单个文件默认上限 100MB
+	autoAcceptWindow         = time.Hour
+	autoAcceptMaxFiles       = 50      // autoAcceptWindow 内最多自动接受的文件数
+	autoAcceptMaxBytes       = 2 << 30 // autoAcceptWindow 内最多自动接受的总大小 2GB
+)
+
+// autoAcceptLimiter 记录最近自动接受的文件，用于总量和频率限制
+type autoAcceptLimiter struct {
+	mu     sync.Mutex
+	recent []autoAcceptRecord
+}
+
+type autoAcceptRecord struct {
+	at   time.Time
+	size int64
+}
+
+// allow 判断窗口内是否还能再自动接受 size 字节的文件，允许时登记
+func (l *autoAcceptLimiter) allow(size int64, now time.Time) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	kept := l.recent[:0]
+	var total int64
+	for _, r := range l.recent {
+		if now.Sub(r.at) < autoAcceptWindow {
+			kept = append(kept, r)
+			total += r.size
+		}
+	}
+	l.recent = kept
+	if len(l.recent) >= autoAcceptMaxFiles || total+size > autoAcceptMaxBytes {
+		return false
+	}
+	l.recent = append(l.recent, autoAcceptRecord{at: now, size: size})
+	return true
+}
+
+// isAutoAcceptUser 判断用户标识是否在信任列表中
+func (node *P2PNode) isAutoAcceptUser(userKey string) bool {
+	if node.Config == nil || userKey == "" {
+		return false
+	}
+	node.ConfigMutex.RLock()
+	defer node.ConfigMutex.RUnlock()
+	return slices.Contains(node.Config.AutoAcceptFrom, userKey)
+}
+
+// shouldAutoAccept 判断文件请求是否自动接受：发送方受信任、不是可执行文件、
+// 大小未超过单文件上限，且未超出窗口内的数量和总量限制
+func (node *P2PNode) shouldAutoAccept(request FileTransferRequest) bool {
+	peer := node.findPeer(request.From)
+	if peer == nil || !node.isAutoAcceptUser(peer.UserKey()) {
+		return false
+	}
+	if isExecutableFile(request.FileName) {
+		Log.Info("可执行文件不自动接受", "from", peer.Name, "fileName", request.FileName)
+		return false
+	}
+	node.ConfigMutex.RLock()
+	maxSize := node.Config.GetAutoAcceptMaxSize()
+	node.ConfigMutex.RUnlock()
+	if request.FileSize > maxSize {
+		Log.Info("文件超过自动接受大小上限", "from", peer.Name, "fileName", request.FileName, "fileSize", request.FileSize)
+		return false
+	}
+	if !node.autoAccept.allow(request.FileSize, time.Now()) {
+		Log.Warn("自动接受的文件过多，改为手动确认", "from", peer.Name, "fileName", request.FileName)
+		return false
+	}
+	return true
+}
+
+// autoAcceptUserNames 返回信任列表中各用户的显示名称
+func (node *P2PNode) autoAcceptUserNames() []string {
+	names := []string{}
+	if node.Config == nil {
+		return names
+	}
+	node.ConfigMutex.RLock()
+	keys := append([]string{}, node.Config.AutoAcceptFrom...)
+	node.ConfigMutex.RUnlock()
+	for _, key := range keys {
+		names = append(names, node.nameForUserKey(key))
+	}
+	return names
+}
+
+// autoAcceptKeyFor 查找目标（用户名或标识）在信任列表中的标识，不在列表中时按在线用户和历史记录解析
+func (node *P2PNode) autoAcceptKeyFor(target string) string {
+	node.ConfigMutex.RLock()
+	keys := append([]string{}, node.Config.AutoAcceptFrom...)
+	node.ConfigMutex.RUnlock()
+	for _, key := range keys {
+		if key == target || node.nameForUserKey(key) == target {
+			return key
+		}
+	}
+	return node.resolveUserKey(target)
+}
+
+// setAutoAcceptUser 将用户加入或移出信任列表并保存配置
+func (node *P2PNode) setAutoAcceptUser(target string, trusted bool) error {
+	if node.Config == nil {
+		return fmt.Errorf("配置不可用")
+	}
+	key := node.autoAcceptKeyFor(target)
+	if key == "" {
+		return fmt.Errorf("未找到用户 %s", target)
+	}
+
+	node.ConfigMutex.Lock()
+	list := make([]string, 0, len(node.Config.AutoAcceptFrom)+1)
+	for _, k := range node.Config.AutoAcceptFrom {
+		if k != key {
+			list = append(list, k)
+		}
+	}
+	if trusted {
+		list = append(list, key)
+	}
+	node.Config.AutoAcceptFrom = list
+	node.ConfigMutex.Unlock()
+
+	if err := node.saveConfig(); err != nil {
+		Log.Error("保存自动接受设置失败", "key", key, "error", err)
+		return err
+	}
+	Log.Info("自动接受设置已更新", "name", node.nameForUserKey(key), "key", key, "trusted", trusted)
+	return nil
+}
+
+// setAutoAcceptMaxSize 设置自动接受的单个文件大小上限（字节，0 = 默认）并保存配置
+func (node *P2PNode) setAutoAcceptMaxSize(size int64) error {
+	if node.Config == nil {
+		return fmt.Errorf("配置不可用")
+	}
+	if size < 0 {
+		return fmt.Errorf("大小上限无效")
+	}
+	node.ConfigMutex.Lock()
+	node.Config.AutoAcceptMaxSize = size
+	node.ConfigMutex.Unlock()
+	return node.saveConfig()
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// 自动回复：AppConfig.AutoReplyEnabled 开启时，收到私聊后自动给发送方回一条预设消息（AppConfig.AutoReply），
+// 同一用户在 autoReplyCooldown 内只回一次。自动回复的消息带 AutoReply 标记并以 autoReplyPrefix 开头，
+// 收到这类消息时不再自动回复，避免两个都开着自动回复的节点互相回复（旧版本没有标记，靠前缀和冷却兜底）
+const (
+	autoReplyPrefix   = "[自动回复] "
+	autoReplyCooldown = 10 * time.Minute
+	maxAutoReplyLen   = 200
+)
+
+// defaultAutoReply 未设置回复内容时使用的默认内容
+const defaultAutoReply = "我现在不在，稍后回复你。"
+
+// autoReplyLimiter 记录最近给每个用户自动回复的时间（按用户稳定标识）
+type autoReplyLimiter struct {
+	mu   sync.Mutex
+	last map[string]time.Time
+}
+
+// allow 判断冷却期内是否还能给该用户自动回复，允许时登记
+func (l *autoReplyLimiter) allow(userKey string, now time.Time) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.last == nil {
+		l.last = make(map[string]time.Time)
+	}
+	for key, at := range l.last {
+		if now.Sub(at) >= autoReplyCooldown {
+			delete(l.last, key)
+		}
+	}
+	if _, ok := l.last[userKey]; ok {
+		return false
+	}
+	l.last[userKey] = now
+	return true
+}
+
+// isAutoReplyMessage 判断收到的消息是否是对方的自动回复
+func isAutoReplyMessage(msg Message) bool {
+	return msg.AutoReply || strings.HasPrefix(msg.Content, autoReplyPrefix)
+}
+
+// maybeAutoReply 收到私聊后按设置自动回复发送方，由 dispatchMessage 的私聊分支调用
+func (node *P2PNode) maybeAutoReply(peer *Peer, msg Message) {
+	if node.Config == nil || isAutoReplyMessage(msg) {
+		return
+	}
+	node.ConfigMutex.RLock()
+	enabled, text := node.Config.AutoReplyEnabled, node.Config.GetAutoReply()
+	node.ConfigMutex.RUnlock()
+	if !enabled {
+		return
+	}
+	if !node.autoReply.allow(peer.UserKey(), time.Now()) {
+		return
+	}
+	reply := Message{
+		Type:      "chat",
+		From:      node.ID,
+		To:        peer.ID,
+		Content:   autoReplyPrefix + text,
+		Timestamp: time.Now(),
+		MessageID: generateMessageID(),
+		AutoReply: true,
+	}
+	senderName := peer.Name
+	go func() {
+		if err := node.sendMessageToPeer(peer, reply); err != nil {
+			Log.Warn("发送自动回复失败", "to", senderName, "error", err)
+			return
+		}
+		Log.Info("已自动回复", "to", senderName)
+	}()
+	node.recordChatMessage(ChatMessage{
+		Sender:      node.Name,
+		Recipient:   senderName,
+		Content:     reply.Content,
+		IsOwn:       true,
+		IsPrivate:   true,
+		MessageType: MessageTypeText,
+		MessageID:   reply.MessageID,
+	})
+}
+
+// setAutoReply 设置自动回复开关和内容并保存配置
+func (node *P2PNode) setAutoReply(enabled bool, text string) error {
+	if node.Config == nil {
+		return fmt.Errorf("配置不可用")
+	}
+	text = strings.TrimSpace(text)
+	if utf8.RuneCountInString(text) > maxAutoReplyLen {
+		return fmt.Errorf("自动回复内容不能超过 %d 个字符", maxAutoReplyLen)
+	}
+	node.ConfigMutex.Lock()
+	node.Config.AutoReplyEnabled = enabled
+	node.Config.AutoReply = text
+	node.ConfigMutex.Unlock()
+	if err := node.saveConfig(); err != nil {
+		Log.Error("保存自动回复设置失败", "error", err)
+		return err
+	}
+	Log.Info("自动回复设置已更新", "enabled", enabled)
+	return nil
+}
@@ -0,0 +1,76 @@
+//go:build darwin
+
+package main
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+const autoStartLabel = "com.lanshare.messager"
+
+// autoStartPlistPath 返回 ~/Library/LaunchAgents 下的 plist 路径
+func autoStartPlistPath() (string, error) {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", fmt.Errorf("无法确定用户目录: %v", err)
+	}
+	return filepath.Join(home, "Library", "LaunchAgents", autoStartLabel+".plist"), nil
+}
+
+// setAutoStart 写入或删除 LaunchAgent plist，登录时由 launchd 启动
+func setAutoStart(enabled bool) error {
+	plistPath, err := autoStartPlistPath()
+	if err != nil {
+		return err
+	}
+	if !enabled {
+		if err := os.Remove(plistPath); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("删除启动项失败: %v", err)
+		}
+		return nil
+	}
+
+	exePath, err := autoStartExecutable()
+	if err != nil {
+		return err
+	}
+	var escaped bytes.Buffer
+	xml.EscapeText(&escaped, []byte(exePath))
+	plist := fmt.Sprintf(`<?xml version="1.0" encoding="UTF-8"?>
+<!DOCTYPE plist PUBLIC "-//Apple//DTD PLIST 1.0//EN" "http://www.apple.com/DTDs/PropertyList-1.0.dtd">
+<plist version="1.0">
+<dict>
+	<key>Label</key>
+	<string>%s</string>
+	<key>ProgramArguments</key>
+	<array>
+		<string>%s</string>
+	</array>
+	<key>RunAtLoad</key>
+	<true/>
+</dict>
+</plist>
+`, autoStartLabel, escaped.String())
+
+	if err := os.MkdirAll(filepath.Dir(plistPath), 0755); err != nil {
+		return fmt.Errorf("创建 LaunchAgents 目录失败: %v", err)
+	}
+	if err := os.WriteFile(plistPath, []byte(plist), 0644); err != nil {
+		return fmt.Errorf("写入启动项失败: %v", err)
+	}
+	return nil
+}
+
+// isAutoStartEnabled 检查 LaunchAgent plist 是否存在
+func isAutoStartEnabled() bool {
+	plistPath, err := autoStartPlistPath()
+	if err != nil {
+		return false
+	}
+	_, err = os.Stat(plistPath)
+	return err == nil
+}
@@ -0,0 +1,64 @@
+//go:build !windows && !darwin
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// autoStartDesktopPath 返回 XDG autostart 目录下的 .desktop 文件路径
+func autoStartDesktopPath() (string, error) {
+	dir, err := os.UserConfigDir() // $XDG_CONFIG_HOME 或 ~/.config
+	if err != nil {
+		return "", fmt.Errorf("无法确定配置目录: %v", err)
+	}
+	return filepath.Join(dir, "autostart", "lanshare.desktop"), nil
+}
+
+// setAutoStart 写入或删除 autostart .desktop 文件，桌面环境登录时启动
+func setAutoStart(enabled bool) error {
+	desktopPath, err := autoStartDesktopPath()
+	if err != nil {
+		return err
+	}
+	if !enabled {
+		if err := os.Remove(desktopPath); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("删除启动项失败: %v", err)
+		}
+		return nil
+	}
+
+	exePath, err := autoStartExecutable()
+	if err != nil {
+		return err
+	}
+	// Exec 字段：路径加引号并转义引号内的特殊字符，再按 string 类型规则转义反斜杠
+	quoted := `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`, "`", "\\`", "$", `\$`).Replace(exePath) + `"`
+	execLine := strings.ReplaceAll(quoted, `\`, `\\`)
+	entry := "[Desktop Entry]\n" +
+		"Type=Application\n" +
+		"Name=LANShare Messager\n" +
+		"Exec=" + execLine + "\n" +
+		"X-GNOME-Autostart-enabled=true\n"
+
+	if err := os.MkdirAll(filepath.Dir(desktopPath), 0755); err != nil {
+		return fmt.Errorf("创建 autostart 目录失败: %v", err)
+	}
+	if err := os.WriteFile(desktopPath, []byte(entry), 0644); err != nil {
+		return fmt.Errorf("写入启动项失败: %v", err)
+	}
+	return nil
+}
+
+// isAutoStartEnabled 检查 autostart .desktop 文件是否存在
+func isAutoStartEnabled() bool {
+	desktopPath, err := autoStartDesktopPath()
+	if err != nil {
+		return false
+	}
+	_, err = os.Stat(desktopPath)
+	return err == nil
+}
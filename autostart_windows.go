@@ -0,0 +1,50 @@
+//go:build windows
+
+package main
+
+import (
+	"fmt"
+
+	"golang.org/x/sys/windows/registry"
+)
+
+const (
+	autoStartRunKey    = `Software\Microsoft\Windows\CurrentVersion\Run`
+	autoStartValueName = "LANShare"
+)
+
+// setAutoStart 在 HKCU\...\Run 写入或删除启动项（当前用户，无需管理员权限）
+func setAutoStart(enabled bool) error {
+	key, err := registry.OpenKey(registry.CURRENT_USER, autoStartRunKey, registry.SET_VALUE)
+	if err != nil {
+		return fmt.Errorf("打开注册表启动项失败: %v", err)
+	}
+	defer key.Close()
+
+	if !enabled {
+		if err := key.DeleteValue(autoStartValueName); err != nil && err != registry.ErrNotExist {
+			return fmt.Errorf("删除注册表启动项失败: %v", err)
+		}
+		return nil
+	}
+
+	exePath, err := autoStartExecutable()
+	if err != nil {
+		return err
+	}
+	if err := key.SetStringValue(autoStartValueName, `"`+exePath+`"`); err != nil {
+		return fmt.Errorf("写入注册表启动项失败: %v", err)
+	}
+	return nil
+}
+
+// isAutoStartEnabled 检查注册表启动项是否存在
+func isAutoStartEnabled() bool {
+	key, err := registry.OpenKey(registry.CURRENT_USER, autoStartRunKey, registry.QUERY_VALUE)
+	if err != nil {
+		return false
+	}
+	defer key.Close()
+	_, _, err = key.GetStringValue(autoStartValueName)
+	return err == nil
+}
@@ -0,0 +1,286 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// 头像：每个用户按稳定标识（UUID，旧版本为用户名）哈希映射到固定调色板，得到确定性的头像颜色，
+// 前端以该颜色加首字母显示。用户也可上传自定义头像（/upload-avatar），文件按内容哈希保存在
+// ~/.lanshare/assets/avatars/<哈希>.<扩展名>，本机头像的哈希记在 AppConfig.Avatar。
+// 哈希在握手中交换，更换时广播 update_avatar；本机界面请求 /avatar/{哈希} 时，
+// 本地没有的从声明该哈希的节点拉取（LAN 共享服务器的同名端点），校验哈希后缓存
+const (
+	avatarMaxSize  = 512 << 10
+	avatarHashLen  = 32 // SHA-256 前 16 字节的十六进制
+	avatarFetchTTL = 10 * time.Minute
+
+	// 节点之间拉取头像时携带，收到该请求的节点只返回本地已有的文件，不再向其他节点转查
+	avatarPeerRequestHeader = "X-LANShare-Avatar-Sync"
+)
+
+// avatarPalette 头像调色板，与前端 AVATAR_COLORS 一致
+var avatarPalette = []string{
+	"#e17076", "#eda86c", "#a695e7", "#7bc862",
+	"#6ec9cb", "#65aadd", "#ee7aae", "#c9956b",
+	"#d4a03c", "#5bab6e", "#7b8be0", "#cf6a4e",
+	"#9c6ad0", "#4eafa6", "#d06a9c", "#6b89b5",
+}
+
+var (
+	// 正在下载/近期下载失败的头像，避免并发重复请求和频繁扫描节点
+	avatarFetchMutex  sync.Mutex
+	avatarFetchLocks  = make(map[string]*sync.Mutex)
+	avatarFetchMissed = make(map[string]time.Time)
+)
+
+// avatarColorFor 按用户稳定标识返回头像颜色
+func avatarColorFor(userKey string) string {
+	h := fnv.New32a()
+	h.Write([]byte(userKey))
+	return avatarPalette[h.Sum32()%uint32(len(avatarPalette))]
+}
+
+// selfUserKey 本机的稳定用户标识
+func (node *P2PNode) selfUserKey() string {
+	if node.UUID != "" {
+		return node.UUID
+	}
+	return node.Name
+}
+
+// messageAvatarColor 消息发送者的头像颜色：收到的消息按会话对方标识（没有时按用户名），自己的按本机标识
+func (node *P2PNode) messageAvatarColor(m ChatMessage) string {
+	switch {
+	case m.IsOwn:
+		return avatarColorFor(node.selfUserKey())
+	case m.PeerUUID != "":
+		return avatarColorFor(m.PeerUUID)
+	}
+	return avatarColorFor(m.Sender)
+}
+
+// avatarHashOf 头像内容哈希
+func avatarHashOf(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:avatarHashLen/2])
+}
+
+// validAvatarHash 头像哈希只允许固定长度的小写十六进制，防止路径穿越
+func validAvatarHash(hash string) bool {
+	if len(hash) != avatarHashLen {
+		return false
+	}
+	for _, c := range hash {
+		if !(c >= '0' && c <= '9' || c >= 'a' && c <= 'f') {
+			return false
+		}
+	}
+	return true
+}
+
+// localAvatarFile 按哈希查找本地头像文件
+func localAvatarFile(hash string) (string, bool) {
+	if !validAvatarHash(hash) {
+		return "", false
+	}
+	matches, _ := filepath.Glob(DataPath("assets", "avatars", hash+".*"))
+	for _, m := range matches {
+		if !strings.HasSuffix(m, ".tmp") {
+			return m, true
+		}
+	}
+	return "", false
+}
+
+// saveAvatarFile 校验头像图片并按哈希保存，返回哈希
+func saveAvatarFile(data []byte) (string, error) {
+	if len(data) > avatarMaxSize {
+		return "", fmt.Errorf("头像不能超过 %s", formatFileSize(avatarMaxSize))
+	}
+	ext := emojiImageExt(data)
+	if ext == "" {
+		return "", fmt.Errorf("只支持 GIF、PNG、JPG、WebP 图片")
+	}
+	hash := avatarHashOf(data)
+	if _, ok := localAvatarFile(hash); ok {
+		return hash, nil
+	}
+	if err := writeEmojiAsset(DataPath("assets", "avatars", hash+ext), data); err != nil {
+		return "", err
+	}
+	return hash, nil
+}
+
+// selfAvatarHash 本机自定义头像的哈希，未设置时为空
+func (node *P2PNode) selfAvatarHash() string {
+	if node.Config == nil {
+		return ""
+	}
+	node.ConfigMutex.RLock()
+	defer node.ConfigMutex.RUnlock()
+	return node.Config.Avatar
+}
+
+// setAvatar 设置（data 为空时清除）本机自定义头像，保存配置并通知在线节点
+func (node *P2PNode) setAvatar(data []byte) (string, error) {
+	if node.Config == nil {
+		return "", fmt.Errorf("配置不可用")
+	}
+	var hash string
+	if len(data) > 0 {
+		var err error
+		if hash, err = saveAvatarFile(data); err != nil {
+			return "", err
+		}
+	}
+	node.ConfigMutex.Lock()
+	old := node.Config.Avatar
+	node.Config.Avatar = hash
+	node.ConfigMutex.Unlock()
+	if err := node.saveConfig(); err != nil {
+		Log.Error("保存头像设置失败", "error", err)
+		return "", err
+	}
+	if old != "" && old != hash {
+		if path, ok := localAvatarFile(old); ok {
+			os.Remove(path)
+		}
+	}
+
+	node.broadcastMessage(Message{
+		Type:      "update_avatar",
+		From:      node.ID,
+		To:        "all",
+		Content:   hash,
+		Timestamp: time.Now(),
+	})
+	Log.Info("头像已更新", "hash", hash)
+	return hash, nil
+}
+
+// handlePeerAvatar 记录对端声明的头像哈希（握手或 update_avatar），无效值视为未设置
+func (node *P2PNode) handlePeerAvatar(peerID, hash string) {
+	if !validAvatarHash(hash) {
+		hash = ""
+	}
+	node.PeersMutex.Lock()
+	peer, exists := node.Peers[peerID]
+	if exists {
+		peer.AvatarHash = hash
+	}
+	node.PeersMutex.Unlock()
+	if exists {
+		Log.Debug("对端头像已更新", "peer", peer.Name, "hash", hash)
+	}
+}
+
+// handleAvatar 服务 /avatar/{哈希}：本机请求时本地缺失会从声明该哈希的节点拉取；
+// 来自其他节点的请求（LAN 共享服务器）只返回本地已有的文件
+func (node *P2PNode) handleAvatar(w http.ResponseWriter, r *http.Request) {
+	hash := strings.TrimPrefix(r.URL.Path, "/avatar/")
+	fromPeer := r.Header.Get(avatarPeerRequestHeader) != ""
+	localPath, ok := localAvatarFile(hash)
+	if !ok && !fromPeer && validAvatarHash(hash) {
+		var err error
+		localPath, err = node.fetchAvatar(hash)
+		ok = err == nil
+	}
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	// 内容按哈希寻址，不会变化
+	w.Header().Set("Cache-Control", "max-age=31536000, immutable")
+	http.ServeFile(w, r, localPath)
+}
+
+// fetchAvatar 向声明该头像哈希的在线节点请求头像，校验哈希后缓存到本地，返回本地路径
+func (node *P2PNode) fetchAvatar(hash string) (string, error) {
+	avatarFetchMutex.Lock()
+	if missed, ok := avatarFetchMissed[hash]; ok && time.Since(missed) < avatarFetchTTL {
+		avatarFetchMutex.Unlock()
+		return "", fmt.Errorf("暂无法获取该头像")
+	}
+	lock, ok := avatarFetchLocks[hash]
+	if !ok {
+		lock = &sync.Mutex{}
+		avatarFetchLocks[hash] = lock
+	}
+	avatarFetchMutex.Unlock()
+
+	// 同一头像只下载一次，其余请求等待后直接读取缓存
+	lock.Lock()
+	defer lock.Unlock()
+	if path, ok := localAvatarFile(hash); ok {
+		return path, nil
+	}
+
+	type source struct{ name, url string }
+	var sources []source
+	node.PeersMutex.RLock()
+	for _, peer := range node.Peers {
+		if peer.IsActive && peer.WebPort > 0 && peer.AvatarHash == hash {
+			sources = append(sources, source{peer.Name,
+				fmt.Sprintf("http://%s:%d/avatar/%s", peer.IP, peer.WebPort, hash)})
+		}
+	}
+	node.PeersMutex.RUnlock()
+
+	client := &http.Client{Timeout: 10 * time.Second}
+	for _, src := range sources {
+		data, err := downloadAvatar(client, src.url)
+		if err == nil && avatarHashOf(data) != hash {
+			err = fmt.Errorf("头像内容与哈希不符")
+		}
+		if err != nil {
+			Log.Debug("从节点获取头像失败", "peer", src.name, "hash", hash, "error", err)
+			continue
+		}
+		if _, err := saveAvatarFile(data); err != nil {
+			return "", err
+		}
+		Log.Info("已从局域网获取头像", "peer", src.name, "hash", hash)
+		path, _ := localAvatarFile(hash)
+		return path, nil
+	}
+
+	avatarFetchMutex.Lock()
+	avatarFetchMissed[hash] = time.Now()
+	avatarFetchMutex.Unlock()
+	return "", fmt.Errorf("暂无法获取该头像")
+}
+
+// downloadAvatar 从其他节点下载头像文件
+func downloadAvatar(client *http.Client, url string) ([]byte, error) {
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set(avatarPeerRequestHeader, "1")
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("HTTP %d", resp.StatusCode)
+	}
+	data, err := io.ReadAll(io.LimitReader(resp.Body, avatarMaxSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(data) > avatarMaxSize {
+		return nil, fmt.Errorf("文件过大")
+	}
+	return data, nil
+}
@@ -2,6 +2,8 @@ package main
 
 import (
 	"archive/zip"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"io"
@@ -10,6 +12,7 @@ import (
 	"os"
 	"path/filepath"
 	"strings"
+	"sync"
 	"time"
 )
 
@@ -155,41 +158,141 @@ func discoverPeersForBootstrap(localIP string, defaultWebPort int) []discoveredP
 	return peers
 }
 
+// webView2DownloadRetries is how many times an interrupted download is resumed
+// from the same peer before moving on to the next one.
+const webView2DownloadRetries = 3
+
+// webView2PartialPath is where an unfinished runtime download is kept, with its
+// ETag in a ".etag" sidecar, so the next attempt (from any peer serving the same
+// zip, or after a restart) continues with a Range request instead of starting over.
+func webView2PartialPath() string {
+	return filepath.Join(os.TempDir(), "lanshare-webview2runtime.zip.part")
+}
+
+// removePartialDownload deletes the partial download and its ETag sidecar.
+func removePartialDownload(partPath string) {
+	os.Remove(partPath)
+	os.Remove(partPath + ".etag")
+}
+
 // downloadAndExtractWebView2 downloads the WebView2 runtime zip from a peer and extracts it.
+// Interrupted downloads are resumed, and the zip is checked against the SHA-256 the
+// peer sends (peers running older versions send none; those downloads are not verified).
 func downloadAndExtractWebView2(url, targetDir string, splash *BootstrapSplash) bool {
-	client := &http.Client{Timeout: 10 * time.Minute}
-	resp, err := client.Get(url)
+	partPath := webView2PartialPath()
+	var sum string
+	var err error
+	for attempt := 0; attempt <= webView2DownloadRetries; attempt++ {
+		if attempt > 0 {
+			splash.SetText(fmt.Sprintf("连接中断，正在续传运行时... (第 %d 次重试)", attempt))
+			time.Sleep(2 * time.Second)
+		}
+		var retry bool
+		sum, retry, err = downloadWebView2Zip(url, partPath, splash)
+		if err == nil || !retry {
+			break
+		}
+		Log.Warn("WebView2下载中断", "url", url, "attempt", attempt+1, "error", err)
+	}
 	if err != nil {
-		Log.Error("WebView2下载连接失败", "url", url, "error", err)
+		Log.Error("WebView2下载失败", "url", url, "error", err)
 		return false
 	}
-	defer resp.Body.Close()
 
-	if resp.StatusCode != 200 {
+	if sum != "" {
+		splash.SetText("正在校验运行时...")
+		if err := verifyFileSHA256(partPath, sum); err != nil {
+			Log.Error("WebView2运行时校验失败", "url", url, "error", err)
+			removePartialDownload(partPath)
+			return false
+		}
+	} else {
+		Log.Warn("对方未提供WebView2运行时校验和，跳过校验", "url", url)
+	}
+
+	// Extract zip
+	splash.SetText("正在解压运行时...")
+	err = extractZip(partPath, targetDir)
+	removePartialDownload(partPath)
+	if err != nil {
+		os.RemoveAll(targetDir)
 		return false
 	}
 
-	totalSize := resp.ContentLength
+	return true
+}
 
-	// Download to temp file
-	tmpFile, err := os.CreateTemp("", "webview2-*.zip")
+// downloadWebView2Zip downloads (or resumes downloading) the runtime zip into
+// partPath and returns the SHA-256 announced by the peer. retry reports whether
+// the error was a connection problem worth resuming from.
+func downloadWebView2Zip(url, partPath string, splash *BootstrapSplash) (sum string, retry bool, err error) {
+	req, err := http.NewRequest("GET", url, nil)
 	if err != nil {
-		return false
+		return "", false, err
+	}
+	// Resume only when we know which version of the zip the partial file belongs to
+	var offset int64
+	etag, _ := os.ReadFile(partPath + ".etag")
+	if info, err := os.Stat(partPath); err == nil && len(etag) > 0 {
+		offset = info.Size()
+	}
+	if offset > 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+		req.Header.Set("If-Range", string(etag))
+	}
+
+	client := &http.Client{Timeout: 10 * time.Minute}
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", true, fmt.Errorf("连接失败: %w", err)
+	}
+	defer resp.Body.Close()
+	sum = resp.Header.Get(webView2ZipSHA256Header)
+
+	var f *os.File
+	switch resp.StatusCode {
+	case http.StatusPartialContent:
+		Log.Info("WebView2运行时续传", "url", url, "offset", offset)
+		f, err = os.OpenFile(partPath, os.O_WRONLY|os.O_APPEND, 0644)
+	case http.StatusOK:
+		// Server ignored the range (older peer, or the zip changed): start over
+		offset = 0
+		f, err = os.Create(partPath)
+		if tag := resp.Header.Get("ETag"); tag != "" && err == nil {
+			os.WriteFile(partPath+".etag", []byte(tag), 0644)
+		} else {
+			os.Remove(partPath + ".etag")
+		}
+	case http.StatusRequestedRangeNotSatisfiable:
+		// The previous attempt already got every byte ("bytes */<size>")
+		if resp.Header.Get("Content-Range") == fmt.Sprintf("bytes */%d", offset) {
+			return sum, false, nil
+		}
+		removePartialDownload(partPath)
+		return "", true, fmt.Errorf("续传位置无效")
+	default:
+		return "", false, fmt.Errorf("HTTP %d", resp.StatusCode)
+	}
+	if err != nil {
+		return "", false, err
+	}
+	defer f.Close()
+
+	totalSize := resp.ContentLength
+	if totalSize > 0 {
+		totalSize += offset
 	}
-	tmpPath := tmpFile.Name()
-	defer os.Remove(tmpPath)
 
 	// Download with progress
-	var downloaded int64
+	downloaded := offset
 	buf := make([]byte, 64*1024)
 	lastUpdate := time.Now()
 
 	for {
 		n, readErr := resp.Body.Read(buf)
 		if n > 0 {
-			if _, writeErr := tmpFile.Write(buf[:n]); writeErr != nil {
-				tmpFile.Close()
-				return false
+			if _, writeErr := f.Write(buf[:n]); writeErr != nil {
+				return "", false, writeErr
 			}
 			downloaded += int64(n)
 
@@ -208,20 +311,30 @@ func downloadAndExtractWebView2(url, targetDir string, splash *BootstrapSplash)
 			break
 		}
 		if readErr != nil {
-			tmpFile.Close()
-			return false
+			return "", true, readErr
 		}
 	}
-	tmpFile.Close()
-
-	// Extract zip
-	splash.SetText("正在解压运行时...")
-	if err := extractZip(tmpPath, targetDir); err != nil {
-		os.RemoveAll(targetDir)
-		return false
+	if totalSize > 0 && downloaded < totalSize {
+		return "", true, io.ErrUnexpectedEOF
 	}
+	return sum, false, nil
+}
 
-	return true
+// verifyFileSHA256 checks that the file's SHA-256 matches the expected hex digest.
+func verifyFileSHA256(path, want string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	hash := sha256.New()
+	if _, err := io.Copy(hash, f); err != nil {
+		return err
+	}
+	if got := hex.EncodeToString(hash.Sum(nil)); !strings.EqualFold(got, want) {
+		return fmt.Errorf("SHA-256 不匹配: 期望 %s，实际 %s", want, got)
+	}
+	return nil
 }
 
 // extractZip extracts a zip file to the target directory.
@@ -324,22 +437,143 @@ func findServableWebView2Dir() string {
 	return ""
 }
 
-// serveWebView2Runtime handles HTTP requests for the WebView2 runtime zip.
-// Serves from local WebView2Runtime/ folder or system-installed Evergreen Runtime.
-func serveWebView2Runtime(w http.ResponseWriter, r *http.Request) {
-	wv2Dir := findServableWebView2Dir()
-	if wv2Dir == "" {
-		http.Error(w, "WebView2Runtime not available", http.StatusNotFound)
-		return
+// webView2ZipSHA256Header carries the hex SHA-256 of the runtime zip so the
+// downloader can verify it before extracting (the ETag holds the same digest).
+const webView2ZipSHA256Header = "X-Content-SHA256"
+
+// webView2ZipCache is the runtime zip built once from findServableWebView2Dir and
+// kept in the data directory. A fixed file (rather than zipping on the fly) gives
+// every response the same Content-Length and ETag, which is what lets clients
+// resume an interrupted download with a Range request.
+var webView2ZipCache struct {
+	sync.Mutex
+	meta webView2ZipMeta
+}
+
+// webView2ZipMeta describes the cached zip; saved next to it so a restart does
+// not rebuild the zip unless the source runtime changed.
+type webView2ZipMeta struct {
+	Source      string    `json:"source"`      // runtime directory the zip was built from
+	Fingerprint string    `json:"fingerprint"` // file count/size/mtime of the source, see dirFingerprint
+	SHA256      string    `json:"sha256"`
+	Size        int64     `json:"size"`
+	ModTime     time.Time `json:"modTime"`
+}
+
+func webView2ZipPath() string { return DataPath("webview2runtime.zip") }
+
+// dirFingerprint summarizes a directory tree cheaply (no file contents), enough to
+// notice that the runtime was updated or replaced.
+func dirFingerprint(dir string) (string, error) {
+	var files, total int64
+	var latest time.Time
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			return nil
+		}
+		files++
+		total += info.Size()
+		if info.ModTime().After(latest) {
+			latest = info.ModTime()
+		}
+		return nil
+	})
+	if err != nil {
+		return "", err
 	}
+	return fmt.Sprintf("%d/%d/%d", files, total, latest.UnixNano()), nil
+}
 
-	w.Header().Set("Content-Type", "application/zip")
-	w.Header().Set("Content-Disposition", "attachment; filename=WebView2Runtime.zip")
+// cachedWebView2Zip returns the metadata of an up-to-date runtime zip for wv2Dir,
+// building it first if needed. Concurrent callers wait for a single build.
+func cachedWebView2Zip(wv2Dir string) (webView2ZipMeta, error) {
+	webView2ZipCache.Lock()
+	defer webView2ZipCache.Unlock()
+
+	fingerprint, err := dirFingerprint(wv2Dir)
+	if err != nil {
+		return webView2ZipMeta{}, err
+	}
+	zipPath := webView2ZipPath()
+	metaPath := zipPath + ".json"
+
+	meta := webView2ZipCache.meta
+	if meta.SHA256 == "" {
+		if data, err := os.ReadFile(metaPath); err == nil {
+			json.Unmarshal(data, &meta)
+		}
+	}
+	if meta.Source == wv2Dir && meta.Fingerprint == fingerprint {
+		if info, err := os.Stat(zipPath); err == nil && info.Size() == meta.Size {
+			webView2ZipCache.meta = meta
+			return meta, nil
+		}
+	}
+
+	Log.Info("生成WebView2运行时缓存包", "source", wv2Dir)
+	start := time.Now()
+	meta, err = buildWebView2Zip(wv2Dir, zipPath)
+	if err != nil {
+		return webView2ZipMeta{}, err
+	}
+	meta.Fingerprint = fingerprint
+	if data, err := json.Marshal(meta); err == nil {
+		os.WriteFile(metaPath, data, 0644)
+	}
+	webView2ZipCache.meta = meta
+	Log.Info("WebView2运行时缓存包已生成", "size", meta.Size, "sha256", meta.SHA256, "耗时", time.Since(start))
+	return meta, nil
+}
+
+// buildWebView2Zip zips wv2Dir into zipPath (via a temp file, so a partial build
+// never replaces a good cache) and returns its size and SHA-256.
+func buildWebView2Zip(wv2Dir, zipPath string) (webView2ZipMeta, error) {
+	if err := os.MkdirAll(filepath.Dir(zipPath), 0755); err != nil {
+		return webView2ZipMeta{}, err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(zipPath), "webview2runtime-*.zip")
+	if err != nil {
+		return webView2ZipMeta{}, err
+	}
+	tmpPath := tmp.Name()
+	defer os.Remove(tmpPath)
+
+	hash := sha256.New()
+	zw := zip.NewWriter(io.MultiWriter(tmp, hash))
+	walkErr := writeWebView2Zip(zw, wv2Dir)
+	closeErr := zw.Close()
+	if err := tmp.Close(); err != nil && closeErr == nil {
+		closeErr = err
+	}
+	if walkErr != nil {
+		return webView2ZipMeta{}, walkErr
+	}
+	if closeErr != nil {
+		return webView2ZipMeta{}, closeErr
+	}
 
-	zw := zip.NewWriter(w)
-	defer zw.Close()
+	os.Remove(zipPath)
+	if err := os.Rename(tmpPath, zipPath); err != nil {
+		return webView2ZipMeta{}, err
+	}
+	info, err := os.Stat(zipPath)
+	if err != nil {
+		return webView2ZipMeta{}, err
+	}
+	return webView2ZipMeta{
+		Source:  wv2Dir,
+		SHA256:  hex.EncodeToString(hash.Sum(nil)),
+		Size:    info.Size(),
+		ModTime: info.ModTime(),
+	}, nil
+}
 
-	filepath.Walk(wv2Dir, func(path string, info os.FileInfo, err error) error {
+// writeWebView2Zip adds every file under wv2Dir to zw, with paths relative to wv2Dir.
+func writeWebView2Zip(zw *zip.Writer, wv2Dir string) error {
+	return filepath.Walk(wv2Dir, func(path string, info os.FileInfo, err error) error {
 		if err != nil {
 			return err
 		}
@@ -375,3 +609,34 @@ func serveWebView2Runtime(w http.ResponseWriter, r *http.Request) {
 		return err
 	})
 }
+
+// serveWebView2Runtime handles HTTP requests for the WebView2 runtime zip.
+// Serves from local WebView2Runtime/ folder or system-installed Evergreen Runtime.
+// The zip is cached (see cachedWebView2Zip) and served with ETag, Content-Length
+// and Range support; the SHA-256 is sent in X-Content-SHA256.
+func serveWebView2Runtime(w http.ResponseWriter, r *http.Request) {
+	wv2Dir := findServableWebView2Dir()
+	if wv2Dir == "" {
+		http.Error(w, "WebView2Runtime not available", http.StatusNotFound)
+		return
+	}
+
+	meta, err := cachedWebView2Zip(wv2Dir)
+	if err != nil {
+		Log.Error("生成WebView2运行时缓存包失败", "source", wv2Dir, "error", err)
+		http.Error(w, "WebView2Runtime not available", http.StatusInternalServerError)
+		return
+	}
+	f, err := os.Open(webView2ZipPath())
+	if err != nil {
+		http.Error(w, "WebView2Runtime not available", http.StatusInternalServerError)
+		return
+	}
+	defer f.Close()
+
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", "attachment; filename=WebView2Runtime.zip")
+	w.Header().Set("ETag", `"`+meta.SHA256+`"`)
+	w.Header().Set(webView2ZipSHA256Header, meta.SHA256)
+	http.ServeContent(w, r, "WebView2Runtime.zip", meta.ModTime, f)
+}
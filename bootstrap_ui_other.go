@@ -19,3 +19,8 @@ func (s *BootstrapSplash) ShowError(msg string) {
 func isWebView2SystemInstalled() bool {
 	return false
 }
+
+// fileVersion reads the version resource of an executable; Windows-only.
+func fileVersion(path string) (string, error) {
+	return "", fmt.Errorf("file version info is only available on Windows")
+}
@@ -10,6 +10,8 @@ import (
 	"sync"
 	"syscall"
 	"unsafe"
+
+	"golang.org/x/sys/windows"
 )
 
 // Win32 API references for bootstrap splash window
@@ -308,3 +310,27 @@ func isWindows11OrLater() bool {
 	fmt.Sscanf(buildStr, "%d", &build)
 	return build >= 22000
 }
+
+// fileVersion reads the fixed file version ("major.minor.build.revision") from the
+// version resource of an executable via GetFileVersionInfo.
+func fileVersion(path string) (string, error) {
+	size, err := windows.GetFileVersionInfoSize(path, nil)
+	if err != nil {
+		return "", err
+	}
+	data := make([]byte, size)
+	if err := windows.GetFileVersionInfo(path, 0, size, unsafe.Pointer(&data[0])); err != nil {
+		return "", err
+	}
+	var info *windows.VS_FIXEDFILEINFO
+	var infoLen uint32
+	if err := windows.VerQueryValue(unsafe.Pointer(&data[0]), `\`, unsafe.Pointer(&info), &infoLen); err != nil {
+		return "", err
+	}
+	if info == nil || infoLen == 0 {
+		return "", fmt.Errorf("no fixed file info in %s", path)
+	}
+	return fmt.Sprintf("%d.%d.%d.%d",
+		info.FileVersionMS>>16, info.FileVersionMS&0xffff,
+		info.FileVersionLS>>16, info.FileVersionLS&0xffff), nil
+}
@@ -17,10 +17,41 @@ fi
 BUILD_DIR="build/bin"
 mkdir -p "$BUILD_DIR"
 
+# ---- 发布签名 ----
+# 设置 LANSHARE_SIGN_KEY 为 Ed25519 私钥 PEM 路径即可签名发布版本：
+#   openssl genpkey -algorithm ed25519 -out lanshare-sign.pem
+# 公钥内嵌到程序中，签名清单（版本、渠道、SHA-256 及其签名）写入 <exe>.sig，
+# 局域网自动更新时据此校验，见 updatesign.go。
+LDFLAGS=""
+if [ -n "$LANSHARE_SIGN_KEY" ]; then
+    PUBKEY=$(openssl pkey -in "$LANSHARE_SIGN_KEY" -pubout -outform DER | tail -c 32 | openssl base64 -A)
+    LDFLAGS="-X main.updatePublicKey=$PUBKEY"
+    echo "  发布签名已启用"
+else
+    echo "  警告: 未设置 LANSHARE_SIGN_KEY，构建产物无法通过局域网自动更新"
+fi
+
+APP_VERSION=$(sed -n 's/^const AppVersion = "\(.*\)"$/\1/p' types.go)
+case "$APP_VERSION" in
+    *-*) APP_CHANNEL="test" ;;
+    *)   APP_CHANNEL="stable" ;;
+esac
+
+sign_binary() {
+    if [ -n "$LANSHARE_SIGN_KEY" ]; then
+        HASH=$( (sha256sum "$1" 2>/dev/null || shasum -a 256 "$1") | cut -d' ' -f1)
+        printf 'LANShare update manifest v1\nversion=%s\nchannel=%s\nsha256=%s\n' "$APP_VERSION" "$APP_CHANNEL" "$HASH" > "$1.manifest"
+        SIG=$(openssl pkeyutl -sign -inkey "$LANSHARE_SIGN_KEY" -rawin -in "$1.manifest" | openssl base64 -A)
+        rm -f "$1.manifest"
+        printf '{"version":"%s","channel":"%s","sha256":"%s","signature":"%s"}\n' "$APP_VERSION" "$APP_CHANNEL" "$HASH" "$SIG" > "$1.sig"
+        echo "  ✓ 已签名 $(basename "$1") ($APP_VERSION)"
+    fi
+}
+
 # ---- 64-bit 构建 ----
 echo ""
 echo ">>> 构建 64-bit 版本..."
-wails build -platform windows/amd64
+wails build -platform windows/amd64 -ldflags "$LDFLAGS"
 
 if [ -f "$BUILD_DIR/LANShare.exe" ]; then
     SIZE=$(stat -c%s "$BUILD_DIR/LANShare.exe" 2>/dev/null || stat -f%z "$BUILD_DIR/LANShare.exe" 2>/dev/null || echo 0)
@@ -37,7 +68,7 @@ cp "$BUILD_DIR/LANShare.exe" "$BUILD_DIR/LANShare_64bit.exe.tmp"
 # ---- 32-bit 构建 ----
 echo ""
 echo ">>> 构建 32-bit 版本..."
-wails build -platform windows/386
+wails build -platform windows/386 -ldflags "$LDFLAGS"
 
 if [ -f "$BUILD_DIR/LANShare.exe" ]; then
     mv "$BUILD_DIR/LANShare.exe" "$BUILD_DIR/LANShare_32bit.exe"
@@ -54,6 +85,9 @@ fi
 # 恢复 64-bit 为默认版本
 mv "$BUILD_DIR/LANShare_64bit.exe.tmp" "$BUILD_DIR/LANShare.exe"
 
+sign_binary "$BUILD_DIR/LANShare.exe"
+sign_binary "$BUILD_DIR/LANShare_32bit.exe"
+
 echo ""
 echo "==========================================="
 echo "           构建完成"
@@ -0,0 +1,61 @@
+package main
+
+// 节点能力协商：不同版本支持的功能不同，旧版本收到不认识的消息类型会忽略或显示异常，
+// 发送方却无从得知。发现消息和握手中声明本机能力（Capabilities），Peer 记录对端声明的能力，
+// 写入连接前按对端能力降级消息（adaptMessageForPeer）。未声明能力的旧版本按不支持处理
+const (
+	CapImageFetch = "image-fetch" // 公聊图片只收链接、从发送方拉取（见 imageshare.go）
+	CapLocation   = "location"    // 位置消息（MessageTypeLocation）
+	CapMarkdown   = "markdown"    // 文字消息的 ContentFormat
+	CapDelivery   = "delivery"    // 私聊送达回执（见 delivery.go）
+)
+
+// localCapabilities 本机支持的能力
+var localCapabilities = []string{CapImageFetch, CapLocation, CapMarkdown, CapDelivery}
+
+// parseCapabilities 解析握手 Data 中的能力列表（JSON 解码后为 []interface{}）
+func parseCapabilities(v interface{}) []string {
+	list, _ := v.([]interface{})
+	caps := make([]string, 0, len(list))
+	for _, item := range list {
+		if c, ok := item.(string); ok && c != "" {
+			caps = append(caps, c)
+		}
+	}
+	return caps
+}
+
+// hasCapability 对端是否声明了能力 c。握手响应可能与发送并发写入 Capabilities，调用方需持有 PeersMutex
+func (p *Peer) hasCapability(c string) bool {
+	for _, have := range p.Capabilities {
+		if have == c {
+			return true
+		}
+	}
+	return false
+}
+
+// peerHasCapability 加锁读取对端能力
+func (node *P2PNode) peerHasCapability(peer *Peer, c string) bool {
+	node.PeersMutex.RLock()
+	defer node.PeersMutex.RUnlock()
+	return peer.hasCapability(c)
+}
+
+// adaptMessageForPeer 按对端能力降级消息；对端无法处理且没有降级方式时返回 false，不发送
+func (node *P2PNode) adaptMessageForPeer(peer *Peer, msg Message) (Message, bool) {
+	switch msg.Type {
+	case "delivered":
+		return msg, node.peerHasCapability(peer, CapDelivery)
+	case "chat":
+		if msg.MessageType == MessageTypeLocation && !node.peerHasCapability(peer, CapLocation) {
+			// Content 已是位置的文字描述（locationText），作为普通文字发送
+			msg.MessageType = MessageTypeText
+			msg.Latitude, msg.Longitude, msg.LocationName = 0, 0, ""
+		}
+		if msg.ContentFormat != "" && !node.peerHasCapability(peer, CapMarkdown) {
+			msg.ContentFormat = ""
+		}
+	}
+	return msg, true
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+)
+
+// initChatStateTable 创建会话状态表：每个会话的未读数与最后已读消息，重启后恢复未读标记
+func initChatStateTable(db *sql.DB) error {
+	_, err := db.Exec(`
+		CREATE TABLE IF NOT EXISTS chat_state (
+			chat_id TEXT PRIMARY KEY,
+			last_read_message_id TEXT NOT NULL DEFAULT '',
+			unread_count INTEGER NOT NULL DEFAULT 0
+		);
+	`)
+	return err
+}
+
+// loadChatState 从数据库加载各会话的未读数到内存
+func (node *P2PNode) loadChatState() {
+	unread := make(map[string]int)
+	if node.DB != nil {
+		rows, err := node.DB.Query("SELECT chat_id, unread_count FROM chat_state WHERE unread_count > 0")
+		if err != nil {
+			Log.Error("加载会话未读状态失败", "error", err)
+		} else {
+			defer rows.Close()
+			for rows.Next() {
+				var chatID string
+				var count int
+				if rows.Scan(&chatID, &count) == nil {
+					unread[chatID] = count
+				}
+			}
+		}
+	}
+
+	node.ChatUnreadMutex.Lock()
+	node.ChatUnread = unread
+	node.ChatUnreadMutex.Unlock()
+}
+
+// incrementUnread 收到新消息时递增会话未读数
+func (node *P2PNode) incrementUnread(chatID string) {
+	node.ChatUnreadMutex.Lock()
+	if node.ChatUnread == nil {
+		node.ChatUnread = make(map[string]int)
+	}
+	node.ChatUnread[chatID]++
+	node.ChatUnreadMutex.Unlock()
+
+	if node.DB == nil {
+		return
+	}
+	if _, err := node.DB.Exec(`
+		INSERT INTO chat_state (chat_id, unread_count) VALUES (?, 1)
+		ON CONFLICT(chat_id) DO UPDATE SET unread_count = unread_count + 1`, chatID); err != nil {
+		Log.Warn("保存会话未读数失败", "chatId", chatID, "error", err)
+	}
+}
+
+// markChatRead 用户查看会话后清零未读数，并记录最后已读的消息ID（可为空）
+func (node *P2PNode) markChatRead(chatID, lastMessageID string) error {
+	if chatID == "" {
+		return fmt.Errorf("会话不能为空")
+	}
+	node.ChatUnreadMutex.Lock()
+	delete(node.ChatUnread, chatID)
+	node.ChatUnreadMutex.Unlock()
+
+	if node.DB == nil {
+		return nil
+	}
+	_, err := node.DB.Exec(`
+		INSERT INTO chat_state (chat_id, last_read_message_id, unread_count) VALUES (?, ?, 0)
+		ON CONFLICT(chat_id) DO UPDATE SET unread_count = 0,
+			last_read_message_id = CASE WHEN excluded.last_read_message_id = '' THEN last_read_message_id
+				ELSE excluded.last_read_message_id END`, chatID, lastMessageID)
+	return err
+}
+
+// clearChatState 删除会话状态（删除聊天记录时调用）
+func (node *P2PNode) clearChatState(chatID string) {
+	node.ChatUnreadMutex.Lock()
+	delete(node.ChatUnread, chatID)
+	node.ChatUnreadMutex.Unlock()
+	if node.DB != nil {
+		node.DB.Exec("DELETE FROM chat_state WHERE chat_id = ?", chatID)
+	}
+}
+
+// renameChatState 对方改名后，私聊会话的未读数与已读位置合并到新名称下
+func (node *P2PNode) renameChatState(oldName, newName string) {
+	if oldName == "" || oldName == newName || oldName == "all" {
+		return
+	}
+	node.ChatUnreadMutex.Lock()
+	if count, ok := node.ChatUnread[oldName]; ok {
+		node.ChatUnread[newName] += count
+		delete(node.ChatUnread, oldName)
+	}
+	node.ChatUnreadMutex.Unlock()
+
+	if node.DB == nil {
+		return
+	}
+	if _, err := node.DB.Exec(`
+		INSERT INTO chat_state (chat_id, last_read_message_id, unread_count)
+		SELECT ?, last_read_message_id, unread_count FROM chat_state WHERE chat_id = ?
+		ON CONFLICT(chat_id) DO UPDATE SET unread_count = unread_count + excluded.unread_count,
+			last_read_message_id = CASE WHEN last_read_message_id = '' THEN excluded.last_read_message_id
+				ELSE last_read_message_id END`, newName, oldName); err != nil {
+		Log.Warn("合并会话未读状态失败", "from", oldName, "to", newName, "error", err)
+		return
+	}
+	node.DB.Exec("DELETE FROM chat_state WHERE chat_id = ?", oldName)
+}
+
+// unreadCount 返回会话的未读数
+func (node *P2PNode) unreadCount(chatID string) int {
+	node.ChatUnreadMutex.RLock()
+	defer node.ChatUnreadMutex.RUnlock()
+	return node.ChatUnread[chatID]
+}
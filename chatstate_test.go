@@ -0,0 +1,55 @@
+package main
+
+import (
+	"database/sql"
+	"path/filepath"
+	"testing"
+)
+
+// 对方改名：旧名称下的未读数合并到新名称，内存与数据库一致，重启后仍能恢复
+func TestRenameChatState(t *testing.T) {
+	db, err := sql.Open("sqlite", filepath.Join(t.TempDir(), "chatstate.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if err := initChatStateTable(db); err != nil {
+		t.Fatal(err)
+	}
+
+	node := &P2PNode{DB: db}
+	node.incrementUnread("旧名")
+	node.incrementUnread("旧名")
+	node.incrementUnread("新名")
+	node.markChatRead("旧名", "m1")
+	node.incrementUnread("旧名")
+
+	node.renameChatState("旧名", "新名")
+
+	if n := node.unreadCount("新名"); n != 2 {
+		t.Fatalf("新名称未读数 = %d，期望 2", n)
+	}
+	if n := node.unreadCount("旧名"); n != 0 {
+		t.Fatalf("旧名称未读数 = %d，期望 0", n)
+	}
+
+	var lastRead string
+	var unread int
+	if err := db.QueryRow("SELECT last_read_message_id, unread_count FROM chat_state WHERE chat_id = ?", "新名").Scan(&lastRead, &unread); err != nil {
+		t.Fatal(err)
+	}
+	if unread != 2 || lastRead != "m1" {
+		t.Fatalf("数据库中新名称状态 = (%q, %d)，期望 (\"m1\", 2)", lastRead, unread)
+	}
+	var left int
+	db.QueryRow("SELECT COUNT(*) FROM chat_state WHERE chat_id = ?", "旧名").Scan(&left)
+	if left != 0 {
+		t.Fatalf("旧名称的会话状态未删除")
+	}
+
+	reloaded := &P2PNode{DB: db}
+	reloaded.loadChatState()
+	if n := reloaded.unreadCount("新名"); n != 2 {
+		t.Fatalf("重新加载后未读数 = %d，期望 2", n)
+	}
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+)
+
+// cliPrompt 命令行输入提示符
+const cliPrompt = "> "
+
+// cliInput 命令行输入。终端支持时关闭回显和行缓冲（enableCLILineEditing），自行维护当前输入行：
+// 收到消息、控制台日志等异步输出先用 ANSI 转义清除输入行，打印后再重绘提示符和已输入内容。
+// 不支持时（非终端、TERM=dumb、旧版 Windows 控制台）按行读取，异步输出直接打印
+type cliInput struct {
+	mu      sync.Mutex
+	reader  *bufio.Reader
+	line    []rune // 已输入的内容（仅行编辑模式）
+	waiting bool   // 提示符已显示，正在等待输入
+	editing bool   // 当前处于行编辑模式
+}
+
+var cliConsole = &cliInput{reader: bufio.NewReader(os.Stdin)}
+
+// readLine 显示提示符并读取一行输入，输入结束（EOF）时 ok 为 false
+func (c *cliInput) readLine() (line string, ok bool) {
+	restore, editing := enableCLILineEditing()
+	c.mu.Lock()
+	c.line = c.line[:0]
+	c.waiting, c.editing = true, editing
+	fmt.Print(cliPrompt)
+	c.mu.Unlock()
+
+	defer func() {
+		c.mu.Lock()
+		c.waiting, c.editing = false, false
+		c.mu.Unlock()
+		if restore != nil {
+			restore()
+		}
+	}()
+
+	if !editing {
+		text, err := c.reader.ReadString('\n')
+		if err != nil && text == "" {
+			return "", false
+		}
+		return strings.TrimRight(text, "\r\n"), true
+	}
+	return c.editLine()
+}
+
+// editLine 行编辑模式下逐字符读取：回车结束，退格删除，Ctrl+U 清空，Ctrl+D 在空行时结束输入
+func (c *cliInput) editLine() (string, bool) {
+	for {
+		r, _, err := c.reader.ReadRune()
+		if err != nil {
+			return "", false
+		}
+
+		c.mu.Lock()
+		switch {
+		case r == '\r' || r == '\n':
+			line := string(c.line)
+			fmt.Print("\n")
+			c.mu.Unlock()
+			if r == '\r' && c.reader.Buffered() > 0 {
+				// "\r\n" 只算一次回车
+				if next, _, err := c.reader.ReadRune(); err == nil && next != '\n' {
+					c.reader.UnreadRune()
+				}
+			}
+			return line, true
+		case r == 4: // Ctrl+D
+			empty := len(c.line) == 0
+			c.mu.Unlock()
+			if empty {
+				fmt.Print("\n")
+				return "", false
+			}
+			continue
+		case r == 127 || r == '\b':
+			if len(c.line) > 0 {
+				c.line = c.line[:len(c.line)-1]
+				c.redrawLocked()
+			}
+		case r == 21: // Ctrl+U
+			c.line = c.line[:0]
+			c.redrawLocked()
+		case r == 0x1b:
+			// 方向键等转义序列不支持编辑，整段丢弃
+			c.mu.Unlock()
+			c.skipEscapeSequence()
+			continue
+		case r == '\t':
+			c.line = append(c.line, ' ')
+			fmt.Print(" ")
+		case r < 0x20:
+			// 其他控制字符忽略
+		default:
+			c.line = append(c.line, r)
+			fmt.Print(string(r))
+		}
+		c.mu.Unlock()
+	}
+}
+
+// skipEscapeSequence 读取并丢弃 ESC 之后的 CSI/SS3 序列
+func (c *cliInput) skipEscapeSequence() {
+	if c.reader.Buffered() == 0 {
+		return
+	}
+	r, _, err := c.reader.ReadRune()
+	if err != nil || (r != '[' && r != 'O') {
+		return
+	}
+	for c.reader.Buffered() > 0 {
+		r, _, err = c.reader.ReadRune()
+		if err != nil || (r >= 0x40 && r <= 0x7e) {
+			return
+		}
+	}
+}
+
+// redrawLocked 清除当前行并重绘提示符和已输入内容，调用方需持有 mu
+func (c *cliInput) redrawLocked() {
+	fmt.Print("\r\x1b[K" + cliPrompt + string(c.line))
+}
+
+// writeAbove 在输入行上方输出一段文字（应以换行结尾），之后恢复输入行
+func (c *cliInput) writeAbove(w io.Writer, p []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.waiting {
+		return w.Write(p)
+	}
+	if !c.editing {
+		// 无法清除输入行：从行首输出，之后补上提示符（已输入的内容不再显示）
+		w.Write([]byte("\r"))
+		n, err := w.Write(p)
+		w.Write([]byte(cliPrompt))
+		return n, err
+	}
+	w.Write([]byte("\r\x1b[K"))
+	n, err := w.Write(p)
+	os.Stdout.Write([]byte(cliPrompt + string(c.line)))
+	return n, err
+}
+
+// stdinIsTerminal 标准输入是否为终端；脚本、管道或作为服务运行时为 false，不能交互询问
+func stdinIsTerminal() bool {
+	info, err := os.Stdin.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
+
+// cliPrintf 打印异步到达的内容（如收到的消息），不打断正在输入的命令
+func cliPrintf(format string, args ...interface{}) {
+	cliConsole.writeAbove(os.Stdout, []byte(fmt.Sprintf(format, args...)))
+}
@@ -0,0 +1,11 @@
+//go:build !windows
+
+package main
+
+import "fmt"
+
+// readClipboardFiles is only implemented on Windows (CF_HDROP); other
+// platforms paste files through the WebView's clipboard data instead.
+func readClipboardFiles() ([]string, error) {
+	return nil, fmt.Errorf("当前平台不支持从剪贴板读取文件")
+}
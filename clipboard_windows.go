@@ -0,0 +1,51 @@
+//go:build windows
+
+package main
+
+import (
+	"fmt"
+	"runtime"
+	"syscall"
+	"unsafe"
+)
+
+var (
+	pOpenClipboard              = user32dll.NewProc("OpenClipboard")
+	pCloseClipboard             = user32dll.NewProc("CloseClipboard")
+	pGetClipboardData           = user32dll.NewProc("GetClipboardData")
+	pIsClipboardFormatAvailable = user32dll.NewProc("IsClipboardFormatAvailable")
+)
+
+// readClipboardFiles returns the file paths on the system clipboard (CF_HDROP),
+// e.g. files copied in Explorer. Like the drag-drop handler, only the path
+// strings are read — never file content.
+func readClipboardFiles() ([]string, error) {
+	// The clipboard is owned by the thread that opened it
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+
+	if ret, _, _ := pIsClipboardFormatAvailable.Call(cfHDROP); ret == 0 {
+		return nil, nil
+	}
+	if ret, _, err := pOpenClipboard.Call(0); ret == 0 {
+		return nil, fmt.Errorf("打开剪贴板失败: %v", err)
+	}
+	defer pCloseClipboard.Call()
+
+	// The HDROP handle belongs to the clipboard; do not free it
+	hdrop, _, _ := pGetClipboardData.Call(cfHDROP)
+	if hdrop == 0 {
+		return nil, nil
+	}
+
+	count, _, _ := procDragQueryFileW.Call(hdrop, 0xFFFFFFFF, 0, 0)
+	var paths []string
+	buf := make([]uint16, 4096)
+	for i := uintptr(0); i < count; i++ {
+		n, _, _ := procDragQueryFileW.Call(hdrop, i, uintptr(unsafe.Pointer(&buf[0])), uintptr(len(buf)))
+		if n > 0 {
+			paths = append(paths, syscall.UTF16ToString(buf[:n]))
+		}
+	}
+	return paths, nil
+}
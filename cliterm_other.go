@@ -0,0 +1,8 @@
+//go:build !windows && !linux && !darwin
+
+package main
+
+// enableCLILineEditing 其他平台不做行编辑，按行读取输入
+func enableCLILineEditing() (restore func(), ok bool) {
+	return nil, false
+}
@@ -0,0 +1,34 @@
+//go:build linux || darwin
+
+package main
+
+import (
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// enableCLILineEditing 关闭终端的行缓冲和回显，由 cliInput 自行处理输入；
+// 保留输出处理（换行）和信号（Ctrl+C），其他协程的普通输出不受影响。
+// stdin/stdout 不是终端或 TERM=dumb 时返回 false
+func enableCLILineEditing() (restore func(), ok bool) {
+	if os.Getenv("TERM") == "dumb" {
+		return nil, false
+	}
+	in, out := int(os.Stdin.Fd()), int(os.Stdout.Fd())
+	if _, err := unix.IoctlGetTermios(out, ioctlGetTermios); err != nil {
+		return nil, false
+	}
+	old, err := unix.IoctlGetTermios(in, ioctlGetTermios)
+	if err != nil {
+		return nil, false
+	}
+	t := *old
+	t.Lflag &^= unix.ICANON | unix.ECHO
+	t.Cc[unix.VMIN] = 1
+	t.Cc[unix.VTIME] = 0
+	if err := unix.IoctlSetTermios(in, ioctlSetTermios, &t); err != nil {
+		return nil, false
+	}
+	return func() { unix.IoctlSetTermios(in, ioctlSetTermios, old) }, true
+}
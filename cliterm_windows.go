@@ -0,0 +1,30 @@
+//go:build windows
+
+package main
+
+import (
+	"os"
+
+	"golang.org/x/sys/windows"
+)
+
+// enableCLILineEditing 关闭控制台的行输入和回显，并开启 ANSI 转义（Windows 10 起支持）；
+// 保留 Ctrl+C 处理。不是控制台或不支持 ANSI 的旧版 Windows 返回 false
+func enableCLILineEditing() (restore func(), ok bool) {
+	in, out := windows.Handle(os.Stdin.Fd()), windows.Handle(os.Stdout.Fd())
+	var inMode, outMode uint32
+	if windows.GetConsoleMode(in, &inMode) != nil || windows.GetConsoleMode(out, &outMode) != nil {
+		return nil, false
+	}
+	if err := windows.SetConsoleMode(out, outMode|windows.ENABLE_PROCESSED_OUTPUT|windows.ENABLE_VIRTUAL_TERMINAL_PROCESSING); err != nil {
+		return nil, false
+	}
+	if err := windows.SetConsoleMode(in, inMode&^(windows.ENABLE_LINE_INPUT|windows.ENABLE_ECHO_INPUT)); err != nil {
+		windows.SetConsoleMode(out, outMode)
+		return nil, false
+	}
+	return func() {
+		windows.SetConsoleMode(in, inMode)
+		windows.SetConsoleMode(out, outMode)
+	}, true
+}
@@ -1,29 +1,263 @@
 package main
 
 import (
+	"crypto/rand"
 	"encoding/json"
 	"fmt"
 	"os"
 	"path/filepath"
+	"strconv"
 	"sync"
+	"time"
 )
 
 // AppConfig holds all persistent user settings.
 type AppConfig struct {
-	Name         string   `json:"name"`
-	WebPort      int      `json:"webPort"`
-	LogLevel     string   `json:"logLevel"`
-	WindowWidth  int      `json:"windowWidth"`
-	WindowHeight int      `json:"windowHeight"`
-	BlockedUsers []string `json:"blockedUsers"`
-	SaveHistory  *bool    `json:"saveHistory"` // nil = true (default on)
+	Name          string   `json:"name"`
+	WebPort       int      `json:"webPort"`
+	LogLevel      string   `json:"logLevel"`
+	WindowWidth   int      `json:"windowWidth"`
+	WindowHeight  int      `json:"windowHeight"`
+	BlockedUsers  []string `json:"blockedUsers"`
+	SaveHistory   *bool    `json:"saveHistory"`   // nil = true (default on)
+	UserUUID      string   `json:"userUUID"`      // 持久用户标识，首次启动生成
+	EnableMDNS    *bool    `json:"enableMDNS"`    // nil = true (default on)
+	SeedNodes     []string `json:"seedNodes"`     // 跨子网种子节点 "IP" 或 "IP:发现端口"
+	UpdateChannel string   `json:"updateChannel"` // 更新提示渠道: stable/test/any，空 = 与当前版本同渠道
+	LogMaxFiles   int      `json:"logMaxFiles"`   // 最多保留的日志文件数，0 = 默认
+	LogMaxDays    int      `json:"logMaxDays"`    // 日志保留天数，0 = 默认
+	MutedChats    []string `json:"mutedChats"`    // 免打扰会话: "all" 表示公聊，其余为用户名
+	PinnedChats   []string `json:"pinnedChats"`   // 置顶会话（按置顶先后），取值同 MutedChats
+	P2PPort       int      `json:"p2pPort"`       // P2P通信TCP端口，0 = 默认 8888（被占用时自动递增）
+	DiscoveryPort int      `json:"discoveryPort"` // 服务发现UDP端口，0 = 默认 9999，需与局域网内其他节点一致
+	Theme         string   `json:"theme"`         // 皮肤: telegram/wisetalk，空 = telegram
+	AccentColor   string   `json:"accentColor"`   // 自定义主题色 "#RRGGBB"，空 = 皮肤默认
+	CloseToTray   *bool    `json:"closeToTray"`   // 点击关闭按钮时隐藏到托盘，nil = true (default on)
+	AutoStart     bool     `json:"autoStart"`     // 开机（登录）自动启动，实际启动项由各平台 setAutoStart 维护
+
+	MaxUploadBytesPerSec int `json:"maxUploadBytesPerSec"` // 文件发送限速（字节/秒），0 = 不限速
+	TransferStallTimeout int `json:"transferStallTimeout"` // 文件传输无进度多少秒视为卡住，0 = 默认 60
+
+	OrganizeDownloads string `json:"organizeDownloads"` // 接收文件整理: none/by_sender/by_type，空 = none
+
+	ConnectMaxRetries int `json:"connectMaxRetries"` // 连接其他节点的最大尝试次数（指数退避），0 = 默认 5
+
+	PublicImageByURL bool `json:"publicImageByUrl"` // 公聊图片只广播链接，接收方从本机拉取（见 imageshare.go）
+
+	MessageFilters []string `json:"messageFilters"` // 消息过滤规则（正则，无效时按关键词），命中的收到消息直接丢弃
+
+	PreferredInterface string `json:"preferredInterface"` // 固定使用的网络接口（网卡名或IP），空 = 自动选择（见 selectLocalInterface）
+	LocalIP            string `json:"localIP"`            // 直接指定本机IP（-ip 参数覆盖），设置后不再选择网卡
+
+	AutoAcceptFrom    []string `json:"autoAcceptFrom"`    // 自动接受其文件的用户标识（同 BlockedUsers），见 autoaccept.go
+	AutoAcceptMaxSize int64    `json:"autoAcceptMaxSize"` // 自动接受的单个文件大小上限（字节），0 = 默认 100MB
+
+	InitialHistoryLimit int `json:"initialHistoryLimit"` // 启动和打开会话时首次加载的历史消息条数，0 = 默认 20
+	MemoryMessageCap    int `json:"memoryMessageCap"`    // 内存中保留的最近消息条数，0 = 默认 500；更早的消息从数据库分页读取
+
+	LongTextThreshold int `json:"longTextThreshold"` // 文字消息超过该字节数时转为 .txt 文件发送，0 = 默认 8KB，-1 = 不转换
+
+	PeerAliases map[string]string `json:"peerAliases"` // 本机给其他用户设置的备注名（key 为用户稳定标识），只在本机显示，见 alias.go
+
+	AutoReplyEnabled bool   `json:"autoReplyEnabled"` // 收到私聊时自动回复发送方（每人冷却期内一次），见 autoreply.go
+	AutoReply        string `json:"autoReply"`        // 自动回复内容，空 = 默认内容
+
+	NetworkKey string `json:"networkKey"` // 预共享网络密钥：设置后发现消息中的用户名等信息加密广播，空 = 明文（见 discovery.go）
+
+	ArchivedChats         []string `json:"archivedChats"`         // 归档会话，从会话列表中隐藏，取值同 PinnedChats（见 archive.go）
+	KeepArchivedOnMessage bool     `json:"keepArchivedOnMessage"` // 归档会话收到新消息时保持归档（只计未读），默认自动取消归档
+
+	Notifications *bool  `json:"notifications"` // 系统通知总开关，nil = true (default on)
+	DndStart      string `json:"dndStart"`      // 免打扰开始时间 "HH:MM"，空 = 不启用；结束时间不晚于开始时间时跨午夜，见 notify.go
+	DndEnd        string `json:"dndEnd"`        // 免打扰结束时间 "HH:MM"
+
+	Avatar string `json:"avatar"` // 自定义头像的内容哈希（文件在 assets/avatars），空 = 颜色加首字母，见 avatar.go
 }
 
+// Default network ports.
+const (
+	defaultP2PPort       = 8888
+	defaultDiscoveryPort = 9999
+)
+
 // IsSaveHistory returns whether chat history should be saved (default true).
 func (c *AppConfig) IsSaveHistory() bool {
 	return c.SaveHistory == nil || *c.SaveHistory
 }
 
+// IsMDNSEnabled returns whether mDNS discovery should run alongside UDP broadcast (default true).
+func (c *AppConfig) IsMDNSEnabled() bool {
+	return c.EnableMDNS == nil || *c.EnableMDNS
+}
+
+// IsCloseToTray returns whether closing the window hides it to the tray instead of quitting (default true).
+func (c *AppConfig) IsCloseToTray() bool {
+	return c.CloseToTray == nil || *c.CloseToTray
+}
+
+// IsNotificationsEnabled returns whether system notifications are shown (default true).
+func (c *AppConfig) IsNotificationsEnabled() bool {
+	return c.Notifications == nil || *c.Notifications
+}
+
+// GetUpdateChannel returns the channel updates are offered from: "stable", "test" or "any".
+// Defaults to the running version's channel.
+func (c *AppConfig) GetUpdateChannel() string {
+	switch c.UpdateChannel {
+	case "stable", "test", "any":
+		return c.UpdateChannel
+	}
+	return AppChannel()
+}
+
+// GetTheme returns the saved skin id, defaulting to "telegram".
+func (c *AppConfig) GetTheme() string {
+	if c.Theme == "wisetalk" {
+		return c.Theme
+	}
+	return "telegram"
+}
+
+// parseHexColor parses a "#RRGGBB" colour string.
+func parseHexColor(s string) (r, g, b uint8, ok bool) {
+	if len(s) != 7 || s[0] != '#' {
+		return 0, 0, 0, false
+	}
+	var v [3]uint8
+	for i := range v {
+		n, err := strconv.ParseUint(s[1+i*2:3+i*2], 16, 8)
+		if err != nil {
+			return 0, 0, 0, false
+		}
+		v[i] = uint8(n)
+	}
+	return v[0], v[1], v[2], true
+}
+
+// GetP2PPort returns the TCP port for peer connections, falling back to the default when unset or invalid.
+func (c *AppConfig) GetP2PPort() int {
+	return validPortOr(c.P2PPort, defaultP2PPort)
+}
+
+// GetDiscoveryPort returns the UDP discovery port, falling back to the default when unset or invalid.
+func (c *AppConfig) GetDiscoveryPort() int {
+	return validPortOr(c.DiscoveryPort, defaultDiscoveryPort)
+}
+
+// GetOrganizeDownloads returns how received files are sorted into sub-directories.
+func (c *AppConfig) GetOrganizeDownloads() string {
+	switch c.OrganizeDownloads {
+	case organizeBySender, organizeByType:
+		return c.OrganizeDownloads
+	}
+	return organizeNone
+}
+
+// GetConnectMaxRetries returns how many times to try connecting to a discovered peer.
+func (c *AppConfig) GetConnectMaxRetries() int {
+	if c.ConnectMaxRetries <= 0 {
+		return defaultConnectMaxRetries
+	}
+	return c.ConnectMaxRetries
+}
+
+// GetAutoAcceptMaxSize returns the largest file accepted automatically from trusted users.
+func (c *AppConfig) GetAutoAcceptMaxSize() int64 {
+	if c.AutoAcceptMaxSize <= 0 {
+		return defaultAutoAcceptMaxSize
+	}
+	return c.AutoAcceptMaxSize
+}
+
+// GetAutoReply returns the auto-reply text, falling back to the default when unset.
+func (c *AppConfig) GetAutoReply() string {
+	if c.AutoReply == "" {
+		return defaultAutoReply
+	}
+	return c.AutoReply
+}
+
+// Defaults and accepted upper bounds for history loading and the in-memory message list.
+const (
+	defaultInitialHistoryLimit = 20
+	defaultMemoryMessageCap    = 500
+	maxInitialHistoryLimit     = 1000
+	maxMemoryMessageCap        = 100000
+)
+
+// GetInitialHistoryLimit returns how many messages to load when starting up or opening a chat.
+func (c *AppConfig) GetInitialHistoryLimit() int {
+	if c.InitialHistoryLimit <= 0 {
+		return defaultInitialHistoryLimit
+	}
+	return c.InitialHistoryLimit
+}
+
+// GetMemoryMessageCap returns how many recent messages are kept in memory.
+// It is never below the initial history limit, so the first page always fits.
+func (c *AppConfig) GetMemoryMessageCap() int {
+	limit := defaultMemoryMessageCap
+	if c.MemoryMessageCap > 0 {
+		limit = c.MemoryMessageCap
+	}
+	return max(limit, c.GetInitialHistoryLimit())
+}
+
+// defaultLongTextThreshold is the size (bytes) above which a text message is sent as a .txt file;
+// maxLongTextThreshold is the largest accepted setting.
+const (
+	defaultLongTextThreshold = 8 << 10
+	maxLongTextThreshold     = 1 << 20
+)
+
+// GetLongTextThreshold returns the long-text size threshold in bytes; 0 means never convert.
+func (c *AppConfig) GetLongTextThreshold() int {
+	switch {
+	case c.LongTextThreshold < 0:
+		return 0
+	case c.LongTextThreshold == 0:
+		return defaultLongTextThreshold
+	}
+	return c.LongTextThreshold
+}
+
+// GetTransferStallTimeout returns how long a file transfer may go without progress
+// before it is marked stalled (failed after twice as long).
+func (c *AppConfig) GetTransferStallTimeout() time.Duration {
+	if c.TransferStallTimeout <= 0 {
+		return defaultTransferStallTimeout
+	}
+	return time.Duration(c.TransferStallTimeout) * time.Second
+}
+
+// validPortOr returns port if it is within 1-65535, otherwise def.
+func validPortOr(port, def int) int {
+	if port <= 0 || port > 65535 {
+		return def
+	}
+	return port
+}
+
+// EnsureUserUUID generates and persists the user's UUID on first launch.
+func (c *AppConfig) EnsureUserUUID() {
+	if c.UserUUID != "" {
+		return
+	}
+	c.UserUUID = newUUID()
+	if err := SaveConfig(c); err != nil {
+		fmt.Printf("保存用户标识失败: %v\n", err)
+	}
+}
+
+// newUUID returns a random RFC 4122 version 4 UUID string.
+func newUUID() string {
+	var b [16]byte
+	rand.Read(b[:])
+	b[6] = (b[6] & 0x0f) | 0x40
+	b[8] = (b[8] & 0x3f) | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:16])
+}
+
 var (
 	appDataDir     string
 	appDataDirOnce sync.Once
@@ -106,3 +340,10 @@ func SaveConfig(cfg *AppConfig) error {
 
 	return os.WriteFile(configPath(), data, 0644)
 }
+
+// saveConfig 在 ConfigMutex 读锁下保存节点配置，避免序列化时其他设置正被修改
+func (node *P2PNode) saveConfig() error {
+	node.ConfigMutex.RLock()
+	defer node.ConfigMutex.RUnlock()
+	return SaveConfig(node.Config)
+}
@@ -0,0 +1,423 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// 配置导出文件格式。字段含义发生不兼容变化时递增 configExportVersion
+const (
+	configExportFormat  = "lanshare-config"
+	configExportVersion = 1
+)
+
+// configExportExcluded 不导出、也不从导入文件读取的设置：
+// 用户标识迁移后两台电脑会被识别为同一用户；窗口尺寸与屏幕相关；
+// 网络密钥属于机密，不应随导出文件流转；网卡和本机IP只对本机有效；
+// 头像只记录哈希，对应的图片文件不在导出文件中
+var configExportExcluded = map[string]bool{
+	"userUUID":           true,
+	"windowWidth":        true,
+	"windowHeight":       true,
+	"networkKey":         true,
+	"preferredInterface": true,
+	"localIP":            true,
+	"avatar":             true,
+}
+
+// configRestartFields 运行中无法切换、重启后才生效的设置
+var configRestartFields = map[string]bool{
+	"webPort":            true,
+	"p2pPort":            true,
+	"discoveryPort":      true,
+	"enableMDNS":         true,
+	"logMaxFiles":        true,
+	"logMaxDays":         true,
+	"preferredInterface": true,
+	"localIP":            true,
+}
+
+// configExportFile 导出文件结构：外层记录格式版本，供导入时处理版本差异
+type configExportFile struct {
+	Format     string          `json:"format"`
+	Version    int             `json:"version"`
+	AppVersion string          `json:"appVersion"`
+	ExportedAt time.Time       `json:"exportedAt"`
+	Config     json.RawMessage `json:"config"`
+}
+
+// ConfigImportResult 导入结果，返回给前端提示用户
+type ConfigImportResult struct {
+	Applied         []string `json:"applied"`         // 发生变化的设置项（JSON 字段名）
+	RestartRequired []string `json:"restartRequired"` // 其中需要重启才生效的设置项
+	Warnings        []string `json:"warnings"`        // 被忽略的内容等提示
+}
+
+// configValidationError 导入的配置未通过校验，Problems 逐条说明原因
+type configValidationError struct {
+	Problems []string
+}
+
+func (e *configValidationError) Error() string {
+	return "配置校验失败: " + strings.Join(e.Problems, "; ")
+}
+
+// exportConfig 将配置序列化为导出文件，去掉 configExportExcluded 中的设备相关项
+func exportConfig(cfg *AppConfig) ([]byte, error) {
+	fields, err := configFields(cfg)
+	if err != nil {
+		return nil, err
+	}
+	for key := range configExportExcluded {
+		delete(fields, key)
+	}
+	raw, err := json.Marshal(fields)
+	if err != nil {
+		return nil, err
+	}
+	return json.MarshalIndent(configExportFile{
+		Format:     configExportFormat,
+		Version:    configExportVersion,
+		AppVersion: AppVersion,
+		ExportedAt: time.Now(),
+		Config:     raw,
+	}, "", "  ")
+}
+
+// exportCurrentConfig 在 ConfigMutex 读锁下导出节点当前配置
+func (node *P2PNode) exportCurrentConfig() ([]byte, error) {
+	node.ConfigMutex.RLock()
+	defer node.ConfigMutex.RUnlock()
+	return exportConfig(node.Config)
+}
+
+// configFields 将配置转为 JSON 字段名 -> 原始值
+func configFields(cfg *AppConfig) (map[string]json.RawMessage, error) {
+	data, err := json.Marshal(cfg)
+	if err != nil {
+		return nil, err
+	}
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return nil, err
+	}
+	return fields, nil
+}
+
+// configFieldNames 返回 AppConfig 全部 JSON 字段名
+func configFieldNames() map[string]bool {
+	names := make(map[string]bool)
+	t := reflect.TypeOf(AppConfig{})
+	for i := 0; i < t.NumField(); i++ {
+		if name, _, _ := strings.Cut(t.Field(i).Tag.Get("json"), ","); name != "" && name != "-" {
+			names[name] = true
+		}
+	}
+	return names
+}
+
+// parseConfigImport 解析导入文件，返回其中可导入的设置字段。
+// 既支持 exportConfig 生成的文件，也支持直接拷贝的 config.json；
+// 较新版本导出的文件仍尝试导入，无法识别的字段忽略并给出提示
+func parseConfigImport(data []byte) (map[string]json.RawMessage, []string, error) {
+	var top map[string]json.RawMessage
+	if err := json.Unmarshal(data, &top); err != nil {
+		return nil, nil, fmt.Errorf("不是有效的配置文件: %v", err)
+	}
+
+	var warnings []string
+	fields := top
+	if _, wrapped := top["config"]; wrapped {
+		var file configExportFile
+		if err := json.Unmarshal(data, &file); err != nil {
+			return nil, nil, fmt.Errorf("不是有效的配置文件: %v", err)
+		}
+		if file.Format != configExportFormat {
+			return nil, nil, fmt.Errorf("不是 LANShare 配置文件")
+		}
+		if file.Version > configExportVersion {
+			warnings = append(warnings, fmt.Sprintf("配置文件来自较新的版本 %s，部分设置可能无法识别", file.AppVersion))
+		}
+		fields = nil
+		if err := json.Unmarshal(file.Config, &fields); err != nil {
+			return nil, nil, fmt.Errorf("配置内容无效: %v", err)
+		}
+	}
+
+	known := configFieldNames()
+	var unknown []string
+	for key := range fields {
+		if configExportExcluded[key] {
+			delete(fields, key)
+		} else if !known[key] {
+			unknown = append(unknown, key)
+			delete(fields, key)
+		}
+	}
+	if len(unknown) > 0 {
+		sort.Strings(unknown)
+		warnings = append(warnings, "已忽略无法识别的设置: "+strings.Join(unknown, ", "))
+	}
+	return fields, warnings, nil
+}
+
+// mergeConfig 将导入字段合并到 cur 的副本上（未出现的字段保持不变），不修改 cur
+func mergeConfig(cur *AppConfig, fields map[string]json.RawMessage) (*AppConfig, error) {
+	base, err := json.Marshal(cur)
+	if err != nil {
+		return nil, err
+	}
+	next := &AppConfig{}
+	if err := json.Unmarshal(base, next); err != nil {
+		return nil, err
+	}
+
+	var problems []string
+	for key, value := range fields {
+		single, _ := json.Marshal(map[string]json.RawMessage{key: value})
+		if err := json.Unmarshal(single, next); err != nil {
+			problems = append(problems, fmt.Sprintf("%s 类型错误", key))
+		}
+	}
+	if len(problems) > 0 {
+		sort.Strings(problems)
+		return nil, &configValidationError{Problems: problems}
+	}
+	return next, nil
+}
+
+// validateConfig 检查各设置取值是否合法。不影响导入、但用户应当知道的问题
+// （如过滤规则不是有效正则，将按关键词匹配）作为 warnings 返回
+func validateConfig(cfg *AppConfig) (warnings []string, err error) {
+	var problems []string
+	add := func(format string, args ...interface{}) {
+		problems = append(problems, fmt.Sprintf(format, args...))
+	}
+
+	if name := strings.TrimSpace(cfg.Name); name == "" || name == "all" {
+		add("name 无效: %q", cfg.Name)
+	}
+	if cfg.WebPort < 1 || cfg.WebPort > 65535 {
+		add("webPort 超出范围 1-65535: %d", cfg.WebPort)
+	}
+	if cfg.P2PPort < 0 || cfg.P2PPort > 65535 {
+		add("p2pPort 超出范围 0-65535: %d", cfg.P2PPort)
+	}
+	if cfg.DiscoveryPort < 0 || cfg.DiscoveryPort > 65535 {
+		add("discoveryPort 超出范围 0-65535: %d", cfg.DiscoveryPort)
+	}
+	switch cfg.LogLevel {
+	case "", "error", "info", "debug":
+	default:
+		add("logLevel 应为 error/info/debug: %q", cfg.LogLevel)
+	}
+	switch cfg.UpdateChannel {
+	case "", "stable", "test", "any":
+	default:
+		add("updateChannel 应为 stable/test/any: %q", cfg.UpdateChannel)
+	}
+	switch cfg.Theme {
+	case "", "telegram", "wisetalk":
+	default:
+		add("theme 应为 telegram/wisetalk: %q", cfg.Theme)
+	}
+	if cfg.AccentColor != "" {
+		if _, _, _, ok := parseHexColor(cfg.AccentColor); !ok {
+			add("accentColor 应为 #RRGGBB: %q", cfg.AccentColor)
+		}
+	}
+	switch cfg.OrganizeDownloads {
+	case "", organizeNone, organizeBySender, organizeByType:
+	default:
+		add("organizeDownloads 应为 none/by_sender/by_type: %q", cfg.OrganizeDownloads)
+	}
+	for _, seed := range cfg.SeedNodes {
+		if !validSeedNode(seed) {
+			add("seedNodes 包含无效地址: %q", seed)
+		}
+	}
+	for key, v := range map[string]int{
+		"logMaxFiles":          cfg.LogMaxFiles,
+		"logMaxDays":           cfg.LogMaxDays,
+		"maxUploadBytesPerSec": cfg.MaxUploadBytesPerSec,
+		"transferStallTimeout": cfg.TransferStallTimeout,
+		"connectMaxRetries":    cfg.ConnectMaxRetries,
+	} {
+		if v < 0 {
+			add("%s 不能为负数: %d", key, v)
+		}
+	}
+	if cfg.InitialHistoryLimit < 0 || cfg.InitialHistoryLimit > maxInitialHistoryLimit {
+		add("initialHistoryLimit 超出范围 0-%d: %d", maxInitialHistoryLimit, cfg.InitialHistoryLimit)
+	}
+	if cfg.MemoryMessageCap < 0 || cfg.MemoryMessageCap > maxMemoryMessageCap {
+		add("memoryMessageCap 超出范围 0-%d: %d", maxMemoryMessageCap, cfg.MemoryMessageCap)
+	}
+	if cfg.LongTextThreshold < -1 || cfg.LongTextThreshold > maxLongTextThreshold {
+		add("longTextThreshold 应在 -1 到 %d 之间: %d", maxLongTextThreshold, cfg.LongTextThreshold)
+	}
+	if (cfg.DndStart == "") != (cfg.DndEnd == "") {
+		add("dndStart 和 dndEnd 需同时设置: %q, %q", cfg.DndStart, cfg.DndEnd)
+	}
+	for key, v := range map[string]string{"dndStart": cfg.DndStart, "dndEnd": cfg.DndEnd} {
+		if v == "" {
+			continue
+		}
+		if _, err := parseDndTime(v); err != nil {
+			add("%s 应为 HH:MM: %q", key, v)
+		}
+	}
+	for _, rule := range cfg.MessageFilters {
+		// 空规则会匹配所有消息
+		if strings.TrimSpace(rule) == "" {
+			add("messageFilters 包含空规则")
+			continue
+		}
+		if _, err := regexp.Compile(rule); err != nil {
+			warnings = append(warnings, fmt.Sprintf("过滤规则不是有效的正则，将按关键词匹配: %q", rule))
+		}
+	}
+
+	if len(problems) > 0 {
+		sort.Strings(problems)
+		return nil, &configValidationError{Problems: problems}
+	}
+	return warnings, nil
+}
+
+// validSeedNode 种子节点格式为 "IP" 或 "IP:端口"（也接受主机名）
+func validSeedNode(seed string) bool {
+	host := seed
+	if h, port, err := net.SplitHostPort(seed); err == nil {
+		p, err := strconv.Atoi(port)
+		if err != nil || p < 1 || p > 65535 {
+			return false
+		}
+		host = h
+	}
+	return host != "" && !strings.ContainsAny(host, " /")
+}
+
+// changedConfigFields 返回两份配置中取值不同的字段名（已排序）
+func changedConfigFields(a, b *AppConfig) []string {
+	before, _ := configFields(a)
+	after, _ := configFields(b)
+	var changed []string
+	for key, value := range after {
+		if !bytes.Equal(before[key], value) {
+			changed = append(changed, key)
+		}
+	}
+	sort.Strings(changed)
+	return changed
+}
+
+// replaceConfigLocked 将导入字段合并到当前配置，校验通过后原地替换并保存，返回发生变化的字段和校验提示。
+// 调用方持有 ConfigMutex 写锁，合并与替换之间其他设置的修改不会丢失；
+// 原地替换是因为桌面端 DesktopApp 与节点共用同一个配置对象
+func (node *P2PNode) replaceConfigLocked(fields map[string]json.RawMessage) (applied, warnings []string, err error) {
+	next, err := mergeConfig(node.Config, fields)
+	if err != nil {
+		return nil, nil, err
+	}
+	if warnings, err = validateConfig(next); err != nil {
+		return nil, nil, err
+	}
+	applied = changedConfigFields(node.Config, next)
+	if len(applied) == 0 {
+		return applied, warnings, nil
+	}
+	prev := *node.Config
+	*node.Config = *next
+	if err := SaveConfig(node.Config); err != nil {
+		*node.Config = prev
+		return nil, nil, fmt.Errorf("保存配置失败: %v", err)
+	}
+	return applied, warnings, nil
+}
+
+// importConfig 校验并合并导入的配置，保存后立即应用可在运行中切换的设置
+func (node *P2PNode) importConfig(data []byte) (*ConfigImportResult, error) {
+	if node.Config == nil {
+		return nil, errors.New("配置不可用")
+	}
+	fields, warnings, err := parseConfigImport(data)
+	if err != nil {
+		return nil, err
+	}
+	node.ConfigMutex.Lock()
+	applied, validationWarnings, err := node.replaceConfigLocked(fields)
+	node.ConfigMutex.Unlock()
+	if err != nil {
+		return nil, err
+	}
+
+	result := &ConfigImportResult{
+		Applied:         applied,
+		RestartRequired: []string{},
+		Warnings:        append(warnings, validationWarnings...),
+	}
+	if result.Warnings == nil {
+		result.Warnings = []string{}
+	}
+	if len(result.Applied) == 0 {
+		return result, nil
+	}
+
+	for _, key := range result.Applied {
+		if configRestartFields[key] {
+			result.RestartRequired = append(result.RestartRequired, key)
+		}
+		if warning := node.applyConfigField(key); warning != "" {
+			result.Warnings = append(result.Warnings, warning)
+		}
+	}
+	Log.Info("已导入配置", "applied", result.Applied, "restartRequired", result.RestartRequired)
+	return result, nil
+}
+
+// applyConfigField 让导入后发生变化的设置在运行中生效，失败时返回提示
+func (node *P2PNode) applyConfigField(key string) string {
+	cfg := node.Config
+	switch key {
+	case "name":
+		node.changeName(cfg.Name)
+	case "logLevel":
+		if cfg.LogLevel != "" {
+			SetLogLevel(cfg.LogLevel)
+		}
+	case "maxUploadBytesPerSec":
+		node.UploadLimiter.SetRate(cfg.MaxUploadBytesPerSec)
+	case "blockedUsers":
+		node.ACLMutex.Lock()
+		node.ACLs[node.Address] = make(map[string]bool)
+		node.ACLMutex.Unlock()
+		applyBlockedUsers(node, cfg)
+	case "updateChannel":
+		node.PeersMutex.Lock()
+		if node.AvailableUpdate != nil && !node.acceptsUpdate(node.AvailableUpdate.Version) {
+			node.AvailableUpdate = nil
+		}
+		node.PeersMutex.Unlock()
+	case "webPort":
+		node.WebPortChangePending = true
+	case "autoStart":
+		// 启动项只由桌面端维护
+		if node.DesktopMode {
+			if err := setAutoStart(cfg.AutoStart); err != nil {
+				Log.Error("设置开机自启动失败", "enabled", cfg.AutoStart, "error", err)
+				return "开机自动启动设置失败: " + err.Error()
+			}
+		}
+	}
+	return ""
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// 连接信息：用于扫码或粘贴后手动添加节点（跨子网、广播被屏蔽时）。编码为紧凑的链接
+//
+//	lanshare://peer?ip=192.168.1.5&port=8888&d=9999&name=张三&fp=1a2b3c4d5e6f7a8b
+//
+// port 为 TCP 监听端口，d 为发现端口，fp 为节点公钥指纹。添加方向 ip:d 单播 announce，
+// 之后与普通发现流程相同；连接建立后核对对方公钥指纹，不一致时提示用户
+const connectLinkScheme = "lanshare"
+
+// addPeerTimeout 手动添加节点时等待连接建立的时间
+const addPeerTimeout = 10 * time.Second
+
+var errPeerFingerprintMismatch = fmt.Errorf("公钥指纹不一致，对方可能不是连接信息中的用户")
+
+// connectInfo 解析后的连接信息
+type connectInfo struct {
+	IP            string `json:"ip"`
+	Port          int    `json:"port"`
+	DiscoveryPort int    `json:"discoveryPort"`
+	Name          string `json:"name,omitempty"`
+	Fingerprint   string `json:"fingerprint,omitempty"`
+}
+
+// keyFingerprint 公钥指纹：SHA-256 的前 8 字节（16 位十六进制），足够人工核对且二维码紧凑
+func keyFingerprint(pub [32]byte) string {
+	sum := sha256.Sum256(pub[:])
+	return hex.EncodeToString(sum[:8])
+}
+
+// localConnectInfo 本机的连接信息
+func (node *P2PNode) localConnectInfo() connectInfo {
+	return connectInfo{
+		IP:            node.LocalIP,
+		Port:          node.LocalPort,
+		DiscoveryPort: node.DiscoveryPort,
+		Name:          node.Name,
+		Fingerprint:   keyFingerprint(node.NodePublicKey),
+	}
+}
+
+// link 编码为 lanshare:// 链接
+func (c connectInfo) link() string {
+	q := url.Values{}
+	q.Set("ip", c.IP)
+	q.Set("port", strconv.Itoa(c.Port))
+	q.Set("d", strconv.Itoa(c.DiscoveryPort))
+	if c.Name != "" {
+		q.Set("name", c.Name)
+	}
+	if c.Fingerprint != "" {
+		q.Set("fp", c.Fingerprint)
+	}
+	return connectLinkScheme + "://peer?" + q.Encode()
+}
+
+// parseConnectLink 解析 lanshare:// 链接；也接受 "IP"、"IP:发现端口" 形式的手动输入
+func parseConnectLink(s string, defaultDiscoveryPort int) (connectInfo, error) {
+	s = strings.TrimSpace(s)
+	info := connectInfo{DiscoveryPort: defaultDiscoveryPort}
+	if !strings.HasPrefix(s, connectLinkScheme+"://") {
+		host, port, err := net.SplitHostPort(s)
+		if err != nil {
+			host = s
+		} else if info.DiscoveryPort, err = strconv.Atoi(port); err != nil {
+			return info, fmt.Errorf("端口无效: %s", port)
+		}
+		info.IP = host
+	} else {
+		u, err := url.Parse(s)
+		if err != nil {
+			return info, fmt.Errorf("连接信息格式错误")
+		}
+		q := u.Query()
+		info.IP = q.Get("ip")
+		info.Name = q.Get("name")
+		info.Fingerprint = strings.ToLower(q.Get("fp"))
+		if p := q.Get("port"); p != "" {
+			if info.Port, err = strconv.Atoi(p); err != nil {
+				return info, fmt.Errorf("端口无效: %s", p)
+			}
+		}
+		if d := q.Get("d"); d != "" {
+			if info.DiscoveryPort, err = strconv.Atoi(d); err != nil {
+				return info, fmt.Errorf("发现端口无效: %s", d)
+			}
+		}
+	}
+	if ip := net.ParseIP(info.IP); ip == nil || ip.To4() == nil {
+		return info, fmt.Errorf("IP地址无效: %s", info.IP)
+	}
+	if info.DiscoveryPort <= 0 || info.DiscoveryPort > 65535 || info.Port < 0 || info.Port > 65535 {
+		return info, fmt.Errorf("端口无效")
+	}
+	return info, nil
+}
+
+// findPeerByAddress 查找指定IP（和TCP端口，0 = 不限）的活跃peer
+func (node *P2PNode) findPeerByAddress(ip string, port int) *Peer {
+	node.PeersMutex.RLock()
+	defer node.PeersMutex.RUnlock()
+	for _, peer := range node.Peers {
+		if peer.IsActive && peer.IP == ip && (port == 0 || peer.Port == port) {
+			return peer
+		}
+	}
+	return nil
+}
+
+// addPeerByInfo 向连接信息中的地址单播 announce 并等待连接建立。
+// 超时未连上时返回 nil（对方可能稍后才响应，不视为错误）；公钥指纹不一致时返回 errPeerFingerprintMismatch。
+// 该地址可能本来就已连接（指纹不一致说明连接信息已过期或被伪造），因此不主动断开，由用户判断
+func (node *P2PNode) addPeerByInfo(info connectInfo) (*Peer, error) {
+	if info.IP == node.LocalIP && (info.Port == 0 || info.Port == node.LocalPort) {
+		return nil, fmt.Errorf("不能添加本机")
+	}
+	Log.Info("手动添加节点", "ip", info.IP, "port", info.Port, "discoveryPort", info.DiscoveryPort, "name", info.Name)
+	node.sendDiscoveryUnicast(fmt.Sprintf("%s:%d", info.IP, info.DiscoveryPort), node.newDiscoveryMessage("announce"))
+
+	deadline := time.Now().Add(addPeerTimeout)
+	for time.Now().Before(deadline) {
+		if peer := node.findPeerByAddress(info.IP, info.Port); peer != nil {
+			node.PeersMutex.RLock()
+			pub := peer.PublicKey
+			node.PeersMutex.RUnlock()
+			if pub == ([32]byte{}) {
+				// 主动连接的公钥在握手响应中才得到
+				time.Sleep(300 * time.Millisecond)
+				continue
+			}
+			if fp := keyFingerprint(pub); info.Fingerprint != "" && fp != info.Fingerprint {
+				Log.Warn("手动添加的节点公钥指纹不一致", "peer", peer.Name, "expected", info.Fingerprint, "actual", fp)
+				return peer, errPeerFingerprintMismatch
+			}
+			return peer, nil
+		}
+		time.Sleep(300 * time.Millisecond)
+	}
+	Log.Info("手动添加节点：等待连接超时", "ip", info.IP)
+	return nil, nil
+}
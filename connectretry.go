@@ -0,0 +1,90 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// 主动连接的重试策略：指数退避（1s、2s、4s...，单次不超过 connectMaxDelay），
+// 重试用尽后该地址进入冷却期，期间发现协议再次触发的连接直接跳过，避免密集重连
+const (
+	defaultConnectMaxRetries = 5
+	connectDialTimeout       = 5 * time.Second
+	connectBaseDelay         = 1 * time.Second
+	connectMaxDelay          = 30 * time.Second
+	connectCooldown          = 60 * time.Second
+)
+
+// connectAttempts 正在进行的连接与冷却中的地址；同一地址同时只有一个连接协程在重试
+type connectAttempts struct {
+	mu       sync.Mutex
+	inFlight map[string]bool      // address -> 正在连接
+	cooldown map[string]time.Time // address -> 冷却截止时间
+}
+
+// connectMaxRetries 返回配置的最大连接尝试次数
+func (node *P2PNode) connectMaxRetries() int {
+	if node.Config == nil {
+		return defaultConnectMaxRetries
+	}
+	return node.Config.GetConnectMaxRetries()
+}
+
+// connectRetryDelay 第 attempt 次（从0开始）失败后的等待时间
+func connectRetryDelay(attempt int) time.Duration {
+	delay := connectBaseDelay
+	for i := 0; i < attempt && delay < connectMaxDelay; i++ {
+		delay *= 2
+	}
+	if delay > connectMaxDelay {
+		delay = connectMaxDelay
+	}
+	return delay
+}
+
+// begin 登记对 address 的连接；已有协程在连接或处于冷却期时返回 false
+func (c *connectAttempts) begin(address string, now time.Time) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.inFlight[address] {
+		return false
+	}
+	if until, ok := c.cooldown[address]; ok {
+		if now.Before(until) {
+			return false
+		}
+		delete(c.cooldown, address)
+	}
+	if c.inFlight == nil {
+		c.inFlight = make(map[string]bool)
+	}
+	c.inFlight[address] = true
+	return true
+}
+
+// end 结束对 address 的连接；失败时进入冷却期
+func (c *connectAttempts) end(address string, failed bool, now time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.inFlight, address)
+	if !failed {
+		return
+	}
+	if c.cooldown == nil {
+		c.cooldown = make(map[string]time.Time)
+	}
+	c.cooldown[address] = now.Add(connectCooldown)
+	// 顺带清理已过期的记录
+	for addr, until := range c.cooldown {
+		if now.After(until) {
+			delete(c.cooldown, addr)
+		}
+	}
+}
+
+// clearCooldown 用户手动连接时解除该地址的冷却
+func (c *connectAttempts) clearCooldown(address string) {
+	c.mu.Lock()
+	delete(c.cooldown, address)
+	c.mu.Unlock()
+}
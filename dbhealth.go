@@ -0,0 +1,127 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	"modernc.org/sqlite"
+	sqlite3 "modernc.org/sqlite/lib"
+)
+
+// errDBIntegrity integrity_check 发现问题
+var errDBIntegrity = fmt.Errorf("完整性检查失败")
+
+// openMessageDB 打开消息数据库并检查完整性。
+// 文件损坏时将其备份为 <path>.corrupt.<时间戳> 并重建空库，返回备份路径以便提示用户。
+// 其他错误（文件被占用、权限不足、磁盘已满等）不会动原文件，直接返回错误，由调用方降级为无数据库运行。
+func openMessageDB(path string) (db *sql.DB, corruptBackup string, err error) {
+	db, err = sql.Open("sqlite", path)
+	if err != nil {
+		return nil, "", err
+	}
+	if err = checkDBIntegrity(db); err == nil {
+		return db, "", nil
+	}
+	db.Close()
+	if !isDBCorrupt(err) {
+		return nil, "", err
+	}
+
+	corruptBackup = fmt.Sprintf("%s.corrupt.%s", path, time.Now().Format("20060102-150405"))
+	fmt.Printf("警告: 聊天记录数据库已损坏 (%v)，已备份为 %s 并重建\n", err, corruptBackup)
+	Log.Error("消息数据库损坏，备份后重建", "path", path, "backup", corruptBackup, "error", err)
+
+	if renameErr := os.Rename(path, corruptBackup); renameErr != nil && !os.IsNotExist(renameErr) {
+		return nil, "", fmt.Errorf("备份损坏的数据库失败: %v", renameErr)
+	}
+	// WAL 中可能还有未合并的数据，随主文件一起备份；共享内存文件可直接删除
+	os.Rename(path+"-wal", corruptBackup+"-wal")
+	os.Remove(path + "-shm")
+
+	db, err = sql.Open("sqlite", path)
+	if err != nil {
+		return nil, corruptBackup, err
+	}
+	return db, corruptBackup, nil
+}
+
+// isDBCorrupt 错误是否表示数据库文件本身已损坏：SQLITE_CORRUPT、SQLITE_NOTADB 或完整性检查未通过
+func isDBCorrupt(err error) bool {
+	if errors.Is(err, errDBIntegrity) {
+		return true
+	}
+	var sqliteErr *sqlite.Error
+	if errors.As(err, &sqliteErr) {
+		// 扩展错误码的低 8 位是主错误码
+		switch sqliteErr.Code() & 0xff {
+		case sqlite3.SQLITE_CORRUPT, sqlite3.SQLITE_NOTADB:
+			return true
+		}
+	}
+	return false
+}
+
+// checkDBIntegrity 执行 PRAGMA integrity_check，结果不是 "ok" 时返回 errDBIntegrity
+func checkDBIntegrity(db *sql.DB) error {
+	rows, err := db.Query("PRAGMA integrity_check")
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	var problems []string
+	for rows.Next() {
+		var line string
+		if err := rows.Scan(&line); err != nil {
+			return err
+		}
+		if line != "ok" {
+			problems = append(problems, line)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	if len(problems) > 0 {
+		return fmt.Errorf("%w: %s", errDBIntegrity, problems[0])
+	}
+	return nil
+}
+
+// backupMessageDB 使用 SQLite 在线备份 API 将消息数据库导出到 dst，备份期间数据库可正常读写
+func (node *P2PNode) backupMessageDB(dst string) error {
+	if node.DB == nil {
+		return fmt.Errorf("数据库不可用")
+	}
+	node.flushMessageWrites()
+
+	conn, err := node.DB.Conn(context.Background())
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	return conn.Raw(func(driverConn any) error {
+		backuper, ok := driverConn.(interface {
+			NewBackup(string) (*sqlite.Backup, error)
+		})
+		if !ok {
+			return fmt.Errorf("数据库驱动不支持在线备份")
+		}
+		bck, err := backuper.NewBackup(dst)
+		if err != nil {
+			return err
+		}
+		for more := true; more; {
+			if more, err = bck.Step(-1); err != nil {
+				bck.Finish()
+				return err
+			}
+		}
+		return bck.Finish()
+	})
+}
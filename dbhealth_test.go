@@ -0,0 +1,47 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// 只有文件损坏才备份重建；打不开等其他错误原样返回，不能把完好的数据库挪走
+func TestOpenMessageDBQuarantine(t *testing.T) {
+	dir := t.TempDir()
+
+	// 不是 SQLite 文件：SQLITE_NOTADB，备份后重建
+	garbage := filepath.Join(dir, "garbage.db")
+	if err := os.WriteFile(garbage, []byte(strings.Repeat("不是数据库", 200)), 0600); err != nil {
+		t.Fatal(err)
+	}
+	db, backup, err := openMessageDB(garbage)
+	if err != nil {
+		t.Fatalf("损坏的数据库应重建，得到错误: %v", err)
+	}
+	db.Close()
+	if backup == "" {
+		t.Fatalf("损坏的数据库未返回备份路径")
+	}
+	if _, err := os.Stat(backup); err != nil {
+		t.Fatalf("备份文件不存在: %v", err)
+	}
+
+	// 路径是目录：SQLITE_CANTOPEN，不属于损坏
+	busy := filepath.Join(dir, "busy.db")
+	if err := os.Mkdir(busy, 0700); err != nil {
+		t.Fatal(err)
+	}
+	db, backup, err = openMessageDB(busy)
+	if err == nil {
+		db.Close()
+		t.Fatalf("无法打开的数据库应返回错误")
+	}
+	if backup != "" || isDBCorrupt(err) {
+		t.Fatalf("打开失败被当作损坏处理: backup=%q err=%v", backup, err)
+	}
+	if info, err := os.Stat(busy); err != nil || !info.IsDir() {
+		t.Fatalf("原路径被移动: %v", err)
+	}
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"database/sql"
+	"sync"
+	"time"
+)
+
+// 消息入库批处理参数：每隔 messageWriteInterval 或积累 messageWriteBatch 条时合并为一个事务写入
+const (
+	messageWriteInterval = 200 * time.Millisecond
+	messageWriteBatch    = 100
+)
+
+const insertMessageSQL = `
+	INSERT INTO messages (
+		sender, recipient, content, nonce, is_private, is_own,
+		message_type, message_id, reply_to_id, reply_to_content,
+		reply_to_sender, file_name, file_size, file_type, file_url, file_data, file_id, peer_uuid,
+		forwarded_from, latitude, longitude, location_name, content_format, display_name
+	) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`
+
+// messageWriter 异步批量写入聊天消息，避免高频消息时大量小事务拖慢WAL。
+// 读取消息表前需先调用 Flush，保证刚加入队列的消息可见。
+type messageWriter struct {
+	db *sql.DB
+
+	mu     sync.Mutex
+	queue  [][]interface{} // 每项为 insertMessageSQL 的参数
+	closed bool
+
+	flushMu sync.Mutex // 串行化写入，保证消息按入队顺序落库
+	wake    chan struct{}
+	stopCh  chan struct{}
+	done    chan struct{}
+}
+
+// newMessageWriter 创建写入器并启动后台写入协程
+func newMessageWriter(db *sql.DB) *messageWriter {
+	w := &messageWriter{
+		db:     db,
+		wake:   make(chan struct{}, 1),
+		stopCh: make(chan struct{}),
+		done:   make(chan struct{}),
+	}
+	go w.run()
+	return w
+}
+
+func (w *messageWriter) run() {
+	defer close(w.done)
+	ticker := time.NewTicker(messageWriteInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			w.Flush()
+		case <-w.wake:
+			w.Flush()
+		case <-w.stopCh:
+			return
+		}
+	}
+}
+
+// Enqueue 将一条消息加入写入队列；写入器关闭后（程序退出中）的消息直接丢弃
+func (w *messageWriter) Enqueue(args ...interface{}) {
+	w.mu.Lock()
+	if w.closed {
+		w.mu.Unlock()
+		Log.Warn("消息写入器已关闭，消息未保存")
+		return
+	}
+	w.queue = append(w.queue, args)
+	full := len(w.queue) >= messageWriteBatch
+	w.mu.Unlock()
+
+	if full {
+		select {
+		case w.wake <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// Flush 同步写入队列中的全部消息
+func (w *messageWriter) Flush() {
+	w.flushMu.Lock()
+	defer w.flushMu.Unlock()
+
+	w.mu.Lock()
+	batch := w.queue
+	w.queue = nil
+	w.mu.Unlock()
+	if len(batch) == 0 {
+		return
+	}
+
+	if err := w.writeBatch(batch); err != nil {
+		// 一条失败会回滚整个事务：逐条重试，只丢弃本身无法写入的消息
+		Log.Warn("批量保存消息失败，逐条重试", "count", len(batch), "error", err)
+		failed := 0
+		for _, args := range batch {
+			if _, err := w.db.Exec(insertMessageSQL, args...); err != nil {
+				failed++
+				Log.Error("保存消息失败", "error", err)
+			}
+		}
+		if failed > 0 {
+			Log.Error("部分消息未能保存", "failed", failed, "count", len(batch))
+		}
+	}
+}
+
+func (w *messageWriter) writeBatch(batch [][]interface{}) error {
+	tx, err := w.db.Begin()
+	if err != nil {
+		return err
+	}
+	stmt, err := tx.Prepare(insertMessageSQL)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	defer stmt.Close()
+	for _, args := range batch {
+		if _, err := stmt.Exec(args...); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// Close 停止后台协程。persist 为 true 时写入剩余队列，否则丢弃
+// （保存聊天记录关闭时，退出前会清空消息表，不应再写入）。可重复调用。
+func (w *messageWriter) Close(persist bool) {
+	w.mu.Lock()
+	if w.closed {
+		w.mu.Unlock()
+		return
+	}
+	w.closed = true
+	if !persist {
+		if len(w.queue) > 0 {
+			Log.Info("丢弃未写入的消息（保存聊天记录已关闭）", "count", len(w.queue))
+		}
+		w.queue = nil
+	}
+	w.mu.Unlock()
+
+	close(w.stopCh)
+	<-w.done
+	w.Flush()
+}
+
+// flushMessageWrites 在读取或修改消息表前调用，使队列中的消息可见
+func (node *P2PNode) flushMessageWrites() {
+	if node.MessageWriter != nil {
+		node.MessageWriter.Flush()
+	}
+}
+
+// closeMessageWriter 退出前关闭写入器，按保存聊天记录设置决定是否写入剩余队列
+func (node *P2PNode) closeMessageWriter() {
+	if node.MessageWriter != nil {
+		node.MessageWriter.Close(node.Config == nil || node.Config.IsSaveHistory())
+	}
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// newTestMessageDB 创建只含消息表的临时数据库；message_id 唯一，便于构造写入失败的行
+func newTestMessageDB(t *testing.T) *sql.DB {
+	t.Helper()
+	db, err := sql.Open("sqlite", filepath.Join(t.TempDir(), "messages.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	_, err = db.Exec(`CREATE TABLE messages (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		sender TEXT, recipient TEXT, content BLOB, nonce BLOB, is_private BOOLEAN, is_own BOOLEAN,
+		message_type TEXT, message_id TEXT UNIQUE, reply_to_id TEXT, reply_to_content TEXT,
+		reply_to_sender TEXT, file_name TEXT, file_size INTEGER, file_type TEXT, file_url TEXT,
+		file_data TEXT, file_id TEXT, peer_uuid TEXT, forwarded_from TEXT, latitude REAL,
+		longitude REAL, location_name TEXT, content_format TEXT, display_name TEXT
+	)`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
+
+// testMessageArgs 返回一条消息的 insertMessageSQL 参数
+func testMessageArgs(id string) []interface{} {
+	return []interface{}{
+		"发送者", "all", []byte("内容"), []byte{}, false, true,
+		MessageTypeText, id, "", "",
+		"", "", 0, "", "", "", "", "",
+		"", 0.0, 0.0, "", "", "",
+	}
+}
+
+func countMessages(t *testing.T, db *sql.DB) int {
+	t.Helper()
+	var n int
+	if err := db.QueryRow("SELECT COUNT(*) FROM messages").Scan(&n); err != nil {
+		t.Fatal(err)
+	}
+	return n
+}
+
+// 丢失边界：Close(true) 写入队列中的全部消息，Close(false) 一条都不写入，关闭后入队的消息被丢弃
+func TestMessageWriterClose(t *testing.T) {
+	const count = messageWriteBatch*2 + 7
+
+	for _, persist := range []bool{true, false} {
+		t.Run(fmt.Sprintf("persist=%v", persist), func(t *testing.T) {
+			db := newTestMessageDB(t)
+			w := newMessageWriter(db)
+			// 关闭前阻止后台写入，保证关闭时消息都还在队列中
+			w.flushMu.Lock()
+			for i := 0; i < count; i++ {
+				w.Enqueue(testMessageArgs(fmt.Sprintf("m%d", i))...)
+			}
+			closed := make(chan struct{})
+			go func() {
+				w.Close(persist)
+				close(closed)
+			}()
+			for {
+				w.mu.Lock()
+				isClosed := w.closed
+				w.mu.Unlock()
+				if isClosed {
+					break
+				}
+				time.Sleep(time.Millisecond)
+			}
+			w.flushMu.Unlock()
+			<-closed
+
+			want := 0
+			if persist {
+				want = count
+			}
+			if got := countMessages(t, db); got != want {
+				t.Fatalf("关闭后消息表有 %d 条，期望 %d 条", got, want)
+			}
+
+			w.Enqueue(testMessageArgs("after-close")...)
+			w.Flush()
+			if got := countMessages(t, db); got != want {
+				t.Fatalf("关闭后入队的消息被写入: 消息表有 %d 条，期望 %d 条", got, want)
+			}
+			w.Close(true) // 可重复调用
+		})
+	}
+}
+
+// 批次中有一条写入失败时，其余消息仍应保存
+func TestMessageWriterPartialFailure(t *testing.T) {
+	db := newTestMessageDB(t)
+	w := newMessageWriter(db)
+	w.Enqueue(testMessageArgs("dup")...)
+	w.Flush()
+
+	w.flushMu.Lock()
+	for i := 0; i < 10; i++ {
+		w.Enqueue(testMessageArgs(fmt.Sprintf("m%d", i))...)
+		if i == 5 {
+			w.Enqueue(testMessageArgs("dup")...) // 违反唯一约束
+		}
+	}
+	w.flushMu.Unlock()
+	w.Close(true)
+
+	if got := countMessages(t, db); got != 11 {
+		t.Fatalf("消息表有 %d 条，期望 11 条（仅丢弃重复的一条）", got)
+	}
+}
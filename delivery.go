@@ -0,0 +1,104 @@
+package main
+
+import "time"
+
+// 私聊消息的发送状态（ChatMessage.DeliveryStatus），只前进不后退：
+// sending → sent → delivered；重试超时仍未发出时为 failed
+const (
+	DeliverySending   = "sending"   // 等待写入连接（含对方离线暂存、断线后等待重发）
+	DeliverySent      = "sent"      // 已写入对方连接
+	DeliveryDelivered = "delivered" // 对方已收到（送达回执）
+	DeliveryFailed    = "failed"    // 重试超时，见 markMessageFailed
+)
+
+// maxPendingDeliveries 尚未入列表的状态暂存上限，超过时清空（仅防止无界增长）
+const maxPendingDeliveries = 500
+
+var deliveryRank = map[string]int{
+	DeliverySending:   1,
+	DeliverySent:      2,
+	DeliveryFailed:    2,
+	DeliveryDelivered: 3,
+}
+
+// setDeliveryStatus 更新自己发出的私聊消息的发送状态并通知前端。
+// 同步发送时状态先于消息入列表产生，此时暂存，由 recordChatMessage 取用
+func (node *P2PNode) setDeliveryStatus(messageID, status string) {
+	if messageID == "" {
+		return
+	}
+
+	changed, found := false, false
+	node.MessagesMutex.Lock()
+	for i := len(node.Messages) - 1; i >= 0; i-- {
+		m := &node.Messages[i]
+		if m.MessageID != messageID || !m.IsOwn || !m.IsPrivate {
+			continue
+		}
+		found = true
+		if deliveryRank[status] > deliveryRank[m.DeliveryStatus] {
+			m.DeliveryStatus = status
+			node.MessagesRevision++
+			changed = true
+		}
+		break
+	}
+	if !found {
+		if node.pendingDeliveries == nil || len(node.pendingDeliveries) >= maxPendingDeliveries {
+			node.pendingDeliveries = make(map[string]string)
+		}
+		if deliveryRank[status] > deliveryRank[node.pendingDeliveries[messageID]] {
+			node.pendingDeliveries[messageID] = status
+		}
+	}
+	node.MessagesMutex.Unlock()
+
+	if changed {
+		node.emitMessageStatus(messageID, status)
+	}
+}
+
+// takePendingDeliveryLocked 取出消息入列表前已产生的发送状态，没有时为 sending。
+// 调用方需持有 MessagesMutex
+func (node *P2PNode) takePendingDeliveryLocked(messageID string) string {
+	status, ok := node.pendingDeliveries[messageID]
+	if !ok {
+		return DeliverySending
+	}
+	delete(node.pendingDeliveries, messageID)
+	return status
+}
+
+// sendDeliveryReceipt 收到私聊消息后向发送方回送达回执
+func (node *P2PNode) sendDeliveryReceipt(peer *Peer, messageID string) {
+	if messageID == "" {
+		return
+	}
+	node.sendMessageToPeer(peer, Message{
+		Type:      "delivered",
+		From:      node.ID,
+		To:        peer.ID,
+		Content:   messageID,
+		Timestamp: time.Now(),
+	})
+}
+
+// handleDeliveryReceipt 处理对方的送达回执，只接受发给该用户的消息
+func (node *P2PNode) handleDeliveryReceipt(peer *Peer, messageID string) {
+	node.MessagesMutex.RLock()
+	valid := false
+	for i := len(node.Messages) - 1; i >= 0; i-- {
+		m := node.Messages[i]
+		if m.MessageID == messageID {
+			valid = m.IsOwn && m.IsPrivate && m.Recipient == peer.Name
+			break
+		}
+	}
+	node.MessagesMutex.RUnlock()
+
+	if !valid {
+		Log.Debug("忽略无效的送达回执", "peer", peer.Name, "messageId", messageID)
+		return
+	}
+	node.setDeliveryStatus(messageID, DeliveryDelivered)
+}
@@ -1,12 +1,81 @@
 package main
 
 import (
+	"crypto/sha256"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net"
 	"time"
 )
 
+// 发现消息加密：设置了预共享网络密钥（AppConfig.NetworkKey）时，发现消息只保留 Type 和 ID 明文
+// （ID 用于忽略自己的广播），用户名、IP、版本、公钥、peer_exchange 列表等整体用网络密钥加密后放在
+// Sealed 中，同网段没有密钥的嗅探者看不到在线用户。没有密钥的节点仍发送和接受明文消息；
+// 设了密钥的节点也接受明文消息（对方没有密钥，信息本就公开），但无法解密的密文消息直接丢弃。
+// mDNS 的 TXT 记录不经过这里，需要完全隐藏时可在配置中关闭 mDNS
+const discoveryKeyContext = "LANShare discovery v1\x00"
+
+// discoveryKey 由网络密钥派生发现消息的加密密钥，未设置时 ok 为 false
+func (node *P2PNode) discoveryKey() (key [32]byte, ok bool) {
+	if node.Config == nil {
+		return key, false
+	}
+	node.ConfigMutex.RLock()
+	networkKey := node.Config.NetworkKey
+	node.ConfigMutex.RUnlock()
+	if networkKey == "" {
+		return key, false
+	}
+	return sha256.Sum256([]byte(discoveryKeyContext + networkKey)), true
+}
+
+// marshalDiscovery 序列化发现消息，有网络密钥时加密除 Type、ID 外的内容
+func (node *P2PNode) marshalDiscovery(msg DiscoveryMessage) ([]byte, error) {
+	data, err := json.Marshal(msg)
+	if err != nil {
+		return nil, err
+	}
+	key, ok := node.discoveryKey()
+	if !ok {
+		return data, nil
+	}
+	sealed, nonce, err := encryptMessage(key, data)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(DiscoveryMessage{Type: msg.Type, ID: msg.ID, Sealed: sealed, SealNonce: nonce})
+}
+
+// unmarshalDiscovery 解析收到的发现消息，密文消息用网络密钥解密；
+// 本机没有密钥、密钥不一致或内外 ID 不符时返回错误
+func (node *P2PNode) unmarshalDiscovery(data []byte) (DiscoveryMessage, error) {
+	var msg DiscoveryMessage
+	if err := json.Unmarshal(data, &msg); err != nil {
+		return msg, err
+	}
+	if len(msg.Sealed) == 0 {
+		return msg, nil
+	}
+	key, ok := node.discoveryKey()
+	if !ok {
+		return msg, fmt.Errorf("未设置网络密钥，无法解密发现消息")
+	}
+	plaintext, err := decryptMessage(key, msg.Sealed, msg.SealNonce)
+	if err != nil {
+		return msg, fmt.Errorf("网络密钥不一致: %w", err)
+	}
+	var inner DiscoveryMessage
+	if err := json.Unmarshal(plaintext, &inner); err != nil {
+		return msg, err
+	}
+	if inner.ID != msg.ID || inner.Type != msg.Type {
+		return msg, fmt.Errorf("发现消息内外不一致")
+	}
+	inner.sealed = true
+	return inner, nil
+}
+
 // 根据本地IP计算子网定向广播地址
 func getSubnetBroadcastAddr(localIP string) (string, error) {
 	targetIP := net.ParseIP(localIP)
@@ -61,13 +130,19 @@ func (node *P2PNode) startDiscovery() {
 	Log.Info("使用广播地址", "addr", node.BroadcastAddr)
 
 	go node.listenBroadcast()
-	time.Sleep(500 * time.Millisecond)
 	// Send multiple rapid announces at startup for fast peer discovery
 	// (UDP is unreliable, single packet may be lost)
+	delay := 500 * time.Millisecond
 	for i := 0; i < 3; i++ {
+		select {
+		case <-node.StopCh:
+			return
+		case <-time.After(delay):
+		}
 		node.sendDiscoveryBroadcast("announce")
-		time.Sleep(1 * time.Second)
+		delay = time.Second
 	}
+	node.announceToSeeds()
 }
 
 // 监听UDP广播
@@ -91,16 +166,32 @@ func (node *P2PNode) listenBroadcast() {
 		return
 	}
 	defer conn.Close()
+	// 节点停止时关闭套接字，解除 ReadFromUDP 的阻塞并释放发现端口
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-node.StopCh:
+			conn.Close()
+		case <-done:
+		}
+	}()
 
-	buffer := make([]byte, 1024)
-	for node.Running {
+	buffer := make([]byte, 64*1024) // peer_exchange 可能携带多个节点
+	for node.Running.Load() {
 		n, remoteAddr, err := conn.ReadFromUDP(buffer)
 		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
 			continue
 		}
 
-		var discoveryMsg DiscoveryMessage
-		if err := json.Unmarshal(buffer[:n], &discoveryMsg); err != nil {
+		discoveryMsg, err := node.unmarshalDiscovery(buffer[:n])
+		if err != nil {
+			if discoveryMsg.ID != node.ID {
+				Log.Debug("忽略无法解析的发现消息", "from", remoteAddr.String(), "error", err)
+			}
 			continue
 		}
 
@@ -114,6 +205,20 @@ func (node *P2PNode) listenBroadcast() {
 
 // 处理服务发现消息
 func (node *P2PNode) handleDiscoveryMessage(msg DiscoveryMessage, remoteAddr *net.UDPAddr) {
+	// 被屏蔽节点的 announce/response 不触发连接，也不回应
+	if node.isDiscoveryBlocked(msg) {
+		return
+	}
+
+	switch {
+	case msg.Type == "peer_exchange":
+		node.handlePeerExchange(msg, remoteAddr)
+		return
+	case msg.Type == "announce" && msg.Relay:
+		// 来自其他子网的单播请求：本机作为种子节点交换peer列表
+		node.relayPeerInfo(msg, remoteAddr)
+	}
+
 	// 检查是否是已知且活跃的节点
 	node.PeersMutex.RLock()
 	existingPeer, exists := node.Peers[msg.ID]
@@ -128,15 +233,13 @@ func (node *P2PNode) handleDiscoveryMessage(msg DiscoveryMessage, remoteAddr *ne
 		if exists {
 			fmt.Printf("[发现] 重新发现已断开的节点: %s (%s:%d)\n", msg.Name, msg.IP, msg.Port)
 			Log.Info("重新发现已断开的节点", "name", msg.Name, "ip", msg.IP, "port", msg.Port)
-			node.PeersMutex.Lock()
-			delete(node.Peers, msg.ID)
-			node.PeersMutex.Unlock()
+			node.removeInactivePeer(msg.ID, existingPeer)
 		} else {
 			fmt.Printf("[发现] 发现新节点: %s (%s:%d)\n", msg.Name, msg.IP, msg.Port)
 			Log.Info("发现新节点", "name", msg.Name, "ip", msg.IP, "port", msg.Port)
 		}
-		// 确定性连接：只有ID较小的节点主动发起TCP连接，避免双向同时连接导致的重连循环
-		if node.ID < msg.ID {
+		// 确定性连接：只有一方主动发起TCP连接，避免双向同时连接导致的重连循环
+		if node.shouldInitiateConnection(msg.ID, msg.UUID) {
 			go node.connectToPeer(msg.IP, msg.Port, msg.ID, msg.Name, msg.WebPort)
 		}
 		// 始终发送响应，让对方知道我们的存在
@@ -146,14 +249,12 @@ func (node *P2PNode) handleDiscoveryMessage(msg DiscoveryMessage, remoteAddr *ne
 		if exists {
 			fmt.Printf("[发现] 收到已断开节点 %s 的响应，重新连接...\n", msg.Name)
 			Log.Info("收到已断开节点的响应", "name", msg.Name)
-			node.PeersMutex.Lock()
-			delete(node.Peers, msg.ID)
-			node.PeersMutex.Unlock()
+			node.removeInactivePeer(msg.ID, existingPeer)
 		} else {
 			Log.Info("收到发现响应", "name", msg.Name, "ip", msg.IP)
 		}
-		// 确定性连接：只有ID较小的节点主动发起TCP连接
-		if node.ID < msg.ID {
+		// 确定性连接：只有一方主动发起TCP连接
+		if node.shouldInitiateConnection(msg.ID, msg.UUID) {
 			fmt.Printf("[发现] 收到来自 %s 的响应，发起连接...\n", msg.Name)
 			go node.connectToPeer(msg.IP, msg.Port, msg.ID, msg.Name, msg.WebPort)
 		} else {
@@ -162,9 +263,9 @@ func (node *P2PNode) handleDiscoveryMessage(msg DiscoveryMessage, remoteAddr *ne
 	}
 }
 
-// 发送服务发现广播
-func (node *P2PNode) sendDiscoveryBroadcast(msgType string) {
-	msg := DiscoveryMessage{
+// 构造本节点的发现消息
+func (node *P2PNode) newDiscoveryMessage(msgType string) DiscoveryMessage {
+	return DiscoveryMessage{
 		Type:    msgType,
 		ID:      node.ID,
 		Name:    node.Name,
@@ -173,9 +274,17 @@ func (node *P2PNode) sendDiscoveryBroadcast(msgType string) {
 		WebPort: node.WebPort,
 		Version: AppVersion,
 		PubKey:  node.NodePublicKey[:],
+		UUID:    node.UUID,
+
+		Capabilities: localCapabilities,
 	}
+}
 
-	data, err := json.Marshal(msg)
+// 发送服务发现广播
+func (node *P2PNode) sendDiscoveryBroadcast(msgType string) {
+	msg := node.newDiscoveryMessage(msgType)
+
+	data, err := node.marshalDiscovery(msg)
 	if err != nil {
 		Log.Error("序列化发现消息失败", "error", err)
 		return
@@ -217,24 +326,19 @@ func (node *P2PNode) sendDiscoveryBroadcast(msgType string) {
 
 // 发送服务发现响应
 func (node *P2PNode) sendDiscoveryResponse(targetIP string) {
-	msg := DiscoveryMessage{
-		Type:    "response",
-		ID:      node.ID,
-		Name:    node.Name,
-		IP:      node.LocalIP,
-		Port:    node.LocalPort,
-		WebPort: node.WebPort,
-		Version: AppVersion,
-		PubKey:  node.NodePublicKey[:],
-	}
+	node.sendDiscoveryUnicast(fmt.Sprintf("%s:%d", targetIP, node.DiscoveryPort), node.newDiscoveryMessage("response"))
+}
 
-	data, err := json.Marshal(msg)
+// 单播发送发现消息（用于响应、种子节点和 peer_exchange）
+func (node *P2PNode) sendDiscoveryUnicast(targetAddr string, msg DiscoveryMessage) {
+	data, err := node.marshalDiscovery(msg)
 	if err != nil {
 		return
 	}
 
-	addr, err := net.ResolveUDPAddr("udp", fmt.Sprintf("%s:%d", targetIP, node.DiscoveryPort))
+	addr, err := net.ResolveUDPAddr("udp", targetAddr)
 	if err != nil {
+		Log.Debug("解析单播地址失败", "addr", targetAddr, "error", err)
 		return
 	}
 
@@ -263,9 +367,191 @@ func (node *P2PNode) periodicBroadcast() {
 		case <-node.StopCh:
 			return
 		case <-ticker.C:
-			if node.Running {
+			if node.Running.Load() {
 				node.sendDiscoveryBroadcast("announce")
+				node.announceToSeeds()
 			}
 		}
 	}
 }
+
+// 跨子网发现参数
+const (
+	maxPeerExchangeEntries    = 32               // 单条 peer_exchange 最多携带的节点数，防止列表无限放大
+	peerExchangeInterval      = 60 * time.Second // 同一请求者IP的交换最小间隔
+	maxPeerExchangeRequesters = 1024             // 限速表最多记录的请求者IP数，满时拒绝新请求者
+)
+
+// announceToSeeds 向配置的种子节点发送单播announce（跨VLAN时广播无法到达）
+func (node *P2PNode) announceToSeeds() {
+	if node.Config == nil || len(node.Config.SeedNodes) == 0 {
+		return
+	}
+	msg := node.newDiscoveryMessage("announce")
+	msg.Relay = true
+	for _, seed := range node.Config.SeedNodes {
+		addr := seed
+		if _, _, err := net.SplitHostPort(seed); err != nil {
+			addr = fmt.Sprintf("%s:%d", seed, node.DiscoveryPort)
+		}
+		node.sendDiscoveryUnicast(addr, msg)
+		Log.Debug("向种子节点发送announce", "seed", addr)
+	}
+}
+
+// allowPeerExchange 按请求者IP限速：消息ID由发送方决定，而源IP是回复的去向，
+// 按IP限制才能防止伪造源地址利用种子节点放大流量
+func (node *P2PNode) allowPeerExchange(ip net.IP, now time.Time) bool {
+	key := ip.String()
+	node.peerExchangeMutex.Lock()
+	defer node.peerExchangeMutex.Unlock()
+
+	if node.lastPeerExchange == nil {
+		node.lastPeerExchange = make(map[string]time.Time)
+	}
+	if last, ok := node.lastPeerExchange[key]; ok && now.Sub(last) < peerExchangeInterval {
+		return false
+	}
+	if _, ok := node.lastPeerExchange[key]; !ok && len(node.lastPeerExchange) >= maxPeerExchangeRequesters {
+		node.expirePeerExchangesLocked(now)
+		if len(node.lastPeerExchange) >= maxPeerExchangeRequesters {
+			return false
+		}
+	}
+	node.lastPeerExchange[key] = now
+	return true
+}
+
+// expirePeerExchanges 清理已过限速间隔的请求者记录（定期内存清理时调用）
+func (node *P2PNode) expirePeerExchanges(now time.Time) {
+	node.peerExchangeMutex.Lock()
+	node.expirePeerExchangesLocked(now)
+	node.peerExchangeMutex.Unlock()
+}
+
+func (node *P2PNode) expirePeerExchangesLocked(now time.Time) {
+	for ip, last := range node.lastPeerExchange {
+		if now.Sub(last) >= peerExchangeInterval {
+			delete(node.lastPeerExchange, ip)
+		}
+	}
+}
+
+// relayPeerInfo 种子节点收到单播请求后：把已知peer回传给请求者，并把请求者告知已知peer。
+// peer_exchange 只转发一跳（接收方不再转发），避免环路。
+func (node *P2PNode) relayPeerInfo(msg DiscoveryMessage, remoteAddr *net.UDPAddr) {
+	if !node.allowPeerExchange(remoteAddr.IP, time.Now()) {
+		return
+	}
+
+	requester := PeerInfo{ID: msg.ID, Name: msg.Name, IP: msg.IP, Port: msg.Port, WebPort: msg.WebPort, UUID: msg.UUID}
+
+	var known []PeerInfo
+	node.PeersMutex.RLock()
+	for _, peer := range node.Peers {
+		if !peer.IsActive || peer.ID == msg.ID || peer.Port <= 0 {
+			continue
+		}
+		known = append(known, PeerInfo{ID: peer.ID, Name: peer.Name, IP: peer.IP, Port: peer.Port, WebPort: peer.WebPort, UUID: peer.UUID})
+		if len(known) >= maxPeerExchangeEntries {
+			break
+		}
+	}
+	node.PeersMutex.RUnlock()
+
+	if len(known) == 0 {
+		return
+	}
+
+	reply := node.newDiscoveryMessage("peer_exchange")
+	reply.Peers = known
+	node.sendDiscoveryUnicast(fmt.Sprintf("%s:%d", remoteAddr.IP.String(), node.DiscoveryPort), reply)
+
+	notify := node.newDiscoveryMessage("peer_exchange")
+	notify.Peers = []PeerInfo{requester}
+	for _, p := range known {
+		node.sendDiscoveryUnicast(fmt.Sprintf("%s:%d", p.IP, node.DiscoveryPort), notify)
+	}
+	Log.Info("种子节点交换peer列表", "requester", msg.Name, "known", len(known))
+}
+
+// trustedPeerExchangeSource peer_exchange 未经认证，只接受：用网络密钥加密的消息、
+// 来自配置的种子节点的消息、来自已连接peer的消息（种子节点通知新请求者时）
+func (node *P2PNode) trustedPeerExchangeSource(msg DiscoveryMessage, remoteAddr *net.UDPAddr) bool {
+	if msg.sealed {
+		return true
+	}
+	node.PeersMutex.RLock()
+	for _, peer := range node.Peers {
+		if peer.IsActive && net.ParseIP(peer.IP).Equal(remoteAddr.IP) {
+			node.PeersMutex.RUnlock()
+			return true
+		}
+	}
+	node.PeersMutex.RUnlock()
+
+	if node.Config == nil {
+		return false
+	}
+	node.ConfigMutex.RLock()
+	seeds := append([]string(nil), node.Config.SeedNodes...)
+	node.ConfigMutex.RUnlock()
+	for _, seed := range seeds {
+		host := seed
+		if h, _, err := net.SplitHostPort(seed); err == nil {
+			host = h
+		}
+		if ip := net.ParseIP(host); ip != nil {
+			if ip.Equal(remoteAddr.IP) {
+				return true
+			}
+			continue
+		}
+		ips, err := net.LookupIP(host)
+		if err != nil {
+			continue
+		}
+		for _, ip := range ips {
+			if ip.Equal(remoteAddr.IP) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// handlePeerExchange 处理种子节点发来的peer列表：按确定性规则连接，不再继续转发
+func (node *P2PNode) handlePeerExchange(msg DiscoveryMessage, remoteAddr *net.UDPAddr) {
+	if !node.trustedPeerExchangeSource(msg, remoteAddr) {
+		Log.Debug("忽略来源不可信的peer_exchange", "from", remoteAddr.String())
+		return
+	}
+	peers := msg.Peers
+	if len(peers) > maxPeerExchangeEntries {
+		peers = peers[:maxPeerExchangeEntries]
+	}
+
+	for _, p := range peers {
+		if p.ID == "" || p.ID == node.ID || (p.UUID != "" && p.UUID == node.UUID) {
+			continue
+		}
+		if node.isDiscoveryBlocked(DiscoveryMessage{ID: p.ID, Name: p.Name, IP: p.IP, Port: p.Port, UUID: p.UUID}) {
+			continue
+		}
+		node.PeersMutex.RLock()
+		existing, exists := node.Peers[p.ID]
+		isActive := exists && existing.IsActive
+		node.PeersMutex.RUnlock()
+		if isActive {
+			continue
+		}
+
+		Log.Info("通过peer_exchange发现节点", "name", p.Name, "ip", p.IP, "via", msg.Name)
+		if node.shouldInitiateConnection(p.ID, p.UUID) {
+			go node.connectToPeer(p.IP, p.Port, p.ID, p.Name, p.WebPort)
+		} else {
+			// 由对方发起连接：单播announce让对方知道本机存在
+			node.sendDiscoveryUnicast(fmt.Sprintf("%s:%d", p.IP, node.DiscoveryPort), node.newDiscoveryMessage("announce"))
+		}
+	}
+}
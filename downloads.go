@@ -0,0 +1,107 @@
+package main
+
+import (
+	"path/filepath"
+	"strings"
+	"unicode"
+)
+
+// 接收文件的整理方式（AppConfig.OrganizeDownloads）
+const (
+	organizeNone     = "none"      // 全部放在 downloads 根目录
+	organizeBySender = "by_sender" // downloads/<发送者>/
+	organizeByType   = "by_type"   // downloads/images|videos|documents|others/
+)
+
+// maxDirNameRunes 发送者子目录名的最大长度，maxFileNameRunes 接收文件名的最大长度
+const (
+	maxDirNameRunes  = 64
+	maxFileNameRunes = 200
+)
+
+// 按扩展名归类的子目录，未列出的扩展名归入 others
+var fileCategoryByExt = map[string]string{
+	".jpg": "images", ".jpeg": "images", ".png": "images", ".gif": "images", ".bmp": "images",
+	".webp": "images", ".svg": "images", ".ico": "images", ".heic": "images", ".tif": "images", ".tiff": "images",
+
+	".mp4": "videos", ".mkv": "videos", ".avi": "videos", ".mov": "videos", ".wmv": "videos",
+	".flv": "videos", ".webm": "videos", ".m4v": "videos", ".3gp": "videos",
+
+	".pdf": "documents", ".doc": "documents", ".docx": "documents", ".xls": "documents", ".xlsx": "documents",
+	".ppt": "documents", ".pptx": "documents", ".txt": "documents", ".md": "documents", ".csv": "documents",
+	".rtf": "documents", ".odt": "documents", ".ods": "documents", ".odp": "documents", ".wps": "documents",
+	".et": "documents", ".dps": "documents",
+}
+
+// fileCategory 返回文件按类型整理时的子目录名
+func fileCategory(fileName string) string {
+	if c, ok := fileCategoryByExt[strings.ToLower(filepath.Ext(fileName))]; ok {
+		return c
+	}
+	return "others"
+}
+
+// windowsReservedNames 不能用作 Windows 文件/目录名（不区分大小写，含扩展名时同样保留）
+var windowsReservedNames = map[string]bool{
+	"CON": true, "PRN": true, "AUX": true, "NUL": true,
+	"COM1": true, "COM2": true, "COM3": true, "COM4": true, "COM5": true, "COM6": true, "COM7": true, "COM8": true, "COM9": true,
+	"LPT1": true, "LPT2": true, "LPT3": true, "LPT4": true, "LPT5": true, "LPT6": true, "LPT7": true, "LPT8": true, "LPT9": true,
+}
+
+// sanitizeDirName 将用户名清洗为可用的目录名
+func sanitizeDirName(name string) string {
+	return sanitizePathElement(name, maxDirNameRunes, "unknown")
+}
+
+// sanitizeFileName 清洗对方发来的文件名：只保留最后一级（不允许带目录），其余同 sanitizeDirName，
+// 保证与下载目录拼接后不会跳出该目录
+func sanitizeFileName(name string) string {
+	if i := strings.LastIndexAny(name, `/\`); i != -1 {
+		name = name[i+1:]
+	}
+	return sanitizePathElement(name, maxFileNameRunes, "未命名文件")
+}
+
+// sanitizePathElement 将名称清洗为可用的单级文件/目录名：替换各平台的非法字符和控制字符，
+// 去掉首尾空格与末尾的点，避开 Windows 保留名与 "."/".."（为空时使用 fallback），并限制长度
+func sanitizePathElement(name string, maxRunes int, fallback string) string {
+	var b strings.Builder
+	for _, r := range name {
+		if unicode.IsControl(r) || strings.ContainsRune(`<>:"/\|?*`, r) {
+			b.WriteRune('_')
+			continue
+		}
+		b.WriteRune(r)
+	}
+	s := []rune(strings.TrimSpace(b.String()))
+	if len(s) > maxRunes {
+		s = s[:maxRunes]
+	}
+	clean := strings.TrimRight(strings.TrimSpace(string(s)), ". ")
+	if clean == "" {
+		return fallback
+	}
+	base := strings.ToUpper(clean)
+	if i := strings.Index(base, "."); i != -1 {
+		base = base[:i]
+	}
+	if windowsReservedNames[base] {
+		clean = "_" + clean
+	}
+	return clean
+}
+
+// downloadDirFor 按整理设置返回接收文件的保存目录
+func (node *P2PNode) downloadDirFor(senderName, fileName string) string {
+	mode := organizeNone
+	if node.Config != nil {
+		mode = node.Config.GetOrganizeDownloads()
+	}
+	switch mode {
+	case organizeBySender:
+		return DataPath("downloads", sanitizeDirName(senderName))
+	case organizeByType:
+		return DataPath("downloads", fileCategory(fileName))
+	}
+	return DataPath("downloads")
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"unicode/utf8"
+)
+
+// maxDraftRunes 单个会话草稿的最大字符数
+const maxDraftRunes = 5000
+
+// initDraftTable 创建草稿表：每个会话一条，内容与聊天记录一样用本地密钥加密
+func initDraftTable(db *sql.DB) error {
+	_, err := db.Exec(`
+		CREATE TABLE IF NOT EXISTS drafts (
+			chat_id TEXT PRIMARY KEY,
+			content BLOB NOT NULL,
+			nonce BLOB NOT NULL,
+			updated_at DATETIME DEFAULT CURRENT_TIMESTAMP
+		);
+	`)
+	return err
+}
+
+// loadDraft 返回会话的草稿，没有草稿时返回空字符串
+func (node *P2PNode) loadDraft(chatID string) (string, error) {
+	if node.DB == nil {
+		return "", fmt.Errorf("数据库不可用")
+	}
+	var content, nonce []byte
+	err := node.DB.QueryRow("SELECT content, nonce FROM drafts WHERE chat_id = ?", chatID).Scan(&content, &nonce)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	plaintext, err := decryptMessage(node.LocalDBKey, content, nonce)
+	if err != nil {
+		Log.Error("解密草稿失败", "chatId", chatID, "error", err)
+		return "", err
+	}
+	return string(plaintext), nil
+}
+
+// saveDraft 保存会话草稿，内容为空时删除草稿（如消息已发送）
+func (node *P2PNode) saveDraft(chatID, text string) error {
+	if node.DB == nil {
+		return fmt.Errorf("数据库不可用")
+	}
+	if chatID == "" {
+		return fmt.Errorf("会话不能为空")
+	}
+	if utf8.RuneCountInString(text) > maxDraftRunes {
+		return fmt.Errorf("草稿不能超过 %d 字", maxDraftRunes)
+	}
+	if text == "" {
+		_, err := node.DB.Exec("DELETE FROM drafts WHERE chat_id = ?", chatID)
+		return err
+	}
+
+	ciphertext, nonce, err := encryptMessage(node.LocalDBKey, []byte(text))
+	if err != nil {
+		return err
+	}
+	_, err = node.DB.Exec(`INSERT INTO drafts (chat_id, content, nonce) VALUES (?, ?, ?)
+		ON CONFLICT(chat_id) DO UPDATE SET content = excluded.content, nonce = excluded.nonce,
+		updated_at = CURRENT_TIMESTAMP`, chatID, ciphertext, nonce)
+	return err
+}
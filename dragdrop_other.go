@@ -2,6 +2,20 @@
 
 package main
 
+import (
+	"context"
+
+	wailsRuntime "github.com/wailsapp/wails/v2/pkg/runtime"
+)
+
 // setupNativeFileDrop is a no-op on non-Windows platforms.
 // WebView2-specific drag-drop interception is only needed on Windows.
 func setupNativeFileDrop(onDrop func([]string)) {}
+
+// registerFileDrop receives dropped file paths on the Go side via Wails'
+// OnFileDrop (macOS/Linux), so drops are handled the same way as the
+// Windows native path. Returns true when the callback was registered.
+func registerFileDrop(ctx context.Context, onDrop func(x, y int, paths []string)) bool {
+	wailsRuntime.OnFileDrop(ctx, onDrop)
+	return true
+}
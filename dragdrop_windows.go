@@ -3,6 +3,7 @@
 package main
 
 import (
+	"context"
 	"sync/atomic"
 	"syscall"
 	"unsafe"
@@ -289,6 +290,13 @@ func setupNativeFileDrop(onDrop func([]string)) {
 	Log.Info("RegisterDragDrop on Wails window", "hwnd", hwnd, "hresult", ret)
 }
 
+// registerFileDrop is not used on Windows: dropped paths are delivered to the
+// frontend's runtime.OnFileDrop directly, so registering a Go-side callback
+// as well would process each drop twice.
+func registerFileDrop(ctx context.Context, onDrop func(x, y int, paths []string)) bool {
+	return false
+}
+
 // _chromeHwnds collects all Chrome_WidgetWin_0 HWNDs found by EnumChildWindows.
 var _chromeHwnds []uintptr
 
@@ -0,0 +1,364 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// GIF 表情资源：emoji_gifs.json 内嵌在程序中，用户上传的自定义表情记录在 ~/.lanshare/custom_emojis.json，
+// 文件统一存放在 ~/.lanshare/assets/emoji-gifs/。
+// 本地缺少某个表情时，从局域网中拥有该资源的节点（/emoji-asset/{id}）下载并缓存。
+const (
+	emojiAssetMaxSize     = 2 << 20          // 单个表情文件上限
+	emojiAssetMissBackoff = 10 * time.Minute // 所有节点都没有时，暂不重复查找
+	customEmojiMaxCount   = 100              // 自定义表情数量上限
+	customEmojiIDPrefix   = "custom-"
+
+	// 节点之间同步表情时携带，收到该请求的节点不再向其他节点转查，避免互相递归请求
+	emojiPeerRequestHeader = "X-LANShare-Emoji-Sync"
+)
+
+// emojiEntry emoji_gifs.json / custom_emojis.json 中的一项
+type emojiEntry struct {
+	ID       string `json:"id"`
+	Name     string `json:"name"`
+	Filename string `json:"filename"`
+	Custom   bool   `json:"custom,omitempty"`
+}
+
+var (
+	builtinEmojiOnce sync.Once
+	builtinEmojiList []emojiEntry
+
+	customEmojiMutex sync.Mutex
+
+	// 正在下载/近期下载失败的表情，避免并发重复请求和频繁扫描节点
+	emojiFetchMutex  sync.Mutex
+	emojiFetchLocks  = make(map[string]*sync.Mutex)
+	emojiFetchMissed = make(map[string]time.Time)
+)
+
+// builtinEmojis 解析内嵌的 emoji_gifs.json
+func builtinEmojis() []emojiEntry {
+	builtinEmojiOnce.Do(func() {
+		data, err := webFS.ReadFile("emoji_gifs.json")
+		if err != nil {
+			return
+		}
+		if err := json.Unmarshal(data, &builtinEmojiList); err != nil {
+			Log.Error("解析表情列表失败", "error", err)
+		}
+	})
+	return builtinEmojiList
+}
+
+// customEmojis 读取用户上传的自定义表情列表
+func customEmojis() []emojiEntry {
+	customEmojiMutex.Lock()
+	defer customEmojiMutex.Unlock()
+	return loadCustomEmojisLocked()
+}
+
+func loadCustomEmojisLocked() []emojiEntry {
+	var list []emojiEntry
+	data, err := os.ReadFile(DataPath("custom_emojis.json"))
+	if err != nil {
+		return list
+	}
+	if err := json.Unmarshal(data, &list); err != nil {
+		Log.Error("解析自定义表情列表失败", "error", err)
+		return nil
+	}
+	for i := range list {
+		list[i].Custom = true
+	}
+	return list
+}
+
+// allEmojis 返回内置与自定义表情
+func allEmojis() []emojiEntry {
+	return append(append([]emojiEntry{}, builtinEmojis()...), customEmojis()...)
+}
+
+// findEmoji 按表情ID查找
+func findEmoji(id string) (emojiEntry, bool) {
+	for _, e := range allEmojis() {
+		if e.ID == id {
+			return e, true
+		}
+	}
+	return emojiEntry{}, false
+}
+
+// findEmojiByFilename 按文件名查找
+func findEmojiByFilename(filename string) (emojiEntry, bool) {
+	for _, e := range allEmojis() {
+		if e.Filename == filename {
+			return e, true
+		}
+	}
+	return emojiEntry{}, false
+}
+
+// emojiAssetPath 返回表情文件的本地路径；文件名必须是纯文件名，防止路径穿越
+func emojiAssetPath(filename string) (string, bool) {
+	if filename == "" || filename != filepath.Base(filename) || strings.ContainsAny(filename, `/\`) || filename == ".." {
+		return "", false
+	}
+	return DataPath("assets", "emoji-gifs", filename), true
+}
+
+// validEmojiID 表情ID只允许字母数字、- 和 _
+func validEmojiID(id string) bool {
+	if id == "" || len(id) > 64 {
+		return false
+	}
+	for _, c := range id {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-' || c == '_') {
+			return false
+		}
+	}
+	return true
+}
+
+// localEmojiFile 按ID查找本地表情文件：已知表情用列表中的文件名，
+// 其他节点的自定义表情同步后以 <id>.<扩展名> 缓存
+func localEmojiFile(id string) (string, bool) {
+	if entry, ok := findEmoji(id); ok {
+		path, ok := emojiAssetPath(entry.Filename)
+		if !ok {
+			return "", false
+		}
+		_, err := os.Stat(path)
+		return path, err == nil
+	}
+	if !validEmojiID(id) {
+		return "", false
+	}
+	matches, _ := filepath.Glob(DataPath("assets", "emoji-gifs", id+".*"))
+	for _, m := range matches {
+		if !strings.HasSuffix(m, ".tmp") {
+			return m, true
+		}
+	}
+	return "", false
+}
+
+// handleEmojiGif 服务 /emoji-gifs/{filename}：本地有则直接返回，否则从局域网节点同步，都没有时返回占位图
+func (node *P2PNode) handleEmojiGif(w http.ResponseWriter, r *http.Request) {
+	filename := strings.TrimPrefix(r.URL.Path, "/emoji-gifs/")
+	localPath, ok := emojiAssetPath(filename)
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	if _, err := os.Stat(localPath); err != nil {
+		entry, known := findEmojiByFilename(filename)
+		if !known {
+			serveEmojiPlaceholder(w)
+			return
+		}
+		if localPath, err = node.fetchEmojiAsset(entry.ID); err != nil {
+			serveEmojiPlaceholder(w)
+			return
+		}
+	}
+	http.ServeFile(w, r, localPath)
+}
+
+// handleEmojiAsset 服务 /emoji-asset/{id}：其他节点同步表情资源时调用，本机前端也用它显示表情消息。
+// 本机请求时若本地缺失会从局域网同步；来自其他节点的同步请求只返回本地已有的文件。
+func (node *P2PNode) handleEmojiAsset(w http.ResponseWriter, r *http.Request) {
+	id := strings.TrimPrefix(r.URL.Path, "/emoji-asset/")
+	fromPeer := r.Header.Get(emojiPeerRequestHeader) != ""
+	localPath, ok := localEmojiFile(id)
+	if !ok && !fromPeer && validEmojiID(id) {
+		var err error
+		localPath, err = node.fetchEmojiAsset(id)
+		ok = err == nil
+	}
+	if !ok {
+		if fromPeer {
+			http.NotFound(w, r)
+		} else {
+			serveEmojiPlaceholder(w)
+		}
+		return
+	}
+	http.ServeFile(w, r, localPath)
+}
+
+// fetchEmojiAsset 依次向在线节点请求表情资源并缓存到本地，返回本地路径
+func (node *P2PNode) fetchEmojiAsset(id string) (string, error) {
+	emojiFetchMutex.Lock()
+	if missed, ok := emojiFetchMissed[id]; ok && time.Since(missed) < emojiAssetMissBackoff {
+		emojiFetchMutex.Unlock()
+		return "", fmt.Errorf("局域网内暂无该表情")
+	}
+	lock, ok := emojiFetchLocks[id]
+	if !ok {
+		lock = &sync.Mutex{}
+		emojiFetchLocks[id] = lock
+	}
+	emojiFetchMutex.Unlock()
+
+	// 同一表情只下载一次，其余请求等待后直接读取缓存
+	lock.Lock()
+	defer lock.Unlock()
+	if path, ok := localEmojiFile(id); ok {
+		return path, nil
+	}
+
+	type source struct{ name, url string }
+	var sources []source
+	node.PeersMutex.RLock()
+	for _, peer := range node.Peers {
+		if peer.IsActive && peer.WebPort > 0 {
+			sources = append(sources, source{peer.Name,
+				fmt.Sprintf("http://%s:%d/emoji-asset/%s", peer.IP, peer.WebPort, id)})
+		}
+	}
+	node.PeersMutex.RUnlock()
+
+	client := &http.Client{Timeout: 10 * time.Second}
+	for _, src := range sources {
+		data, err := downloadEmojiAsset(client, src.url)
+		if err != nil {
+			Log.Debug("从节点获取表情失败", "peer", src.name, "emoji", id, "error", err)
+			continue
+		}
+		// 已知表情按列表中的文件名保存，其他节点的自定义表情按内容类型确定扩展名
+		var localPath string
+		if entry, known := findEmoji(id); known {
+			localPath, _ = emojiAssetPath(entry.Filename)
+		} else {
+			localPath = DataPath("assets", "emoji-gifs", id+emojiImageExt(data))
+		}
+		if err := writeEmojiAsset(localPath, data); err != nil {
+			return "", err
+		}
+		Log.Info("已从局域网同步表情", "peer", src.name, "emoji", id)
+		return localPath, nil
+	}
+
+	emojiFetchMutex.Lock()
+	emojiFetchMissed[id] = time.Now()
+	emojiFetchMutex.Unlock()
+	Log.Debug("局域网内没有节点拥有该表情", "emoji", id, "peers", len(sources))
+	return "", fmt.Errorf("局域网内暂无该表情")
+}
+
+// downloadEmojiAsset 从其他节点下载单个表情文件并校验为图片
+func downloadEmojiAsset(client *http.Client, url string) ([]byte, error) {
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set(emojiPeerRequestHeader, "1")
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("HTTP %d", resp.StatusCode)
+	}
+	data, err := io.ReadAll(io.LimitReader(resp.Body, emojiAssetMaxSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(data) > emojiAssetMaxSize {
+		return nil, fmt.Errorf("文件过大")
+	}
+	if emojiImageExt(data) == "" {
+		return nil, fmt.Errorf("不是支持的图片格式")
+	}
+	return data, nil
+}
+
+// emojiImageExt 根据文件内容返回扩展名，不支持的格式返回空
+func emojiImageExt(data []byte) string {
+	switch http.DetectContentType(data) {
+	case "image/gif":
+		return ".gif"
+	case "image/png":
+		return ".png"
+	case "image/jpeg":
+		return ".jpg"
+	case "image/webp":
+		return ".webp"
+	}
+	return ""
+}
+
+// writeEmojiAsset 原子写入表情文件
+func writeEmojiAsset(localPath string, data []byte) error {
+	if err := os.MkdirAll(filepath.Dir(localPath), 0755); err != nil {
+		return err
+	}
+	tmp := localPath + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, localPath)
+}
+
+// addCustomEmoji 保存用户上传的表情并追加到 custom_emojis.json
+func addCustomEmoji(name string, data []byte) (emojiEntry, error) {
+	if len(data) > emojiAssetMaxSize {
+		return emojiEntry{}, fmt.Errorf("表情文件不能超过 %s", formatFileSize(emojiAssetMaxSize))
+	}
+	ext := emojiImageExt(data)
+	if ext == "" {
+		return emojiEntry{}, fmt.Errorf("只支持 GIF、PNG、JPG、WebP 图片")
+	}
+
+	customEmojiMutex.Lock()
+	defer customEmojiMutex.Unlock()
+
+	list := loadCustomEmojisLocked()
+	if len(list) >= customEmojiMaxCount {
+		return emojiEntry{}, fmt.Errorf("自定义表情最多 %d 个", customEmojiMaxCount)
+	}
+
+	id := customEmojiIDPrefix + strings.ReplaceAll(newUUID(), "-", "")[:16]
+	entry := emojiEntry{ID: id, Name: name, Filename: id + ext, Custom: true}
+	if entry.Name == "" {
+		entry.Name = id
+	}
+	localPath, _ := emojiAssetPath(entry.Filename)
+	if err := writeEmojiAsset(localPath, data); err != nil {
+		return emojiEntry{}, err
+	}
+
+	list = append(list, entry)
+	out, err := json.MarshalIndent(list, "", "  ")
+	if err == nil {
+		err = os.WriteFile(DataPath("custom_emojis.json"), out, 0644)
+	}
+	if err != nil {
+		os.Remove(localPath)
+		return emojiEntry{}, err
+	}
+	Log.Info("已添加自定义表情", "id", id, "name", entry.Name, "size", len(data))
+	return entry, nil
+}
+
+// emojiPlaceholderSVG 资源缺失时显示的占位图
+const emojiPlaceholderSVG = `<svg xmlns="http://www.w3.org/2000/svg" viewBox="0 0 64 64">` +
+	`<circle cx="32" cy="32" r="28" fill="none" stroke="#8b9bab" stroke-width="3" stroke-dasharray="6 5"/>` +
+	`<text x="32" y="40" font-size="22" text-anchor="middle" fill="#8b9bab">?</text></svg>`
+
+func serveEmojiPlaceholder(w http.ResponseWriter) {
+	w.Header().Set("Content-Type", "image/svg+xml")
+	// 不缓存，资源同步到后可正常显示
+	w.Header().Set("Cache-Control", "no-store")
+	io.WriteString(w, emojiPlaceholderSVG)
+}
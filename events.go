@@ -1,5 +1,12 @@
 package main
 
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
 // Event name constants for Wails runtime events
 const (
 	EventNewMessage      = "new-message"
@@ -8,6 +15,12 @@ const (
 	EventUpdateAvailable = "update-available"
 	EventUpdateCleared   = "update-cleared"
 	EventFocusChat       = "focus-chat"
+	EventMessageFailed   = "message-failed"
+	EventMessageStatus   = "message-status"
+	EventFilesDropped    = "files-dropped"
+	EventNameConflict    = "name-conflict"
+	EventHistoryChanged  = "history-changed"
+	EventPinnedMessages  = "pinned-messages-changed"
 )
 
 // Safe event emission helpers - check for nil before calling.
@@ -18,15 +31,123 @@ func (node *P2PNode) emitNewMessage(msg ChatMessage) {
 	}
 }
 
-func (node *P2PNode) emitUserOnline(name string) {
-	if node.OnUserOnline != nil {
-		go node.OnUserOnline(name)
+// nextPresenceSeq returns a monotonically increasing sequence number for online/offline
+// events. Take it while holding PeersMutex together with the state change, so the
+// numbering follows the real order; callbacks run in goroutines and may arrive out of
+// order, and the frontend drops events older than the last one seen for that user.
+func (node *P2PNode) nextPresenceSeq() uint64 {
+	return atomic.AddUint64(&node.presenceSeq, 1)
+}
+
+// presenceDebounceDelay is how long a user's online/offline state must stay unchanged
+// before the event is emitted. Discovery broadcasts and mDNS queries can make a peer
+// flap; each change restarts the user's timer, so only the final state goes out.
+const presenceDebounceDelay = 1500 * time.Millisecond
+
+// presenceDebounce holds the pending (not yet emitted) presence change per user name
+// and the last state emitted, so a flap that ends where it started emits nothing.
+type presenceDebounce struct {
+	mu      sync.Mutex
+	pending map[string]*pendingPresence
+	emitted map[string]bool // name -> last emitted state (true = online)
+}
+
+type pendingPresence struct {
+	online bool
+	seq    uint64
+	timer  *time.Timer
+}
+
+func (node *P2PNode) emitUserOnline(name string, seq uint64) {
+	node.debouncePresence(name, true, seq)
+}
+
+func (node *P2PNode) emitUserOffline(name string, seq uint64) {
+	node.debouncePresence(name, false, seq)
+}
+
+// debouncePresence records the latest state for name and (re)starts its timer.
+func (node *P2PNode) debouncePresence(name string, online bool, seq uint64) {
+	d := &node.presence
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.pending == nil {
+		d.pending = make(map[string]*pendingPresence)
+		d.emitted = make(map[string]bool)
+	}
+	if p, ok := d.pending[name]; ok {
+		// Out-of-order callers: keep the state with the higher sequence number
+		if seq > p.seq {
+			p.online, p.seq = online, seq
+		}
+		p.timer.Reset(presenceDebounceDelay)
+		return
+	}
+	p := &pendingPresence{online: online, seq: seq}
+	p.timer = time.AfterFunc(presenceDebounceDelay, func() { node.flushPresence(name, p) })
+	d.pending[name] = p
+}
+
+// flushPresence emits the settled state for name unless it equals the last one emitted.
+func (node *P2PNode) flushPresence(name string, p *pendingPresence) {
+	d := &node.presence
+	d.mu.Lock()
+	if d.pending[name] != p {
+		d.mu.Unlock()
+		return
+	}
+	delete(d.pending, name)
+	online, seq := p.online, p.seq
+	last, known := d.emitted[name]
+	d.emitted[name] = online
+	d.mu.Unlock()
+
+	if known && last == online {
+		return
+	}
+	if online {
+		if node.OnUserOnline != nil {
+			go node.OnUserOnline(name, seq)
+		}
+	} else if node.OnUserOffline != nil {
+		go node.OnUserOffline(name, seq)
+	}
+}
+
+// emitNameConflict notifies that a peer's name clashed with another user and it is
+// shown as displayName (the name with a distinguishing suffix) instead.
+func (node *P2PNode) emitNameConflict(name, displayName string) {
+	fmt.Printf("用户名冲突: %s 显示为 %s\n", name, displayName)
+	if node.OnNameConflict != nil {
+		go node.OnNameConflict(name, displayName)
+	}
+}
+
+func (node *P2PNode) emitMessageFailed(messageID string) {
+	if node.OnMessageFailed != nil {
+		go node.OnMessageFailed(messageID)
+	}
+}
+
+// emitHistoryChanged notifies the frontend that stored history of chatID was deleted
+// (fully or a time range) and the chat should be reloaded.
+func (node *P2PNode) emitHistoryChanged(chatID string) {
+	if node.OnHistoryChanged != nil {
+		go node.OnHistoryChanged(chatID)
+	}
+}
+
+// emitPinnedMessagesChanged notifies the frontend that the pinned messages of chatID changed.
+func (node *P2PNode) emitPinnedMessagesChanged(chatID string) {
+	if node.OnPinnedMessagesChanged != nil {
+		go node.OnPinnedMessagesChanged(chatID)
 	}
 }
 
-func (node *P2PNode) emitUserOffline(name string) {
-	if node.OnUserOffline != nil {
-		go node.OnUserOffline(name)
+// emitMessageStatus notifies the frontend that a private message's delivery status changed.
+func (node *P2PNode) emitMessageStatus(messageID, status string) {
+	if node.OnMessageStatus != nil {
+		go node.OnMessageStatus(messageID, status)
 	}
 }
 
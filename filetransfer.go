@@ -5,11 +5,121 @@ import (
 	"encoding/hex"
 	"fmt"
 	"io"
+	"mime"
 	"os"
 	"path/filepath"
+	"strings"
 	"time"
 )
 
+// 打开即会被执行的文件类型（小写扩展名）。接收时提示风险，打开前需二次确认
+var dangerousFileExtensions = map[string]bool{
+	// Windows
+	".exe": true, ".com": true, ".scr": true, ".pif": true, ".bat": true, ".cmd": true,
+	".msi": true, ".msp": true, ".cpl": true, ".hta": true, ".lnk": true, ".reg": true,
+	".vbs": true, ".vbe": true, ".js": true, ".jse": true, ".wsf": true, ".wsh": true,
+	".ps1": true, ".psm1": true, ".jar": true,
+	// macOS / Linux
+	".app": true, ".command": true, ".pkg": true, ".sh": true, ".run": true,
+	".appimage": true, ".deb": true, ".rpm": true,
+}
+
+// fileRequestTimeout 文件传输请求等待接受/拒绝的时间，超时后双方都将请求标记为 timeout
+const fileRequestTimeout = 60 * time.Second
+
+// 文件分块大小自适应：从 initialChunkSize 开始，按测得的发送速度调整，使每块的发送耗时接近
+// chunkTargetDuration（快网络用大块减少每块的 JSON 与加密开销，慢网络用小块保持进度与取消及时），
+// 范围 minChunkSize~maxChunkSize，且不超过文件剩余大小和限速下的单块预算。
+// 数据块仍以 JSON（Data/Ciphertext 为 base64）随聊天消息在同一连接上发送，旧版本可以照常接收；
+// 接收方按 Offset 定位写入，缺块时请求重传（见 handleFileChunk）
+const (
+	minChunkSize        = 16 << 10
+	initialChunkSize    = 64 << 10
+	maxChunkSize        = 1 << 20
+	chunkTargetDuration = 100 * time.Millisecond
+)
+
+// chunkSizer 根据最近的发送速度计算下一块的大小
+type chunkSizer struct {
+	size int
+	rate float64 // 平滑后的发送速度（字节/秒），0 = 尚未测量
+}
+
+// observe 记录一块的发送耗时并调整下一块大小；uploadLimit 为限速（字节/秒，0 = 不限速）
+func (c *chunkSizer) observe(n int, elapsed time.Duration, uploadLimit int) {
+	if elapsed <= 0 {
+		elapsed = time.Millisecond
+	}
+	sample := float64(n) / elapsed.Seconds()
+	if c.rate == 0 {
+		c.rate = sample
+	} else {
+		c.rate = 0.7*c.rate + 0.3*sample
+	}
+	target := c.rate * chunkTargetDuration.Seconds()
+	if uploadLimit > 0 {
+		target = min(target, float64(uploadLimit)*chunkTargetDuration.Seconds())
+	}
+	// 每次最多翻倍或减半，避免单次测量偏差导致大幅跳动；按 16KB 取整
+	target = max(min(target, float64(c.size*2)), float64(c.size/2))
+	c.size = min(max(int(target)/minChunkSize*minChunkSize, minChunkSize), maxChunkSize)
+}
+
+// next 返回下一块的大小，不超过剩余字节数
+func (c *chunkSizer) next(remaining int64) int {
+	if int64(c.size) > remaining {
+		return int(max(remaining, 1))
+	}
+	return c.size
+}
+
+// openConfirmRequired 打开可执行文件未经确认时返回给前端的错误标识
+const openConfirmRequired = "confirm_required"
+
+// isExecutableFile 判断文件名是否属于危险的可执行类型。
+// Windows 会忽略文件名末尾的点和空格（"a.exe." 等同 "a.exe"），比较前先去掉
+func isExecutableFile(name string) bool {
+	name = strings.TrimRight(filepath.Base(name), ". ")
+	return dangerousFileExtensions[strings.ToLower(filepath.Ext(name))]
+}
+
+// fileTypeFor 由扩展名推断文件的 MIME 类型（去掉 charset 等参数），无法识别时为 application/octet-stream
+func fileTypeFor(name string) string {
+	fileType := mime.TypeByExtension(strings.ToLower(filepath.Ext(name)))
+	if fileType == "" {
+		return "application/octet-stream"
+	}
+	if mediaType, _, err := mime.ParseMediaType(fileType); err == nil {
+		return mediaType
+	}
+	return fileType
+}
+
+// fileIconHint 文件图标提示，供界面选择类型图标：
+// image/video/audio/pdf/archive/document/executable，其他为 file
+func fileIconHint(name, fileType string) string {
+	if isExecutableFile(name) {
+		return "executable"
+	}
+	switch {
+	case strings.HasPrefix(fileType, "image/"):
+		return "image"
+	case strings.HasPrefix(fileType, "video/"):
+		return "video"
+	case strings.HasPrefix(fileType, "audio/"):
+		return "audio"
+	case fileType == "application/pdf":
+		return "pdf"
+	}
+	switch strings.ToLower(filepath.Ext(name)) {
+	case ".zip", ".rar", ".7z", ".tar", ".gz", ".bz2", ".xz":
+		return "archive"
+	case ".txt", ".md", ".doc", ".docx", ".xls", ".xlsx", ".ppt", ".pptx", ".csv", ".rtf", ".odt":
+		return "document"
+	}
+	return "file"
+}
+
 // 生成文件ID
 func generateFileID() string {
 	bytes := make([]byte, 8)
@@ -32,14 +142,9 @@ func (node *P2PNode) sendFileTransferRequest(filePath string, targetName string)
 	// 检查文件大小
 	// 查找目标用户
 	var targetID string
-	node.PeersMutex.RLock()
-	for id, peer := range node.Peers {
-		if peer.Name == targetName {
-			targetID = id
-			break
-		}
+	if peer := node.findPeer(targetName); peer != nil {
+		targetID = peer.ID
 	}
-	node.PeersMutex.RUnlock()
 
 	if targetID == "" {
 		fmt.Printf("用户 %s 不在线\n", targetName)
@@ -59,6 +164,8 @@ func (node *P2PNode) sendFileTransferRequest(filePath string, targetName string)
 		To:        targetID,
 		Timestamp: time.Now(),
 	}
+	request.FileType = fileTypeFor(request.FileName)
+	request.FileIcon = fileIconHint(request.FileName, request.FileType)
 
 	// 添加到传输状态
 	node.FileTransfersMutex.Lock()
@@ -67,6 +174,8 @@ func (node *P2PNode) sendFileTransferRequest(filePath string, targetName string)
 		FileName:  request.FileName,
 		FilePath:  filePath, // 保存完整路径
 		FileSize:  request.FileSize,
+		FileType:  request.FileType,
+		FileIcon:  request.FileIcon,
 		Progress:  0,
 		Status:    "pending",
 		Direction: "send",
@@ -75,6 +184,7 @@ func (node *P2PNode) sendFileTransferRequest(filePath string, targetName string)
 		StartTime: time.Now(),
 	}
 	node.FileTransfersMutex.Unlock()
+	time.AfterFunc(fileRequestTimeout, func() { node.expireFileRequest(fileID) })
 
 	fmt.Printf("向 %s 发送文件传输请求: %s (%s)\n",
 		targetName, request.FileName, formatFileSize(request.FileSize))
@@ -97,8 +207,17 @@ func (node *P2PNode) sendFileTransferRequest(filePath string, targetName string)
 
 // 处理文件传输请求
 func (node *P2PNode) handleFileTransferRequest(request FileTransferRequest) {
-	fmt.Printf("\n收到来自 %s 的文件传输请求: %s (%s)\n",
-		node.getPeerName(request.From), request.FileName, formatFileSize(request.FileSize))
+	// 文件名来自对方，清洗后才用于拼接保存路径
+	request.FileName = sanitizeFileName(request.FileName)
+	// 旧版本发送方不带类型，按扩展名自行推断；可执行文件的提示以本机判断为准
+	if request.FileType == "" {
+		request.FileType = fileTypeFor(request.FileName)
+	}
+	if request.FileIcon == "" || isExecutableFile(request.FileName) {
+		request.FileIcon = fileIconHint(request.FileName, request.FileType)
+	}
+	fmt.Printf("\n收到来自 %s 的文件传输请求: %s (%s, %s)\n",
+		node.getPeerName(request.From), request.FileName, formatFileSize(request.FileSize), request.FileType)
 
 	// 添加到传输状态
 	node.FileTransfersMutex.Lock()
@@ -106,22 +225,38 @@ func (node *P2PNode) handleFileTransferRequest(request FileTransferRequest) {
 		FileID:    request.FileID,
 		FileName:  request.FileName,
 		FileSize:  request.FileSize,
+		FileType:  request.FileType,
+		FileIcon:  request.FileIcon,
 		Progress:  0,
 		Status:    "pending",
 		Direction: "receive",
 		PeerName:  node.getPeerName(request.From),
 		PeerID:    request.From, // 存储发送方的peer ID
 		StartTime: time.Now(),
+
+		IsExecutable: isExecutableFile(request.FileName),
 	}
 	node.FileTransfersMutex.Unlock()
+	time.AfterFunc(fileRequestTimeout, func() { node.expireFileRequest(request.FileID) })
+
+	if node.shouldAutoAccept(request) {
+		fmt.Println("发送方在信任列表中，已自动接受")
+		Log.Info("自动接受文件", "from", node.getPeerName(request.From), "fileName", request.FileName, "fileSize", request.FileSize)
+		node.respondToFileTransfer(request.FileID, true, "")
+		return
+	}
 
 	// 通知用户
+	if isExecutableFile(request.FileName) {
+		fmt.Println("⚠ 警告: 这是可执行文件，打开后会直接运行，请确认来源可信再接受")
+	}
 	fmt.Printf("要接受，请输入: /accept %s\n", request.FileID)
 	fmt.Printf("要拒绝，请输入: /reject %s\n", request.FileID)
 }
 
 // 响应文件传输请求
-func (node *P2PNode) respondToFileTransfer(fileID string, accepted bool) {
+// savePath 为用户选择的保存位置（桌面端"另存为"），为空时按整理设置存到下载目录
+func (node *P2PNode) respondToFileTransfer(fileID string, accepted bool, savePath string) {
 	node.FileTransfersMutex.Lock()
 	transfer, exists := node.FileTransfers[fileID]
 	if !exists || transfer.Direction != "receive" {
@@ -129,6 +264,11 @@ func (node *P2PNode) respondToFileTransfer(fileID string, accepted bool) {
 		fmt.Println("无效的文件传输ID")
 		return
 	}
+	if transfer.Status != "pending" {
+		node.FileTransfersMutex.Unlock()
+		fmt.Println("该文件传输请求已过期或已处理")
+		return
+	}
 	node.FileTransfersMutex.Unlock()
 
 	// 发送响应
@@ -142,14 +282,9 @@ func (node *P2PNode) respondToFileTransfer(fileID string, accepted bool) {
 
 	// 找到请求来源的Peer
 	var fromPeerID string
-	node.PeersMutex.RLock()
-	for id, peer := range node.Peers {
-		if peer.Name == transfer.PeerName {
-			fromPeerID = id
-			break
-		}
+	if peer := node.findPeer(transfer.PeerID, transfer.PeerName); peer != nil {
+		fromPeerID = peer.ID
 	}
-	node.PeersMutex.RUnlock()
 
 	if fromPeerID == "" {
 		fmt.Println("找不到文件发送方")
@@ -160,8 +295,19 @@ func (node *P2PNode) respondToFileTransfer(fileID string, accepted bool) {
 		responseMsg.Message = "文件传输已接受"
 		fmt.Printf("已接受文件传输，准备接收文件...\n")
 		Log.Info("接受文件传输", "fileID", fileID, "from", transfer.PeerName, "fileName", transfer.FileName)
+		if savePath != "" {
+			// 保存对话框已确认覆盖；数据块按追加写入，先删除同名旧文件
+			if err := os.Remove(savePath); err != nil && !os.IsNotExist(err) {
+				Log.Warn("删除已存在的目标文件失败", "path", savePath, "error", err)
+			}
+			Log.Info("接收文件另存为", "fileID", fileID, "path", savePath)
+		}
 		node.FileTransfersMutex.Lock()
 		transfer.Status = "transferring"
+		transfer.LastProgressTime = time.Now()
+		if savePath != "" {
+			transfer.ReceivePath = savePath
+		}
 		node.FileTransfersMutex.Unlock()
 	} else {
 		responseMsg.Message = "文件传输被拒绝"
@@ -189,9 +335,11 @@ func (node *P2PNode) respondToFileTransfer(fileID string, accepted bool) {
 func (node *P2PNode) handleFileTransferResponse(response FileTransferResponse) {
 	node.FileTransfersMutex.RLock()
 	transfer, exists := node.FileTransfers[response.FileID]
+	pending := exists && transfer.Status == "pending"
 	node.FileTransfersMutex.RUnlock()
 
-	if !exists {
+	// 请求已超时（expireFileRequest）后才到达的响应直接忽略
+	if !pending {
 		return
 	}
 
@@ -200,6 +348,7 @@ func (node *P2PNode) handleFileTransferResponse(response FileTransferResponse) {
 		// 更新状态
 		node.FileTransfersMutex.Lock()
 		transfer.Status = "transferring"
+		transfer.LastProgressTime = time.Now()
 		node.FileTransfersMutex.Unlock()
 
 		// 开始发送文件
@@ -210,13 +359,47 @@ func (node *P2PNode) handleFileTransferResponse(response FileTransferResponse) {
 		node.FileTransfersMutex.Lock()
 		delete(node.FileTransfers, response.FileID)
 		node.FileTransfersMutex.Unlock()
+		node.releaseTempFile(transfer.FilePath)
+	}
+}
+
+// expireFileRequest 请求超时仍未被接受或拒绝时标记为 timeout。
+// 发送方同时通知接收方取消，避免对方之后再接受一个已放弃的请求
+func (node *P2PNode) expireFileRequest(fileID string) {
+	node.FileTransfersMutex.Lock()
+	transfer, exists := node.FileTransfers[fileID]
+	if !exists || transfer.Status != "pending" {
+		node.FileTransfersMutex.Unlock()
+		return
+	}
+	transfer.Status = "timeout"
+	transfer.EndTime = time.Now()
+	fileName, direction, filePath := transfer.FileName, transfer.Direction, transfer.FilePath
+	peerName, peerID := transfer.PeerName, transfer.PeerID
+	node.FileTransfersMutex.Unlock()
+
+	if direction == "receive" {
+		fmt.Printf("文件传输请求已过期: %s\n", fileName)
+		Log.Info("文件传输请求已过期", "fileID", fileID, "fileName", fileName, "from", peerName)
+		return
+	}
+	node.releaseTempFile(filePath)
+
+	fmt.Printf("对方未响应文件传输请求: %s (%s)\n", fileName, peerName)
+	Log.Warn("文件传输请求超时", "fileID", fileID, "fileName", fileName, "peer", peerName)
+	if peer := node.findPeer(peerID, peerName); peer != nil {
+		node.sendMessageToPeer(peer, Message{
+			Type:      "file_cancel",
+			From:      node.ID,
+			To:        peer.ID,
+			Timestamp: time.Now(),
+			Content:   fileID,
+		})
 	}
 }
 
 // 发送文件
 func (node *P2PNode) sendFile(fileID string, filePath string) {
-	const chunkSize = 64 * 1024 // 64KB
-
 	// 查找目标用户
 	node.FileTransfersMutex.RLock()
 	transfer, exists := node.FileTransfers[fileID]
@@ -226,18 +409,10 @@ func (node *P2PNode) sendFile(fileID string, filePath string) {
 		Log.Error("发送文件失败: 无效的文件ID", "fileID", fileID)
 		return
 	}
-	targetName := transfer.PeerName
+	targetName, targetID := transfer.PeerName, transfer.PeerID
 	node.FileTransfersMutex.RUnlock()
 
-	var targetPeer *Peer
-	node.PeersMutex.RLock()
-	for _, p := range node.Peers {
-		if p.Name == targetName {
-			targetPeer = p
-			break
-		}
-	}
-	node.PeersMutex.RUnlock()
+	targetPeer := node.findPeer(targetID, targetName)
 
 	if targetPeer == nil {
 		fmt.Printf("发送文件失败: 用户 %s 不在线\n", targetName)
@@ -267,10 +442,12 @@ func (node *P2PNode) sendFile(fileID string, filePath string) {
 	defer file.Close()
 
 	fileInfo, _ := file.Stat()
-	totalChunks := (int(fileInfo.Size()) + chunkSize - 1) / chunkSize
-	
-	buffer := make([]byte, chunkSize)
+	fileSize := fileInfo.Size()
+
+	sizer := chunkSizer{size: initialChunkSize}
+	buffer := make([]byte, max(min(fileSize, maxChunkSize), 1))
 	chunkNum := 0
+	var offset int64
 
 	for {
 		// Check if transfer was cancelled
@@ -281,9 +458,18 @@ func (node *P2PNode) sendFile(fileID string, filePath string) {
 			Log.Info("文件传输已取消", "fileID", fileID)
 			return
 		}
+		// 卡死检测判定失败（或对方通知失败）后停止发送
+		if transfer.Status == "failed" {
+			node.FileTransfersMutex.RUnlock()
+			Log.Info("文件传输已失败，停止发送", "fileID", fileID)
+			return
+		}
 		node.FileTransfersMutex.RUnlock()
 
-		bytesRead, err := file.Read(buffer)
+		bytesRead, err := io.ReadFull(file, buffer[:sizer.next(fileSize-offset)])
+		if err == io.ErrUnexpectedEOF {
+			err = nil // 文件末尾不足一块
+		}
 		if err != nil {
 			if err == io.EOF {
 				break // 文件读取完毕
@@ -296,47 +482,26 @@ func (node *P2PNode) sendFile(fileID string, filePath string) {
 			break
 		}
 
-		chunkNum++
-		chunkData := buffer[:bytesRead]
-
-		chunk := FileChunk{
-			Type:        "file_chunk",
-			FileID:      fileID,
-			ChunkNum:    chunkNum,
-			TotalChunks: totalChunks,
-			Data:        chunkData,
-			Timestamp:   time.Now(),
-		}
-
-		// 加密 chunk Data
-		if len(targetPeer.SharedKey) == 32 {
-			ciphertext, nonce, err := encryptMessage([32]byte(targetPeer.SharedKey), chunkData)
-			if err == nil {
-				chunk.Encrypted = true
-				chunk.Nonce = nonce
-				chunk.Ciphertext = ciphertext
-				chunk.Data = nil // 清空明文
-			} else {
-				fmt.Printf("加密文件块失败: %v，将尝试不加密传输\n", err)
-				Log.Error("加密文件块失败", "fileID", fileID, "chunk", chunkNum, "error", err)
-				// 如果加密失败，保持明文传输
-				chunk.Encrypted = false
-				chunk.Data = chunkData
-			}
-		} else {
-			// 密钥无效，保持明文传输
-			chunk.Encrypted = false
-			chunk.Data = chunkData
+		// 按限速等待令牌；等待期间传输被取消则直接结束
+		if !node.UploadLimiter.Wait(bytesRead, func() bool {
+			node.FileTransfersMutex.RLock()
+			defer node.FileTransfersMutex.RUnlock()
+			return transfer.Status == "cancelled"
+		}) {
+			fmt.Printf("文件传输已取消: %s\n", transfer.FileName)
+			Log.Info("文件传输已取消", "fileID", fileID)
+			return
 		}
 
-		msg := Message{
-			Type: "file_chunk",
-			From: node.ID,
-			To:   targetPeer.ID,
-			Data: chunk,
-		}
+		chunkNum++
+		// 记录每块的起始位置和长度，接收方请求重传时按块序号重新读取
+		node.FileTransfersMutex.Lock()
+		transfer.sentChunks = append(transfer.sentChunks, sentChunk{offset: offset, length: bytesRead})
+		node.FileTransfersMutex.Unlock()
 
-		if err := node.sendMessageToPeer(targetPeer, msg); err != nil {
+		totalChunks := chunkNum + int((fileSize-offset-int64(bytesRead)+int64(sizer.size)-1)/int64(sizer.size)) // 按当前块大小估算，最后一块时准确
+		sendStart := time.Now()
+		if err := node.sendFileChunk(targetPeer, fileID, chunkNum, totalChunks, offset, buffer[:bytesRead]); err != nil {
 			fmt.Printf("发送文件块失败: %v\n", err)
 			Log.Error("发送文件块失败", "fileID", fileID, "chunk", chunkNum, "error", err)
 			// 标记传输失败
@@ -350,17 +515,23 @@ func (node *P2PNode) sendFile(fileID string, filePath string) {
 			return
 		}
 
+		sizer.observe(bytesRead, time.Since(sendStart), node.UploadLimiter.Rate())
+		offset += int64(bytesRead)
+
 		// 更新进度
 		node.updateTransferProgress(fileID, int64(bytesRead))
 
-		// Log progress every 100 chunks (~6.4MB)
-		if chunkNum%100 == 0 || chunkNum == totalChunks {
+		// Log progress every 100 chunks
+		if chunkNum%100 == 0 || offset >= fileSize {
 			node.FileTransfersMutex.RLock()
 			pct := float64(transfer.Progress) / float64(transfer.FileSize) * 100
 			node.FileTransfersMutex.RUnlock()
-			Log.Info("发送进度", "fileID", fileID, "chunk", chunkNum, "total", totalChunks,
+			Log.Info("发送进度", "fileID", fileID, "chunk", chunkNum, "chunkSize", sizer.size,
 				"progress", fmt.Sprintf("%.1f%%", pct))
 		}
+		if offset >= fileSize {
+			break
+		}
 	}
 
 	// 所有块已写入TCP，等待接收方确认（status仍为transferring）
@@ -369,40 +540,156 @@ func (node *P2PNode) sendFile(fileID string, filePath string) {
 	Log.Info("文件块全部发送", "path", filePath, "fileID", fileID)
 }
 
+// sendFileChunk 加密并发送一个数据块，等待写入连接
+func (node *P2PNode) sendFileChunk(peer *Peer, fileID string, chunkNum, totalChunks int, offset int64, data []byte) error {
+	chunk := FileChunk{
+		Type:        "file_chunk",
+		FileID:      fileID,
+		ChunkNum:    chunkNum,
+		TotalChunks: totalChunks,
+		Offset:      &offset,
+		Data:        data,
+		Timestamp:   time.Now(),
+	}
+
+	// 加密 chunk Data
+	if len(peer.SharedKey) == 32 {
+		ciphertext, nonce, err := encryptMessage([32]byte(peer.SharedKey), data)
+		if err == nil {
+			chunk.Encrypted = true
+			chunk.Nonce = nonce
+			chunk.Ciphertext = ciphertext
+			chunk.Data = nil // 清空明文
+		} else {
+			// 如果加密失败，保持明文传输
+			fmt.Printf("加密文件块失败: %v，将尝试不加密传输\n", err)
+			Log.Error("加密文件块失败", "fileID", fileID, "chunk", chunkNum, "error", err)
+		}
+	}
+
+	return node.sendMessageToPeer(peer, Message{
+		Type: "file_chunk",
+		From: node.ID,
+		To:   peer.ID,
+		Data: chunk,
+	})
+}
+
+// 接收端重组：每块按 Offset（旧版本发送方没有此字段，按固定 legacyChunkSize 由 ChunkNum 推算）定位写入，
+// 已接收的块记在位图中，重复的块丢弃。收到结束于文件末尾的块后才知道总块数，
+// 此后块数与字节数都对上才标记完成；仍有缺失时向发送方请求重传（file_resend），
+// 最多 maxChunkResendRounds 轮，仍未收齐时由卡死检测判定失败
+const (
+	legacyChunkSize       = 64 << 10
+	maxChunkResendRounds  = 5
+	chunkResendInterval   = 5 * time.Second
+	maxResendChunksPerReq = 256
+)
+
+// sentChunk 发送方记录的一个已发出块的位置，重传时按原样重新读取
+type sentChunk struct {
+	offset int64
+	length int
+}
+
+// chunkBitmap 接收方已写入的块（序号从 1 开始）
+type chunkBitmap struct {
+	bits  []uint64
+	count int
+	high  int // 已收到的最大序号
+	total int // 总块数，收到最后一块前为 0
+}
+
+func (b *chunkBitmap) has(n int) bool {
+	i := (n - 1) / 64
+	return i < len(b.bits) && b.bits[i]&(1<<uint((n-1)%64)) != 0
+}
+
+// set 标记块 n 已接收，已存在时返回 false
+func (b *chunkBitmap) set(n int) bool {
+	if b.has(n) {
+		return false
+	}
+	for len(b.bits) <= (n-1)/64 {
+		b.bits = append(b.bits, 0)
+	}
+	b.bits[(n-1)/64] |= 1 << uint((n-1)%64)
+	b.count++
+	b.high = max(b.high, n)
+	return true
+}
+
+// missing 返回总块数（未知时为已收到的最大序号）以内缺失的块，最多 limit 个
+func (b *chunkBitmap) missing(limit int) []int {
+	upper := b.total
+	if upper == 0 {
+		upper = b.high
+	}
+	var list []int
+	for n := 1; n <= upper && len(list) < limit; n++ {
+		if !b.has(n) {
+			list = append(list, n)
+		}
+	}
+	return list
+}
+
+// FileResendRequest 接收方请求重传缺失的数据块
+type FileResendRequest struct {
+	FileID    string `json:"fileId"`
+	Chunks    []int  `json:"chunks,omitempty"`    // 缺失的块序号
+	FromChunk int    `json:"fromChunk,omitempty"` // 尚未收到最后一块时，从该序号起全部重传；0 = 不需要
+}
+
+// chunkOffset 数据块在文件中的起始位置
+func (chunk FileChunk) chunkOffset() int64 {
+	if chunk.Offset != nil {
+		return *chunk.Offset
+	}
+	return int64(chunk.ChunkNum-1) * legacyChunkSize
+}
+
 // 处理文件数据块
+// transfer 只在持有 FileTransfersMutex 时读写；文件写入由 transfer.writeMu 串行化，
+// 与超时失败、对方取消后的部分文件清理互斥，避免写入已结束的传输
 func (node *P2PNode) handleFileChunk(chunk FileChunk) {
+	offset := chunk.chunkOffset()
+
 	node.FileTransfersMutex.Lock()
 	transfer, exists := node.FileTransfers[chunk.FileID]
 	if !exists {
 		node.FileTransfersMutex.Unlock()
 		return
 	}
-	node.FileTransfersMutex.Unlock()
-
-	// 创建下载目录
-	downloadDir := DataPath("downloads")
-	if err := os.MkdirAll(downloadDir, 0755); err != nil {
-		fmt.Printf("创建下载目录失败: %v\n", err)
-		Log.Error("创建下载目录失败", "error", err)
+	// 已取消或已判定失败的传输不再写入（部分文件可能已被清理）
+	if !transfer.isActive() {
+		node.FileTransfersMutex.Unlock()
 		return
 	}
-
-	filePath := filepath.Join(downloadDir, transfer.FileName)
-
-	// 以追加模式打开文件
-	file, err := os.OpenFile(filePath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
-	if err != nil {
-		fmt.Printf("打开文件失败: %v\n", err)
-		Log.Error("打开接收文件失败", "path", filePath, "error", err)
+	// 块序号上限按最小块大小估算，防止异常序号撑大位图
+	if chunk.ChunkNum < 1 || chunk.ChunkNum > int(transfer.FileSize/minChunkSize)+2 || offset < 0 || offset > transfer.FileSize {
+		node.FileTransfersMutex.Unlock()
+		Log.Warn("丢弃无效的文件块", "fileID", chunk.FileID, "chunk", chunk.ChunkNum, "offset", offset)
 		return
 	}
-	defer file.Close()
+	if transfer.chunks.has(chunk.ChunkNum) {
+		node.FileTransfersMutex.Unlock()
+		Log.Debug("丢弃重复的文件块", "fileID", chunk.FileID, "chunk", chunk.ChunkNum)
+		return
+	}
+	// 保存位置在首个数据块时确定，传输中途修改整理设置或对方改名不会拆分文件
+	if transfer.ReceivePath == "" {
+		transfer.ReceivePath = filepath.Join(node.downloadDirFor(transfer.PeerName, transfer.FileName), transfer.FileName)
+	}
+	filePath := transfer.ReceivePath
+	fileName, peerName, peerID, fileSize := transfer.FileName, transfer.PeerName, transfer.PeerID, transfer.FileSize
+	node.FileTransfersMutex.Unlock()
 
-	// 解密 Data
+	// 解密 Data；失败时该块视为缺失，之后请求重传
 	var chunkData []byte
 	if chunk.Encrypted && len(chunk.Nonce) > 0 && len(chunk.Ciphertext) > 0 {
 		node.PeersMutex.RLock()
-		senderPeer, exists := node.Peers[transfer.PeerID] // 使用存储的peer ID查找发送方
+		senderPeer, exists := node.Peers[peerID] // 使用存储的peer ID查找发送方
 		node.PeersMutex.RUnlock()
 
 		if exists && len(senderPeer.SharedKey) > 0 {
@@ -411,65 +698,199 @@ func (node *P2PNode) handleFileChunk(chunk FileChunk) {
 				chunkData = plaintext
 			} else {
 				fmt.Printf("解密文件块失败: %v (文件: %s, 发送方: %s, PeerID: %s)\n",
-					err, transfer.FileName, transfer.PeerName, transfer.PeerID)
-				Log.Error("解密文件块失败", "fileName", transfer.FileName, "peer", transfer.PeerName, "error", err)
-				fmt.Printf("调试信息 - 密文长度: %d, Nonce长度: %d, 密钥长度: %d\n",
-					len(chunk.Ciphertext), len(chunk.Nonce), len(senderPeer.SharedKey))
+					err, fileName, peerName, peerID)
+				Log.Error("解密文件块失败", "fileName", fileName, "peer", peerName, "chunk", chunk.ChunkNum, "error", err)
 				return
 			}
 		} else {
-			fmt.Printf("无密钥解密文件块 (文件: %s, PeerID: %s, Peer存在: %v, 有密钥: %v)\n",
-				transfer.FileName, transfer.PeerID, exists, exists && len(senderPeer.SharedKey) > 0)
-
-			// 列出所有可用的peers用于调试
-			node.PeersMutex.RLock()
-			fmt.Printf("可用Peers: ")
-			for id, peer := range node.Peers {
-				fmt.Printf("%s(%s, 密钥长度:%d) ", peer.Name, id, len(peer.SharedKey))
-			}
-			fmt.Printf("\n")
-			node.PeersMutex.RUnlock()
-
+			fmt.Printf("无密钥解密文件块 (文件: %s, PeerID: %s, Peer存在: %v)\n", fileName, peerID, exists)
+			Log.Error("无密钥解密文件块", "fileName", fileName, "peerId", peerID, "chunk", chunk.ChunkNum)
 			return
 		}
 	} else {
 		chunkData = chunk.Data
 	}
+	if offset+int64(len(chunkData)) > fileSize {
+		Log.Warn("文件块超出文件大小，已丢弃", "fileID", chunk.FileID, "chunk", chunk.ChunkNum, "offset", offset, "size", len(chunkData))
+		return
+	}
+
+	transfer.writeMu.Lock()
+	defer transfer.writeMu.Unlock()
+
+	// 解密期间传输可能已被取消或判定失败
+	node.FileTransfersMutex.RLock()
+	active := transfer.isActive()
+	node.FileTransfersMutex.RUnlock()
+	if !active {
+		return
+	}
 
-	// 写入数据
-	if _, err := file.Write(chunkData); err != nil {
+	if err := writeFileChunk(filePath, fileSize, offset, chunkData); err != nil {
 		fmt.Printf("写入文件块失败: %v\n", err)
-		Log.Error("写入文件块失败", "fileID", chunk.FileID, "error", err)
+		Log.Error("写入文件块失败", "fileID", chunk.FileID, "path", filePath, "error", err)
 		return
 	}
 
-	// 更新进度
-	node.updateTransferProgress(chunk.FileID, int64(len(chunkData)))
+	// 登记块并检查是否完成，在同一次持锁内进行，避免与取消/清理交错
+	last := offset+int64(len(chunkData)) == fileSize
+	progress, completed, incomplete := node.recordReceivedChunk(chunk.FileID, transfer, chunk.ChunkNum, last, int64(len(chunkData)))
 
-	// Log receive progress every 100 chunks (~6.4MB)
-	if chunk.ChunkNum%100 == 0 || chunk.ChunkNum == chunk.TotalChunks {
-		node.FileTransfersMutex.RLock()
-		pct := float64(transfer.Progress) / float64(transfer.FileSize) * 100
-		node.FileTransfersMutex.RUnlock()
+	// Log receive progress every 100 chunks
+	if chunk.ChunkNum%100 == 0 || completed {
+		pct := float64(progress) / float64(fileSize) * 100
 		Log.Info("接收进度", "fileID", chunk.FileID, "chunk", chunk.ChunkNum, "total", chunk.TotalChunks,
 			"progress", fmt.Sprintf("%.1f%%", pct))
 	}
 
-	// 检查是否完成
+	if completed {
+		fmt.Printf("\n文件接收完成: %s，已保存到 %s\n", fileName, filePath)
+		Log.Info("文件接收完成", "fileName", fileName, "savePath", filePath)
+
+		// 发送完成确认给发送方
+		node.sendFileComplete(chunk.FileID, peerID)
+	} else if last && incomplete {
+		// 最后一块已到，之前仍有缺失：请求重传
+		go node.requestMissingChunks(chunk.FileID)
+	}
+}
+
+// writeFileChunk 在 offset 处写入一个数据块，必要时创建下载目录（按整理设置可能是发送者或类型子目录）。
+// 首次打开时把文件截断到 fileSize，目标位置已有的旧文件不会在末尾残留多余内容
+func writeFileChunk(filePath string, fileSize, offset int64, data []byte) error {
+	if err := os.MkdirAll(filepath.Dir(filePath), 0755); err != nil {
+		return fmt.Errorf("创建下载目录失败: %v", err)
+	}
+	file, err := os.OpenFile(filePath, os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	// 块都在 fileSize 范围内，截断后文件大小不再变化，之后的写入不会再次截断
+	if info, err := file.Stat(); err != nil || info.Size() != fileSize {
+		if err := file.Truncate(fileSize); err != nil {
+			file.Close()
+			return err
+		}
+	}
+	if _, err := file.WriteAt(data, offset); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+// recordReceivedChunk 登记收到的块并累加接收进度；last 表示该块结束于文件末尾，其序号即总块数。
+// 总块数已知、块数与字节数都对上时标记完成并记录保存路径；incomplete 表示总块数已知但仍有缺块。
+// 传输已被清理或不再进行中时不做修改；completed 仅在本次调用完成传输时为 true
+func (node *P2PNode) recordReceivedChunk(fileID string, transfer *FileTransferStatus, chunkNum int, last bool, n int64) (progress int64, completed, incomplete bool) {
 	node.FileTransfersMutex.Lock()
-	if transfer.Progress >= transfer.FileSize {
+	defer node.FileTransfersMutex.Unlock()
+
+	if node.FileTransfers[fileID] != transfer || !transfer.isActive() || !transfer.chunks.set(chunkNum) {
+		return transfer.Progress, false, false
+	}
+	if last {
+		transfer.chunks.total = chunkNum
+	}
+	transfer.addProgressLocked(n, time.Now())
+	total := transfer.chunks.total
+	if total == 0 {
+		return transfer.Progress, false, false
+	}
+	if transfer.chunks.count == total && transfer.chunks.high == total && transfer.Progress == transfer.FileSize {
 		transfer.Status = "completed"
 		transfer.EndTime = time.Now()
-		transfer.SavePath = filePath
-		fmt.Printf("\n文件接收完成: %s，已保存到 %s\n", transfer.FileName, filePath)
-		Log.Info("文件接收完成", "fileName", transfer.FileName, "savePath", filePath)
+		transfer.SavePath = transfer.ReceivePath
+		return transfer.Progress, true, false
+	}
+	return transfer.Progress, false, true
+}
 
-		// 发送完成确认给发送方
-		peerID := transfer.PeerID
+// requestMissingChunks 向发送方请求重传缺失的块；之后每隔 chunkResendInterval 复查，
+// 直到收齐、传输结束或达到最大轮数
+func (node *P2PNode) requestMissingChunks(fileID string) {
+	node.FileTransfersMutex.Lock()
+	transfer, exists := node.FileTransfers[fileID]
+	if !exists || transfer.Direction != "receive" || !transfer.isActive() || transfer.resendRounds >= maxChunkResendRounds {
 		node.FileTransfersMutex.Unlock()
-		node.sendFileComplete(chunk.FileID, peerID)
-	} else {
+		return
+	}
+	req := FileResendRequest{FileID: fileID, Chunks: transfer.chunks.missing(maxResendChunksPerReq)}
+	if transfer.chunks.total == 0 {
+		req.FromChunk = transfer.chunks.high + 1
+	}
+	if len(req.Chunks) == 0 && req.FromChunk == 0 {
 		node.FileTransfersMutex.Unlock()
+		return
+	}
+	transfer.resendRounds++
+	round, peerID := transfer.resendRounds, transfer.PeerID
+	node.FileTransfersMutex.Unlock()
+
+	node.PeersMutex.RLock()
+	peer, ok := node.Peers[peerID]
+	node.PeersMutex.RUnlock()
+	if !ok {
+		return
+	}
+	Log.Warn("请求重传缺失的文件块", "fileID", fileID, "missing", len(req.Chunks), "fromChunk", req.FromChunk, "round", round)
+	if err := node.sendMessageToPeer(peer, Message{Type: "file_resend", From: node.ID, To: peerID, Data: req, Timestamp: time.Now()}); err != nil {
+		Log.Error("发送重传请求失败", "fileID", fileID, "error", err)
+		return
+	}
+	time.AfterFunc(chunkResendInterval, func() { node.requestMissingChunks(fileID) })
+}
+
+// handleFileResend 发送方按接收方的请求重新发送数据块（只接受该传输的接收方，且传输仍在进行）
+func (node *P2PNode) handleFileResend(fromID string, req FileResendRequest) {
+	node.FileTransfersMutex.RLock()
+	transfer, exists := node.FileTransfers[req.FileID]
+	if !exists || transfer.Direction != "send" || transfer.PeerID != fromID || !transfer.isActive() {
+		node.FileTransfersMutex.RUnlock()
+		return
+	}
+	sent := transfer.sentChunks
+	filePath := transfer.FilePath
+	node.FileTransfersMutex.RUnlock()
+
+	nums := req.Chunks
+	if req.FromChunk > 0 {
+		for n := req.FromChunk; n <= len(sent); n++ {
+			nums = append(nums, n)
+		}
+	}
+	if len(nums) > maxResendChunksPerReq {
+		nums = nums[:maxResendChunksPerReq]
+	}
+
+	node.PeersMutex.RLock()
+	peer, ok := node.Peers[fromID]
+	node.PeersMutex.RUnlock()
+	if !ok || len(nums) == 0 {
+		return
+	}
+	file, err := os.Open(filePath)
+	if err != nil {
+		Log.Error("重传文件块失败：无法打开文件", "path", filePath, "error", err)
+		return
+	}
+	defer file.Close()
+
+	Log.Info("重传文件块", "fileID", req.FileID, "count", len(nums))
+	for _, n := range nums {
+		if n < 1 || n > len(sent) {
+			continue
+		}
+		c := sent[n-1]
+		data := make([]byte, c.length)
+		if _, err := file.ReadAt(data, c.offset); err != nil && err != io.EOF {
+			Log.Error("重传文件块失败：读取文件出错", "path", filePath, "chunk", n, "error", err)
+			return
+		}
+		if err := node.sendFileChunk(peer, req.FileID, n, len(sent), c.offset, data); err != nil {
+			Log.Error("重传文件块失败", "fileID", req.FileID, "chunk", n, "error", err)
+			return
+		}
 	}
 }
 
@@ -506,6 +927,8 @@ func (node *P2PNode) handleFileComplete(fileID string) {
 	transfer.EndTime = time.Now()
 	fmt.Printf("文件传输完成确认: %s\n", transfer.FileName)
 	Log.Info("文件传输完成确认", "fileName", transfer.FileName, "fileID", fileID)
+	// 持有锁期间不能检查引用，删除中转副本放到协程里
+	go node.releaseTempFile(transfer.FilePath)
 }
 
 // 更新文件传输状态（计算速度和ETA）
@@ -517,10 +940,13 @@ func (node *P2PNode) updateTransferProgress(fileID string, bytesAdded int64) {
 	if !exists {
 		return
 	}
+	transfer.addProgressLocked(bytesAdded, time.Now())
+}
 
+// addProgressLocked 累加进度并计算速度和ETA，调用方需持有 FileTransfersMutex
+func (transfer *FileTransferStatus) addProgressLocked(bytesAdded int64, now time.Time) {
 	// 更新进度
 	transfer.Progress += bytesAdded
-	now := time.Now()
 
 	// 计算速度和ETA
 	if transfer.LastUpdateTime.IsZero() {
@@ -542,7 +968,31 @@ func (node *P2PNode) updateTransferProgress(fileID string, bytesAdded int64) {
 	}
 
 	transfer.LastUpdateTime = now
-	transfer.Status = "transferring"
+	transfer.LastProgressTime = now
+	if transfer.Status == "stalled" {
+		Log.Info("文件传输已恢复", "fileID", transfer.FileID, "fileName", transfer.FileName)
+	}
+	if transfer.Status != "failed" && transfer.Status != "cancelled" {
+		transfer.Status = "transferring"
+	}
+}
+
+// isActive 传输是否仍在进行（可继续收发数据块），调用方需持有 FileTransfersMutex
+func (transfer *FileTransferStatus) isActive() bool {
+	return transfer.Status == "transferring" || transfer.Status == "stalled"
+}
+
+// activeTransferCount 返回进行中（含卡住）的文件传输数
+func (node *P2PNode) activeTransferCount() int {
+	node.FileTransfersMutex.RLock()
+	defer node.FileTransfersMutex.RUnlock()
+	count := 0
+	for _, transfer := range node.FileTransfers {
+		if transfer.isActive() {
+			count++
+		}
+	}
+	return count
 }
 
 // 格式化文件大小
@@ -569,19 +1019,16 @@ func (node *P2PNode) cancelFileTransfer(fileID string) {
 	}
 	transfer.Status = "cancelled"
 	transfer.EndTime = time.Now()
-	peerName := transfer.PeerName
+	peerName, peerID := transfer.PeerName, transfer.PeerID
+	filePath := ""
+	if transfer.Direction == "send" {
+		filePath = transfer.FilePath
+	}
 	node.FileTransfersMutex.Unlock()
+	node.releaseTempFile(filePath)
 
 	// Send cancel message to the other peer
-	var targetPeer *Peer
-	node.PeersMutex.RLock()
-	for _, p := range node.Peers {
-		if p.Name == peerName {
-			targetPeer = p
-			break
-		}
-	}
-	node.PeersMutex.RUnlock()
+	targetPeer := node.findPeer(peerID, peerName)
 
 	if targetPeer != nil {
 		msg := Message{
@@ -628,6 +1075,9 @@ func (node *P2PNode) showFileTransfers() {
 		
 		fmt.Printf("文件: %s\n", transfer.FileName)
 		fmt.Printf("大小: %s\n", formatFileSize(transfer.FileSize))
+		if transfer.FileType != "" {
+			fmt.Printf("类型: %s\n", transfer.FileType)
+		}
 		fmt.Printf("进度: %.1f%% (%s/%s)\n", 
 			progressPercent, 
 			formatFileSize(transfer.Progress), 
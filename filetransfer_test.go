@@ -0,0 +1,112 @@
+package main
+
+import (
+	"bytes"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+// 多个协程乱序（含重复）投递数据块，重组后的文件应与原文件逐字节一致
+func TestHandleFileChunkConcurrentOutOfOrder(t *testing.T) {
+	// 块大小按自适应分块的范围变化，最后一块不足一块
+	sizes := []int{minChunkSize, initialChunkSize, 20000, maxChunkSize, 3000}
+	var chunks []FileChunk
+	var want []byte
+	rng := rand.New(rand.NewSource(1))
+	for i := 0; len(want) < 3*maxChunkSize+12345; i++ {
+		data := make([]byte, sizes[i%len(sizes)])
+		rng.Read(data)
+		offset := int64(len(want))
+		chunks = append(chunks, FileChunk{Type: "file_chunk", FileID: "f1", ChunkNum: i + 1, Offset: &offset, Data: data})
+		want = append(want, data...)
+	}
+	for i := range chunks {
+		chunks[i].TotalChunks = len(chunks)
+	}
+
+	savePath := filepath.Join(t.TempDir(), "received.bin")
+	node := &P2PNode{
+		Peers:         make(map[string]*Peer),
+		FileTransfers: make(map[string]*FileTransferStatus),
+	}
+	transfer := &FileTransferStatus{
+		FileID:      "f1",
+		FileName:    "received.bin",
+		FileSize:    int64(len(want)),
+		Status:      "transferring",
+		Direction:   "receive",
+		PeerID:      "peer-1",
+		ReceivePath: savePath,
+	}
+	node.FileTransfers["f1"] = transfer
+
+	// 打乱顺序后分给多个协程，部分块重复投递
+	order := rng.Perm(len(chunks))
+	order = append(order, order[:len(order)/3]...)
+	rng.Shuffle(len(order), func(i, j int) { order[i], order[j] = order[j], order[i] })
+	const workers = 8
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := w; i < len(order); i += workers {
+				node.handleFileChunk(chunks[order[i]])
+			}
+		}(w)
+	}
+	wg.Wait()
+
+	node.FileTransfersMutex.RLock()
+	status, progress, saved := transfer.Status, transfer.Progress, transfer.SavePath
+	node.FileTransfersMutex.RUnlock()
+	if status != "completed" {
+		t.Fatalf("传输状态 = %q，期望 completed", status)
+	}
+	if progress != int64(len(want)) {
+		t.Fatalf("接收进度 = %d，期望 %d（重复块不应重复计数）", progress, len(want))
+	}
+	if saved != savePath {
+		t.Fatalf("保存路径 = %q，期望 %q", saved, savePath)
+	}
+	got, err := os.ReadFile(savePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Fatalf("重组后的文件与原文件不一致: 大小 %d，期望 %d", len(got), len(want))
+	}
+}
+
+// 目标位置已有更大的旧文件时，接收完成后不应残留旧内容
+func TestHandleFileChunkTruncatesExistingFile(t *testing.T) {
+	savePath := filepath.Join(t.TempDir(), "old.bin")
+	if err := os.WriteFile(savePath, bytes.Repeat([]byte{0xff}, 4*minChunkSize), 0644); err != nil {
+		t.Fatal(err)
+	}
+	want := bytes.Repeat([]byte("lanshare"), minChunkSize/8)
+	node := &P2PNode{
+		Peers:         make(map[string]*Peer),
+		FileTransfers: make(map[string]*FileTransferStatus),
+	}
+	node.FileTransfers["f2"] = &FileTransferStatus{
+		FileID:      "f2",
+		FileSize:    int64(len(want)),
+		Status:      "transferring",
+		Direction:   "receive",
+		ReceivePath: savePath,
+	}
+	var offset int64
+	node.handleFileChunk(FileChunk{FileID: "f2", ChunkNum: 1, TotalChunks: 1, Offset: &offset, Data: want})
+
+	got, err := os.ReadFile(savePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Fatalf("接收后的文件大小 %d，期望 %d", len(got), len(want))
+	}
+}
@@ -6,6 +6,7 @@ require (
 	github.com/gen2brain/beeep v0.11.2
 	github.com/hashicorp/mdns v1.0.6
 	github.com/ra1phdd/systray-on-wails v0.0.0-20241115230547-79e792e24569
+	github.com/skip2/go-qrcode v0.0.0-20200617195104-da1b6568686e
 	github.com/wailsapp/wails/v2 v2.11.0
 	golang.org/x/crypto v0.43.0
 	golang.org/x/sys v0.37.0
@@ -0,0 +1,43 @@
+package main
+
+import "fmt"
+
+// 消息处理钩子：dispatchMessage 按类型分发之前依次调用已注册的钩子，用于在不改动核心流程的前提下
+// 扩展行为（审计日志、自动回复、敏感词替换等）。钩子可以修改消息；聊天消息此时已解密，Content 为明文。
+// 钩子返回 false 时拦截该消息，后续钩子和分发都不再执行。
+// 钩子在消息主循环中串行调用，不应阻塞，耗时操作请另起协程；钩子 panic 时记录日志并视为放行
+
+// RegisterMessageHook 注册一个消息处理钩子，按注册顺序调用
+func (node *P2PNode) RegisterMessageHook(hook func(*Message) bool) {
+	if hook == nil {
+		return
+	}
+	node.messageHooksMutex.Lock()
+	node.messageHooks = append(node.messageHooks, hook)
+	node.messageHooksMutex.Unlock()
+}
+
+// runMessageHooks 依次调用钩子，有钩子拦截时返回 false
+func (node *P2PNode) runMessageHooks(msg *Message) bool {
+	node.messageHooksMutex.RLock()
+	hooks := node.messageHooks
+	node.messageHooksMutex.RUnlock()
+	for i, hook := range hooks {
+		if !callMessageHook(i, hook, msg) {
+			Log.Debug("消息被钩子拦截", "from", msg.From, "type", msg.Type, "hook", i)
+			return false
+		}
+	}
+	return true
+}
+
+// callMessageHook 调用单个钩子，panic 时放行
+func callMessageHook(index int, hook func(*Message) bool, msg *Message) (pass bool) {
+	defer func() {
+		if r := recover(); r != nil {
+			Log.Error("消息钩子 panic", "hook", index, "from", msg.From, "type", msg.Type, "panic", fmt.Sprintf("%v", r))
+			pass = true
+		}
+	}()
+	return hook(msg)
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// maxInlineImageSize 内联图片消息的大小上限，超过需按文件发送
+const maxInlineImageSize = 5 << 20
+
+// 可内联发送的图片扩展名及其MIME类型
+var imageContentTypes = map[string]string{
+	".jpg":  "image/jpeg",
+	".jpeg": "image/jpeg",
+	".png":  "image/png",
+	".gif":  "image/gif",
+	".bmp":  "image/bmp",
+	".webp": "image/webp",
+}
+
+// sendImageFile 读取本地图片，以内联图片消息发给 targetName（"all" 为公聊），
+// 不走文件传输确认流程。目标离线时暂存为离线消息。返回图片URL和消息ID
+func (node *P2PNode) sendImageFile(filePath, targetName string) (imageURL, messageID string, err error) {
+	fileName := filepath.Base(filePath)
+	ext := strings.ToLower(filepath.Ext(fileName))
+	contentType, ok := imageContentTypes[ext]
+	if !ok {
+		return "", "", fmt.Errorf("不支持的图片格式: %s", fileName)
+	}
+
+	info, err := os.Stat(filePath)
+	if err != nil {
+		return "", "", fmt.Errorf("读取图片失败: %v", err)
+	}
+	if info.IsDir() {
+		return "", "", fmt.Errorf("不是图片文件: %s", fileName)
+	}
+	if info.Size() > maxInlineImageSize {
+		return "", "", fmt.Errorf("图片文件不能超过5MB")
+	}
+
+	imageData, err := os.ReadFile(filePath)
+	if err != nil {
+		return "", "", fmt.Errorf("读取图片失败: %v", err)
+	}
+	if !strings.HasPrefix(http.DetectContentType(imageData), "image/") {
+		return "", "", fmt.Errorf("文件内容不是有效的图片: %s", fileName)
+	}
+
+	// Save to images directory
+	imageDir := DataPath("images")
+	os.MkdirAll(imageDir, 0755)
+	imageFileName := fmt.Sprintf("%s_%d%s", generateMessageID(), time.Now().Unix(), ext)
+	imagePath := filepath.Join(imageDir, imageFileName)
+	if err := os.WriteFile(imagePath, imageData, 0644); err != nil {
+		return "", "", fmt.Errorf("保存图片失败: %v", err)
+	}
+
+	imageURL = fmt.Sprintf("/images/%s", imageFileName)
+	messageID = generateMessageID()
+
+	imageMsg := Message{
+		Type:        "chat",
+		From:        node.ID,
+		Content:     fmt.Sprintf("发送了图片: %s", fileName),
+		Timestamp:   time.Now(),
+		MessageType: MessageTypeImage,
+		MessageID:   messageID,
+		FileName:    fileName,
+		FileSize:    int64(len(imageData)),
+		FileType:    contentType,
+		FileURL:     imageURL,
+		FileData:    base64.StdEncoding.EncodeToString(imageData),
+	}
+
+	if targetName == "all" {
+		imageMsg.To = "all"
+		node.broadcastImage(imageMsg)
+	} else if peer := node.findPeer(targetName); peer != nil {
+		imageMsg.To = peer.ID
+		node.sendMessageToPeer(peer, imageMsg)
+	} else {
+		// 对方离线：暂存，待其上线后投递
+		if err := node.queueOfflineMessage(targetName, imageMsg); err != nil {
+			return "", "", fmt.Errorf("目标用户不在线")
+		}
+	}
+
+	isPrivate := targetName != "all"
+	node.addChatMessageWithType(
+		node.Name, targetName, imageMsg.Content, true, isPrivate,
+		MessageTypeImage, messageID, "", "", "", fileName, int64(len(imageData)), contentType, imageURL, "", "",
+	)
+	return imageURL, messageID, nil
+}
@@ -0,0 +1,270 @@
+package main
+
+import (
+	"encoding/base64"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// 公聊图片按链接发送（AppConfig.PublicImageByURL）：广播时不再给每个节点各发一份 base64 数据，
+// 支持的接收方（握手时声明 CapImageFetch）只收到发送方的图片URL，再从发送方的 /shared-images/ 拉取；
+// 旧版本节点仍收到完整数据。HTTP 拉取失败时改经P2P连接请求（image_request/image_data），
+// 发送方已离线时保留待拉取记录，在其重新连接后重试
+const remoteImageFetchTimeout = 15 * time.Second
+
+// remoteImage 尚未拉取到本地的图片
+type remoteImage struct {
+	PeerKey    string // 发送方 UserKey
+	RemoteName string // 发送方 images 目录下的文件名
+}
+
+// validImageFileName 只接受 images 目录下的文件名，不允许路径
+func validImageFileName(name string) bool {
+	return name != "" && name == filepath.Base(name) && !strings.HasPrefix(name, ".")
+}
+
+// broadcastImage 广播公聊图片消息；开启按链接发送时，支持拉取的节点只收到图片URL
+func (node *P2PNode) broadcastImage(msg Message) {
+	if node.Config == nil || !node.Config.PublicImageByURL || msg.FileData == "" || !strings.HasPrefix(msg.FileURL, "/images/") {
+		node.broadcastMessage(msg)
+		return
+	}
+	linkOnly := msg
+	linkOnly.FileData = ""
+
+	type imageSend struct {
+		peer *Peer
+		msg  Message
+	}
+	node.PeersMutex.RLock()
+	var sends []imageSend
+	for _, peer := range node.Peers {
+		if !peer.IsActive {
+			continue
+		}
+		if peer.hasCapability(CapImageFetch) {
+			sends = append(sends, imageSend{peer, linkOnly})
+		} else {
+			sends = append(sends, imageSend{peer, msg})
+		}
+	}
+	node.PeersMutex.RUnlock()
+
+	// 在锁外入队，与 broadcastMessage 一致
+	for _, s := range sends {
+		node.queueSend(s.peer, s.msg, nil)
+	}
+}
+
+// sharedImagePath 返回可供其他节点拉取的图片路径：只限自己在公聊中发出的图片
+func (node *P2PNode) sharedImagePath(name string) (string, bool) {
+	if !validImageFileName(name) || node.DB == nil {
+		return "", false
+	}
+	node.flushMessageWrites()
+	var count int
+	err := node.DB.QueryRow(
+		"SELECT COUNT(*) FROM messages WHERE is_own = TRUE AND is_private = FALSE AND file_url = ?",
+		"/images/"+name).Scan(&count)
+	if err != nil || count == 0 {
+		return "", false
+	}
+	path := DataPath("images", name)
+	if _, err := os.Stat(path); err != nil {
+		return "", false
+	}
+	return path, true
+}
+
+// handleSharedImage 供其他节点拉取公聊图片
+func (node *P2PNode) handleSharedImage(w http.ResponseWriter, r *http.Request) {
+	path, ok := node.sharedImagePath(strings.TrimPrefix(r.URL.Path, "/shared-images/"))
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	http.ServeFile(w, r, path)
+}
+
+// receiveImageByURL 为只带链接的公聊图片分配本地文件名并在后台拉取，返回本地图片URL
+func (node *P2PNode) receiveImageByURL(msg Message) string {
+	remoteName := strings.TrimPrefix(msg.FileURL, "/images/")
+	if !strings.HasPrefix(msg.FileURL, "/images/") || !validImageFileName(remoteName) {
+		return ""
+	}
+	node.PeersMutex.RLock()
+	peer, exists := node.Peers[msg.From]
+	node.PeersMutex.RUnlock()
+	if !exists {
+		return ""
+	}
+
+	ext := filepath.Ext(msg.FileName)
+	if ext == "" {
+		ext = ".jpg" // 默认扩展名
+	}
+	localName := fmt.Sprintf("%s_%d%s", generateMessageID(), time.Now().Unix(), ext)
+
+	node.RemoteImagesMutex.Lock()
+	if node.RemoteImages == nil {
+		node.RemoteImages = make(map[string]remoteImage)
+	}
+	node.RemoteImages[localName] = remoteImage{PeerKey: peer.UserKey(), RemoteName: remoteName}
+	node.RemoteImagesMutex.Unlock()
+
+	go node.fetchRemoteImage(peer, localName, remoteName)
+	return "/images/" + localName
+}
+
+// fetchRemoteImage 先从发送方的HTTP服务拉取图片，失败时经P2P连接请求
+func (node *P2PNode) fetchRemoteImage(peer *Peer, localName, remoteName string) {
+	if peer.WebPort > 0 {
+		url := fmt.Sprintf("http://%s:%d/shared-images/%s", peer.IP, peer.WebPort, remoteName)
+		data, err := downloadSharedImage(url)
+		if err == nil {
+			node.saveRemoteImage(localName, data)
+			return
+		}
+		Log.Debug("HTTP拉取图片失败，改经P2P连接请求", "peer", peer.Name, "image", remoteName, "error", err)
+	}
+	// 发送方离线时发送失败，保留记录等待其重新连接（retryRemoteImages）
+	node.sendMessageToPeer(peer, Message{
+		Type:      "image_request",
+		From:      node.ID,
+		To:        peer.ID,
+		Content:   remoteName,
+		Timestamp: time.Now(),
+	})
+}
+
+// downloadSharedImage 下载其他节点的公聊图片并校验
+func downloadSharedImage(url string) ([]byte, error) {
+	client := &http.Client{Timeout: remoteImageFetchTimeout}
+	resp, err := client.Get(url)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("HTTP %d", resp.StatusCode)
+	}
+	data, err := io.ReadAll(io.LimitReader(resp.Body, maxInlineImageSize+1))
+	if err != nil {
+		return nil, err
+	}
+	return data, checkImageData(data)
+}
+
+// checkImageData 校验拉取到的图片大小和内容
+func checkImageData(data []byte) error {
+	if len(data) > maxInlineImageSize {
+		return fmt.Errorf("图片过大")
+	}
+	if !strings.HasPrefix(http.DetectContentType(data), "image/") {
+		return fmt.Errorf("不是有效的图片")
+	}
+	return nil
+}
+
+// saveRemoteImage 保存拉取到的图片，并让前端重新加载消息列表以显示图片
+func (node *P2PNode) saveRemoteImage(localName string, data []byte) {
+	node.RemoteImagesMutex.Lock()
+	entry, pending := node.RemoteImages[localName]
+	delete(node.RemoteImages, localName)
+	node.RemoteImagesMutex.Unlock()
+	if !pending {
+		return
+	}
+
+	imageDir := DataPath("images")
+	os.MkdirAll(imageDir, 0755)
+	if err := os.WriteFile(filepath.Join(imageDir, localName), data, 0644); err != nil {
+		Log.Error("保存拉取的图片失败", "image", localName, "error", err)
+		return
+	}
+	Log.Info("已拉取公聊图片", "peer", entry.PeerKey, "image", entry.RemoteName)
+
+	node.MessagesMutex.Lock()
+	node.MessagesRevision++
+	node.MessagesMutex.Unlock()
+}
+
+// retryRemoteImages 节点重新连接后，重试拉取其尚未拉取成功的图片
+func (node *P2PNode) retryRemoteImages(peerID string) {
+	node.PeersMutex.RLock()
+	peer, exists := node.Peers[peerID]
+	node.PeersMutex.RUnlock()
+	if !exists {
+		return
+	}
+
+	key := peer.UserKey()
+	type pendingFetch struct{ localName, remoteName string }
+	var pending []pendingFetch
+	node.RemoteImagesMutex.Lock()
+	for localName, entry := range node.RemoteImages {
+		if entry.PeerKey == key {
+			pending = append(pending, pendingFetch{localName, entry.RemoteName})
+		}
+	}
+	node.RemoteImagesMutex.Unlock()
+
+	for _, p := range pending {
+		node.fetchRemoteImage(peer, p.localName, p.remoteName)
+	}
+}
+
+// handleImageRequest 对方经P2P连接请求公聊图片（HTTP拉取失败时的回退）
+func (node *P2PNode) handleImageRequest(peer *Peer, name string) {
+	if node.isPeerBlocked(peer) {
+		return
+	}
+	path, ok := node.sharedImagePath(name)
+	if !ok {
+		Log.Debug("忽略无效的图片请求", "peer", peer.Name, "image", name)
+		return
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return
+	}
+	node.sendMessageToPeer(peer, Message{
+		Type:      "image_data",
+		From:      node.ID,
+		To:        peer.ID,
+		Content:   name,
+		Timestamp: time.Now(),
+		FileData:  base64.StdEncoding.EncodeToString(data),
+	})
+}
+
+// handleImageData 收到经P2P连接发来的图片，保存到所有等待该图片的消息
+func (node *P2PNode) handleImageData(peer *Peer, name, fileData string) {
+	data, err := base64.StdEncoding.DecodeString(fileData)
+	if err == nil {
+		err = checkImageData(data)
+	}
+	if err != nil {
+		Log.Warn("收到无效的图片数据", "peer", peer.Name, "image", name, "error", err)
+		return
+	}
+
+	key := peer.UserKey()
+	var localNames []string
+	node.RemoteImagesMutex.Lock()
+	for localName, entry := range node.RemoteImages {
+		if entry.PeerKey == key && entry.RemoteName == name {
+			localNames = append(localNames, localName)
+		}
+	}
+	node.RemoteImagesMutex.Unlock()
+
+	for _, localName := range localNames {
+		node.saveRemoteImage(localName, data)
+	}
+}
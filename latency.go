@@ -0,0 +1,158 @@
+package main
+
+import (
+	"strconv"
+	"sync"
+	"time"
+)
+
+// 连接质量监测参数：RTT 取最近若干次心跳的滑动窗口平均，避免单次抖动
+const (
+	rttWindowSize      = 10                     // 滑动窗口大小（心跳次数）
+	rttPoorThreshold   = 300 * time.Millisecond // 平均RTT超过该值视为网络较差
+	rttFairThreshold   = 100 * time.Millisecond
+	rttPoorLossRate    = 0.3 // 丢包率超过该值视为网络较差
+	rttPoorStreakToLog = 3   // 连续多少次评估为较差时记录日志
+)
+
+// rttSample 一次心跳的结果：收到pong记录RTT，超时未收到记为丢包
+type rttSample struct {
+	rtt  time.Duration
+	lost bool
+}
+
+// peerLatency 记录与单个peer的心跳往返时间与丢包情况
+type peerLatency struct {
+	mu         sync.Mutex
+	seq        uint64
+	pending    map[string]time.Time // ping序号 -> 发送时间
+	samples    []rttSample
+	echoSeen   bool // 对端会回显ping序号（旧版本不回显，无法测量）
+	poorStreak int
+}
+
+// PeerLatencyStats 连接质量统计，供 /peers 接口返回
+type PeerLatencyStats struct {
+	RTT      time.Duration // 滑动窗口平均RTT，无样本时为0
+	LossRate float64       // 窗口内丢包比例 0-1
+	Samples  int
+}
+
+// Quality 将统计结果归类为 good/fair/poor，尚无数据时为 unknown
+func (s PeerLatencyStats) Quality() string {
+	switch {
+	case s.Samples == 0:
+		return "unknown"
+	case s.RTT >= rttPoorThreshold || s.LossRate >= rttPoorLossRate:
+		return "poor"
+	case s.RTT >= rttFairThreshold || s.LossRate > 0:
+		return "fair"
+	}
+	return "good"
+}
+
+// nextPing 生成新的ping序号；上一轮仍未响应的ping计为丢包
+func (l *peerLatency) nextPing(now time.Time) string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.pending == nil {
+		l.pending = make(map[string]time.Time)
+	}
+	for id, sent := range l.pending {
+		if now.Sub(sent) >= heartbeatInterval {
+			delete(l.pending, id)
+			if l.echoSeen {
+				l.addSample(rttSample{lost: true})
+			}
+		}
+	}
+
+	l.seq++
+	id := strconv.FormatUint(l.seq, 10)
+	l.pending[id] = now
+	return id
+}
+
+// recordPong 根据pong回显的序号计算RTT，未知序号返回false
+func (l *peerLatency) recordPong(id string, now time.Time) (time.Duration, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	sent, ok := l.pending[id]
+	if !ok {
+		return 0, false
+	}
+	delete(l.pending, id)
+	l.echoSeen = true
+	rtt := now.Sub(sent)
+	l.addSample(rttSample{rtt: rtt})
+	return rtt, true
+}
+
+// addSample 追加样本并保持窗口大小，调用方需持有锁
+func (l *peerLatency) addSample(s rttSample) {
+	l.samples = append(l.samples, s)
+	if len(l.samples) > rttWindowSize {
+		l.samples = l.samples[len(l.samples)-rttWindowSize:]
+	}
+}
+
+// Stats 返回当前窗口内的平均RTT与丢包率
+func (l *peerLatency) Stats() PeerLatencyStats {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.statsLocked()
+}
+
+func (l *peerLatency) statsLocked() PeerLatencyStats {
+	var total time.Duration
+	var received, lost int
+	for _, s := range l.samples {
+		if s.lost {
+			lost++
+			continue
+		}
+		total += s.rtt
+		received++
+	}
+	stats := PeerLatencyStats{Samples: len(l.samples)}
+	if received > 0 {
+		stats.RTT = total / time.Duration(received)
+	}
+	if stats.Samples > 0 {
+		stats.LossRate = float64(lost) / float64(stats.Samples)
+	}
+	return stats
+}
+
+// updatePoorStreak 更新“网络较差”的连续计数，刚达到阈值时返回true以便只记一次日志
+func (l *peerLatency) updatePoorStreak() (PeerLatencyStats, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	stats := l.statsLocked()
+	if stats.Quality() != "poor" {
+		l.poorStreak = 0
+		return stats, false
+	}
+	l.poorStreak++
+	return stats, l.poorStreak == rttPoorStreakToLog
+}
+
+// newHeartbeatPing 构造带序号的ping，并在连接质量持续较差时记日志提示
+func (node *P2PNode) newHeartbeatPing(peer *Peer) Message {
+	pingID := peer.Latency.nextPing(time.Now())
+	if stats, warn := peer.Latency.updatePoorStreak(); warn {
+		Log.Warn("与节点的网络状况较差", "peer", peer.Name,
+			"rtt", stats.RTT.Round(time.Millisecond), "lossRate", stats.LossRate)
+	}
+	return Message{Type: "ping", From: node.ID, Content: pingID, Timestamp: time.Now()}
+}
+
+// handlePong 按pong回显的ping序号记录RTT（旧版本节点不回显，忽略）
+func (node *P2PNode) handlePong(peer *Peer, pingID string) {
+	if pingID == "" {
+		return
+	}
+	peer.Latency.recordPong(pingID, time.Now())
+}
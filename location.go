@@ -0,0 +1,93 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// maxLocationNameRunes 地点名称的最大长度
+const maxLocationNameRunes = 100
+
+// validLocation 检查经纬度是否在有效范围内
+func validLocation(lat, lon float64) bool {
+	if math.IsNaN(lat) || math.IsNaN(lon) {
+		return false
+	}
+	return lat >= -90 && lat <= 90 && lon >= -180 && lon <= 180
+}
+
+// locationText 位置消息的文字内容，用于命令行显示、会话预览，以及不认识位置消息的旧版本
+func locationText(name string, lat, lon float64) string {
+	if name == "" {
+		return fmt.Sprintf("[位置] %.6f, %.6f", lat, lon)
+	}
+	return fmt.Sprintf("[位置] %s (%.6f, %.6f)", name, lat, lon)
+}
+
+// normalizeLocationName 去掉首尾空白并截断过长的地点名称
+func normalizeLocationName(name string) string {
+	name = strings.TrimSpace(name)
+	if utf8.RuneCountInString(name) > maxLocationNameRunes {
+		name = string([]rune(name)[:maxLocationNameRunes])
+	}
+	return name
+}
+
+// sendLocation 向 targetName（"all" 为公聊）发送位置消息，对方离线时暂存，返回消息ID
+func (node *P2PNode) sendLocation(targetName string, lat, lon float64, name string) (string, error) {
+	if !validLocation(lat, lon) {
+		return "", fmt.Errorf("坐标无效: 纬度应在 -90~90，经度应在 -180~180")
+	}
+	name = normalizeLocationName(name)
+	content := locationText(name, lat, lon)
+	messageID := generateMessageID()
+
+	locationMsg := Message{
+		Type:         "chat",
+		From:         node.ID,
+		Content:      content,
+		Timestamp:    time.Now(),
+		MessageType:  MessageTypeLocation,
+		MessageID:    messageID,
+		Latitude:     lat,
+		Longitude:    lon,
+		LocationName: name,
+	}
+
+	if targetName == "all" {
+		locationMsg.To = "all"
+		node.broadcastMessage(locationMsg)
+	} else if peer := node.findPeer(targetName); peer != nil {
+		locationMsg.To = peer.ID
+		node.sendMessageToPeer(peer, locationMsg)
+	} else if err := node.queueOfflineMessage(targetName, locationMsg); err != nil {
+		return "", fmt.Errorf("目标用户不在线")
+	}
+
+	node.addLocationMessage(node.Name, targetName, true, targetName != "all", messageID, lat, lon, name)
+	return messageID, nil
+}
+
+// addLocationMessage 保存位置消息，文字内容按坐标在本机生成；坐标无效的消息丢弃
+func (node *P2PNode) addLocationMessage(sender, recipient string, isOwn, isPrivate bool, messageID string, lat, lon float64, name string) {
+	if !validLocation(lat, lon) {
+		Log.Warn("忽略坐标无效的位置消息", "sender", sender, "latitude", lat, "longitude", lon)
+		return
+	}
+	name = normalizeLocationName(name)
+	node.recordChatMessage(ChatMessage{
+		Sender:       sender,
+		Recipient:    recipient,
+		Content:      locationText(name, lat, lon),
+		IsOwn:        isOwn,
+		IsPrivate:    isPrivate,
+		MessageType:  MessageTypeLocation,
+		MessageID:    messageID,
+		Latitude:     lat,
+		Longitude:    lon,
+		LocationName: name,
+	})
+}
@@ -1,10 +1,15 @@
 package main
 
 import (
+	"context"
+	"fmt"
+	"io"
 	"log/slog"
 	"os"
 	"path/filepath"
+	"sort"
 	"strings"
+	"sync"
 	"time"
 )
 
@@ -14,26 +19,211 @@ var Log *slog.Logger
 // logLevelVar allows changing the log level at runtime.
 var logLevelVar slog.LevelVar
 
+// Log rotation defaults. A new file is started once the current one exceeds
+// logMaxFileSize; old files are pruned by count and age (see SetLogRetention).
+const (
+	logMaxFileSize     = 10 * 1024 * 1024
+	defaultLogMaxFiles = 20
+	defaultLogMaxDays  = 7
+)
+
+var (
+	logMaxFiles = defaultLogMaxFiles
+	logMaxDays  = defaultLogMaxDays
+)
+
 // InitLogger initializes the global structured logger.
 // level: "error" (default), "info", or "debug".
-// Returns the log file handle (caller should defer Close) and any error.
-func InitLogger(level string) (*os.File, error) {
+// alsoConsole additionally writes log records to stderr (CLI mode); desktop
+// mode logs to file only.
+// Returns the log writer (caller should defer Close) and any error.
+func InitLogger(level string, alsoConsole bool) (io.Closer, error) {
 	setLogLevelVar(level)
 
-	// Log file: ~/.lanshare/logs/lanshare_YYYYMMDD.log
+	// Log files: ~/.lanshare/logs/lanshare_YYYYMMDD_HHMMSS.log
 	logDir := DataPath("logs")
 	if err := os.MkdirAll(logDir, 0755); err != nil {
 		return nil, err
 	}
-	logFile := filepath.Join(logDir, "lanshare_"+time.Now().Format("20060102_150405")+".log")
+	w := &rotatingWriter{dir: logDir}
+	if err := w.rotate(); err != nil {
+		return nil, err
+	}
+	cleanupOldLogs(logDir)
+
+	// Files keep full RFC3339 timestamps; only the console gets the compact form.
+	var handler slog.Handler = slog.NewTextHandler(w, &slog.HandlerOptions{
+		Level: &logLevelVar,
+	})
+	if alsoConsole {
+		handler = teeHandler{handler, slog.NewTextHandler(consoleLogWriter{}, &slog.HandlerOptions{
+			Level:       &logLevelVar,
+			ReplaceAttr: compactLogAttr,
+		})}
+	}
+	Log = slog.New(handler)
+	return w, nil
+}
+
+// teeHandler passes each record to every wrapped handler, so the file and the
+// console can format the same record differently.
+type teeHandler []slog.Handler
+
+func (t teeHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	for _, h := range t {
+		if h.Enabled(ctx, level) {
+			return true
+		}
+	}
+	return false
+}
+
+func (t teeHandler) Handle(ctx context.Context, r slog.Record) error {
+	var firstErr error
+	for _, h := range t {
+		if !h.Enabled(ctx, r.Level) {
+			continue
+		}
+		if err := h.Handle(ctx, r.Clone()); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+func (t teeHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	out := make(teeHandler, len(t))
+	for i, h := range t {
+		out[i] = h.WithAttrs(attrs)
+	}
+	return out
+}
+
+func (t teeHandler) WithGroup(name string) slog.Handler {
+	out := make(teeHandler, len(t))
+	for i, h := range t {
+		out[i] = h.WithGroup(name)
+	}
+	return out
+}
+
+// compactLogAttr shortens the timestamp so lines stay readable on the console.
+func compactLogAttr(groups []string, a slog.Attr) slog.Attr {
+	if a.Key == slog.TimeKey && len(groups) == 0 {
+		a.Value = slog.StringValue(a.Value.Time().Format("01-02 15:04:05.000"))
+	}
+	return a
+}
+
+// consoleLogWriter writes log lines to stderr. When the CLI prompt is showing,
+// the line is printed above it and the prompt is redrawn afterwards (see cliInput).
+type consoleLogWriter struct{}
+
+func (consoleLogWriter) Write(p []byte) (int, error) {
+	return cliConsole.writeAbove(os.Stderr, p)
+}
+
+// SetLogRetention sets how many log files to keep and for how many days.
+// Zero or negative values fall back to the defaults. Call before InitLogger.
+func SetLogRetention(maxFiles, maxDays int) {
+	logMaxFiles = defaultLogMaxFiles
+	if maxFiles > 0 {
+		logMaxFiles = maxFiles
+	}
+	logMaxDays = defaultLogMaxDays
+	if maxDays > 0 {
+		logMaxDays = maxDays
+	}
+}
+
+// rotatingWriter writes to a log file and switches to a new file once it
+// grows beyond logMaxFileSize.
+type rotatingWriter struct {
+	mu   sync.Mutex
+	dir  string
+	file *os.File
+	size int64
+}
+
+func (w *rotatingWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.size+int64(len(p)) > logMaxFileSize {
+		if err := w.rotate(); err != nil {
+			return 0, err
+		}
+		cleanupOldLogs(w.dir)
+	}
+	n, err := w.file.Write(p)
+	w.size += int64(n)
+	return n, err
+}
+
+func (w *rotatingWriter) Close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.file == nil {
+		return nil
+	}
+	err := w.file.Close()
+	w.file = nil
+	return err
+}
+
+// rotate closes the current file and opens a new timestamped one. Caller holds mu
+// (or has exclusive access during construction).
+func (w *rotatingWriter) rotate() error {
+	base := "lanshare_" + time.Now().Format("20060102_150405")
+	path := filepath.Join(w.dir, base+".log")
+	// 同一秒内多次滚动时追加序号，避免写回已满的文件
+	for i := 1; ; i++ {
+		if _, err := os.Stat(path); os.IsNotExist(err) {
+			break
+		}
+		path = filepath.Join(w.dir, fmt.Sprintf("%s_%d.log", base, i))
+	}
 
-	f, err := os.OpenFile(logFile, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
 	if err != nil {
-		return nil, err
+		return err
+	}
+	if w.file != nil {
+		w.file.Close()
 	}
+	w.file = f
+	w.size = 0
+	return nil
+}
 
-	Log = slog.New(slog.NewTextHandler(f, &slog.HandlerOptions{Level: &logLevelVar}))
-	return f, nil
+// cleanupOldLogs deletes log files older than logMaxDays and keeps at most
+// logMaxFiles of the most recent ones.
+func cleanupOldLogs(dir string) {
+	matches, err := filepath.Glob(filepath.Join(dir, "lanshare_*.log"))
+	if err != nil {
+		return
+	}
+	type logFile struct {
+		path    string
+		modTime time.Time
+	}
+	var files []logFile
+	for _, path := range matches {
+		info, err := os.Stat(path)
+		if err != nil {
+			continue
+		}
+		files = append(files, logFile{path: path, modTime: info.ModTime()})
+	}
+	// 最新的在前
+	sort.Slice(files, func(i, j int) bool { return files[i].modTime.After(files[j].modTime) })
+
+	cutoff := time.Now().AddDate(0, 0, -logMaxDays)
+	for i, f := range files {
+		if i >= logMaxFiles || f.modTime.Before(cutoff) {
+			os.Remove(f.path)
+		}
+	}
 }
 
 // SetLogLevel changes the log level at runtime without restarting.
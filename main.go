@@ -1,15 +1,16 @@
 package main
 
 import (
-	"bufio"
 	"crypto/rand"
 	"database/sql"
 	"encoding/hex"
 	"flag"
 	"fmt"
+	"math"
 	"net"
 	"os"
 	"path/filepath"
+	"slices"
 	"strconv"
 	"strings"
 	"sync"
@@ -30,14 +31,45 @@ func generateMessageID() string {
 	return hex.EncodeToString(bytes)
 }
 
+// setListenPort 更新实际监听的端口，同时更新 node.Address。
+// ACL 以 node.Address 为键，启动前已恢复的屏蔽列表随之迁移到新地址下
+func (node *P2PNode) setListenPort(port int) {
+	oldAddress := node.Address
+	node.LocalPort = port
+	node.Address = fmt.Sprintf("%s:%d", node.LocalIP, port)
+	if node.Address == oldAddress {
+		return
+	}
+
+	node.ACLMutex.Lock()
+	if acl, exists := node.ACLs[oldAddress]; exists {
+		merged := node.ACLs[node.Address]
+		if merged == nil {
+			merged = make(map[string]bool)
+		}
+		for key, allowed := range acl {
+			merged[key] = allowed
+		}
+		node.ACLs[node.Address] = merged
+		delete(node.ACLs, oldAddress)
+	}
+	node.ACLMutex.Unlock()
+}
+
 // 创建新的P2P节点
-func NewP2PNode(name string, webEnabled bool, localIP string) *P2PNode {
+func NewP2PNode(name string, webEnabled bool, localIP string, p2pPort, discoveryPort int) *P2PNode {
 	t := time.Now()
 	if localIP == "" {
-		localIP = getLocalIP()
+		localIP = getLocalIP("")
 	}
-	nodeID := fmt.Sprintf("%s_%d", localIP, time.Now().Unix())
-	address := fmt.Sprintf("%s:%d", localIP, 8888)
+	// 附加随机后缀：同一主机同一秒启动的多个实例也不会得到相同的nodeID
+	nodeID := fmt.Sprintf("%s_%d_%s", localIP, time.Now().Unix(), generateMessageID()[:8])
+	if p2pPort != validPortOr(p2pPort, defaultP2PPort) || discoveryPort != validPortOr(discoveryPort, defaultDiscoveryPort) {
+		Log.Warn("配置的端口无效，使用默认端口", "p2pPort", p2pPort, "discoveryPort", discoveryPort)
+	}
+	p2pPort = validPortOr(p2pPort, defaultP2PPort)
+	discoveryPort = validPortOr(discoveryPort, defaultDiscoveryPort)
+	address := fmt.Sprintf("%s:%d", localIP, p2pPort)
 
 	// Generate node-level ECDH key pair (persistent for node lifetime)
 	tStep := time.Now()
@@ -49,7 +81,7 @@ func NewP2PNode(name string, webEnabled bool, localIP string) *P2PNode {
 
 	node := &P2PNode{
 		LocalIP:        localIP,
-		LocalPort:      8888,
+		LocalPort:      p2pPort,
 		Name:           name,
 		ID:             nodeID,
 		Address:        address,
@@ -58,26 +90,27 @@ func NewP2PNode(name string, webEnabled bool, localIP string) *P2PNode {
 		Peers:          make(map[string]*Peer),
 		MessageChan:    make(chan Message, 100),
 		StopCh:         make(chan struct{}),
-		Running:        false,
-		DiscoveryPort:  9999,
+		DiscoveryPort:  discoveryPort,
 		WebPort:        8080,
 		Messages:       make([]ChatMessage, 0),
 		WebEnabled:     webEnabled,
 		FileTransfers:  make(map[string]*FileTransferStatus),
 		ACLs:           make(map[string]map[string]bool),
 		ACLMutex:       sync.RWMutex{},
+		APIToken:       generateMessageID(),
 	}
 
 	// 初始化数据库
 	dbPath := DataPath("message.db")
 	tStep = time.Now()
-	db, err := sql.Open("sqlite", dbPath)
+	db, corruptBackup, err := openMessageDB(dbPath)
 	if err != nil {
 		Log.Error("打开数据库失败", "error", err, "path", dbPath)
 		node.DB = nil
 		return node
 	}
 	node.DB = db
+	node.DBCorruptBackup = corruptBackup
 	Log.Debug("sql.Open 完成", "耗时", time.Since(tStep), "path", dbPath)
 
 	tStep = time.Now()
@@ -115,8 +148,39 @@ func NewP2PNode(name string, webEnabled bool, localIP string) *P2PNode {
 	}
 	Log.Debug("CREATE TABLE 完成", "耗时", time.Since(tStep))
 
+	node.MessageWriter = newMessageWriter(db)
+
+	if err := initOfflineMessageTable(db); err != nil {
+		Log.Error("创建离线消息表失败", "error", err)
+	}
+	if err := initDraftTable(db); err != nil {
+		Log.Error("创建草稿表失败", "error", err)
+	}
+	if err := initChatStateTable(db); err != nil {
+		Log.Error("创建会话状态表失败", "error", err)
+	}
+	if err := initPresenceTable(db); err != nil {
+		Log.Error("创建在线时长统计表失败", "error", err)
+	}
+	if err := initPinnedMessagesTable(db); err != nil {
+		Log.Error("创建置顶消息表失败", "error", err)
+	}
+
 	// Migration: add file_id column (fails silently if already exists)
 	db.Exec("ALTER TABLE messages ADD COLUMN file_id TEXT DEFAULT ''")
+	// Migration: add peer_uuid column — 会话对方的持久标识，用于历史归属
+	db.Exec("ALTER TABLE messages ADD COLUMN peer_uuid TEXT DEFAULT ''")
+	db.Exec("CREATE INDEX IF NOT EXISTS idx_peer_uuid ON messages(peer_uuid)")
+	// Migration: add forwarded_from column — 转发消息的原发送者
+	db.Exec("ALTER TABLE messages ADD COLUMN forwarded_from TEXT DEFAULT ''")
+	// Migration: add location columns — 位置消息的坐标与名称
+	db.Exec("ALTER TABLE messages ADD COLUMN latitude REAL DEFAULT 0")
+	db.Exec("ALTER TABLE messages ADD COLUMN longitude REAL DEFAULT 0")
+	db.Exec("ALTER TABLE messages ADD COLUMN location_name TEXT DEFAULT ''")
+	// Migration: add content_format column — 文字消息格式（plain/markdown）
+	db.Exec("ALTER TABLE messages ADD COLUMN content_format TEXT DEFAULT ''")
+	// Migration: add display_name column — 发送者的临时显示名
+	db.Exec("ALTER TABLE messages ADD COLUMN display_name TEXT DEFAULT ''")
 
 	// 清理旧消息（保留30天）
 	tStep = time.Now()
@@ -127,6 +191,7 @@ func NewP2PNode(name string, webEnabled bool, localIP string) *P2PNode {
 		deleted, _ := result.RowsAffected()
 		Log.Debug("清理旧消息完成", "耗时", time.Since(tStep), "deleted", deleted)
 	}
+	node.cleanupOfflineMessages()
 
 	// Now load history with proper key
 	tStep = time.Now()
@@ -148,91 +213,207 @@ func NewP2PNode(name string, webEnabled bool, localIP string) *P2PNode {
 func (node *P2PNode) clearHistoryIfDisabled() {
 	if node.Config != nil && !node.Config.IsSaveHistory() && node.DB != nil {
 		node.DB.Exec("DELETE FROM messages")
+		node.DB.Exec("DELETE FROM drafts")
+		node.DB.Exec("DELETE FROM chat_state")
 		node.Messages = node.Messages[:0]
 		Log.Info("启动时清空聊天记录（保存聊天记录已关闭）")
 	}
 }
 
 // ACL 方法实现
-func (node *P2PNode) isBlocked(targetAddress string) bool {
+// 屏蔽项以用户稳定标识（UUID，旧版本节点回退为用户名）为 key；
+// 旧配置中以 IP:port 保存的屏蔽项在对应peer连接时迁移（见 isPeerBlocked）。
+func (node *P2PNode) isBlocked(userKey string) bool {
 	node.ACLMutex.RLock()
 	defer node.ACLMutex.RUnlock()
 	if acl, exists := node.ACLs[node.Address]; exists {
-		if val, ok := acl[targetAddress]; ok {
+		if val, ok := acl[userKey]; ok {
 			return !val
 		}
 	}
 	return false
 }
 
-func (node *P2PNode) blockUser(targetAddress string) {
+// isPeerBlocked 判断peer是否被屏蔽，命中旧版 IP:port 屏蔽项时迁移为该peer的稳定标识
+func (node *P2PNode) isPeerBlocked(peer *Peer) bool {
+	key := peer.UserKey()
+	if node.isBlocked(key) {
+		return true
+	}
+	if peer.Address == "" || !node.isBlocked(peer.Address) {
+		return false
+	}
 	node.ACLMutex.Lock()
-	defer node.ACLMutex.Unlock()
-	if node.ACLs[node.Address] == nil {
-		node.ACLs[node.Address] = make(map[string]bool)
+	acl := node.ACLs[node.Address]
+	delete(acl, peer.Address)
+	acl[key] = false
+	node.ACLMutex.Unlock()
+	Log.Info("已迁移旧版屏蔽项", "address", peer.Address, "key", key, "peer", peer.Name)
+	return true
+}
+
+// isDiscoveryBlocked 判断发现消息的来源是否被屏蔽（被屏蔽节点不触发连接）
+func (node *P2PNode) isDiscoveryBlocked(msg DiscoveryMessage) bool {
+	if msg.UUID != "" && node.isBlocked(msg.UUID) {
+		return true
+	}
+	if msg.UUID == "" && node.isBlocked(msg.Name) {
+		return true
 	}
-	node.ACLs[node.Address][targetAddress] = false
-	// 查找用户名显示
-	displayName := targetAddress
+	return node.isBlocked(fmt.Sprintf("%s:%d", msg.IP, msg.Port))
+}
+
+// nameForUserKey 返回稳定标识对应的显示名称：优先在线peer，其次历史记录
+func (node *P2PNode) nameForUserKey(userKey string) string {
 	node.PeersMutex.RLock()
 	for _, peer := range node.Peers {
-		if peer.Address == targetAddress {
-			displayName = peer.Name
-			break
+		if peer.UserKey() == userKey || peer.Address == userKey {
+			node.PeersMutex.RUnlock()
+			return peer.Name
 		}
 	}
 	node.PeersMutex.RUnlock()
-	fmt.Printf("已屏蔽用户 %s (%s)\n", displayName, targetAddress)
+
+	if node.DB != nil {
+		node.flushMessageWrites()
+		var name string
+		node.DB.QueryRow(`SELECT CASE WHEN is_own = 0 THEN sender ELSE recipient END FROM messages
+			WHERE peer_uuid = ? ORDER BY timestamp DESC LIMIT 1`, userKey).Scan(&name)
+		if name != "" {
+			return name
+		}
+	}
+	return userKey
 }
 
-func (node *P2PNode) unblockUser(targetAddress string) {
+func (node *P2PNode) blockUser(userKey string) {
 	node.ACLMutex.Lock()
-	defer node.ACLMutex.Unlock()
 	if node.ACLs[node.Address] == nil {
 		node.ACLs[node.Address] = make(map[string]bool)
 	}
-	node.ACLs[node.Address][targetAddress] = true
-	// 查找用户名显示
-	displayName := targetAddress
+	node.ACLs[node.Address][userKey] = false
+	node.ACLMutex.Unlock()
+
+	displayName := node.nameForUserKey(userKey)
+	fmt.Printf("已屏蔽用户 %s (%s)\n", displayName, userKey)
+	Log.Info("已屏蔽用户", "name", displayName, "key", userKey)
+
+	// 双向生效：断开已连接的被屏蔽节点
+	node.disconnectBlockedPeers(userKey)
+}
+
+// disconnectBlockedPeers 断开与指定用户的连接，handlePeerConnection 负责标记离线和清理
+func (node *P2PNode) disconnectBlockedPeers(userKey string) {
+	var blocked []*Peer
 	node.PeersMutex.RLock()
 	for _, peer := range node.Peers {
-		if peer.Address == targetAddress {
-			displayName = peer.Name
-			break
+		if peer.IsActive && peer.UserKey() == userKey {
+			blocked = append(blocked, peer)
 		}
 	}
 	node.PeersMutex.RUnlock()
-	fmt.Printf("已解除屏蔽用户 %s (%s)\n", displayName, targetAddress)
+
+	for _, peer := range blocked {
+		Log.Info("断开被屏蔽节点", "peer", peer.Name)
+		peer.IsActive = false
+		peer.Conn.Close()
+	}
 }
 
-func (node *P2PNode) showACL() {
+func (node *P2PNode) unblockUser(userKey string) {
+	node.ACLMutex.Lock()
+	if node.ACLs[node.Address] == nil {
+		node.ACLs[node.Address] = make(map[string]bool)
+	}
+	// 删除屏蔽项而非置为 true，避免配置中残留无用条目
+	delete(node.ACLs[node.Address], userKey)
+	node.ACLMutex.Unlock()
+
+	displayName := node.nameForUserKey(userKey)
+	fmt.Printf("已解除屏蔽用户 %s (%s)\n", displayName, userKey)
+	Log.Info("已解除屏蔽用户", "name", displayName, "key", userKey)
+
+	// 立即广播一次，让对方尽快重新建立连接
+	go node.sendDiscoveryBroadcast("announce")
+}
+
+// blockedUserKeys 返回当前所有被屏蔽的用户标识
+func (node *P2PNode) blockedUserKeys() []string {
 	node.ACLMutex.RLock()
 	defer node.ACLMutex.RUnlock()
-	
-	fmt.Println("屏蔽列表:")
+	var blocked []string
 	if acl, exists := node.ACLs[node.Address]; exists {
-		blocked := 0
-		for addr, allowed := range acl {
+		for key, allowed := range acl {
 			if !allowed {
-				// 查找用户名
-				displayName := addr
-				node.PeersMutex.RLock()
-				for _, peer := range node.Peers {
-					if peer.Address == addr {
-						displayName = peer.Name
-						break
-					}
-				}
-				node.PeersMutex.RUnlock()
-				fmt.Printf(" - %s (%s)\n", displayName, addr)
-				blocked++
+				blocked = append(blocked, key)
 			}
 		}
-		if blocked == 0 {
-			fmt.Println("  无屏蔽用户")
+	}
+	return blocked
+}
+
+// resolveUserKey 将用户名或节点ID解析为稳定标识；不在线时从历史记录按用户名查找
+func (node *P2PNode) resolveUserKey(target string) string {
+	node.PeersMutex.RLock()
+	peer, exists := node.Peers[target]
+	node.PeersMutex.RUnlock()
+	if exists {
+		return peer.UserKey()
+	}
+	return node.lookupUserKey(target)
+}
+
+// blockedUserKeyFor 解除屏蔽时查找目标对应的屏蔽项：被屏蔽的用户处于断开状态，
+// 先按屏蔽列表中的标识和显示名称匹配
+func (node *P2PNode) blockedUserKeyFor(target string) string {
+	for _, key := range node.blockedUserKeys() {
+		if key == target || node.nameForUserKey(key) == target {
+			return key
 		}
-	} else {
+	}
+	return node.resolveUserKey(target)
+}
+
+// saveBlockedUsers 将当前屏蔽列表写入配置文件
+func (node *P2PNode) saveBlockedUsers() {
+	if node.Config == nil {
+		return
+	}
+	blocked := node.blockedUserKeys()
+	node.ConfigMutex.Lock()
+	node.Config.BlockedUsers = blocked
+	node.ConfigMutex.Unlock()
+	node.saveConfig()
+}
+
+// changeName 修改本机用户名，立即保存到配置并广播名称更新消息
+func (node *P2PNode) changeName(name string) {
+	node.Name = name
+	if node.Config != nil {
+		node.ConfigMutex.Lock()
+		node.Config.Name = name
+		node.ConfigMutex.Unlock()
+		node.saveConfig()
+	}
+
+	updateMsg := Message{
+		Type:    "update_name",
+		From:    node.ID,
+		To:      "all",
+		Content: name,
+	}
+	node.broadcastMessage(updateMsg)
+}
+
+func (node *P2PNode) showACL() {
+	fmt.Println("屏蔽列表:")
+	blocked := node.blockedUserKeys()
+	if len(blocked) == 0 {
 		fmt.Println("  无屏蔽用户")
+		return
+	}
+	for _, key := range blocked {
+		fmt.Printf(" - %s (%s)\n", node.nameForUserKey(key), key)
 	}
 }
 
@@ -265,7 +446,7 @@ func (node *P2PNode) Start() error {
 			addr := fmt.Sprintf("%s:%d", node.LocalIP, tryPort)
 			listener, err = net.Listen("tcp", addr)
 			if err == nil {
-				node.LocalPort = tryPort
+				node.setListenPort(tryPort)
 				Log.Debug("TCP使用备用端口", "originalPort", basePort, "actualPort", tryPort)
 				break
 			}
@@ -277,7 +458,8 @@ func (node *P2PNode) Start() error {
 		return fmt.Errorf("启动TCP监听失败: %v", err)
 	}
 	node.Listener = listener
-	node.Running = true
+	node.Running.Store(true)
+	node.writeAPITokenFile()
 
 	Log.Info("P2P节点启动", "ip", node.LocalIP, "port", node.LocalPort, "name", node.Name, "version", AppVersion)
 
@@ -287,10 +469,18 @@ func (node *P2PNode) Start() error {
 		node.startWebGUI()
 	}
 	go node.startDiscovery()
-	go node.startMDNSDiscovery()
+	if node.Config == nil || node.Config.IsMDNSEnabled() {
+		go node.startMDNSDiscovery()
+	}
 	go node.handleMessages()
 	go node.acceptConnections()
 	go node.periodicBroadcast()
+	go node.startHeartbeat()
+	go node.startPeerSweeper()
+	go node.watchFileTransfers()
+
+	// 节点启动成功，确认本次更新可用（否则下次启动将回滚）
+	markStartupSuccess()
 
 	Log.Debug("node.Start() 所有goroutine已启动")
 	return nil
@@ -305,6 +495,7 @@ func (node *P2PNode) showCommandHelp() {
 	fmt.Println("  直接输入消息 - 公聊")
 	fmt.Println("  /to <用户名> <消息> - 私聊")
 	fmt.Println("  /send <用户名> <文件路径> - 发送文件")
+	fmt.Println("  /img <用户名|all> <图片路径> - 发送图片 (对方直接显示，无需确认)")
 	fmt.Println("  /accept <文件ID> - 接受文件")
 	fmt.Println("  /reject <文件ID> - 拒绝文件")
 	fmt.Println("  /transfers - 查看文件传输列表")
@@ -316,9 +507,13 @@ func (node *P2PNode) showCommandHelp() {
 	fmt.Println("  /block <用户名> - 屏蔽用户")
 	fmt.Println("  /unblock <用户名> - 解除屏蔽")
 	fmt.Println("  /acl - 查看屏蔽列表")
+	fmt.Println("  /mute <用户名|all> - 会话免打扰 (all 为公聊，无参数查看列表)")
+	fmt.Println("  /unmute <用户名|all> - 取消会话免打扰")
 	fmt.Println("  /connect <IP:端口> - 手动连接到指定节点")
-	fmt.Println("  /history [用户名] [数量] - 查看历史消息 (默认20条)")
+	fmt.Println("  /history [用户名] [数量] [游标] - 查看历史消息 (默认20条，可用配置 initialHistoryLimit 修改；游标用于翻页)")
+	fmt.Println("  /clear [用户名|all] - 清空会话记录 (默认公聊)")
 	fmt.Println("  /update - 从局域网获取最新版本")
+	fmt.Println("  /update confirm - 确认跨渠道更新（稳定版 ↔ 测试版）")
 	fmt.Println("  /version - 显示版本信息")
 	fmt.Println("  /help - 显示帮助信息")
 	fmt.Println("  /quit - 退出程序")
@@ -332,34 +527,32 @@ func (node *P2PNode) startCLI() {
 	fmt.Println("===========================================")
 	node.showCommandHelp()
 
-	scanner := bufio.NewScanner(os.Stdin)
+	quitConfirm := false // 有进行中的传输时需再次输入 /quit 确认
 	for {
-		fmt.Print("> ")
-		if !scanner.Scan() {
+		line, ok := cliConsole.readLine()
+		if !ok {
 			break
 		}
 
-		text := strings.TrimSpace(scanner.Text())
+		text := strings.TrimSpace(line)
 		if text == "" {
 			continue
 		}
 
 		if strings.HasPrefix(text, "/") {
 			if text == "/quit" {
+				if n := node.activeTransferCount(); n > 0 && !quitConfirm {
+					fmt.Printf("还有 %d 个文件正在传输，退出将中断传输。再次输入 /quit 确认退出\n", n)
+					quitConfirm = true
+					continue
+				}
 				break
 			}
+			quitConfirm = false
 			node.handleCommand(text)
 		} else {
 			// 公聊消息
-			msg := Message{
-				Type:      "chat",
-				From:      node.ID,
-				To:        "all",
-				Content:   text,
-				Timestamp: time.Now(),
-			}
-			node.broadcastMessage(msg)
-			node.addChatMessage("我", "all", text, true, false)
+			node.sendPublicText(text, "")
 		}
 	}
 
@@ -383,42 +576,14 @@ func (node *P2PNode) handleCommand(command string) {
 		targetName := parts[1]
 		message := strings.Join(parts[2:], " ")
 		
-		// 查找目标用户
-		var targetID, targetAddress string
-		node.PeersMutex.RLock()
-		for id, peer := range node.Peers {
-			if peer.Name == targetName && peer.IsActive {
-				targetID = id
-				targetAddress = peer.Address
-				break
+		if _, err := node.sendPrivateText(targetName, message, ""); err != nil {
+			fmt.Printf("发送给 '%s' 失败: %v\n", targetName, err)
+			if err == errPrivateTargetBlocked {
+				fmt.Println("提示: 使用 /unblock 命令解除屏蔽")
+			} else {
+				fmt.Println("提示: 使用 /list 命令查看在线用户")
 			}
 		}
-		node.PeersMutex.RUnlock()
-		
-		if targetID == "" {
-			fmt.Printf("错误: 用户 '%s' 不在线或不存在\n", targetName)
-			fmt.Println("提示: 使用 /list 命令查看在线用户")
-			return
-		}
-
-		if node.isBlocked(targetAddress) {
-			fmt.Printf("错误: 用户 '%s' 被屏蔽，无法发送私聊\n", targetName)
-			fmt.Println("提示: 使用 /unblock 命令解除屏蔽")
-			return
-		}
-		
-		msg := Message{
-			Type:      "chat",
-			From:      node.ID,
-			To:        targetID,
-			Content:   message,
-			Timestamp: time.Now(),
-		}
-		
-		if peer, exists := node.Peers[targetID]; exists {
-			node.sendMessageToPeer(peer, msg)
-			node.addChatMessage(node.Name, targetName, message, true, true)
-		}
 		
 	case "/list":
 		fmt.Println("在线用户:")
@@ -427,7 +592,7 @@ func (node *P2PNode) handleCommand(command string) {
 		node.PeersMutex.RLock()
 		for _, peer := range node.Peers {
 			if peer.IsActive {
-				blocked := node.isBlocked(peer.Address)
+				blocked := node.isPeerBlocked(peer)
 				status := ""
 				if blocked {
 					status = " (屏蔽)"
@@ -443,23 +608,8 @@ func (node *P2PNode) handleCommand(command string) {
 			return
 		}
 		oldName := node.Name
-		node.Name = parts[1]
+		node.changeName(parts[1])
 		fmt.Printf("用户名已从 %s 更改为 %s\n", oldName, node.Name)
-
-		// Save to config immediately
-		if node.Config != nil {
-			node.Config.Name = node.Name
-			SaveConfig(node.Config)
-		}
-
-		// 广播名称更新消息
-		updateMsg := Message{
-			Type:    "update_name",
-			From:    node.ID,
-			To:      "all",
-			Content: node.Name,
-		}
-		node.broadcastMessage(updateMsg)
 		
 	case "/web":
 		if !node.WebEnabled {
@@ -492,50 +642,45 @@ func (node *P2PNode) handleCommand(command string) {
 			return
 		}
 		targetName := parts[1]
-		// 查找目标地址
-		var targetAddress string
-		node.PeersMutex.RLock()
-		for _, peer := range node.Peers {
-			if peer.Name == targetName && peer.IsActive {
-				targetAddress = peer.Address
-				break
-			}
-		}
-		node.PeersMutex.RUnlock()
-		
-		if targetAddress == "" {
-			fmt.Printf("用户 %s 不在线，无法屏蔽\n", targetName)
-			return
-		}
-		node.blockUser(targetAddress)
+		// 按稳定标识屏蔽（不在线时从历史记录查找）
+		node.blockUser(node.resolveUserKey(targetName))
+		node.saveBlockedUsers()
 		
 	case "/unblock":
 		if len(parts) < 2 {
 			fmt.Println("用法: /unblock <用户名>")
 			return
 		}
-		targetName := parts[1]
-		// 查找目标地址
-		var targetAddress string
-		node.PeersMutex.RLock()
-		for _, peer := range node.Peers {
-			if peer.Name == targetName && peer.IsActive {
-				targetAddress = peer.Address
-				break
+		node.unblockUser(node.blockedUserKeyFor(parts[1]))
+		node.saveBlockedUsers()
+		
+	case "/acl":
+		node.showACL()
+
+	case "/mute", "/unmute":
+		if len(parts) < 2 {
+			if parts[0] == "/unmute" {
+				fmt.Println("用法: /unmute <用户名|all>")
+				return
 			}
+			muted := node.mutedChats()
+			if len(muted) == 0 {
+				fmt.Println("免打扰列表为空，用法: /mute <用户名|all>")
+				return
+			}
+			fmt.Printf("免打扰会话: %s\n", strings.Join(muted, ", "))
+			return
 		}
-		node.PeersMutex.RUnlock()
-		
-		if targetAddress == "" {
-			fmt.Printf("用户 %s 不在线，但仍可解除屏蔽\n", targetName)
-			// 尝试直接用用户名作为地址（向后兼容，但不推荐）
-			node.unblockUser(targetName)
+		chatID := strings.Join(parts[1:], " ")
+		if err := node.setChatMuted(chatID, parts[0] == "/mute"); err != nil {
+			fmt.Printf("设置免打扰失败: %v\n", err)
 			return
 		}
-		node.unblockUser(targetAddress)
-		
-	case "/acl":
-		node.showACL()
+		if parts[0] == "/mute" {
+			fmt.Printf("已开启免打扰: %s\n", chatID)
+		} else {
+			fmt.Printf("已取消免打扰: %s\n", chatID)
+		}
 		
 	case "/send":
 		if len(parts) < 3 {
@@ -546,16 +691,11 @@ func (node *P2PNode) handleCommand(command string) {
 		filePath := strings.Join(parts[2:], " ")
 		
 		// 查找目标用户
-		var targetID, targetAddress string
-		node.PeersMutex.RLock()
-		for id, peer := range node.Peers {
-			if peer.Name == targetName && peer.IsActive {
-				targetID = id
-				targetAddress = peer.Address
-				break
-			}
+		var targetID string
+		targetPeer := node.findPeer(targetName)
+		if targetPeer != nil {
+			targetID = targetPeer.ID
 		}
-		node.PeersMutex.RUnlock()
 		
 		if targetID == "" {
 			fmt.Printf("错误: 用户 '%s' 不在线或不存在\n", targetName)
@@ -563,13 +703,41 @@ func (node *P2PNode) handleCommand(command string) {
 			return
 		}
 
-		if node.isBlocked(targetAddress) {
+		if node.isPeerBlocked(targetPeer) {
 			fmt.Printf("错误: 用户 '%s' 被屏蔽，无法发送文件\n", targetName)
 			fmt.Println("提示: 使用 /unblock 命令解除屏蔽")
 			return
 		}
 		node.sendFileTransferRequest(filePath, targetName)
-		
+
+	case "/img":
+		if len(parts) < 3 {
+			fmt.Println("用法: /img <用户名|all> <图片路径>")
+			return
+		}
+		targetName := parts[1]
+		filePath := strings.Join(parts[2:], " ")
+
+		if targetName != "all" {
+			targetPeer := node.findPeer(targetName)
+			if targetPeer == nil {
+				fmt.Printf("错误: 用户 '%s' 不在线或不存在\n", targetName)
+				fmt.Println("提示: 使用 /list 命令查看在线用户")
+				return
+			}
+			if node.isPeerBlocked(targetPeer) {
+				fmt.Printf("错误: 用户 '%s' 被屏蔽，无法发送图片\n", targetName)
+				fmt.Println("提示: 使用 /unblock 命令解除屏蔽")
+				return
+			}
+			targetName = targetPeer.Name
+		}
+		if _, _, err := node.sendImageFile(filePath, targetName); err != nil {
+			fmt.Printf("发送图片失败: %v\n", err)
+			return
+		}
+		fmt.Printf("图片已发送给 %s: %s\n", targetName, filepath.Base(filePath))
+
 	case "/transfers":
 		node.showFileTransfers()
 
@@ -578,14 +746,14 @@ func (node *P2PNode) handleCommand(command string) {
 			fmt.Println("用法: /accept <文件ID>")
 			return
 		}
-		node.respondToFileTransfer(parts[1], true)
+		node.respondToFileTransfer(parts[1], true, "")
 
 	case "/reject":
 		if len(parts) < 2 {
 			fmt.Println("用法: /reject <文件ID>")
 			return
 		}
-		node.respondToFileTransfer(parts[1], false)
+		node.respondToFileTransfer(parts[1], false, "")
 		
 	case "/webstatus":
 		if node.WebEnabled {
@@ -596,7 +764,7 @@ func (node *P2PNode) handleCommand(command string) {
 		}
 		
 	case "/update":
-		node.performUpdate()
+		node.performUpdate(len(parts) > 1 && parts[1] == "confirm")
 
 	case "/version":
 		channelLabel := "稳定版"
@@ -608,9 +776,26 @@ func (node *P2PNode) handleCommand(command string) {
 	case "/help":
 		node.showCommandHelp()
 
+	case "/clear":
+		chatID := "all"
+		label := "公聊"
+		if len(parts) > 1 && parts[1] != "all" {
+			chatID = strings.Join(parts[1:], " ")
+			label = "与 " + chatID + " 的私聊"
+		}
+		fmt.Printf("确认清空%s的全部聊天记录？此操作不可恢复 (y/N)\n", label)
+		answer, ok := cliConsole.readLine()
+		if !ok || !strings.EqualFold(strings.TrimSpace(answer), "y") {
+			fmt.Println("已取消")
+			return
+		}
+		removed := node.deleteChatHistory(chatID, time.Time{}, time.Time{})
+		fmt.Printf("已清空%s的聊天记录 (%d 条)\n", label, removed)
+
 	case "/history":
 		chatId := "all"
-		limit := 20
+		limit := node.initialHistoryLimit()
+		var beforeID int64
 		if len(parts) > 1 {
 			chatId = parts[1]
 		}
@@ -619,96 +804,49 @@ func (node *P2PNode) handleCommand(command string) {
 				limit = l
 			}
 		}
-
-		if node.DB == nil {
-			fmt.Println("数据库未初始化")
-			return
-		}
-
-		var rows *sql.Rows
-		var err error
-
-		if chatId == "all" {
-			rows, err = node.DB.Query(`
-				SELECT sender, recipient, content, nonce, is_private, is_own, timestamp,
-					   message_type, message_id, reply_to_id, reply_to_content, reply_to_sender,
-					   file_name, file_size, file_type
-				FROM messages
-				WHERE recipient = 'all' AND is_private = FALSE
-				ORDER BY timestamp DESC
-				LIMIT ?
-			`, limit)
-		} else {
-			rows, err = node.DB.Query(`
-				SELECT sender, recipient, content, nonce, is_private, is_own, timestamp,
-					   message_type, message_id, reply_to_id, reply_to_content, reply_to_sender,
-					   file_name, file_size, file_type
-				FROM messages
-				WHERE is_private = TRUE AND (
-					(sender = ? AND recipient = ?) OR
-					(sender = ? AND recipient = ?)
-				)
-				ORDER BY timestamp DESC
-				LIMIT ?
-			`, node.Name, chatId, chatId, node.Name, limit)
+		if len(parts) > 3 {
+			if b, err := strconv.ParseInt(parts[3], 10, 64); err == nil && b > 0 {
+				beforeID = b
+			}
 		}
 
+		msgs, nextBeforeID, err := node.queryHistoryPage(chatId, beforeID, limit)
 		if err != nil {
 			fmt.Printf("查询历史消息失败: %v\n", err)
 			return
 		}
-		defer rows.Close()
-
-		fmt.Printf("历史消息 (%s, 最近 %d 条):\n", chatId, limit)
-		count := 0
-		for rows.Next() {
-			var sender, recipient string
-			var content, nonce []byte
-			var isPrivate, isOwn bool
-			var timestamp time.Time
-			var messageType, messageID, replyToID, replyToContent, replyToSender, fileName, fileType string
-			var fileSize int64
-
-			err = rows.Scan(&sender, &recipient, &content, &nonce, &isPrivate, &isOwn, &timestamp,
-				&messageType, &messageID, &replyToID, &replyToContent, &replyToSender,
-				&fileName, &fileSize, &fileType)
-			if err != nil {
-				continue
-			}
-
-			// 解密
-			plaintext, err := decryptMessage(node.LocalDBKey, content, nonce)
-			if err != nil {
-				fmt.Printf("解密消息失败: %v\n", err)
-				continue
-			}
 
-			displayContent := string(plaintext)
+		fmt.Printf("历史消息 (%s, %d 条):\n", chatId, len(msgs))
+		now := time.Now()
+		for _, m := range msgs {
+			displayContent := m.Content
 			if strings.HasPrefix(displayContent, "emoji:") {
 				displayContent = "[表情]"
-			} else if messageType == "image" && fileName != "" {
-				displayContent = fmt.Sprintf("[图片: %s]", fileName)
-			} else if messageType == "file" && fileName != "" {
-				displayContent = fmt.Sprintf("[文件: %s (%s)]", fileName, formatFileSize(fileSize))
-			} else if messageType == "reply" && replyToSender != "" {
-				displayContent = fmt.Sprintf("[回复 %s]: %s", replyToSender, displayContent)
+			} else if m.MessageType == "image" && m.FileName != "" {
+				displayContent = fmt.Sprintf("[图片: %s]", m.FileName)
+			} else if m.MessageType == "file" && m.FileName != "" {
+				displayContent = fmt.Sprintf("[文件: %s (%s)]", m.FileName, formatFileSize(m.FileSize))
+			} else if m.MessageType == "reply" && m.ReplyToSender != "" {
+				displayContent = fmt.Sprintf("[回复 %s]: %s", m.ReplyToSender, displayContent)
 			}
 
 			prefix := ""
-			if isPrivate {
+			if m.IsPrivate {
 				prefix = "(私聊) "
 			}
-			if isOwn {
-				fmt.Printf("[%s] 我 %s%s: %s\n", timestamp.Format("15:04:05"), prefix, recipient, displayContent)
+			if m.IsOwn {
+				fmt.Printf("[%s] 我 %s%s: %s\n", formatMessageTime(m.Timestamp, now), prefix, m.Recipient, displayContent)
 			} else {
-				fmt.Printf("[%s] %s %s: %s\n", timestamp.Format("15:04:05"), sender, prefix, displayContent)
+				fmt.Printf("[%s] %s %s: %s\n", formatMessageTime(m.Timestamp, now), m.Sender, prefix, displayContent)
 			}
-			count++
 		}
-		if count == 0 {
+		if len(msgs) == 0 {
 			fmt.Println("无历史消息")
 		}
-		
+		if nextBeforeID > 0 {
+			fmt.Printf("查看更早的消息: /history %s %d %d\n", chatId, limit, nextBeforeID)
+		}
+
 	case "/connect":
 		if len(parts) < 2 {
 			fmt.Println("用法: /connect <IP:端口>")
@@ -727,6 +865,7 @@ func (node *P2PNode) handleCommand(command string) {
 			return
 		}
 		fmt.Printf("正在尝试连接到 %s...\n", address)
+		node.connects.clearCooldown(net.JoinHostPort(host, strconv.Itoa(port)))
 		tempID := fmt.Sprintf("manual_%s_%d", host, time.Now().Unix())
 		go node.connectToPeer(host, port, tempID, "unknown", 0)
 
@@ -735,16 +874,23 @@ func (node *P2PNode) handleCommand(command string) {
 	}
 }
 
+// memoryCleanupInterval handleMessages 定期调用 cleanupMemory 的间隔
+const memoryCleanupInterval = 5 * time.Minute
+
 // 清理内存 - 移除旧的完成/失败传输
 func (node *P2PNode) cleanupMemory() {
 	now := time.Now()
 
-	// 每5分钟清理一次
-	if now.Sub(node.lastCleanupTime) < 5*time.Minute {
+	// 防止短时间内重复清理；定时器触发时刻有抖动，按半个周期判断，避免与定时器同周期时隔一次跳过一次
+	if now.Sub(node.lastCleanupTime) < memoryCleanupInterval/2 {
 		return
 	}
 	node.lastCleanupTime = now
 
+	node.cleanupOfflineMessages()
+	node.cleanupTempFiles(tempFileMaxAge)
+	node.expirePeerExchanges(now)
+
 	node.FileTransfersMutex.Lock()
 	defer node.FileTransfersMutex.Unlock()
 
@@ -768,18 +914,23 @@ func (node *P2PNode) cleanupMemory() {
 
 // 停止节点 (idempotent — safe to call multiple times)
 func (node *P2PNode) Stop() {
-	node.Running = false
+	node.Running.Store(false)
 
 	// Signal all goroutines to stop before closing connections.
-	// If StopCh is already closed, this is a duplicate call — bail out.
-	select {
-	case <-node.StopCh:
+	// sync.Once 保证并发或重复调用时 StopCh 只关闭一次，后续调用直接返回
+	first := false
+	node.stopOnce.Do(func() {
+		close(node.StopCh)
+		first = true
+	})
+	if !first {
 		Log.Debug("node.Stop() 重复调用，跳过")
 		return
-	default:
-		close(node.StopCh)
 	}
 
+	// 撤销窗口内的消息在关闭连接前立即发出
+	node.flushUndoableSends()
+
 	// 停止mDNS服务
 	node.stopMDNS()
 
@@ -791,13 +942,21 @@ func (node *P2PNode) Stop() {
 		node.BroadcastConn.Close()
 	}
 
+	// 关闭连接前累计仍在线用户的在线时长（读协程在节点停止后直接退出，不走下线路径）
+	node.recordActiveSessions()
+
 	node.PeersMutex.Lock()
 	for _, peer := range node.Peers {
 		peer.Conn.Close()
 	}
 	node.PeersMutex.Unlock()
 
-	close(node.MessageChan)
+	// 退出时清理中转文件；传输中被打断的文件留给下次启动后的定期清理
+	node.cleanupTempFiles(0)
+
+	// 不关闭 MessageChan：读协程可能仍在向其发送，handleMessages 通过 StopCh 退出，
+	// 通道随节点一起被回收
+	node.closeMessageWriter()
 	if node.DB != nil {
 		node.DB.Close()
 	}
@@ -805,6 +964,22 @@ func (node *P2PNode) Stop() {
 	Log.Info("P2P节点已停止", "name", node.Name)
 }
 
+// initialHistoryLimit 返回首次加载的历史消息条数
+func (node *P2PNode) initialHistoryLimit() int {
+	if node.Config == nil {
+		return defaultInitialHistoryLimit
+	}
+	return node.Config.GetInitialHistoryLimit()
+}
+
+// memoryMessageCap 返回 node.Messages 保留的最大条数
+func (node *P2PNode) memoryMessageCap() int {
+	if node.Config == nil {
+		return defaultMemoryMessageCap
+	}
+	return node.Config.GetMemoryMessageCap()
+}
+
 func (node *P2PNode) loadHistoryFromDB() {
 	if node.DB == nil {
 		return
@@ -813,11 +988,14 @@ func (node *P2PNode) loadHistoryFromDB() {
 	rows, err := node.DB.Query(`
 		SELECT sender, recipient, content, nonce, is_private, is_own, timestamp,
 			   message_type, message_id, reply_to_id, reply_to_content, reply_to_sender,
-			   file_name, file_size, file_type, file_url, file_data, COALESCE(file_id, '')
+			   file_name, file_size, file_type, file_url, file_data, COALESCE(file_id, ''),
+			   COALESCE(peer_uuid, ''), COALESCE(forwarded_from, ''),
+			   COALESCE(latitude, 0), COALESCE(longitude, 0), COALESCE(location_name, ''),
+			   COALESCE(content_format, ''), COALESCE(display_name, '')
 		FROM messages
 		ORDER BY timestamp DESC
-		LIMIT 20
-	`)
+		LIMIT ?
+	`, node.initialHistoryLimit())
 	if err != nil {
 		fmt.Printf("加载历史消息失败: %v\n", err)
 		Log.Error("加载历史消息失败", "error", err)
@@ -837,9 +1015,16 @@ func (node *P2PNode) loadHistoryFromDB() {
 		var fileURL string
 		var fileData string
 		var fileID string
+		var peerUUID string
+		var forwardedFrom string
+		var latitude, longitude float64
+		var locationName string
+		var contentFormat string
+		var displayName string
 		if err := rows.Scan(&sender, &recipient, &content, &nonce, &isPrivate, &isOwn, &ts,
 			&messageType, &messageID, &replyToID, &replyToContent, &replyToSender,
-			&fileName, &fileSize, &fileType, &fileURL, &fileData, &fileID); err != nil {
+			&fileName, &fileSize, &fileType, &fileURL, &fileData, &fileID, &peerUUID, &forwardedFrom,
+			&latitude, &longitude, &locationName, &contentFormat, &displayName); err != nil {
 			continue
 		}
 
@@ -853,7 +1038,7 @@ func (node *P2PNode) loadHistoryFromDB() {
 			Sender:        sender,
 			Recipient:     recipient,
 			Content:       string(plaintext),
-			Timestamp:     ts,
+			Timestamp:     ts.Local(),
 			IsOwn:         isOwn,
 			IsPrivate:     isPrivate,
 			MessageType:   messageType,
@@ -866,7 +1051,15 @@ func (node *P2PNode) loadHistoryFromDB() {
 			FileType:      fileType,
 			FileURL:       fileURL,
 			FileID:        fileID,
+			PeerUUID:      peerUUID,
+			ForwardedFrom: forwardedFrom,
+			ContentFormat: contentFormat,
+			DisplayName:   displayName,
+			Latitude:      latitude,
+			Longitude:     longitude,
+			LocationName:  locationName,
 		}
+		cm.AvatarColor = node.messageAvatarColor(cm)
 		dbMsgs = append(dbMsgs, cm)
 	}
 
@@ -878,6 +1071,200 @@ func (node *P2PNode) loadHistoryFromDB() {
 	node.MessagesMutex.Lock()
 	node.Messages = dbMsgs
 	node.MessagesMutex.Unlock()
+
+	node.loadChatState()
+}
+
+// deleteChatHistory 删除会话（chatID 为 "all" 或对方用户名）的内存与数据库记录，
+// 同时清除草稿和未读状态，返回删除的条数（有数据库时以数据库为准，内存只保留最近的消息）。
+// after/before 非零时只删除 [after, before) 时间段内的记录，草稿和未读状态保留
+func (node *P2PNode) deleteChatHistory(chatID string, after, before time.Time) int {
+	inRange := func(ts time.Time) bool {
+		return (after.IsZero() || !ts.Before(after)) && (before.IsZero() || ts.Before(before))
+	}
+	ranged := !after.IsZero() || !before.IsZero()
+
+	// Delete from in-memory messages
+	node.MessagesMutex.Lock()
+	filtered := make([]ChatMessage, 0, len(node.Messages))
+	for _, msg := range node.Messages {
+		keep := true
+		if chatID == "all" {
+			if !msg.IsPrivate {
+				keep = false
+			}
+		} else {
+			if msg.IsPrivate && (msg.Sender == chatID || msg.Recipient == chatID) {
+				keep = false
+			}
+		}
+		if !keep && !inRange(msg.Timestamp) {
+			keep = true
+		}
+		if keep {
+			filtered = append(filtered, msg)
+		}
+	}
+	removed := len(node.Messages) - len(filtered)
+	node.Messages = filtered
+	node.MessagesRevision++
+	node.MessagesMutex.Unlock()
+
+	// Delete from SQLite
+	if node.DB != nil {
+		node.flushMessageWrites()
+		query := "DELETE FROM messages WHERE is_private = 1 AND (sender = ? OR recipient = ?)"
+		args := []interface{}{chatID, chatID}
+		if chatID == "all" {
+			query, args = "DELETE FROM messages WHERE is_private = 0", nil
+		}
+		// timestamp 列由 CURRENT_TIMESTAMP 以 UTC 文本写入，按相同格式比较
+		if !after.IsZero() {
+			query += " AND timestamp >= ?"
+			args = append(args, after.UTC().Format(time.DateTime))
+		}
+		if !before.IsZero() {
+			query += " AND timestamp < ?"
+			args = append(args, before.UTC().Format(time.DateTime))
+		}
+		res, err := node.DB.Exec(query, args...)
+		if err != nil {
+			Log.Error("删除会话记录失败", "chat", chatID, "error", err)
+		} else if n, err := res.RowsAffected(); err == nil {
+			removed = int(n)
+		}
+		if !ranged {
+			node.saveDraft(chatID, "")
+		}
+	}
+	if ranged {
+		// 只删除了部分记录，草稿和未读状态保留；通知前端重新加载该会话
+		Log.Info("已删除会话时间段内的记录", "chat", chatID, "after", after, "before", before, "removed", removed)
+		node.emitHistoryChanged(chatID)
+		return removed
+	}
+	node.clearChatState(chatID)
+	Log.Info("会话记录已清空", "chat", chatID, "removed", removed)
+	node.emitHistoryChanged(chatID)
+	return removed
+}
+
+// queryHistoryPage 按自增id游标分页读取会话历史（chatId 为 "all" 或对方用户名）。
+// beforeID <= 0 表示从最新一条开始；返回结果按时间正序，
+// nextBeforeID 为下一页（更早消息）的游标，没有更多消息时为 0。
+// 数据库不可用时从内存消息列表读取最近的消息（没有更早的分页）
+func (node *P2PNode) queryHistoryPage(chatId string, beforeID int64, limit int) (msgs []ChatMessage, nextBeforeID int64, err error) {
+	if node.DB == nil {
+		if beforeID > 0 {
+			return nil, 0, nil
+		}
+		return node.memoryHistoryPage(chatId, limit), 0, nil
+	}
+	if beforeID <= 0 {
+		beforeID = math.MaxInt64
+	}
+	node.flushMessageWrites()
+
+	const columns = `id, sender, recipient, content, nonce, is_private, is_own, timestamp,
+		message_type, message_id, reply_to_id, reply_to_content, reply_to_sender,
+		file_name, file_size, file_type, file_url, COALESCE(file_id, ''),
+		COALESCE(peer_uuid, ''), COALESCE(forwarded_from, ''),
+		COALESCE(latitude, 0), COALESCE(longitude, 0), COALESCE(location_name, ''),
+		COALESCE(content_format, ''), COALESCE(display_name, '')`
+	var rows *sql.Rows
+	if chatId == "all" {
+		rows, err = node.DB.Query(`SELECT `+columns+`
+			FROM messages
+			WHERE recipient = 'all' AND is_private = FALSE AND id < ?
+			ORDER BY id DESC
+			LIMIT ?`, beforeID, limit)
+	} else {
+		rows, err = node.DB.Query(`SELECT `+columns+`
+			FROM messages
+			WHERE is_private = TRUE AND (
+				(sender = ? AND recipient = ?) OR
+				(sender = ? AND recipient = ?)
+			) AND id < ?
+			ORDER BY id DESC
+			LIMIT ?`, node.Name, chatId, chatId, node.Name, beforeID, limit)
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+
+	var scanned int
+	var oldestID int64
+	for rows.Next() {
+		var id int64
+		var content, nonce []byte
+		var cm ChatMessage
+		if err := rows.Scan(&id, &cm.Sender, &cm.Recipient, &content, &nonce, &cm.IsPrivate, &cm.IsOwn, &cm.Timestamp,
+			&cm.MessageType, &cm.MessageID, &cm.ReplyToID, &cm.ReplyToContent, &cm.ReplyToSender,
+			&cm.FileName, &cm.FileSize, &cm.FileType, &cm.FileURL, &cm.FileID,
+			&cm.PeerUUID, &cm.ForwardedFrom, &cm.Latitude, &cm.Longitude, &cm.LocationName,
+			&cm.ContentFormat, &cm.DisplayName); err != nil {
+			continue
+		}
+		// 解密失败的消息也推进游标，避免下一页重复读取
+		scanned++
+		oldestID = id
+
+		plaintext, err := decryptMessage(node.LocalDBKey, content, nonce)
+		if err != nil {
+			Log.Error("解密历史消息失败", "id", id, "error", err)
+			continue
+		}
+		cm.Content = string(plaintext)
+		// CURRENT_TIMESTAMP 以 UTC 存储，统一转换为本地时区
+		cm.Timestamp = cm.Timestamp.Local()
+		cm.AvatarColor = node.messageAvatarColor(cm)
+		msgs = append(msgs, cm)
+	}
+
+	// 查询为倒序，翻转为正序
+	for i, j := 0, len(msgs)-1; i < j; i, j = i+1, j-1 {
+		msgs[i], msgs[j] = msgs[j], msgs[i]
+	}
+	if scanned == limit {
+		nextBeforeID = oldestID
+	}
+	return msgs, nextBeforeID, nil
+}
+
+// memoryHistoryPage 从内存消息列表读取会话最近的 limit 条消息，按时间正序
+func (node *P2PNode) memoryHistoryPage(chatId string, limit int) []ChatMessage {
+	node.MessagesMutex.RLock()
+	defer node.MessagesMutex.RUnlock()
+	var msgs []ChatMessage
+	for i := len(node.Messages) - 1; i >= 0 && len(msgs) < limit; i-- {
+		m := node.Messages[i]
+		if chatIDForMessage(m.Sender, m.Recipient, m.IsOwn, m.IsPrivate) == chatId {
+			msgs = append(msgs, m)
+		}
+	}
+	slices.Reverse(msgs)
+	return msgs
+}
+
+// formatMessageTime 按消息距今时间格式化：今天只显示时间，昨天显示"昨天 HH:MM"，
+// 今年内显示月日，更早显示完整日期。t 与 now 均按本地时区比较
+func formatMessageTime(t, now time.Time) string {
+	t, now = t.Local(), now.Local()
+	y, m, d := t.Date()
+	ny, nm, nd := now.Date()
+	today := time.Date(ny, nm, nd, 0, 0, 0, 0, now.Location())
+	day := time.Date(y, m, d, 0, 0, 0, 0, t.Location())
+
+	switch {
+	case day.Equal(today):
+		return t.Format("15:04")
+	case day.Equal(today.AddDate(0, 0, -1)):
+		return "昨天 " + t.Format("15:04")
+	case y == ny:
+		return t.Format("01-02 15:04")
+	}
+	return t.Format("2006-01-02 15:04")
 }
 
 func main() {
@@ -888,6 +1275,8 @@ func main() {
 	var showHelp bool
 	var logLevel string
 	var restartDelay int
+	var p2pPort, discoveryPort int
+	var localIP string
 
 	flag.StringVar(&name, "name", "", "指定用户名")
 	flag.BoolVar(&cliMode, "cli", false, "CLI模式（默认为桌面应用模式）")
@@ -895,6 +1284,9 @@ func main() {
 	flag.BoolVar(&showHelp, "help", false, "显示帮助信息")
 	flag.StringVar(&logLevel, "loglevel", "", "日志级别: error, info, debug")
 	flag.IntVar(&restartDelay, "restart-delay", 0, "启动前等待秒数（重启用）")
+	flag.IntVar(&p2pPort, "p2p-port", 0, "P2P通信TCP端口")
+	flag.IntVar(&discoveryPort, "discovery-port", 0, "服务发现UDP端口")
+	flag.StringVar(&localIP, "ip", "", "指定本机IP地址（跳过网卡选择）")
 	flag.Parse()
 
 	// Prevent multiple instances.
@@ -909,6 +1301,7 @@ func main() {
 	// Load persistent config; CLI flags override saved values
 	t = time.Now()
 	cfg := LoadConfig()
+	cfg.EnsureUserUUID()
 	fmt.Printf("配置加载完成 (%v)\n", time.Since(t))
 	if name != "" {
 		cfg.Name = name
@@ -919,6 +1312,15 @@ func main() {
 	if logLevel != "" {
 		cfg.LogLevel = logLevel
 	}
+	if p2pPort != 0 {
+		cfg.P2PPort = p2pPort
+	}
+	if discoveryPort != 0 {
+		cfg.DiscoveryPort = discoveryPort
+	}
+	if localIP != "" {
+		cfg.LocalIP = localIP
+	}
 	// Ensure defaults for zero values
 	if cfg.WebPort == 0 {
 		cfg.WebPort = 8080
@@ -930,11 +1332,14 @@ func main() {
 	dataDir := AppDataDir()
 	fmt.Printf("数据目录: %s\n", dataDir)
 
-	// 清理旧版本遗留文件
-	cleanupOldExecutable()
+	// 检查上次更新是否启动失败，必要时回滚到旧版本；否则清理旧版本遗留文件
+	if checkUpdateRollback() {
+		return
+	}
 
 	t = time.Now()
-	logFile, err := InitLogger(cfg.LogLevel)
+	SetLogRetention(cfg.LogMaxFiles, cfg.LogMaxDays)
+	logFile, err := InitLogger(cfg.LogLevel, cliMode)
 	if err != nil {
 		fmt.Printf("初始化日志失败: %v\n", err)
 	} else {
@@ -943,7 +1348,8 @@ func main() {
 	// From here on, Log.Debug is available
 	Log.Debug("日志系统初始化完成", "耗时", time.Since(t), "级别", cfg.LogLevel)
 	Log.Debug("main() 启动参数", "name", name, "cli", cliMode, "webPort", webPort, "logLevel", logLevel, "restartDelay", restartDelay)
-	Log.Debug("main() 最终配置", "cfgName", cfg.Name, "cfgWebPort", cfg.WebPort, "cfgLogLevel", cfg.LogLevel, "dataDir", dataDir)
+	Log.Debug("main() 最终配置", "cfgName", cfg.Name, "cfgWebPort", cfg.WebPort, "cfgLogLevel", cfg.LogLevel,
+		"p2pPort", cfg.GetP2PPort(), "discoveryPort", cfg.GetDiscoveryPort(), "dataDir", dataDir)
 	Log.Debug("main() 预初始化耗时", "elapsed", time.Since(appStart))
 
 	if showHelp {
@@ -957,6 +1363,9 @@ func main() {
 		fmt.Println("  -cli            CLI模式（默认为桌面应用模式）")
 		fmt.Println("  -port int       Web/应用端口 (默认 8080)")
 		fmt.Println("  -loglevel string 日志级别: error, info, debug (默认 error)")
+		fmt.Println("  -p2p-port int   P2P通信TCP端口 (默认 8888)")
+		fmt.Println("  -discovery-port int 服务发现UDP端口 (默认 9999，需与其他节点一致)")
+		fmt.Println("  -ip string      指定本机IP地址，不再询问选择网卡")
 		fmt.Println("  -help           显示此帮助信息")
 		fmt.Println()
 		fmt.Println("模式:")
@@ -964,8 +1373,8 @@ func main() {
 		fmt.Println("  -cli模式: 命令行界面 + 可选Web界面")
 		fmt.Println()
 		fmt.Println("网络端口:")
-		fmt.Println("  P2P通信: 8888 (TCP)")
-		fmt.Println("  服务发现: 9999 (UDP)")
+		fmt.Printf("  P2P通信: %d (TCP)\n", cfg.GetP2PPort())
+		fmt.Printf("  服务发现: %d (UDP)\n", cfg.GetDiscoveryPort())
 		fmt.Println()
 		fmt.Printf("数据目录: %s\n", AppDataDir())
 		return
@@ -1001,7 +1410,16 @@ func startCLIMode(cfg *AppConfig) {
 		}
 	}
 
-	localIP := getLocalIP()
+	// 指定了IP时直接使用；输入不是终端（脚本、服务）时不能交互选择，自动选择网卡
+	localIP := configuredLocalIP(cfg)
+	if localIP == "" {
+		if stdinIsTerminal() {
+			localIP = getLocalIP(cfg.PreferredInterface)
+		} else {
+			localIP = getLocalIPAuto(cfg.PreferredInterface)
+			fmt.Printf("使用网络接口: %s\n", localIP)
+		}
+	}
 
 	webMode := false
 	fmt.Print("是否启用Web界面? (y/N): ")
@@ -1011,8 +1429,10 @@ func startCLIMode(cfg *AppConfig) {
 		webMode = true
 	}
 
-	node := NewP2PNode(cfg.Name, webMode, localIP)
+	node := NewP2PNode(cfg.Name, webMode, localIP, cfg.GetP2PPort(), cfg.GetDiscoveryPort())
 	node.Config = cfg
+	node.UUID = cfg.UserUUID
+	node.UploadLimiter.SetRate(cfg.MaxUploadBytesPerSec)
 	node.clearHistoryIfDisabled()
 
 	if webMode {
@@ -1048,6 +1468,7 @@ func startCLIMode(cfg *AppConfig) {
 }
 
 // applyBlockedUsers restores blocked users from config into the node's ACL.
+// Entries are user keys (UUID); legacy IP:port entries are migrated on first match.
 func applyBlockedUsers(node *P2PNode, cfg *AppConfig) {
 	if len(cfg.BlockedUsers) == 0 {
 		return
@@ -1057,24 +1478,14 @@ func applyBlockedUsers(node *P2PNode, cfg *AppConfig) {
 	if node.ACLs[node.Address] == nil {
 		node.ACLs[node.Address] = make(map[string]bool)
 	}
-	for _, addr := range cfg.BlockedUsers {
-		node.ACLs[node.Address][addr] = false
+	for _, key := range cfg.BlockedUsers {
+		node.ACLs[node.Address][key] = false
 	}
 }
 
-// collectBlockedUsers extracts blocked user addresses from the node's ACL.
+// collectBlockedUsers extracts blocked user keys from the node's ACL.
 func collectBlockedUsers(node *P2PNode) []string {
-	node.ACLMutex.RLock()
-	defer node.ACLMutex.RUnlock()
-	var blocked []string
-	if acl, exists := node.ACLs[node.Address]; exists {
-		for addr, allowed := range acl {
-			if !allowed {
-				blocked = append(blocked, addr)
-			}
-		}
-	}
-	return blocked
+	return node.blockedUserKeys()
 }
 
 // 桌面应用模式启动（Wails）
@@ -1092,15 +1503,20 @@ func startDesktopMode(cfg *AppConfig) {
 	Log.Debug("桌面模式: 用户名确定", "name", cfg.Name, "hostname", hostname)
 
 	tStep := time.Now()
-	localIP := getLocalIPAuto()
+	localIP := configuredLocalIP(cfg)
+	if localIP == "" {
+		localIP = getLocalIPAuto(cfg.PreferredInterface)
+	}
 	Log.Debug("桌面模式: 本地IP获取", "耗时", time.Since(tStep), "localIP", localIP)
 
 	tStep = time.Now()
-	node := NewP2PNode(cfg.Name, true, localIP)
+	node := NewP2PNode(cfg.Name, true, localIP, cfg.GetP2PPort(), cfg.GetDiscoveryPort())
 	Log.Debug("桌面模式: NewP2PNode 返回", "耗时", time.Since(tStep))
 
 	node.DesktopMode = true
 	node.Config = cfg
+	node.UUID = cfg.UserUUID
+	node.UploadLimiter.SetRate(cfg.MaxUploadBytesPerSec)
 	node.clearHistoryIfDisabled()
 	node.WebPort = cfg.WebPort
 
@@ -1144,7 +1560,8 @@ func startDesktopMode(cfg *AppConfig) {
 			Height:            cfg.WindowHeight,
 			MinWidth:          380,
 			MinHeight:         400,
-			HideWindowOnClose: true,
+			// 关闭按钮由 OnBeforeClose 按 CloseToTray 配置决定隐藏到托盘还是退出
+			HideWindowOnClose: false,
 			AssetServer: &assetserver.Options{
 				Handler: app.APIHandler(),
 			},
@@ -1159,27 +1576,14 @@ func startDesktopMode(cfg *AppConfig) {
 				WindowIsTranslucent:                 false,
 				WebviewBrowserPath:                  path,
 				WebviewDisableRendererCodeIntegrity: true,
-				CustomTheme: &windows.ThemeSettings{
-					// Dark mode (Telegram skin): standard dark title bar
-					DarkModeTitleBar:           windows.RGB(23, 33, 43),
-					DarkModeTitleBarInactive:   windows.RGB(23, 33, 43),
-					DarkModeTitleText:          windows.RGB(200, 200, 200),
-					DarkModeTitleTextInactive:  windows.RGB(120, 120, 120),
-					DarkModeBorder:             windows.RGB(23, 33, 43),
-					DarkModeBorderInactive:     windows.RGB(23, 33, 43),
-					// Light mode (WiseTalk skin): blue title bar (#0089FF)
-					LightModeTitleBar:          windows.RGB(0, 137, 255),
-					LightModeTitleBarInactive:  windows.RGB(0, 106, 200),
-					LightModeTitleText:         windows.RGB(255, 255, 255),
-					LightModeTitleTextInactive: windows.RGB(200, 220, 255),
-					LightModeBorder:            windows.RGB(0, 137, 255),
-					LightModeBorderInactive:    windows.RGB(0, 106, 200),
-				},
+				Theme:                               windowThemeMode(cfg),
+				CustomTheme:                         windowThemeSettings(cfg),
 			},
-			OnStartup:  app.startup,
-			OnDomReady: app.onDomReady,
-			OnShutdown: app.shutdown,
-			Bind:       []interface{}{app},
+			OnStartup:     app.startup,
+			OnDomReady:    app.onDomReady,
+			OnShutdown:    app.shutdown,
+			OnBeforeClose: app.beforeClose,
+			Bind:          []interface{}{app},
 		})
 		if lastErr == nil {
 			Log.Debug("桌面模式: wails.Run 正常退出", "strategy", label, "运行时长", time.Since(tWails))
@@ -1202,6 +1606,57 @@ type webviewCandidate struct {
 	path  string // WebviewBrowserPath ("" = system auto-detect)
 }
 
+// windowThemeMode 根据保存的皮肤选择标题栏模式：深色皮肤用 Dark，即时通皮肤用 Light
+func windowThemeMode(cfg *AppConfig) windows.Theme {
+	if cfg.GetTheme() == "wisetalk" {
+		return windows.Light
+	}
+	return windows.Dark
+}
+
+// windowThemeSettings 生成标题栏配色。未设置主题色时使用两套皮肤的默认色，
+// 设置了主题色则替换当前皮肤的标题栏与边框颜色，标题文字按亮度选黑/白。
+func windowThemeSettings(cfg *AppConfig) *windows.ThemeSettings {
+	ts := &windows.ThemeSettings{
+		// Dark mode (Telegram skin): standard dark title bar
+		DarkModeTitleBar:          windows.RGB(23, 33, 43),
+		DarkModeTitleBarInactive:  windows.RGB(23, 33, 43),
+		DarkModeTitleText:         windows.RGB(200, 200, 200),
+		DarkModeTitleTextInactive: windows.RGB(120, 120, 120),
+		DarkModeBorder:            windows.RGB(23, 33, 43),
+		DarkModeBorderInactive:    windows.RGB(23, 33, 43),
+		// Light mode (WiseTalk skin): blue title bar (#0089FF)
+		LightModeTitleBar:          windows.RGB(0, 137, 255),
+		LightModeTitleBarInactive:  windows.RGB(0, 106, 200),
+		LightModeTitleText:         windows.RGB(255, 255, 255),
+		LightModeTitleTextInactive: windows.RGB(200, 220, 255),
+		LightModeBorder:            windows.RGB(0, 137, 255),
+		LightModeBorderInactive:    windows.RGB(0, 106, 200),
+	}
+
+	r, g, b, ok := parseHexColor(cfg.AccentColor)
+	if !ok {
+		return ts
+	}
+	// 非活动窗口颜色压暗 20%
+	active := windows.RGB(r, g, b)
+	inactive := windows.RGB(uint8(int(r)*4/5), uint8(int(g)*4/5), uint8(int(b)*4/5))
+	text, textInactive := windows.RGB(255, 255, 255), windows.RGB(220, 220, 220)
+	if int(r)*299+int(g)*587+int(b)*114 > 150*1000 {
+		text, textInactive = windows.RGB(0, 0, 0), windows.RGB(60, 60, 60)
+	}
+	if cfg.GetTheme() == "wisetalk" {
+		ts.LightModeTitleBar, ts.LightModeTitleBarInactive = active, inactive
+		ts.LightModeBorder, ts.LightModeBorderInactive = active, inactive
+		ts.LightModeTitleText, ts.LightModeTitleTextInactive = text, textInactive
+	} else {
+		ts.DarkModeTitleBar, ts.DarkModeTitleBarInactive = active, inactive
+		ts.DarkModeBorder, ts.DarkModeBorderInactive = active, inactive
+		ts.DarkModeTitleText, ts.DarkModeTitleTextInactive = text, textInactive
+	}
+	return ts
+}
+
 // buildWebViewPathCandidates returns an ordered list of WebView2 paths to try.
 // Priority: system auto-detect → local Fixed Version → LAN bootstrap → empty (last resort).
 func buildWebViewPathCandidates(localIP string, webPort int) []webviewCandidate {
@@ -1273,8 +1728,30 @@ func buildWebViewPathCandidates(localIP string, webPort int) []webviewCandidate
 	return candidates
 }
 
+// minWebView2Version 本地运行时的最低版本，与 Wails 要求的 WebView2 运行时版本一致
+// （wv2installer.MinimumRuntimeVersion）。更旧的运行时可能无法加载页面导致白屏
+const minWebView2Version = "94.0.992.31"
+
+// webView2RuntimeUsable 检查目录下 msedgewebview2.exe 的文件版本是否满足最低要求。
+// 读取不到版本信息时无法判断，仍然使用
+func webView2RuntimeUsable(dir string) bool {
+	exe := filepath.Join(dir, "msedgewebview2.exe")
+	version, err := fileVersion(exe)
+	if err != nil {
+		Log.Warn("读取WebView2运行时版本失败", "path", exe, "error", err)
+		return true
+	}
+	if compareVersions(version, minWebView2Version) < 0 {
+		Log.Warn("本地WebView2运行时版本过旧，跳过", "path", dir, "version", version, "min", minWebView2Version)
+		fmt.Printf("本地 WebView2 运行时版本过旧 (%s < %s)，跳过: %s\n", version, minWebView2Version, dir)
+		return false
+	}
+	Log.Debug("本地WebView2运行时版本", "path", dir, "version", version)
+	return true
+}
+
 // detectWebView2Runtime 检测 exe 同目录下的 WebView2Runtime/ 文件夹
-// WebviewBrowserPath 需要指向包含 msedgewebview2.exe 的目录
+// WebviewBrowserPath 需要指向包含 msedgewebview2.exe 的目录；版本低于 minWebView2Version 的不使用
 func detectWebView2Runtime() string {
 	exePath, err := os.Executable()
 	if err != nil {
@@ -1289,7 +1766,7 @@ func detectWebView2Runtime() string {
 	}
 
 	// Check if msedgewebview2.exe is directly in WebView2Runtime/
-	if _, err := os.Stat(filepath.Join(wv2Dir, "msedgewebview2.exe")); err == nil {
+	if _, err := os.Stat(filepath.Join(wv2Dir, "msedgewebview2.exe")); err == nil && webView2RuntimeUsable(wv2Dir) {
 		fmt.Printf("检测到本地 WebView2 运行时: %s\n", wv2Dir)
 		return wv2Dir
 	}
@@ -1302,7 +1779,7 @@ func detectWebView2Runtime() string {
 	for _, entry := range entries {
 		if entry.IsDir() {
 			subDir := filepath.Join(wv2Dir, entry.Name())
-			if _, err := os.Stat(filepath.Join(subDir, "msedgewebview2.exe")); err == nil {
+			if _, err := os.Stat(filepath.Join(subDir, "msedgewebview2.exe")); err == nil && webView2RuntimeUsable(subDir) {
 				fmt.Printf("检测到本地 WebView2 运行时: %s\n", subDir)
 				return subDir
 			}
@@ -1312,31 +1789,34 @@ func detectWebView2Runtime() string {
 	return ""
 }
 
-// 自动选择本地IP（非交互式，用于桌面模式）
-func getLocalIPAuto() string {
-	interfaces, err := net.Interfaces()
-	if err != nil {
-		return "127.0.0.1"
+// configuredLocalIP 返回 -ip 参数或配置 LocalIP 指定的地址，未指定或格式无效时返回空字符串
+func configuredLocalIP(cfg *AppConfig) string {
+	if cfg.LocalIP == "" {
+		return ""
 	}
-
-	for _, iface := range interfaces {
-		if iface.Flags&net.FlagUp == 0 || iface.Flags&net.FlagLoopback != 0 {
-			continue
-		}
-
-		addrs, err := iface.Addrs()
-		if err != nil {
-			continue
-		}
-
-		for _, addr := range addrs {
-			if ipnet, ok := addr.(*net.IPNet); ok && !ipnet.IP.IsLoopback() {
-				if ipnet.IP.To4() != nil {
-					return ipnet.IP.String()
-				}
-			}
+	ip := net.ParseIP(cfg.LocalIP)
+	if ip == nil || ip.To4() == nil {
+		Log.Warn("指定的本机IP无效，自动选择", "ip", cfg.LocalIP)
+		fmt.Printf("指定的本机IP无效: %s\n", cfg.LocalIP)
+		return ""
+	}
+	found := false
+	for _, li := range listLocalInterfaces() {
+		if li.IP == ip.String() {
+			found = true
+			break
 		}
 	}
+	if !found {
+		Log.Warn("指定的本机IP不属于任何已启用的网卡", "ip", cfg.LocalIP)
+	}
+	return ip.String()
+}
 
+// 自动选择本地IP（非交互式，用于桌面模式），选择规则见 selectLocalInterface
+func getLocalIPAuto(preferred string) string {
+	if li, ok := selectLocalInterface(preferred); ok {
+		return li.IP
+	}
 	return "127.0.0.1"
 }
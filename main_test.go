@@ -0,0 +1,259 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"runtime"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestMain(m *testing.M) {
+	// 使用临时数据目录，测试不读写用户的 ~/.lanshare
+	home, err := os.MkdirTemp("", "lanshare-test")
+	if err != nil {
+		panic(err)
+	}
+	os.Setenv("HOME", home)
+	os.Setenv("USERPROFILE", home)
+	Log = slog.New(testLogRecorder)
+
+	code := m.Run()
+	os.RemoveAll(home)
+	os.Exit(code)
+}
+
+// freeTCPPort 返回一个当前空闲的本机TCP端口
+func freeTCPPort(t *testing.T) int {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("获取空闲TCP端口失败: %v", err)
+	}
+	defer l.Close()
+	return l.Addr().(*net.TCPAddr).Port
+}
+
+// freeUDPPort 返回一个当前空闲的UDP端口（发现端口）
+func freeUDPPort(t *testing.T) int {
+	t.Helper()
+	c, err := net.ListenUDP("udp", &net.UDPAddr{})
+	if err != nil {
+		t.Fatalf("获取空闲UDP端口失败: %v", err)
+	}
+	defer c.Close()
+	return c.LocalAddr().(*net.UDPAddr).Port
+}
+
+// waitGoroutines 等待协程数回落到 base 以内，超时则打印全部协程栈并失败
+func waitGoroutines(t *testing.T, base int) {
+	t.Helper()
+	deadline := time.Now().Add(10 * time.Second)
+	for runtime.NumGoroutine() > base {
+		if time.Now().After(deadline) {
+			buf := make([]byte, 1<<20)
+			n := runtime.Stack(buf, true)
+			t.Fatalf("协程泄漏: 现有 %d 个，基线 %d 个\n%s", runtime.NumGoroutine(), base, buf[:n])
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+func TestNodeStartStop(t *testing.T) {
+	base := runtime.NumGoroutine()
+
+	// 反复启停：每轮都能重新监听同一端口，说明上一轮已释放
+	tcpPort, udpPort := freeTCPPort(t), freeUDPPort(t)
+	for i := 0; i < 5; i++ {
+		node := NewP2PNode("启停测试", false, "127.0.0.1", tcpPort, udpPort)
+		if err := node.Start(); err != nil {
+			t.Fatalf("第 %d 轮启动失败: %v", i+1, err)
+		}
+		if node.LocalPort != tcpPort {
+			t.Fatalf("第 %d 轮未能重新监听端口 %d，实际为 %d", i+1, tcpPort, node.LocalPort)
+		}
+		node.Stop()
+	}
+	waitGoroutines(t, base)
+
+	// 并发：多个节点同时启停，每个节点的 Stop 被并发调用多次
+	const nodes = 4
+	ports := make([][2]int, nodes)
+	for i := range ports {
+		ports[i] = [2]int{freeTCPPort(t), freeUDPPort(t)}
+	}
+	var wg sync.WaitGroup
+	for i := 0; i < nodes; i++ {
+		wg.Add(1)
+		go func(tcpPort, udpPort int) {
+			defer wg.Done()
+			node := NewP2PNode("并发启停", false, "127.0.0.1", tcpPort, udpPort)
+			if err := node.Start(); err != nil {
+				t.Errorf("启动失败: %v", err)
+				return
+			}
+			var stops sync.WaitGroup
+			for j := 0; j < 3; j++ {
+				stops.Add(1)
+				go func() {
+					defer stops.Done()
+					node.Stop()
+				}()
+			}
+			stops.Wait()
+			if node.Running.Load() {
+				t.Errorf("Stop 之后节点仍标记为运行中")
+			}
+		}(ports[i][0], ports[i][1])
+	}
+	wg.Wait()
+	waitGoroutines(t, base)
+}
+
+// testLogRecorder 测试期间的日志处理器：丢弃日志，只记录 panic
+var testLogRecorder = &panicLogRecorder{}
+
+// panicLogRecorder 记录日志中的 panic：读协程等会 recover 并只记日志，测试需据此判断
+type panicLogRecorder struct {
+	mu     sync.Mutex
+	panics []string
+}
+
+func (h *panicLogRecorder) Enabled(context.Context, slog.Level) bool { return true }
+
+func (h *panicLogRecorder) Handle(_ context.Context, r slog.Record) error {
+	if strings.Contains(r.Message, "panic") {
+		r.Attrs(func(a slog.Attr) bool {
+			if a.Key == "panic" {
+				h.mu.Lock()
+				h.panics = append(h.panics, r.Message+": "+a.Value.String())
+				h.mu.Unlock()
+			}
+			return true
+		})
+	}
+	return nil
+}
+
+func (h *panicLogRecorder) WithAttrs([]slog.Attr) slog.Handler { return h }
+func (h *panicLogRecorder) WithGroup(string) slog.Handler      { return h }
+
+// since 返回第 n 条之后记录的 panic
+func (h *panicLogRecorder) since(n int) []string {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return append([]string(nil), h.panics[n:]...)
+}
+
+func (h *panicLogRecorder) count() int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return len(h.panics)
+}
+
+// floodPeer 向节点注入一条内存连接并持续写入消息，直到连接被关闭
+func floodPeer(node *P2PNode, id string) net.Conn {
+	local, remote := net.Pipe()
+	peer := &Peer{ID: id, Name: "注入节点", Conn: local, IsActive: true, LastSeen: time.Now()}
+	node.PeersMutex.Lock()
+	node.Peers[id] = peer
+	node.PeersMutex.Unlock()
+	go node.handlePeerConnection(peer)
+	go func() {
+		encoder := json.NewEncoder(remote)
+		// handshake 在分发时不做处理，只占用 MessageChan
+		for encoder.Encode(Message{Type: "handshake", From: id, Timestamp: time.Now()}) == nil {
+		}
+	}()
+	return remote
+}
+
+// 在持续收发中反复启停：对端不停发来消息时 Stop，读协程向 MessageChan 投递不能 panic，
+// 节点停止后所有协程都应退出（配合 -race 运行）
+func TestNodeStartStopUnderTraffic(t *testing.T) {
+	panicsBefore := testLogRecorder.count()
+	base := runtime.NumGoroutine()
+
+	a := NewP2PNode("收发节点A", false, "127.0.0.1", freeTCPPort(t), freeUDPPort(t))
+	if err := a.Start(); err != nil {
+		t.Fatalf("A 启动失败: %v", err)
+	}
+	defer a.Stop()
+
+	tcpPort, udpPort := freeTCPPort(t), freeUDPPort(t)
+	for i := 0; i < 5; i++ {
+		if !startStopUnderTraffic(t, a, i+1, tcpPort, udpPort) {
+			return
+		}
+	}
+
+	a.Stop()
+	waitGoroutines(t, base)
+
+	if panics := testLogRecorder.since(panicsBefore); len(panics) > 0 {
+		t.Fatalf("启停过程中发生 panic:\n%s", strings.Join(panics, "\n"))
+	}
+}
+
+// startStopUnderTraffic 启动 B 并与 A 建立连接，双方持续互发消息时停止 B；
+// 失败时也会停止发送协程和 B，返回是否成功
+func startStopUnderTraffic(t *testing.T, a *P2PNode, round, tcpPort, udpPort int) bool {
+	t.Helper()
+	b := NewP2PNode("收发节点B", false, "127.0.0.1", tcpPort, udpPort)
+	if err := b.Start(); err != nil {
+		t.Errorf("第 %d 轮 B 启动失败: %v", round, err)
+		return false
+	}
+	defer b.Stop()
+	a.connectToPeer("127.0.0.1", b.LocalPort, b.ID, b.Name)
+	flood := floodPeer(b, fmt.Sprintf("flood-%d", round))
+	defer flood.Close()
+
+	// 双方持续互发公聊消息，直到本轮结束
+	stop := make(chan struct{})
+	var senders sync.WaitGroup
+	defer senders.Wait()
+	defer close(stop)
+	for _, n := range []*P2PNode{a, b} {
+		for j := 0; j < 2; j++ {
+			senders.Add(1)
+			go func(n *P2PNode) {
+				defer senders.Done()
+				for k := 0; ; k++ {
+					select {
+					case <-stop:
+						return
+					default:
+					}
+					n.broadcastMessage(Message{Type: "chat", From: n.ID, To: "all", Content: fmt.Sprintf("消息 %d", k), Timestamp: time.Now()})
+					time.Sleep(time.Millisecond)
+				}
+			}(n)
+		}
+	}
+
+	// B 上还有注入的连接，只看与 A 的连接
+	deadline := time.Now().Add(15 * time.Second)
+	for {
+		if _, conn := peerConnSnapshot(b, a.ID); conn != nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Errorf("第 %d 轮 A 与 B 未能建立连接", round)
+			return false
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	// 收发进行中停止 B，B 停止后 A 仍继续向其发送
+	b.Stop()
+	time.Sleep(50 * time.Millisecond)
+	return true
+}
@@ -1,7 +1,9 @@
 package main
 
 import (
+	"encoding/base64"
 	"fmt"
+	"strconv"
 	"strings"
 	"time"
 
@@ -14,6 +16,10 @@ func (node *P2PNode) startMDNSDiscovery() {
 	info := []string{
 		fmt.Sprintf("id=%s", node.ID),
 		fmt.Sprintf("name=%s", node.Name),
+		fmt.Sprintf("webPort=%d", node.WebPort),
+		fmt.Sprintf("uuid=%s", node.UUID),
+		// 公钥 base64 后 44 字节，单条TXT记录上限 255 字节
+		fmt.Sprintf("pubkey=%s", base64.StdEncoding.EncodeToString(node.NodePublicKey[:])),
 	}
 
 	service, err := mdns.NewMDNSService(
@@ -27,15 +33,27 @@ func (node *P2PNode) startMDNSDiscovery() {
 	)
 	if err != nil {
 		fmt.Printf("[mDNS] 创建mDNS服务失败: %v\n", err)
+		Log.Error("创建mDNS服务失败", "error", err)
 		return
 	}
 
 	server, err := mdns.NewServer(&mdns.Config{Zone: service})
 	if err != nil {
 		fmt.Printf("[mDNS] 启动mDNS服务器失败: %v\n", err)
+		Log.Error("启动mDNS服务器失败", "error", err)
 		return
 	}
+	node.mdnsMutex.Lock()
+	select {
+	case <-node.StopCh:
+		// 注册期间节点已停止，Stop 看不到这个服务，直接关闭
+		node.mdnsMutex.Unlock()
+		server.Shutdown()
+		return
+	default:
+	}
 	node.MdnsServer = server
+	node.mdnsMutex.Unlock()
 	fmt.Println("[mDNS] mDNS服务已注册: _lanshare._tcp")
 
 	// 立即执行一次查询
@@ -53,10 +71,12 @@ func (node *P2PNode) periodicMDNSQuery() {
 	for {
 		select {
 		case <-ticker.C:
-			if !node.Running {
+			if !node.Running.Load() {
 				return
 			}
 			node.queryMDNS()
+		case <-node.StopCh:
+			return
 		}
 	}
 }
@@ -86,12 +106,22 @@ func (node *P2PNode) queryMDNS() {
 // 处理mDNS发现的服务条目
 func (node *P2PNode) handleMDNSEntry(entry *mdns.ServiceEntry) {
 	// 从TXT记录中提取ID和名称
-	var peerID, peerName string
+	var peerID, peerName, peerUUID string
+	var peerWebPort int
+	var peerPubKey []byte
 	for _, txt := range entry.InfoFields {
 		if strings.HasPrefix(txt, "id=") {
 			peerID = strings.TrimPrefix(txt, "id=")
 		} else if strings.HasPrefix(txt, "name=") {
 			peerName = strings.TrimPrefix(txt, "name=")
+		} else if strings.HasPrefix(txt, "webPort=") {
+			peerWebPort, _ = strconv.Atoi(strings.TrimPrefix(txt, "webPort="))
+		} else if strings.HasPrefix(txt, "uuid=") {
+			peerUUID = strings.TrimPrefix(txt, "uuid=")
+		} else if strings.HasPrefix(txt, "pubkey=") {
+			if key, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(txt, "pubkey=")); err == nil && len(key) == 32 {
+				peerPubKey = key
+			}
 		}
 	}
 
@@ -128,20 +158,30 @@ func (node *P2PNode) handleMDNSEntry(entry *mdns.ServiceEntry) {
 
 	port := entry.Port
 
+	// 与UDP发现共用屏蔽规则
+	if node.isDiscoveryBlocked(DiscoveryMessage{ID: peerID, Name: peerName, IP: ip, Port: port, UUID: peerUUID}) {
+		return
+	}
+
+	// 与UDP发现保持一致的确定性连接：只有一方主动发起，避免与UDP发现重复连接
+	if !node.shouldInitiateConnection(peerID, peerUUID) {
+		return
+	}
+
 	if exists {
 		fmt.Printf("[mDNS] 重新发现已断开的节点: %s (%s:%d)\n", peerName, ip, port)
-		node.PeersMutex.Lock()
-		delete(node.Peers, peerID)
-		node.PeersMutex.Unlock()
+		node.removeInactivePeer(peerID, existingPeer)
 	} else {
 		fmt.Printf("[mDNS] 发现新节点: %s (%s:%d)\n", peerName, ip, port)
 	}
 
-	go node.connectToPeer(ip, port, peerID, peerName)
+	go node.connectToPeerWithKey(ip, port, peerID, peerName, peerWebPort, peerPubKey)
 }
 
 // 停止mDNS服务
 func (node *P2PNode) stopMDNS() {
+	node.mdnsMutex.Lock()
+	defer node.mdnsMutex.Unlock()
 	if node.MdnsServer != nil {
 		if err := node.MdnsServer.Shutdown(); err != nil {
 			fmt.Printf("[mDNS] 关闭mDNS服务器失败: %v\n", err)
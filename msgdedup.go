@@ -0,0 +1,69 @@
+package main
+
+import (
+	"container/list"
+	"sync"
+	"time"
+)
+
+const (
+	seenMessageLimit = 2048             // 记录的已处理消息ID数量上限，超出后淘汰最久未见的
+	seenMessageTTL   = 30 * time.Minute // 超过该时长未再见到的消息ID不再记录（重发都发生在此之前）
+)
+
+// seenMessages 最近处理过的聊天消息ID（有界LRU，条目按 seenMessageTTL 过期）。发送方未收到送达回执会重发，
+// 重连期间新旧连接也可能各投递一次，同一条消息只应入库、展示一次
+type seenMessages struct {
+	mu    sync.Mutex
+	order *list.List               // 最近见到的在前，元素值为 *seenEntry
+	index map[string]*list.Element // key -> order 中的元素
+}
+
+type seenEntry struct {
+	key  string
+	seen time.Time // 最近一次见到的时间
+}
+
+// seenMessageKey 去重键：消息ID由发送方随机生成，加上发送方ID避免不同节点间冲突
+func seenMessageKey(from, messageID string) string {
+	return from + "|" + messageID
+}
+
+// markSeen 记录一条消息，已经处理过时返回 true。
+// 旧版本发来的消息没有 MessageID，无法判断是否重复，总是当作新消息
+func (s *seenMessages) markSeen(from, messageID string, now time.Time) bool {
+	if messageID == "" {
+		return false
+	}
+	key := seenMessageKey(from, messageID)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.index == nil {
+		s.order = list.New()
+		s.index = make(map[string]*list.Element)
+	}
+	s.expireLocked(now)
+	if e, ok := s.index[key]; ok {
+		e.Value.(*seenEntry).seen = now
+		s.order.MoveToFront(e)
+		return true
+	}
+	s.index[key] = s.order.PushFront(&seenEntry{key: key, seen: now})
+	if s.order.Len() > seenMessageLimit {
+		s.removeLocked(s.order.Back())
+	}
+	return false
+}
+
+// expireLocked 从最久未见的一端移除超过 seenMessageTTL 的条目
+func (s *seenMessages) expireLocked(now time.Time) {
+	for e := s.order.Back(); e != nil && now.Sub(e.Value.(*seenEntry).seen) > seenMessageTTL; e = s.order.Back() {
+		s.removeLocked(e)
+	}
+}
+
+func (s *seenMessages) removeLocked(e *list.Element) {
+	s.order.Remove(e)
+	delete(s.index, e.Value.(*seenEntry).key)
+}
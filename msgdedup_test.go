@@ -0,0 +1,60 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestSeenMessagesReplay(t *testing.T) {
+	var s seenMessages
+	t0 := time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC)
+
+	if s.markSeen("peer-a", "m1", t0) {
+		t.Fatal("首次收到的消息被当作重复")
+	}
+	// TTL 内重放同一ID：丢弃
+	if !s.markSeen("peer-a", "m1", t0.Add(time.Minute)) {
+		t.Fatal("重放的消息ID未被丢弃")
+	}
+	// 不同发送方的相同ID互不影响
+	if s.markSeen("peer-b", "m1", t0.Add(time.Minute)) {
+		t.Fatal("其他发送方的相同消息ID被当作重复")
+	}
+	// 没有 MessageID 的旧版本消息总是投递
+	for i := 0; i < 2; i++ {
+		if s.markSeen("peer-a", "", t0) {
+			t.Fatal("没有消息ID的消息被当作重复")
+		}
+	}
+
+	// TTL 之后新ID照常投递，过期条目被清除
+	later := t0.Add(time.Minute + seenMessageTTL + time.Second)
+	if s.markSeen("peer-a", "m2", later) {
+		t.Fatal("TTL 之后的新消息ID被当作重复")
+	}
+	if len(s.index) != 1 {
+		t.Fatalf("过期条目未清除: 仍记录 %d 个ID，期望 1 个", len(s.index))
+	}
+	if !s.markSeen("peer-a", "m2", later.Add(time.Second)) {
+		t.Fatal("TTL 之后重放的新消息ID未被丢弃")
+	}
+}
+
+func TestSeenMessagesLimit(t *testing.T) {
+	var s seenMessages
+	now := time.Now()
+	for i := 0; i <= seenMessageLimit; i++ {
+		s.markSeen("peer-a", fmt.Sprintf("m%d", i), now)
+	}
+	if len(s.index) != seenMessageLimit || s.order.Len() != seenMessageLimit {
+		t.Fatalf("记录 %d 个ID，期望上限 %d", len(s.index), seenMessageLimit)
+	}
+	// 最早的ID已被淘汰，最近的仍会被判为重复
+	if s.markSeen("peer-a", "m0", now) {
+		t.Fatal("超出上限后最早的ID未被淘汰")
+	}
+	if !s.markSeen("peer-a", fmt.Sprintf("m%d", seenMessageLimit), now) {
+		t.Fatal("最近的ID被误淘汰")
+	}
+}
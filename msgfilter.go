@@ -0,0 +1,112 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+)
+
+// 消息过滤规则保存在 AppConfig.MessageFilters：每条规则按正则匹配，
+// 编译失败时降级为纯文本包含匹配。命中规则的收到的消息直接丢弃（不入库、不通知）
+var messageFilters struct {
+	sync.Mutex
+	source   []string        // 编译时的规则列表，与配置不同时（修改或导入配置后）重新编译
+	compiled []messageFilter // 与 source 一一对应
+}
+
+// messageFilter 编译后的一条过滤规则，re 为 nil 时按纯文本包含匹配
+type messageFilter struct {
+	rule string
+	re   *regexp.Regexp
+}
+
+// compileMessageFilter 编译一条规则，不是有效正则时记录日志并降级为包含匹配
+func compileMessageFilter(rule string) messageFilter {
+	re, err := regexp.Compile(rule)
+	if err != nil {
+		Log.Warn("过滤规则不是有效的正则，按关键词匹配", "rule", rule, "error", err)
+		return messageFilter{rule: rule}
+	}
+	return messageFilter{rule: rule, re: re}
+}
+
+func (f messageFilter) match(content string) bool {
+	if f.re != nil {
+		return f.re.MatchString(content)
+	}
+	return strings.Contains(content, f.rule)
+}
+
+// normalizeMessageFilters 去掉空规则和重复规则
+func normalizeMessageFilters(rules []string) []string {
+	list := make([]string, 0, len(rules))
+	for _, rule := range rules {
+		rule = strings.TrimSpace(rule)
+		if rule != "" && !slices.Contains(list, rule) {
+			list = append(list, rule)
+		}
+	}
+	return list
+}
+
+// matchMessageFilter 返回内容命中的第一条规则，未命中时返回空字符串
+func (node *P2PNode) matchMessageFilter(content string) string {
+	if node.Config == nil || content == "" {
+		return ""
+	}
+	node.ConfigMutex.RLock()
+	rules := slices.Clone(node.Config.MessageFilters)
+	node.ConfigMutex.RUnlock()
+	messageFilters.Lock()
+	defer messageFilters.Unlock()
+	if !slices.Equal(messageFilters.source, rules) {
+		messageFilters.source = rules
+		messageFilters.compiled = make([]messageFilter, 0, len(messageFilters.source))
+		for _, rule := range messageFilters.source {
+			messageFilters.compiled = append(messageFilters.compiled, compileMessageFilter(rule))
+		}
+	}
+	for _, f := range messageFilters.compiled {
+		if f.match(content) {
+			return f.rule
+		}
+	}
+	return ""
+}
+
+// messageFilterRules 返回过滤规则列表的副本
+func (node *P2PNode) messageFilterRules() []string {
+	if node.Config == nil {
+		return []string{}
+	}
+	node.ConfigMutex.RLock()
+	defer node.ConfigMutex.RUnlock()
+	return append([]string{}, node.Config.MessageFilters...)
+}
+
+// setMessageFilters 替换过滤规则并保存配置，返回不是有效正则、按关键词匹配的规则
+func (node *P2PNode) setMessageFilters(rules []string) ([]string, error) {
+	if node.Config == nil {
+		return nil, fmt.Errorf("配置不可用")
+	}
+	rules = normalizeMessageFilters(rules)
+	invalid := []string{}
+	for _, rule := range rules {
+		if _, err := regexp.Compile(rule); err != nil {
+			invalid = append(invalid, rule)
+		}
+	}
+
+	node.ConfigMutex.Lock()
+	node.Config.MessageFilters = rules
+	node.ConfigMutex.Unlock()
+
+	if err := node.saveConfig(); err != nil {
+		Log.Error("保存消息过滤规则失败", "error", err)
+		return invalid, err
+	}
+	Log.Info("消息过滤规则已更新", "count", len(rules), "keywordOnly", len(invalid))
+	return invalid, nil
+}
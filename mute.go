@@ -0,0 +1,71 @@
+package main
+
+import (
+	"fmt"
+)
+
+// chatIDForMessage 返回消息所属会话：公聊为 "all"，私聊为对方用户名
+func chatIDForMessage(sender, recipient string, isOwn, isPrivate bool) string {
+	if !isPrivate {
+		return "all"
+	}
+	if isOwn {
+		return recipient
+	}
+	return sender
+}
+
+// isChatMuted 判断会话是否开启了免打扰
+func (node *P2PNode) isChatMuted(chatID string) bool {
+	if node.Config == nil {
+		return false
+	}
+	node.ConfigMutex.RLock()
+	defer node.ConfigMutex.RUnlock()
+	for _, id := range node.Config.MutedChats {
+		if id == chatID {
+			return true
+		}
+	}
+	return false
+}
+
+// mutedChats 返回免打扰会话列表的副本
+func (node *P2PNode) mutedChats() []string {
+	if node.Config == nil {
+		return []string{}
+	}
+	node.ConfigMutex.RLock()
+	defer node.ConfigMutex.RUnlock()
+	return append([]string{}, node.Config.MutedChats...)
+}
+
+// setChatMuted 开启或关闭会话免打扰并保存配置
+func (node *P2PNode) setChatMuted(chatID string, muted bool) error {
+	if node.Config == nil {
+		return fmt.Errorf("配置不可用")
+	}
+	if chatID == "" {
+		return fmt.Errorf("会话不能为空")
+	}
+
+	node.ConfigMutex.Lock()
+	list := make([]string, 0, len(node.Config.MutedChats)+1)
+	for _, id := range node.Config.MutedChats {
+		if id != chatID {
+			list = append(list, id)
+		}
+	}
+	if muted {
+		list = append(list, chatID)
+	}
+	node.Config.MutedChats = list
+	node.ConfigMutex.Unlock()
+
+	if err := node.saveConfig(); err != nil {
+		Log.Error("保存免打扰设置失败", "chatId", chatID, "error", err)
+		return err
+	}
+	Log.Info("免打扰设置已更新", "chatId", chatID, "muted", muted)
+	return nil
+}
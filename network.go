@@ -11,7 +11,10 @@ import (
 	"net"
 	"os"
 	"path/filepath"
+	"sort"
 	"strconv"
+	"strings"
+	"sync"
 	"time"
 	"golang.org/x/crypto/curve25519"
 )
@@ -24,6 +27,19 @@ func enableTCPKeepAlive(conn net.Conn) {
 	}
 }
 
+// 应用层心跳参数
+const (
+	heartbeatInterval = 20 * time.Second // 向活跃peer发送ping的间隔
+	heartbeatTimeout  = 60 * time.Second // 超过该时长未收到任何数据则判定为死连接
+)
+
+// peer 巡检参数：正常情况下断开的peer由 handlePeerConnection 退出时删除，
+// 巡检兜底清理遗留的非活跃条目
+const (
+	peerSweepInterval = 5 * time.Minute
+	stalePeerTimeout  = 10 * time.Minute // 非活跃且超过该时长未收到数据的peer视为遗留
+)
+
 // ECDH密钥生成
 func generateECDHKeyPair() (privateKey [32]byte, publicKey [32]byte, err error) {
 	_, err = rand.Read(privateKey[:])
@@ -76,8 +92,40 @@ func decryptMessage(key [32]byte, ciphertext []byte, nonce []byte) ([]byte, erro
 	return aesGCM.Open(nil, nonce, ciphertext, nil)
 }
 
+// shouldInitiateConnection 决定本机是否应主动向对端发起TCP连接，双方得出相反结论，避免双向同时连接。
+// 优先比较持久的 UserUUID（重启后方向不变），旧版本节点没有UUID时回退到完整 nodeID；
+// 两者都相同时无法区分（视为自身），双方都不发起。
+func (node *P2PNode) shouldInitiateConnection(peerID, peerUUID string) bool {
+	if node.UUID != "" && peerUUID != "" && node.UUID != peerUUID {
+		return node.UUID < peerUUID
+	}
+	if node.ID == peerID {
+		return false
+	}
+	return node.ID < peerID
+}
+
+// removeInactivePeer 删除已断开的peer记录；若期间已被新连接替换或重新激活则保留
+func (node *P2PNode) removeInactivePeer(id string, stale *Peer) {
+	node.PeersMutex.Lock()
+	if cp, ok := node.Peers[id]; ok && cp == stale && !cp.IsActive {
+		delete(node.Peers, id)
+	}
+	node.PeersMutex.Unlock()
+}
+
 // 连接到对等节点（带重试机制）
 func (node *P2PNode) connectToPeer(ip string, port int, id, name string, webPort ...int) {
+	peerWebPort := 0
+	if len(webPort) > 0 {
+		peerWebPort = webPort[0]
+	}
+	node.connectToPeerWithKey(ip, port, id, name, peerWebPort, nil)
+}
+
+// connectToPeerWithKey 同 connectToPeer，pubKey 为发现阶段（mDNS TXT记录）得到的对端公钥：
+// 有效时立即派生共享密钥，握手响应到达前即可加密发送；握手响应中的公钥仍以其为准
+func (node *P2PNode) connectToPeerWithKey(ip string, port int, id, name string, peerWebPort int, pubKey []byte) {
 	// Skip invalid port (old CLI versions may broadcast port 0)
 	if port <= 0 {
 		return
@@ -94,32 +142,48 @@ func (node *P2PNode) connectToPeer(ip string, port int, id, name string, webPort
 		return
 	}
 
-	address := fmt.Sprintf("%s:%d", ip, port)
-	maxRetries := 3
-	baseDelay := 1 * time.Second
+	address := net.JoinHostPort(ip, strconv.Itoa(port)) // IPv6 地址需要加方括号
+	// 同一地址只保留一个重试协程；重试用尽后冷却一段时间
+	if !node.connects.begin(address, time.Now()) {
+		Log.Debug("跳过连接：正在连接或处于冷却期", "peer", name, "address", address)
+		return
+	}
+	connected := false
+	defer func() { node.connects.end(address, !connected, time.Now()) }()
+	maxRetries := node.connectMaxRetries()
 
 	for attempt := 0; attempt < maxRetries; attempt++ {
-		conn, err := net.Dial("tcp", address)
+		conn, err := net.DialTimeout("tcp", address, connectDialTimeout)
 		if err != nil {
 			if attempt < maxRetries-1 {
-				delay := time.Duration(attempt+1) * baseDelay
+				delay := connectRetryDelay(attempt)
 				fmt.Printf("连接到 %s (%s) 失败，重试 %d/%d，等待 %v: %v\n",
 					name, address, attempt+1, maxRetries, delay, err)
 				Log.Debug("连接失败，重试中", "peer", name, "address", address, "attempt", attempt+1, "error", err)
-				time.Sleep(delay)
+				select {
+				case <-node.StopCh:
+					return
+				case <-time.After(delay):
+				}
+				// 等待期间对方可能已主动连入
+				node.PeersMutex.RLock()
+				ep, exists := node.Peers[id]
+				active := exists && ep.IsActive
+				node.PeersMutex.RUnlock()
+				if active {
+					connected = true
+					return
+				}
 				continue
 			} else {
 				fmt.Printf("连接到 %s (%s) 失败，已达到最大重试次数: %v\n", name, address, err)
-				Log.Error("连接失败，已达到最大重试次数", "peer", name, "address", address, "error", err)
+				Log.Error("连接失败，已达到最大重试次数", "peer", name, "address", address, "cooldown", connectCooldown, "error", err)
 				return
 			}
 		}
+		connected = true
 		enableTCPKeepAlive(conn)
 
-		peerWebPort := 0
-		if len(webPort) > 0 {
-			peerWebPort = webPort[0]
-		}
 		peer := &Peer{
 			ID:       id,
 			Name:     name,
@@ -130,6 +194,12 @@ func (node *P2PNode) connectToPeer(ip string, port int, id, name string, webPort
 			IP:       ip,
 			Port:     port,
 			WebPort:  peerWebPort,
+			Outbound: true,
+		}
+		if len(pubKey) == 32 {
+			copy(peer.PublicKey[:], pubKey)
+			shared := deriveSharedKey(node.NodePrivateKey, peer.PublicKey)
+			peer.SharedKey = shared[:]
 		}
 
 		node.PeersMutex.Lock()
@@ -140,12 +210,18 @@ func (node *P2PNode) connectToPeer(ip string, port int, id, name string, webPort
 			conn.Close()
 			return
 		}
+		conflict := node.assignDisplayNameLocked(peer, name)
+		peer.OnlineSince = peer.LastSeen
 		node.Peers[id] = peer
+		onlineSeq := node.nextPresenceSeq()
 		node.PeersMutex.Unlock()
 
-		fmt.Printf("成功连接到节点: %s (%s)\n", name, address)
-		Log.Info("成功连接到节点", "peer", name, "address", address)
-		node.emitUserOnline(name)
+		fmt.Printf("成功连接到节点: %s (%s)\n", peer.Name, address)
+		Log.Info("成功连接到节点", "peer", peer.Name, "address", address)
+		if conflict {
+			node.emitNameConflict(name, peer.Name)
+		}
+		node.emitUserOnline(peer.Name, onlineSeq)
 
 		// Use node-level persistent keys for handshake
 		handshakeMsg := Message{
@@ -154,7 +230,7 @@ func (node *P2PNode) connectToPeer(ip string, port int, id, name string, webPort
 			Content:     node.Name,
 			Timestamp:   time.Now(),
 			SenderPubKey: node.NodePublicKey[:],
-			Data:        map[string]interface{}{"webPort": node.WebPort, "tcpPort": node.LocalPort},
+			Data:        map[string]interface{}{"webPort": node.WebPort, "tcpPort": node.LocalPort, "uuid": node.UUID, "capabilities": localCapabilities, "avatarHash": node.selfAvatarHash()},
 		}
 		node.sendMessageToPeer(peer, handshakeMsg)
 
@@ -163,6 +239,16 @@ func (node *P2PNode) connectToPeer(ip string, port int, id, name string, webPort
 	}
 }
 
+// bufferedConn 先读出已缓冲的数据，再继续从连接读取；写入和关闭直接作用于连接
+type bufferedConn struct {
+	net.Conn
+	r io.Reader
+}
+
+func (c *bufferedConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
+
 // 接受连接
 func (node *P2PNode) acceptConnections() {
 	defer func() {
@@ -170,10 +256,10 @@ func (node *P2PNode) acceptConnections() {
 			Log.Error("acceptConnections panic", "panic", fmt.Sprintf("%v", r))
 		}
 	}()
-	for node.Running {
+	for node.Running.Load() {
 		conn, err := node.Listener.Accept()
 		if err != nil {
-			if node.Running {
+			if node.Running.Load() {
 				fmt.Printf("接受连接失败: %v\n", err)
 				Log.Error("接受TCP连接失败", "error", err)
 			}
@@ -210,7 +296,8 @@ func (node *P2PNode) handleIncomingConnection(conn net.Conn) {
 	}
 
 	peer := &Peer{
-		Conn: conn,
+		// 发起方握手后紧接着发送的消息可能已被读入握手解码器的缓冲区，需接在连接前面继续读取
+		Conn: &bufferedConn{Conn: conn, r: io.MultiReader(decoder.Buffered(), conn)},
 	}
 
 	// Use node-level persistent keys; derive shared key from node.private × peer.public
@@ -237,38 +324,68 @@ func (node *P2PNode) handleIncomingConnection(conn net.Conn) {
 		if tp, ok := data["tcpPort"].(float64); ok && int(tp) > 0 {
 			peer.Port = int(tp)
 		}
+		if uuid, ok := data["uuid"].(string); ok {
+			peer.UUID = uuid
+		}
+		peer.Capabilities = parseCapabilities(data["capabilities"])
+		if hash, ok := data["avatarHash"].(string); ok && validAvatarHash(hash) {
+			peer.AvatarHash = hash
+		}
 	}
 	// 使用对端的监听端口构建重连地址（而非连接的临时端口）
 	if peer.Port > 0 {
-		peer.Address = fmt.Sprintf("%s:%d", peer.IP, peer.Port)
+		peer.Address = net.JoinHostPort(peer.IP, strconv.Itoa(peer.Port))
 	} else {
 		// 兼容旧版本：没有tcpPort字段时使用连接地址
 		peer.Address = conn.RemoteAddr().String()
 	}
 
+	// 被屏蔽的节点直接拒绝（屏蔽双向生效）
+	if node.isPeerBlocked(peer) {
+		Log.Info("拒绝被屏蔽节点的连接", "peer", peer.Name)
+		conn.Close()
+		return
+	}
+
 	node.PeersMutex.Lock()
 	oldPeer, alreadyKnown := node.Peers[peer.ID]
-	if alreadyKnown && oldPeer.IsActive {
-		if node.ID < peer.ID {
-			// 本机是发起方（小ID），不应该收到对方的incoming → 拒绝
+	wasActive := alreadyKnown && oldPeer.IsActive
+	if wasActive {
+		if oldPeer.Outbound && node.shouldInitiateConnection(peer.ID, peer.UUID) {
+			// 本机是发起方且主动连接仍然活跃，对方的incoming属于重复连接 → 拒绝
 			node.PeersMutex.Unlock()
 			Log.Debug("拒绝重复连接：本机应为发起方", "peer", peer.Name)
 			conn.Close()
 			return
 		}
-		// 本机是被动方（大ID），对方是发起方 → 信任对方的重连判断，替换旧连接
+		// 对方是发起方（或旧连接同为incoming）→ 信任对方的重连判断，替换旧连接
 		Log.Info("替换旧连接：接受发起方的新连接", "peer", peer.Name)
 	}
-	if alreadyKnown && oldPeer.Conn != nil {
-		oldPeer.Conn.Close()
+	if alreadyKnown {
+		// 先标记为非活跃再关闭，旧协程读到错误后发现已被替换会直接退出，不会删除新peer
+		oldPeer.IsActive = false
+		if oldPeer.Conn != nil {
+			oldPeer.Conn.Close()
+		}
+	}
+	conflict := node.assignDisplayNameLocked(peer, handshakeMsg.Content)
+	if wasActive {
+		// 替换仍活跃的旧连接不算重新上线，沿用旧连接的上线时间
+		peer.OnlineSince = oldPeer.OnlineSince
+	} else {
+		peer.OnlineSince = peer.LastSeen
 	}
 	node.Peers[peer.ID] = peer
+	onlineSeq := node.nextPresenceSeq()
 	node.PeersMutex.Unlock()
 
+	if conflict {
+		node.emitNameConflict(handshakeMsg.Content, peer.Name)
+	}
 	fmt.Printf("接受来自节点的连接: %s (%s)\n", peer.Name, peer.Address)
 	Log.Info("接受来自节点的连接", "peer", peer.Name, "address", peer.Address)
-	if !alreadyKnown {
-		node.emitUserOnline(peer.Name)
+	if !wasActive {
+		node.emitUserOnline(peer.Name, onlineSeq)
 	}
 
 	// 发送握手响应 (with node-level public key)
@@ -278,9 +395,13 @@ func (node *P2PNode) handleIncomingConnection(conn net.Conn) {
 		Content:     node.Name,
 		Timestamp:   time.Now(),
 		SenderPubKey: node.NodePublicKey[:],
-		Data:        map[string]interface{}{"webPort": node.WebPort, "tcpPort": node.LocalPort},
+		Data:        map[string]interface{}{"webPort": node.WebPort, "tcpPort": node.LocalPort, "uuid": node.UUID, "capabilities": localCapabilities, "avatarHash": node.selfAvatarHash()},
 	}
 	node.sendMessageToPeer(peer, responseMsg)
+	go node.syncPeerIdentity(peer.ID)
+	go node.flushPendingSends(peer.ID)
+	go node.deliverOfflineMessages(peer.ID)
+	go node.retryRemoteImages(peer.ID)
 
 	go node.handlePeerConnection(peer)
 }
@@ -292,13 +413,14 @@ func (node *P2PNode) handlePeerConnection(peer *Peer) {
 			Log.Error("handlePeerConnection panic", "peer", peer.Name, "panic", fmt.Sprintf("%v", r))
 		}
 		peer.Conn.Close()
+		node.closeOutbox(peer)
 	}()
 
-	for node.Running {
+	for node.Running.Load() {
 		decoder := json.NewDecoder(peer.Conn)
 
 		// 读取消息循环
-		for node.Running {
+		for node.Running.Load() {
 			var msg Message
 			if err := decoder.Decode(&msg); err != nil {
 				if err != io.EOF && err.Error() != "use of closed network connection" {
@@ -308,9 +430,17 @@ func (node *P2PNode) handlePeerConnection(peer *Peer) {
 				break
 			}
 
+			// 心跳检查在 PeersMutex 下读取 LastSeen
+			node.PeersMutex.Lock()
 			peer.LastSeen = time.Now()
 			peer.ReconnectAttempts = 0 // 重置重连计数
-			// Safe send: use StopCh to avoid send-on-closed-channel panic
+			node.PeersMutex.Unlock()
+			// 消息来源以所在连接为准，不信任对方自报的 From
+			if msg.From != peer.ID {
+				Log.Warn("消息来源与连接不符，已改为连接对应的节点", "peer", peer.Name, "claimed", msg.From)
+				msg.From = peer.ID
+			}
+			// MessageChan 不会被关闭（避免读协程向已关闭通道发送而panic），停止后由 StopCh 退出
 			select {
 			case node.MessageChan <- msg:
 			case <-node.StopCh:
@@ -319,21 +449,37 @@ func (node *P2PNode) handlePeerConnection(peer *Peer) {
 		}
 
 		// 连接断开
-		if !node.Running {
+		if !node.Running.Load() {
 			break
 		}
 
-		// Check if we've been replaced by a newer connection
-		node.PeersMutex.RLock()
+		// Check if we've been replaced by a newer connection; 检查与标记在同一把锁内完成，
+		// 避免新连接恰好在两步之间写入map时被误报下线
+		node.PeersMutex.Lock()
 		currentPeer, stillInMap := node.Peers[peer.ID]
-		node.PeersMutex.RUnlock()
-		if !stillInMap || currentPeer != peer {
+		replaced := !stillInMap || currentPeer != peer
+		var offlineSeq uint64
+		if !replaced {
+			peer.IsActive = false
+			// 对方重启后以新节点ID重连时，新旧连接会短暂并存：仍有同名活跃连接则不报下线
+			if !node.hasActivePeerNamedLocked(peer.Name) {
+				offlineSeq = node.nextPresenceSeq()
+			} else {
+				node.inheritOnlineSinceLocked(peer)
+			}
+		}
+		node.PeersMutex.Unlock()
+		if replaced {
 			Log.Info("连接已被新连接替换，退出旧协程", "peer", peer.Name)
 			return
 		}
 
-		peer.IsActive = false
-		node.emitUserOffline(peer.Name)
+		if offlineSeq != 0 {
+			node.recordOnlineSession(peer, time.Now())
+			node.emitUserOffline(peer.Name, offlineSeq)
+		} else {
+			Log.Info("同名用户仍有活跃连接，不发送下线事件", "peer", peer.Name)
+		}
 
 		// If the disconnecting peer was the update source, clear the update banner
 		node.PeersMutex.RLock()
@@ -371,149 +517,387 @@ func (node *P2PNode) handleMessages() {
 			Log.Error("handleMessages panic", "panic", fmt.Sprintf("%v", r))
 		}
 	}()
-	cleanupTicker := time.NewTicker(5 * time.Minute)
+	cleanupTicker := time.NewTicker(memoryCleanupInterval)
 	defer cleanupTicker.Stop()
 
 	for {
 		select {
-		case msg, ok := <-node.MessageChan:
-			if !ok {
-				return // 通道已关闭
+		case <-node.StopCh:
+			return
+		case msg := <-node.MessageChan:
+			node.dispatchMessage(msg)
+		case <-cleanupTicker.C:
+			node.cleanupMemory()
+		}
+	}
+}
+
+// decryptChatMessage 解密聊天消息，明文（或失败提示）写回 Content，之后按未加密消息处理
+func (node *P2PNode) decryptChatMessage(msg *Message) {
+	if !msg.Encrypted || len(msg.Nonce) == 0 || len(msg.Ciphertext) == 0 {
+		return
+	}
+	// 查找发送方 peer 以获取共享密钥
+	// 共享密钥可能在握手响应时更新，在锁内读取
+	node.PeersMutex.RLock()
+	var sharedKey []byte
+	if senderPeer, exists := node.Peers[msg.From]; exists {
+		sharedKey = senderPeer.SharedKey
+	}
+	node.PeersMutex.RUnlock()
+	if len(sharedKey) > 0 {
+		plaintext, err := decryptMessage([32]byte(sharedKey), msg.Ciphertext, msg.Nonce)
+		if err == nil {
+			msg.Content = string(plaintext)
+		} else {
+			fmt.Printf("解密失败: %v\n", err)
+			Log.Error("消息解密失败", "from", msg.From, "error", err)
+			msg.Content = "[解密失败]"
+		}
+	} else {
+		msg.Content = "[无密钥]"
+	}
+	msg.Encrypted, msg.Ciphertext, msg.Nonce = false, nil, nil
+}
+
+// dispatchMessage 按消息类型分发一条收到的消息，由 handleMessages 主循环串行调用。
+// 单条消息处理 panic 只丢弃该消息，主循环（含定期清理）继续运行
+func (node *P2PNode) dispatchMessage(msg Message) {
+	defer func() {
+		if r := recover(); r != nil {
+			Log.Error("处理消息 panic", "from", msg.From, "type", msg.Type, "panic", fmt.Sprintf("%v", r))
+		}
+	}()
+	Log.Debug("收到消息", "from", msg.From, "type", msg.Type)
+
+	if msg.Type == "chat" {
+		node.decryptChatMessage(&msg)
+	}
+	if !node.runMessageHooks(&msg) {
+		return
+	}
+
+	switch msg.Type {
+	case "chat":
+		content := msg.Content
+		node.PeersMutex.RLock()
+		senderPeer, exists := node.Peers[msg.From]
+		node.PeersMutex.RUnlock()
+		if !exists {
+			return
+		}
+		senderName := node.getPeerName(msg.From)
+		if node.seenMessages.markSeen(msg.From, msg.MessageID, time.Now()) {
+			// 重复投递（发送方重发或重连期间新旧连接各送一次）：不入库、不展示。
+			// 重发多因回执丢失，私聊再回一次送达回执
+			Log.Debug("丢弃重复消息", "from", senderName, "messageId", msg.MessageID)
+			if msg.To == node.ID && !node.isPeerBlocked(senderPeer) {
+				go node.sendDeliveryReceipt(senderPeer, msg.MessageID)
 			}
-			Log.Debug("收到消息", "from", msg.From, "type", msg.Type)
-
-			switch msg.Type {
-		case "chat":
-			// 解密聊天消息
-			var content string
-			if msg.Encrypted && len(msg.Nonce) > 0 && len(msg.Ciphertext) > 0 {
-				// 查找发送方 peer 以获取共享密钥
-				node.PeersMutex.RLock()
-				senderPeer, exists := node.Peers[msg.From]
-				node.PeersMutex.RUnlock()
-				if exists && len(senderPeer.SharedKey) > 0 {
-					plaintext, err := decryptMessage([32]byte(senderPeer.SharedKey), msg.Ciphertext, msg.Nonce)
-					if err == nil {
-						content = string(plaintext)
-					} else {
-						fmt.Printf("解密失败: %v\n", err)
-						Log.Error("消息解密失败", "from", msg.From, "error", err)
-						content = "[解密失败]"
-					}
-				} else {
-					content = "[无密钥]"
-				}
-			} else {
-				content = msg.Content
+			return
+		}
+		if rule := node.matchMessageFilter(content); rule != "" {
+			// 命中过滤规则：不入库、不通知（私聊仍回送达回执，避免对方显示未送达）
+			Log.Debug("消息命中过滤规则，已丢弃", "from", senderName, "rule", rule)
+			if msg.To == node.ID && !node.isPeerBlocked(senderPeer) {
+				go node.sendDeliveryReceipt(senderPeer, msg.MessageID)
 			}
-
-			senderPeer, exists := node.Peers[msg.From]
-			if !exists {
-				continue
+			return
+		}
+		if msg.To == "" || msg.To == "all" {
+			// 公聊消息
+			if node.isPeerBlocked(senderPeer) {
+				return
 			}
-			senderName := node.getPeerName(msg.From)
-			if msg.To == "" || msg.To == "all" {
-				// 公聊消息
-				if node.isBlocked(senderPeer.Address) {
-					continue
-				}
-				fileURL := node.processReceivedFile(msg)
-				node.addChatMessageWithType(senderName, "all", content, false, false,
-					msg.MessageType, msg.MessageID, msg.ReplyToID, msg.ReplyToContent, msg.ReplyToSender,
-					msg.FileName, msg.FileSize, msg.FileType, fileURL, msg.FileID)
-			} else if msg.To == node.ID {
-				// 私聊消息
-				if node.isBlocked(senderPeer.Address) {
-					continue
-				}
+			if msg.MessageType == MessageTypeLocation {
+				node.addLocationMessage(senderName, "all", false, false,
+					msg.MessageID, msg.Latitude, msg.Longitude, msg.LocationName)
+				return
+			}
+			fileURL := node.processReceivedFile(msg)
+			node.addReceivedMessage(senderName, "all", content, false, msg, fileURL)
+		} else if msg.To == node.ID {
+			// 私聊消息
+			if node.isPeerBlocked(senderPeer) {
+				return
+			}
+			go node.sendDeliveryReceipt(senderPeer, msg.MessageID)
+			if msg.MessageType == MessageTypeLocation {
+				node.addLocationMessage(senderName, node.Name, false, true,
+					msg.MessageID, msg.Latitude, msg.Longitude, msg.LocationName)
+			} else {
 				fileURL := node.processReceivedFile(msg)
-				node.addChatMessageWithType(senderName, node.Name, content, false, true,
-					msg.MessageType, msg.MessageID, msg.ReplyToID, msg.ReplyToContent, msg.ReplyToSender,
-					msg.FileName, msg.FileSize, msg.FileType, fileURL, msg.FileID)
+				node.addReceivedMessage(senderName, node.Name, content, true, msg, fileURL)
 			}
-		case "file_complete":
-			// 文件传输完成确认（接收方→发送方）
-			node.handleFileComplete(msg.Content)
-		case "file_cancel":
-			// 文件传输取消
-			node.handleFileTransferCancel(msg.Content)
-		case "handshake":
-			// 握手消息已在连接处理中处理
-		case "handshake_response":
-			// 握手响应 - 使用节点持久密钥派生共享密钥
-			node.PeersMutex.Lock()
-			var peer *Peer
-			var exists bool
-			peer, exists = node.Peers[msg.From]
-			if exists && len(msg.SenderPubKey) == 32 {
-				var remotePub [32]byte
-				copy(remotePub[:], msg.SenderPubKey)
-				peer.PublicKey = remotePub // Store remote peer's public key
-				shared := deriveSharedKey(node.NodePrivateKey, remotePub)
-				peer.SharedKey = shared[:]
-				// 从握手响应中提取WebPort和tcpPort
-				if data, ok := msg.Data.(map[string]interface{}); ok {
-					if wp, ok := data["webPort"].(float64); ok {
-						peer.WebPort = int(wp)
-					}
-					if tp, ok := data["tcpPort"].(float64); ok && int(tp) > 0 {
-						peer.Port = int(tp)
-						peer.Address = fmt.Sprintf("%s:%d", peer.IP, peer.Port)
-					}
-				}
-				fmt.Printf("与 %s 建立加密连接\n", peer.Name)
-				Log.Info("建立加密连接", "peer", peer.Name)
+			node.maybeAutoReply(senderPeer, msg)
+		}
+	case "pin_message", "unpin_message":
+		// 会话成员置顶/取消置顶消息，Content 为消息ID
+		node.PeersMutex.RLock()
+		peer, exists := node.Peers[msg.From]
+		node.PeersMutex.RUnlock()
+		if exists {
+			node.handlePinMessage(peer, msg)
+		}
+	case "delivered":
+		// 私聊消息送达回执（接收方→发送方），Content 为消息ID
+		node.PeersMutex.RLock()
+		peer, exists := node.Peers[msg.From]
+		node.PeersMutex.RUnlock()
+		if exists {
+			node.handleDeliveryReceipt(peer, msg.Content)
+		}
+	case "image_request", "image_data":
+		// 按链接发送的公聊图片：HTTP拉取失败时经P2P连接请求/回传图片
+		node.PeersMutex.RLock()
+		peer, exists := node.Peers[msg.From]
+		node.PeersMutex.RUnlock()
+		if !exists {
+			return
+		}
+		if msg.Type == "image_request" {
+			go node.handleImageRequest(peer, msg.Content)
+		} else {
+			node.handleImageData(peer, msg.Content, msg.FileData)
+		}
+	case "file_complete":
+		// 文件传输完成确认（接收方→发送方）
+		node.handleFileComplete(msg.Content)
+	case "file_cancel":
+		// 文件传输取消
+		node.handleFileTransferCancel(msg.Content)
+	case "file_failed":
+		// 对方检测到文件传输卡死，已判定失败
+		node.handleFileTransferFailed(msg.Content)
+	case "handshake":
+		// 握手消息已在连接处理中处理
+	case "handshake_response":
+		// 握手响应 - 使用节点持久密钥派生共享密钥
+		node.PeersMutex.Lock()
+		var peer *Peer
+		var exists bool
+		peer, exists = node.Peers[msg.From]
+		if exists && len(msg.SenderPubKey) == 32 {
+			var remotePub [32]byte
+			copy(remotePub[:], msg.SenderPubKey)
+			if len(peer.SharedKey) > 0 && peer.PublicKey != remotePub {
+				Log.Warn("握手公钥与发现阶段公告的不一致，以握手为准", "peer", peer.Name)
 			}
-			node.PeersMutex.Unlock()
-		case "file_request":
-			// 文件传输请求
+			peer.PublicKey = remotePub // Store remote peer's public key
+			shared := deriveSharedKey(node.NodePrivateKey, remotePub)
+			peer.SharedKey = shared[:]
+			// 从握手响应中提取WebPort和tcpPort
 			if data, ok := msg.Data.(map[string]interface{}); ok {
-				jsonData, _ := json.Marshal(data)
-				var request FileTransferRequest
-				if err := json.Unmarshal(jsonData, &request); err == nil {
-					node.handleFileTransferRequest(request)
+				if wp, ok := data["webPort"].(float64); ok {
+					peer.WebPort = int(wp)
 				}
-			}
-		case "file_response":
-			// 文件传输响应
-			if data, ok := msg.Data.(map[string]interface{}); ok {
-				jsonData, _ := json.Marshal(data)
-				var response FileTransferResponse
-				if err := json.Unmarshal(jsonData, &response); err == nil {
-					node.handleFileTransferResponse(response)
+				if tp, ok := data["tcpPort"].(float64); ok && int(tp) > 0 {
+					peer.Port = int(tp)
+					peer.Address = net.JoinHostPort(peer.IP, strconv.Itoa(peer.Port))
 				}
-			}
-		case "file_chunk":
-			// 文件数据块
-			if data, ok := msg.Data.(map[string]interface{}); ok {
-				jsonData, _ := json.Marshal(data)
-				var chunk FileChunk
-				if err := json.Unmarshal(jsonData, &chunk); err == nil {
-					node.handleFileChunk(chunk)
+				if uuid, ok := data["uuid"].(string); ok {
+					peer.UUID = uuid
+				}
+				peer.Capabilities = parseCapabilities(data["capabilities"])
+				if hash, ok := data["avatarHash"].(string); ok && validAvatarHash(hash) {
+					peer.AvatarHash = hash
 				}
 			}
-		case "update_name":
-			// 用户名更新
-			node.PeersMutex.Lock()
-			var oldName string
-			if peer, exists := node.Peers[msg.From]; exists {
-				oldName = peer.Name
-				peer.Name = msg.Content
-				fmt.Printf("用户 %s 已更名为 %s\n", oldName, peer.Name)
+			fmt.Printf("与 %s 建立加密连接\n", peer.Name)
+			Log.Info("建立加密连接", "peer", peer.Name)
+		}
+		node.PeersMutex.Unlock()
+		if exists && node.isPeerBlocked(peer) {
+			// 主动连接的对端在握手响应后才知道其UUID
+			Log.Info("断开被屏蔽节点", "peer", peer.Name)
+			peer.IsActive = false
+			peer.Conn.Close()
+		} else if exists {
+			go node.syncPeerIdentity(msg.From)
+			go node.flushPendingSends(msg.From)
+			go node.deliverOfflineMessages(msg.From)
+			go node.retryRemoteImages(msg.From)
+		}
+	case "file_request":
+		// 文件传输请求
+		if data, ok := msg.Data.(map[string]interface{}); ok {
+			jsonData, _ := json.Marshal(data)
+			var request FileTransferRequest
+			if err := json.Unmarshal(jsonData, &request); err == nil {
+				// 发送方以连接对应的节点为准（自动接受按它判断信任），不使用载荷中自报的 From
+				request.From = msg.From
+				node.handleFileTransferRequest(request)
 			}
-			node.PeersMutex.Unlock()
+		}
+	case "file_response":
+		// 文件传输响应
+		if data, ok := msg.Data.(map[string]interface{}); ok {
+			jsonData, _ := json.Marshal(data)
+			var response FileTransferResponse
+			if err := json.Unmarshal(jsonData, &response); err == nil {
+				node.handleFileTransferResponse(response)
+			}
+		}
+	case "file_chunk":
+		// 文件数据块
+		if data, ok := msg.Data.(map[string]interface{}); ok {
+			jsonData, _ := json.Marshal(data)
+			var chunk FileChunk
+			if err := json.Unmarshal(jsonData, &chunk); err == nil {
+				node.handleFileChunk(chunk)
+			}
+		}
+	case "file_resend":
+		// 接收方请求重传缺失的文件块
+		if data, ok := msg.Data.(map[string]interface{}); ok {
+			jsonData, _ := json.Marshal(data)
+			var req FileResendRequest
+			if err := json.Unmarshal(jsonData, &req); err == nil {
+				go node.handleFileResend(msg.From, req)
+			}
+		}
+	case "ping":
+		// 心跳请求，回复pong（不落库、不进历史）
+		node.PeersMutex.RLock()
+		peer, exists := node.Peers[msg.From]
+		node.PeersMutex.RUnlock()
+		if exists {
+			// 回显ping序号，供对端计算RTT
+			go node.sendMessageToPeer(peer, Message{Type: "pong", From: node.ID, Content: msg.Content, Timestamp: time.Now()})
+		}
+	case "pong":
+		// 心跳响应，LastSeen 已在 handlePeerConnection 中刷新
+		node.PeersMutex.RLock()
+		peer, exists := node.Peers[msg.From]
+		node.PeersMutex.RUnlock()
+		if exists {
+			node.handlePong(peer, msg.Content)
+		}
+	case "update_name":
+		// 用户名更新
+		node.PeersMutex.Lock()
+		var oldName, newName, peerUUID string
+		var conflict bool
+		if peer, exists := node.Peers[msg.From]; exists {
+			oldName = peer.Name
+			peerUUID = peer.UUID
+			conflict = node.assignDisplayNameLocked(peer, msg.Content)
+			newName = peer.Name
+			fmt.Printf("用户 %s 已更名为 %s\n", oldName, peer.Name)
+		}
+		node.PeersMutex.Unlock()
+		if conflict {
+			node.emitNameConflict(msg.Content, newName)
+		}
+
+		// Merge old name's messages into new name
+		if oldName != "" && oldName != newName {
+			node.renamePeerInMessages(peerUUID, oldName, newName)
+		}
+	case "update_avatar":
+		// 对端更换或清除了自定义头像（Content 为新哈希）
+		node.handlePeerAvatar(msg.From, msg.Content)
+	}
+}
+
+// 心跳：定期向活跃peer发送ping，并主动断开超时未响应的死连接
+func (node *P2PNode) startHeartbeat() {
+	ticker := time.NewTicker(heartbeatInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			node.checkPeerHeartbeats()
+			node.expirePendingSends()
+		case <-node.StopCh:
+			return
+		}
+	}
+}
+
+// 检查所有活跃peer的心跳状态
+func (node *P2PNode) checkPeerHeartbeats() {
+	type deadPeer struct {
+		name     string
+		lastSeen time.Time
+		conn     net.Conn
+	}
+	var alive []*Peer
+	var dead []deadPeer
+	node.PeersMutex.Lock()
+	for _, peer := range node.Peers {
+		if !peer.IsActive {
+			continue
+		}
+		if time.Since(peer.LastSeen) > heartbeatTimeout {
+			// 在锁内标记为非活跃，其他协程不会再向这条连接发送
+			peer.IsActive = false
+			dead = append(dead, deadPeer{peer.Name, peer.LastSeen, peer.Conn})
+		} else {
+			alive = append(alive, peer)
+		}
+	}
+	node.PeersMutex.Unlock()
+
+	for _, d := range dead {
+		// 关闭连接后 handlePeerConnection 读取失败，会负责标记离线并清理
+		fmt.Printf("节点 %s 心跳超时，断开连接\n", d.name)
+		Log.Warn("心跳超时，主动断开连接", "peer", d.name, "lastSeen", d.lastSeen)
+		if d.conn != nil {
+			d.conn.Close()
+		}
+	}
 
-			// Merge old name's messages into new name
-			if oldName != "" && oldName != msg.Content {
-				node.renamePeerInMessages(oldName, msg.Content)
+	for _, peer := range alive {
+		go func(p *Peer) {
+			if err := node.sendMessageToPeer(p, node.newHeartbeatPing(p)); err != nil {
+				Log.Debug("发送心跳失败", "peer", p.Name, "error", err)
 			}
+		}(peer)
+	}
+}
+
+// startPeerSweeper 定期清理遗留的非活跃peer条目
+func (node *P2PNode) startPeerSweeper() {
+	ticker := time.NewTicker(peerSweepInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if n := node.sweepStalePeers(time.Now()); n > 0 {
+				Log.Info("已清理遗留的非活跃节点", "count", n)
 			}
-		case <-cleanupTicker.C:
-			node.cleanupMemory()
+		case <-node.StopCh:
+			return
 		}
 	}
 }
 
+// sweepStalePeers 删除 IsActive=false 且长时间未收到数据的peer，关闭其可能泄漏的连接，返回清理数量
+func (node *P2PNode) sweepStalePeers(now time.Time) int {
+	var stale []*Peer
+	node.PeersMutex.Lock()
+	for id, peer := range node.Peers {
+		if peer.IsActive || now.Sub(peer.LastSeen) < stalePeerTimeout {
+			continue
+		}
+		delete(node.Peers, id)
+		stale = append(stale, peer)
+	}
+	node.PeersMutex.Unlock()
+
+	for _, peer := range stale {
+		Log.Debug("清理非活跃节点", "peer", peer.Name, "id", peer.ID, "lastSeen", peer.LastSeen)
+		if peer.Conn != nil {
+			peer.Conn.Close()
+		}
+		node.closeOutbox(peer)
+	}
+	return len(stale)
+}
+
 // 获取对等节点名称
 func (node *P2PNode) getPeerName(peerID string) string {
 	node.PeersMutex.RLock()
@@ -525,12 +909,233 @@ func (node *P2PNode) getPeerName(peerID string) string {
 	return peerID
 }
 
+// hasActivePeerNamedLocked 是否存在该显示名的活跃连接，调用方需持有 PeersMutex
+func (node *P2PNode) hasActivePeerNamedLocked(name string) bool {
+	for _, peer := range node.Peers {
+		if peer.IsActive && peer.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// findPeer 按标识查找在线peer，依次尝试每个key，每个key按节点ID、用户UUID、显示名的顺序匹配。
+// 调用方应优先传入稳定标识（如传输记录中的peer ID），用户名作为回退
+func (node *P2PNode) findPeer(keys ...string) *Peer {
+	node.PeersMutex.RLock()
+	defer node.PeersMutex.RUnlock()
+
+	for _, key := range keys {
+		if key == "" {
+			continue
+		}
+		if peer, exists := node.Peers[key]; exists && peer.IsActive {
+			return peer
+		}
+		var byName *Peer
+		for _, peer := range node.Peers {
+			if !peer.IsActive {
+				continue
+			}
+			if peer.UUID == key {
+				return peer
+			}
+			if peer.Name == key {
+				byName = peer
+			}
+		}
+		if byName != nil {
+			return byName
+		}
+	}
+	return nil
+}
+
+// assignDisplayNameLocked 设置peer的自报名与显示名。自报名与本机或其他在线用户重名时，
+// 显示名追加IP区分（如 "Admin (192.168.1.5)"，同一IP多开时用IP:端口），先上线的用户保留原名。
+// 返回是否发生了重名。调用方需持有 PeersMutex 写锁
+func (node *P2PNode) assignDisplayNameLocked(peer *Peer, name string) bool {
+	peer.BaseName = name
+	if !node.displayNameTakenLocked(peer, name) {
+		peer.Name = name
+		return false
+	}
+
+	candidates := []string{}
+	if peer.IP != "" {
+		candidates = append(candidates, fmt.Sprintf("%s (%s)", name, peer.IP))
+	}
+	if peer.Address != "" {
+		candidates = append(candidates, fmt.Sprintf("%s (%s)", name, peer.Address))
+	}
+	for _, c := range candidates {
+		if !node.displayNameTakenLocked(peer, c) {
+			peer.Name = c
+			Log.Warn("节点名称冲突，已追加区分后缀", "name", name, "displayName", c, "peerID", peer.ID)
+			return true
+		}
+	}
+	// IP和地址都无法区分时使用节点ID前缀
+	suffix := peer.ID
+	if len(suffix) > 8 {
+		suffix = suffix[len(suffix)-8:]
+	}
+	peer.Name = fmt.Sprintf("%s (%s)", name, suffix)
+	Log.Warn("节点名称冲突，已追加区分后缀", "name", name, "displayName", peer.Name, "peerID", peer.ID)
+	return true
+}
+
+// displayNameTakenLocked 判断显示名是否已被本机或其他在线用户占用（同一节点或同一用户的旧连接不算）
+func (node *P2PNode) displayNameTakenLocked(peer *Peer, name string) bool {
+	if name == node.Name || name == "all" {
+		return true
+	}
+	for _, other := range node.Peers {
+		if other == peer || !other.IsActive || other.ID == peer.ID {
+			continue
+		}
+		if peer.UUID != "" && other.UUID == peer.UUID {
+			continue
+		}
+		if other.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
 // 发送消息到对等节点
 func (node *P2PNode) sendMessageToPeer(peer *Peer, msg Message) error {
-	if len(peer.SharedKey) > 0 && msg.Type == "chat" {
+	if msg.Type == "chat" && msg.MessageID == "" {
+		msg.MessageID = generateMessageID()
+	}
+	result := make(chan error, 1)
+	if !node.queueSend(peer, msg, result) {
+		return errPeerOutboxClosed
+	}
+	return <-result
+}
+
+// errPeerOutboxClosed 连接已断开，发送队列不再接受消息
+var errPeerOutboxClosed = fmt.Errorf("连接已关闭")
+
+// outgoingMessage 发送队列中的一项；result 非空时写入结果回传给调用方
+type outgoingMessage struct {
+	msg    Message
+	result chan error
+}
+
+// peerOutbox 单个peer的串行发送队列：调用方按顺序入队，由一个协程依次写入连接，
+// 避免各自起协程发送时因调度导致对端收到乱序消息。连接断开后关闭。
+type peerOutbox struct {
+	mu      sync.Mutex
+	queue   []outgoingMessage
+	started bool
+	closed  bool
+	wake    chan struct{}
+}
+
+// queueSend 将消息加入peer的发送队列，必要时启动发送协程；队列已关闭时返回false。
+// 聊天消息在连接不可用时转入重试队列，与直接写入失败的处理一致。
+func (node *P2PNode) queueSend(peer *Peer, msg Message, result chan error) bool {
+	box := &peer.Outbox
+	box.mu.Lock()
+	if box.closed {
+		box.mu.Unlock()
+		if msg.Type == "chat" {
+			node.enqueuePendingSend(peer, msg)
+		}
+		return false
+	}
+	if !box.started {
+		box.started = true
+		box.wake = make(chan struct{}, 1)
+		go node.runOutbox(peer)
+	}
+	box.queue = append(box.queue, outgoingMessage{msg: msg, result: result})
+	box.mu.Unlock()
+
+	select {
+	case box.wake <- struct{}{}:
+	default:
+	}
+	return true
+}
+
+// closeOutbox 连接断开时关闭发送队列，尚未发送的消息以连接关闭错误返回。可重复调用。
+func (node *P2PNode) closeOutbox(peer *Peer) {
+	box := &peer.Outbox
+	box.mu.Lock()
+	if box.closed {
+		box.mu.Unlock()
+		return
+	}
+	box.closed = true
+	rest := box.queue
+	box.queue = nil
+	wake := box.wake
+	box.mu.Unlock()
+
+	for _, out := range rest {
+		if out.msg.Type == "chat" {
+			node.enqueuePendingSend(peer, out.msg)
+		}
+		if out.result != nil {
+			out.result <- errPeerOutboxClosed
+		}
+	}
+	if wake != nil {
+		select {
+		case wake <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// runOutbox 发送协程：按入队顺序写入连接，队列关闭后退出
+func (node *P2PNode) runOutbox(peer *Peer) {
+	box := &peer.Outbox
+	for range box.wake {
+		for {
+			box.mu.Lock()
+			if len(box.queue) == 0 {
+				closed := box.closed
+				box.mu.Unlock()
+				if closed {
+					return
+				}
+				break
+			}
+			out := box.queue[0]
+			box.queue = box.queue[1:]
+			box.mu.Unlock()
+
+			err := node.writeMessageToPeer(peer, out.msg)
+			if out.result != nil {
+				out.result <- err
+			} else if err != nil {
+				Log.Error("发送消息失败", "peer", peer.Name, "type", out.msg.Type, "error", err)
+			}
+		}
+	}
+}
+
+// writeMessageToPeer 加密（仅聊天消息）并写入连接，失败的聊天消息加入重试队列
+func (node *P2PNode) writeMessageToPeer(peer *Peer, msg Message) error {
+	msg, ok := node.adaptMessageForPeer(peer, msg)
+	if !ok {
+		return nil
+	}
+	original := msg // 保留明文，重发时用新连接的共享密钥重新加密
+
+	// 共享密钥可能在握手响应时更新，在锁内读取
+	node.PeersMutex.RLock()
+	sharedKey := peer.SharedKey
+	node.PeersMutex.RUnlock()
+	if len(sharedKey) > 0 && msg.Type == "chat" {
 		// 加密聊天消息
 		plaintext := []byte(msg.Content)
-		ciphertext, nonce, err := encryptMessage([32]byte(peer.SharedKey), plaintext)
+		ciphertext, nonce, err := encryptMessage([32]byte(sharedKey), plaintext)
 		if err != nil {
 			return err
 		}
@@ -542,37 +1147,103 @@ func (node *P2PNode) sendMessageToPeer(peer *Peer, msg Message) error {
 
 	// Serialize writes to prevent concurrent JSON encoder interleaving
 	peer.WriteMutex.Lock()
-	defer peer.WriteMutex.Unlock()
 	encoder := json.NewEncoder(peer.Conn)
-	return encoder.Encode(msg)
+	err := encoder.Encode(msg)
+	peer.WriteMutex.Unlock()
+
+	if err != nil && original.Type == "chat" {
+		node.enqueuePendingSend(peer, original)
+	} else if err == nil && original.Type == "chat" && original.To != "" && original.To != "all" {
+		node.setDeliveryStatus(original.MessageID, DeliverySent)
+	}
+	return err
 }
 
 // 广播消息到所有对等节点
 func (node *P2PNode) broadcastMessage(msg Message) {
-	node.PeersMutex.RLock()
-	defer node.PeersMutex.RUnlock()
+	if msg.Type == "chat" && msg.MessageID == "" {
+		msg.MessageID = generateMessageID()
+	}
 
+	node.PeersMutex.RLock()
+	var active []*Peer
 	for _, peer := range node.Peers {
 		if peer.IsActive {
-			go func(p *Peer) {
-				if err := node.sendMessageToPeer(p, msg); err != nil {
-					Log.Error("发送消息失败", "peer", p.Name, "type", msg.Type, "error", err)
-				}
-			}(peer)
+			active = append(active, peer)
 		}
 	}
+	node.PeersMutex.RUnlock()
+
+	// 在调用方协程内按顺序入队，连续两次广播在每个peer上的发送顺序与调用顺序一致；
+	// 入队在锁外进行，连接已关闭时转入重试队列需要读取peer信息
+	for _, peer := range active {
+		node.queueSend(peer, msg, nil)
+	}
 }
 
-// 获取本地IP地址
-func getLocalIP() string {
-	interfaces, err := net.Interfaces()
+// localInterface 一个可用的本机 IPv4 地址及其评分，评分越高越可能是真实局域网
+type localInterface struct {
+	Name  string
+	IP    string
+	Score int
+}
+
+// 常见虚拟网卡（虚拟机、容器、VPN）的名称关键字与 MAC 前缀
+var (
+	virtualInterfaceKeywords = []string{
+		"vmware", "vmnet", "virtualbox", "vbox", "hyper-v", "vethernet", "docker", "br-", "veth",
+		"virbr", "tun", "tap", "wg", "tailscale", "zerotier", "utun", "vpn", "hamachi", "npcap", "loopback",
+	}
+	virtualMACPrefixes = []string{
+		"00:05:69", "00:0c:29", "00:1c:14", "00:50:56", // VMware
+		"08:00:27", "0a:00:27", // VirtualBox
+		"00:15:5d", // Hyper-V
+		"00:1c:42", // Parallels
+		"02:42",    // Docker
+	}
+)
+
+// isVirtualInterface 按名称和 MAC 前缀判断是否为虚拟网卡
+func isVirtualInterface(iface net.Interface) bool {
+	name := strings.ToLower(iface.Name)
+	for _, kw := range virtualInterfaceKeywords {
+		if strings.Contains(name, kw) {
+			return true
+		}
+	}
+	mac := strings.ToLower(iface.HardwareAddr.String())
+	for _, prefix := range virtualMACPrefixes {
+		if strings.HasPrefix(mac, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// defaultRouteIP 返回访问外网时系统选用的源地址，即默认网关所在接口的地址。
+// UDP "连接"只查路由表，不会发出数据包；没有默认路由时返回空字符串
+func defaultRouteIP() string {
+	conn, err := net.Dial("udp4", "8.8.8.8:53")
 	if err != nil {
-		return "127.0.0.1"
+		return ""
 	}
+	defer conn.Close()
+	if addr, ok := conn.LocalAddr().(*net.UDPAddr); ok {
+		return addr.IP.String()
+	}
+	return ""
+}
 
-	var availableIPs []string
-	var interfaceNames []string
+// listLocalInterfaces 列出所有已启用的非回环 IPv4 地址，按评分从高到低排序：
+// 有默认网关 +40，私有网段（192.168/10/172.16）+20，虚拟网卡 -30，链路本地地址（169.254）-50
+func listLocalInterfaces() []localInterface {
+	interfaces, err := net.Interfaces()
+	if err != nil {
+		return nil
+	}
+	gatewayIP := defaultRouteIP()
 
+	var list []localInterface
 	for _, iface := range interfaces {
 		if iface.Flags&net.FlagUp == 0 || iface.Flags&net.FlagLoopback != 0 {
 			continue
@@ -583,51 +1254,112 @@ func getLocalIP() string {
 			continue
 		}
 
+		virtual := isVirtualInterface(iface)
 		for _, addr := range addrs {
-			if ipnet, ok := addr.(*net.IPNet); ok && !ipnet.IP.IsLoopback() {
-				if ipnet.IP.To4() != nil {
-					ip := ipnet.IP.String()
-					availableIPs = append(availableIPs, ip)
-					interfaceNames = append(interfaceNames, iface.Name)
-				}
+			ipnet, ok := addr.(*net.IPNet)
+			if !ok || ipnet.IP.IsLoopback() || ipnet.IP.To4() == nil {
+				continue
+			}
+			ip := ipnet.IP.String()
+			score := 0
+			if ip == gatewayIP {
+				score += 40
+			}
+			if ipnet.IP.IsPrivate() {
+				score += 20
 			}
+			if virtual {
+				score -= 30
+			}
+			if ipnet.IP.IsLinkLocalUnicast() {
+				score -= 50
+			}
+			list = append(list, localInterface{Name: iface.Name, IP: ip, Score: score})
+		}
+	}
+	// 同分时保持系统枚举顺序
+	sort.SliceStable(list, func(i, j int) bool { return list[i].Score > list[j].Score })
+	return list
+}
+
+// findPreferredInterface 按配置的 PreferredInterface（网卡名或 IP）查找接口
+func findPreferredInterface(list []localInterface, preferred string) (localInterface, bool) {
+	if preferred == "" {
+		return localInterface{}, false
+	}
+	for _, li := range list {
+		if li.IP == preferred || strings.EqualFold(li.Name, preferred) {
+			return li, true
 		}
 	}
+	Log.Warn("配置的首选网络接口不可用，自动选择", "preferred", preferred)
+	return localInterface{}, false
+}
 
-	if len(availableIPs) == 0 {
+// selectLocalInterface 选择本机地址：优先使用配置固定的接口，否则取评分最高的；没有可用地址时 ok 为 false
+func selectLocalInterface(preferred string) (localInterface, bool) {
+	list := listLocalInterfaces()
+	if li, ok := findPreferredInterface(list, preferred); ok {
+		return li, true
+	}
+	if len(list) == 0 {
+		return localInterface{}, false
+	}
+	Log.Debug("自动选择网络接口", "name", list[0].Name, "ip", list[0].IP, "score", list[0].Score, "candidates", len(list))
+	return list[0], true
+}
+
+// 获取本地IP地址（命令行模式）：配置了 PreferredInterface 时直接使用，
+// 多个网卡时让用户选择，直接回车使用推荐的接口
+func getLocalIP(preferred string) string {
+	list := listLocalInterfaces()
+	if len(list) == 0 {
 		return "127.0.0.1"
 	}
 
-	if len(availableIPs) == 1 {
-		fmt.Printf("使用网络接口: %s (%s)\n", interfaceNames[0], availableIPs[0])
-		return availableIPs[0]
+	if li, ok := findPreferredInterface(list, preferred); ok {
+		fmt.Printf("使用网络接口: %s (%s)\n", li.Name, li.IP)
+		return li.IP
+	}
+
+	if len(list) == 1 {
+		fmt.Printf("使用网络接口: %s (%s)\n", list[0].Name, list[0].IP)
+		return list[0].IP
 	}
 
 	// 多个网卡时让用户选择
 	fmt.Println("检测到的网络接口:")
-	for i, ip := range availableIPs {
-		fmt.Printf("  %d. %s: %s\n", i+1, interfaceNames[i], ip)
+	for i, li := range list {
+		if i == 0 {
+			fmt.Printf("  %d. %s: %s (推荐)\n", i+1, li.Name, li.IP)
+		} else {
+			fmt.Printf("  %d. %s: %s\n", i+1, li.Name, li.IP)
+		}
 	}
 
-	var choice int
+	choice := 1
 	for {
-		fmt.Print("请选择网络接口 (1-" + strconv.Itoa(len(availableIPs)) + "): ")
-		_, err := fmt.Scanln(&choice)
-		if err == nil && choice >= 1 && choice <= len(availableIPs) {
+		fmt.Print("请选择网络接口 (1-" + strconv.Itoa(len(list)) + "，回车使用推荐): ")
+		var input string
+		fmt.Scanln(&input)
+		if input == "" {
+			break
+		}
+		if n, err := strconv.Atoi(input); err == nil && n >= 1 && n <= len(list) {
+			choice = n
 			break
 		}
 		fmt.Println("无效选择，请重试。")
 	}
 
-	selectedIP := availableIPs[choice-1]
-	selectedName := interfaceNames[choice-1]
-	fmt.Printf("使用网络接口: %s (%s)\n", selectedName, selectedIP)
-	return selectedIP
+	selected := list[choice-1]
+	fmt.Printf("使用网络接口: %s (%s)\n", selected.Name, selected.IP)
+	return selected.IP
 }
 
 // 处理接收到的文件数据
 func (node *P2PNode) processReceivedFile(msg Message) string {
-	if msg.MessageType == MessageTypeImage && msg.FileData != "" {
+	if msg.FileData != "" && (msg.MessageType == MessageTypeImage || forwardedKind(msg.MessageType, msg.FileType, msg.FileName) == MessageTypeImage) {
 		// 对于图片消息，解码base64数据并保存到本地
 		imageData, err := base64.StdEncoding.DecodeString(msg.FileData)
 		if err != nil {
@@ -661,6 +1393,11 @@ func (node *P2PNode) processReceivedFile(msg Message) string {
 
 		return fmt.Sprintf("/images/%s", imageFileName)
 	}
+	if msg.FileData == "" && msg.FileURL != "" && (msg.To == "" || msg.To == "all") &&
+		(msg.MessageType == MessageTypeImage || forwardedKind(msg.MessageType, msg.FileType, msg.FileName) == MessageTypeImage) {
+		// 按链接发送的公聊图片，从发送方拉取
+		return node.receiveImageByURL(msg)
+	}
 
 	// 对于其他类型的文件，返回空字符串（暂时不支持）
 	return ""
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// newListeningNode 创建只开启TCP监听和消息处理的节点（不做发现广播），便于精确控制连接时机
+func newListeningNode(t *testing.T, name string) *P2PNode {
+	t.Helper()
+	node := NewP2PNode(name, false, "127.0.0.1", freeTCPPort(t), freeUDPPort(t))
+	node.UUID = generateMessageID()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("监听失败: %v", err)
+	}
+	node.Listener = l
+	node.setListenPort(l.Addr().(*net.TCPAddr).Port)
+	node.Running.Store(true)
+	go node.acceptConnections()
+	go node.handleMessages()
+	t.Cleanup(node.Stop)
+	return node
+}
+
+// peerConnSnapshot 在持锁状态下读取节点的peer表：活跃peer数及对 id 的连接
+func peerConnSnapshot(node *P2PNode, id string) (active int, conn net.Conn) {
+	node.PeersMutex.RLock()
+	defer node.PeersMutex.RUnlock()
+	for _, p := range node.Peers {
+		if p.IsActive {
+			active++
+		}
+	}
+	if p, ok := node.Peers[id]; ok && p.IsActive {
+		conn = p.Conn
+	}
+	return active, conn
+}
+
+// singleConnection 两个节点各只有一个活跃peer，且两端是同一条TCP连接
+func singleConnection(a, b *P2PNode) bool {
+	aActive, aConn := peerConnSnapshot(a, b.ID)
+	bActive, bConn := peerConnSnapshot(b, a.ID)
+	if aActive != 1 || bActive != 1 || aConn == nil || bConn == nil {
+		return false
+	}
+	return aConn.LocalAddr().String() == bConn.RemoteAddr().String() &&
+		aConn.RemoteAddr().String() == bConn.LocalAddr().String()
+}
+
+// 双方同时向对方发起连接，最终只保留一条连接，且该连接保持可用
+func TestSimultaneousConnect(t *testing.T) {
+	for round := 0; round < 10; round++ {
+		a := newListeningNode(t, "节点A")
+		b := newListeningNode(t, "节点B")
+
+		start := make(chan struct{})
+		var wg sync.WaitGroup
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			<-start
+			a.connectToPeer("127.0.0.1", b.LocalPort, b.ID, b.Name)
+		}()
+		go func() {
+			defer wg.Done()
+			<-start
+			b.connectToPeer("127.0.0.1", a.LocalPort, a.ID, a.Name)
+		}()
+		close(start)
+		wg.Wait()
+
+		deadline := time.Now().Add(5 * time.Second)
+		for !singleConnection(a, b) {
+			if time.Now().After(deadline) {
+				aActive, _ := peerConnSnapshot(a, b.ID)
+				bActive, _ := peerConnSnapshot(b, a.ID)
+				t.Fatalf("第 %d 轮未收敛到单条连接: A 活跃peer %d 个，B 活跃peer %d 个", round+1, aActive, bActive)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		// 被放弃的连接关闭后，保留的连接不应受影响
+		time.Sleep(200 * time.Millisecond)
+		if !singleConnection(a, b) {
+			t.Fatalf("第 %d 轮保留的连接随后断开或出现了第二条连接", round+1)
+		}
+
+		a.Stop()
+		b.Stop()
+	}
+}
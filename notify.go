@@ -0,0 +1,96 @@
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+// 系统通知设置：全局开关（AppConfig.Notifications，默认开启）与每日免打扰时段（DndStart/DndEnd，"HH:MM" 本地时间）。
+// 关闭通知或处于免打扰时段时桌面端不弹系统通知，消息照常入列表、计入未读数。
+// 结束时间不晚于开始时间的时段跨越午夜，如 22:00-07:00；两者都为空时不启用免打扰
+const dndTimeLayout = "15:04"
+
+// notificationSettings /notification-settings 读写的通知设置
+type notificationSettings struct {
+	Enabled  bool   `json:"enabled"`
+	DndStart string `json:"dndStart"` // 空 = 不启用免打扰
+	DndEnd   string `json:"dndEnd"`
+}
+
+// parseDndTime 解析 "HH:MM"，返回当天零点起的分钟数
+func parseDndTime(s string) (int, error) {
+	t, err := time.Parse(dndTimeLayout, s)
+	if err != nil {
+		return 0, fmt.Errorf("时间格式应为 HH:MM: %s", s)
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+// inDndPeriod 判断 now 是否处于 [start, end) 时段内；end <= start 时时段跨越午夜
+func inDndPeriod(start, end string, now time.Time) bool {
+	if start == "" || end == "" {
+		return false
+	}
+	from, err1 := parseDndTime(start)
+	to, err2 := parseDndTime(end)
+	if err1 != nil || err2 != nil {
+		return false
+	}
+	minute := now.Hour()*60 + now.Minute()
+	if from < to {
+		return minute >= from && minute < to
+	}
+	// 跨午夜（开始与结束相同时为全天）
+	return minute >= from || minute < to
+}
+
+// notificationSettings 返回当前的通知设置
+func (node *P2PNode) notificationSettings() notificationSettings {
+	if node.Config == nil {
+		return notificationSettings{Enabled: true}
+	}
+	node.ConfigMutex.RLock()
+	defer node.ConfigMutex.RUnlock()
+	return notificationSettings{
+		Enabled:  node.Config.IsNotificationsEnabled(),
+		DndStart: node.Config.DndStart,
+		DndEnd:   node.Config.DndEnd,
+	}
+}
+
+// notificationsSilenced 判断此刻是否应静默系统通知（已关闭或处于免打扰时段）
+func (node *P2PNode) notificationsSilenced(now time.Time) bool {
+	s := node.notificationSettings()
+	return !s.Enabled || inDndPeriod(s.DndStart, s.DndEnd, now)
+}
+
+// setNotificationSettings 校验并保存通知设置；免打扰的开始和结束时间须同时设置或同时为空
+func (node *P2PNode) setNotificationSettings(s notificationSettings) error {
+	if node.Config == nil {
+		return fmt.Errorf("配置不可用")
+	}
+	if (s.DndStart == "") != (s.DndEnd == "") {
+		return fmt.Errorf("免打扰的开始和结束时间需同时设置")
+	}
+	for _, t := range []string{s.DndStart, s.DndEnd} {
+		if t == "" {
+			continue
+		}
+		if _, err := parseDndTime(t); err != nil {
+			return err
+		}
+	}
+
+	node.ConfigMutex.Lock()
+	enabled := s.Enabled
+	node.Config.Notifications = &enabled
+	node.Config.DndStart, node.Config.DndEnd = s.DndStart, s.DndEnd
+	node.ConfigMutex.Unlock()
+
+	if err := node.saveConfig(); err != nil {
+		Log.Error("保存通知设置失败", "error", err)
+		return err
+	}
+	Log.Info("通知设置已更新", "enabled", s.Enabled, "dndStart", s.DndStart, "dndEnd", s.DndEnd)
+	return nil
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+)
+
+// 离线消息保留时长，超过后清理（对方长期不上线）
+const offlineMessageTTLDays = 7
+
+// initOfflineMessageTable 创建离线消息暂存表：message_json 与聊天记录一样用本地密钥加密，
+// nonce 为空的是旧版本写入的明文行
+func initOfflineMessageTable(db *sql.DB) error {
+	_, err := db.Exec(`
+		CREATE TABLE IF NOT EXISTS pending_messages (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			recipient_id TEXT NOT NULL,
+			message_json BLOB NOT NULL,
+			nonce BLOB,
+			created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+		);
+		CREATE INDEX IF NOT EXISTS idx_pending_recipient ON pending_messages(recipient_id);
+	`)
+	if err != nil {
+		return err
+	}
+	// Migration: 旧表没有 nonce 列（已存在时报错，忽略）
+	db.Exec("ALTER TABLE pending_messages ADD COLUMN nonce BLOB")
+	return nil
+}
+
+// cleanupOfflineMessages 删除超过TTL仍未投递的离线消息
+func (node *P2PNode) cleanupOfflineMessages() {
+	if node.DB == nil {
+		return
+	}
+	result, err := node.DB.Exec(fmt.Sprintf(
+		"DELETE FROM pending_messages WHERE created_at < DATETIME('now', '-%d days')", offlineMessageTTLDays))
+	if err != nil {
+		Log.Error("清理过期离线消息失败", "error", err)
+		return
+	}
+	if deleted, _ := result.RowsAffected(); deleted > 0 {
+		Log.Info("已清理过期离线消息", "deleted", deleted)
+	}
+}
+
+// queueOfflineMessage 为不在线的用户暂存私聊消息，只暂存给能确认身份的用户（见 knownUserKey），
+// 从未联系过的用户名返回 errPrivateTargetNotFound，不会为其无限期保留消息
+func (node *P2PNode) queueOfflineMessage(targetName string, msg Message) error {
+	key := node.knownUserKey(targetName)
+	if key == "" {
+		return errPrivateTargetNotFound
+	}
+	return node.storeOfflineMessage(key, msg)
+}
+
+// storeOfflineMessage 目标用户不在线时暂存私聊消息，待其上线后投递。
+// recipientKey 为接收方的稳定标识（见 lookupUserKey）。
+func (node *P2PNode) storeOfflineMessage(recipientKey string, msg Message) error {
+	if node.DB == nil {
+		return fmt.Errorf("数据库不可用")
+	}
+	if msg.MessageID == "" {
+		msg.MessageID = generateMessageID()
+	}
+	data, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	ciphertext, nonce, err := encryptMessage(node.LocalDBKey, data)
+	if err != nil {
+		return err
+	}
+	if _, err := node.DB.Exec("INSERT INTO pending_messages (recipient_id, message_json, nonce) VALUES (?, ?, ?)",
+		recipientKey, ciphertext, nonce); err != nil {
+		Log.Error("保存离线消息失败", "recipient", recipientKey, "error", err)
+		return err
+	}
+	fmt.Printf("用户 %s 不在线，消息将在其上线后投递\n", recipientKey)
+	Log.Info("已暂存离线消息", "recipient", recipientKey, "messageId", msg.MessageID)
+	return nil
+}
+
+// deliverOfflineMessages 在peer完成握手（共享密钥就绪）后投递其离线消息
+func (node *P2PNode) deliverOfflineMessages(peerID string) {
+	if node.DB == nil {
+		return
+	}
+
+	node.PeersMutex.RLock()
+	peer, exists := node.Peers[peerID]
+	node.PeersMutex.RUnlock()
+	if !exists {
+		return
+	}
+
+	// 按稳定标识匹配；同时匹配用户名以兼容旧版本节点或暂存时尚未知UUID的情况
+	rows, err := node.DB.Query("SELECT id, message_json, nonce FROM pending_messages WHERE recipient_id IN (?, ?) ORDER BY id ASC",
+		peer.UserKey(), peer.Name)
+	if err != nil {
+		Log.Error("查询离线消息失败", "peer", peer.Name, "error", err)
+		return
+	}
+	type pendingRow struct {
+		id  int64
+		msg Message
+	}
+	var pending []pendingRow
+	for rows.Next() {
+		var id int64
+		var data, nonce []byte
+		if err := rows.Scan(&id, &data, &nonce); err != nil {
+			continue
+		}
+		if len(nonce) > 0 {
+			plaintext, err := decryptMessage(node.LocalDBKey, data, nonce)
+			if err != nil {
+				Log.Error("解密离线消息失败", "id", id, "error", err)
+				node.DB.Exec("DELETE FROM pending_messages WHERE id = ?", id)
+				continue
+			}
+			data = plaintext
+		}
+		var msg Message
+		if err := json.Unmarshal(data, &msg); err != nil {
+			Log.Error("解析离线消息失败", "id", id, "error", err)
+			node.DB.Exec("DELETE FROM pending_messages WHERE id = ?", id)
+			continue
+		}
+		pending = append(pending, pendingRow{id: id, msg: msg})
+	}
+	rows.Close()
+
+	if len(pending) == 0 {
+		return
+	}
+
+	delivered := 0
+	for _, p := range pending {
+		// 对方重启后节点ID会变化，按当前连接重新设置接收方
+		p.msg.To = peer.ID
+		if err := node.sendMessageToPeer(peer, p.msg); err != nil {
+			// 保留在表中等待下次上线，避免与内存重试队列重复投递
+			node.dropPendingSend(peer, p.msg.MessageID)
+			Log.Warn("投递离线消息失败", "peer", peer.Name, "error", err)
+			break
+		}
+		node.DB.Exec("DELETE FROM pending_messages WHERE id = ?", p.id)
+		delivered++
+	}
+	fmt.Printf("已向 %s 投递 %d 条离线消息\n", peer.Name, delivered)
+	Log.Info("离线消息投递完成", "peer", peer.Name, "delivered", delivered, "total", len(pending))
+}
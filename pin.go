@@ -0,0 +1,114 @@
+package main
+
+import (
+	"fmt"
+)
+
+// ChatActivity 会话的置顶状态与最近活跃时间，供前端排序：置顶在前，其余按最近活跃
+type ChatActivity struct {
+	ChatID     string `json:"chatId"` // "all" 表示公聊，其余为用户名
+	Pinned     bool   `json:"pinned"`
+	LastActive int64  `json:"lastActive,omitempty"` // 最后一条消息的时间（Unix毫秒），无记录时为0
+	Unread     int    `json:"unread,omitempty"`     // 会话未读数
+}
+
+// isChatPinned 判断会话是否已置顶
+func (node *P2PNode) isChatPinned(chatID string) bool {
+	if node.Config == nil {
+		return false
+	}
+	node.ConfigMutex.RLock()
+	defer node.ConfigMutex.RUnlock()
+	for _, id := range node.Config.PinnedChats {
+		if id == chatID {
+			return true
+		}
+	}
+	return false
+}
+
+// pinnedChats 返回置顶会话列表的副本
+func (node *P2PNode) pinnedChats() []string {
+	if node.Config == nil {
+		return []string{}
+	}
+	node.ConfigMutex.RLock()
+	defer node.ConfigMutex.RUnlock()
+	return append([]string{}, node.Config.PinnedChats...)
+}
+
+// setChatPinned 置顶或取消置顶会话并保存配置；重复置顶不改变原有顺序
+func (node *P2PNode) setChatPinned(chatID string, pinned bool) error {
+	if node.Config == nil {
+		return fmt.Errorf("配置不可用")
+	}
+	if chatID == "" {
+		return fmt.Errorf("会话不能为空")
+	}
+
+	node.ConfigMutex.Lock()
+	list := make([]string, 0, len(node.Config.PinnedChats)+1)
+	found := false
+	for _, id := range node.Config.PinnedChats {
+		if id == chatID {
+			found = true
+			if !pinned {
+				continue
+			}
+		}
+		list = append(list, id)
+	}
+	if pinned && !found {
+		list = append(list, chatID)
+	}
+	node.Config.PinnedChats = list
+	node.ConfigMutex.Unlock()
+
+	if err := node.saveConfig(); err != nil {
+		Log.Error("保存置顶设置失败", "chatId", chatID, "error", err)
+		return err
+	}
+	Log.Info("置顶设置已更新", "chatId", chatID, "pinned", pinned)
+	return nil
+}
+
+// chatLastActive 从数据库查询每个会话最后一条消息的时间（Unix毫秒）
+func (node *P2PNode) chatLastActive() map[string]int64 {
+	active := make(map[string]int64)
+	if node.DB == nil {
+		return active
+	}
+	node.flushMessageWrites()
+	rows, err := node.DB.Query(`
+		SELECT CASE
+			WHEN is_private = TRUE AND is_own = TRUE THEN recipient
+			WHEN is_private = TRUE THEN sender
+			ELSE 'all'
+		END AS chat, CAST(strftime('%s', MAX(timestamp)) AS INTEGER)
+		FROM messages
+		GROUP BY chat
+	`)
+	if err != nil {
+		Log.Warn("查询会话活跃时间失败", "error", err)
+		return active
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var chat string
+		var ts int64
+		if rows.Scan(&chat, &ts) == nil && chat != "" {
+			active[chat] = ts * 1000
+		}
+	}
+	return active
+}
+
+// chatActivities 返回公聊与所有私聊会话的置顶状态、最近活跃时间和未读数
+func (node *P2PNode) chatActivities(partners []string) []ChatActivity {
+	active := node.chatLastActive()
+	chats := []ChatActivity{{ChatID: "all", Pinned: node.isChatPinned("all"), LastActive: active["all"], Unread: node.unreadCount("all")}}
+	for _, name := range partners {
+		chats = append(chats, ChatActivity{ChatID: name, Pinned: node.isChatPinned(name), LastActive: active[name], Unread: node.unreadCount(name)})
+	}
+	return chats
+}
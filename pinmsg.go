@@ -0,0 +1,229 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// 消息置顶：会话成员把某条消息置顶后，向会话其他成员发送 pin_message（取消为 unpin_message，
+// Content 为消息ID），各端记录在 pinned_messages 表并在聊天顶部展示。一个会话可以有多条置顶。
+// 公聊广播给所有在线用户，私聊只发给对方；对方不在线时只在本机生效。
+// 被置顶的消息在本机已被删除（清空会话、按时间段删除、超期清理）时，读取置顶列表时自动取消置顶
+const maxPinnedMessages = 20
+
+// PinnedMessage 一条置顶记录；Message 为被置顶的消息（读取列表时填充）
+type PinnedMessage struct {
+	ChatID    string       `json:"chatId"`
+	MessageID string       `json:"messageId"`
+	PinnedBy  string       `json:"pinnedBy"`
+	PinnedAt  time.Time    `json:"pinnedAt"`
+	Message   *ChatMessage `json:"message,omitempty"`
+}
+
+// pinnedMessageStore 数据库不可用时的内存置顶记录（会话ID -> 按置顶先后排列）
+type pinnedMessageStore struct {
+	mu   sync.Mutex
+	pins map[string][]PinnedMessage
+}
+
+// initPinnedMessagesTable 创建置顶消息表
+func initPinnedMessagesTable(db *sql.DB) error {
+	_, err := db.Exec(`
+		CREATE TABLE IF NOT EXISTS pinned_messages (
+			chat_id TEXT NOT NULL,
+			message_id TEXT NOT NULL,
+			pinned_by TEXT NOT NULL DEFAULT '',
+			pinned_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+			PRIMARY KEY (chat_id, message_id)
+		);
+	`)
+	return err
+}
+
+// storedPins 读取会话的置顶记录（不含消息内容），按置顶先后排列
+func (node *P2PNode) storedPins(chatID string) []PinnedMessage {
+	if node.DB == nil {
+		s := &node.pinnedMessages
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		return append([]PinnedMessage{}, s.pins[chatID]...)
+	}
+	rows, err := node.DB.Query(`SELECT message_id, pinned_by, pinned_at FROM pinned_messages
+		WHERE chat_id = ? ORDER BY pinned_at, rowid`, chatID)
+	if err != nil {
+		Log.Error("查询置顶消息失败", "chatId", chatID, "error", err)
+		return nil
+	}
+	defer rows.Close()
+	var pins []PinnedMessage
+	for rows.Next() {
+		p := PinnedMessage{ChatID: chatID}
+		var pinnedAt sql.NullTime
+		if rows.Scan(&p.MessageID, &p.PinnedBy, &pinnedAt) != nil {
+			continue
+		}
+		p.PinnedAt = pinnedAt.Time.Local()
+		pins = append(pins, p)
+	}
+	return pins
+}
+
+// storePin 写入或删除一条置顶记录，返回是否有变化
+func (node *P2PNode) storePin(chatID, messageID, pinnedBy string, pinned bool) (bool, error) {
+	if node.DB == nil {
+		s := &node.pinnedMessages
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		list := s.pins[chatID]
+		for i, p := range list {
+			if p.MessageID == messageID {
+				if !pinned {
+					s.pins[chatID] = append(list[:i:i], list[i+1:]...)
+				}
+				return !pinned, nil
+			}
+		}
+		if !pinned {
+			return false, nil
+		}
+		if len(list) >= maxPinnedMessages {
+			return false, fmt.Errorf("每个会话最多置顶 %d 条消息", maxPinnedMessages)
+		}
+		if s.pins == nil {
+			s.pins = make(map[string][]PinnedMessage)
+		}
+		s.pins[chatID] = append(list, PinnedMessage{ChatID: chatID, MessageID: messageID, PinnedBy: pinnedBy, PinnedAt: time.Now()})
+		return true, nil
+	}
+
+	if !pinned {
+		res, err := node.DB.Exec("DELETE FROM pinned_messages WHERE chat_id = ? AND message_id = ?", chatID, messageID)
+		if err != nil {
+			return false, err
+		}
+		n, _ := res.RowsAffected()
+		return n > 0, nil
+	}
+	var count int
+	node.DB.QueryRow("SELECT COUNT(*) FROM pinned_messages WHERE chat_id = ?", chatID).Scan(&count)
+	if count >= maxPinnedMessages {
+		return false, fmt.Errorf("每个会话最多置顶 %d 条消息", maxPinnedMessages)
+	}
+	res, err := node.DB.Exec(`INSERT OR IGNORE INTO pinned_messages (chat_id, message_id, pinned_by) VALUES (?, ?, ?)`,
+		chatID, messageID, pinnedBy)
+	if err != nil {
+		return false, err
+	}
+	n, _ := res.RowsAffected()
+	return n > 0, nil
+}
+
+// setMessagePinned 置顶或取消置顶会话中的一条消息（本机记录），消息必须属于该会话
+func (node *P2PNode) setMessagePinned(chatID, messageID, pinnedBy string, pinned bool) (bool, error) {
+	if chatID == "" || messageID == "" {
+		return false, fmt.Errorf("会话和消息ID不能为空")
+	}
+	if pinned {
+		m, ok := node.findChatMessage(messageID)
+		if !ok || chatIDForMessage(m.Sender, m.Recipient, m.IsOwn, m.IsPrivate) != chatID {
+			return false, fmt.Errorf("消息不存在")
+		}
+	}
+	changed, err := node.storePin(chatID, messageID, pinnedBy, pinned)
+	if err != nil {
+		return false, err
+	}
+	if changed {
+		Log.Info("置顶消息已更新", "chatId", chatID, "messageId", messageID, "by", pinnedBy, "pinned", pinned)
+		node.emitPinnedMessagesChanged(chatID)
+	}
+	return changed, nil
+}
+
+// pinMessage 本机用户置顶或取消置顶一条消息，并通知会话其他成员
+func (node *P2PNode) pinMessage(chatID, messageID string, pinned bool) error {
+	changed, err := node.setMessagePinned(chatID, messageID, node.Name, pinned)
+	if err != nil || !changed {
+		return err
+	}
+	msg := Message{
+		Type:      "pin_message",
+		From:      node.ID,
+		Content:   messageID,
+		Timestamp: time.Now(),
+	}
+	if !pinned {
+		msg.Type = "unpin_message"
+	}
+	if chatID == "all" {
+		msg.To = "all"
+		node.broadcastMessage(msg)
+	} else if peer := node.findPeer(chatID); peer != nil && !node.isPeerBlocked(peer) {
+		msg.To = peer.ID
+		node.queueSend(peer, msg, nil)
+	}
+	return nil
+}
+
+// handlePinMessage 处理其他成员发来的置顶/取消置顶：公聊消息记在公聊，私聊记在与发送方的会话
+func (node *P2PNode) handlePinMessage(peer *Peer, msg Message) {
+	if node.isPeerBlocked(peer) {
+		return
+	}
+	node.PeersMutex.RLock()
+	name := peer.Name
+	node.PeersMutex.RUnlock()
+	chatID := name
+	if msg.To == "" || msg.To == "all" {
+		chatID = "all"
+	} else if msg.To != node.ID {
+		return
+	}
+	if _, err := node.setMessagePinned(chatID, msg.Content, name, msg.Type == "pin_message"); err != nil {
+		Log.Debug("忽略置顶消息", "from", name, "chatId", chatID, "messageId", msg.Content, "error", err)
+	}
+}
+
+// pinnedMessagesFor 返回会话的置顶消息（含消息内容）。本机已删除的消息自动取消置顶
+func (node *P2PNode) pinnedMessagesFor(chatID string) []PinnedMessage {
+	result := []PinnedMessage{}
+	removed := false
+	for _, p := range node.storedPins(chatID) {
+		m, ok := node.findChatMessage(p.MessageID)
+		if !ok || chatIDForMessage(m.Sender, m.Recipient, m.IsOwn, m.IsPrivate) != chatID {
+			node.storePin(chatID, p.MessageID, "", false)
+			removed = true
+			continue
+		}
+		p.Message = &m
+		result = append(result, p)
+	}
+	if removed {
+		Log.Info("被置顶的消息已删除，自动取消置顶", "chatId", chatID)
+	}
+	return result
+}
+
+// renamePinnedChat 对方改名后，私聊会话的置顶记录跟随新名称
+func (node *P2PNode) renamePinnedChat(oldName, newName string) {
+	if oldName == "" || oldName == newName || oldName == "all" {
+		return
+	}
+	if node.DB == nil {
+		s := &node.pinnedMessages
+		s.mu.Lock()
+		if list, ok := s.pins[oldName]; ok {
+			for i := range list {
+				list[i].ChatID = newName
+			}
+			s.pins[newName] = append(s.pins[newName], list...)
+			delete(s.pins, oldName)
+		}
+		s.mu.Unlock()
+		return
+	}
+	node.DB.Exec("UPDATE OR IGNORE pinned_messages SET chat_id = ? WHERE chat_id = ?", newName, oldName)
+	node.DB.Exec("DELETE FROM pinned_messages WHERE chat_id = ?", oldName)
+}
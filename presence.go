@@ -0,0 +1,238 @@
+package main
+
+import (
+	"database/sql"
+	"sync"
+	"time"
+)
+
+// 在线时长统计：peer 上线时记录 OnlineSince，真正下线（没有替换它的新连接、也没有同名活跃连接）时
+// 把这段在线时间按自然日累计到 presence_stats 表，同时记下最后在线时间。
+// 数据库不可用时只累计在内存中（presenceStats）
+const presenceDayFormat = "2006-01-02"
+
+// presenceStats 数据库不可用时的内存统计
+type presenceStats struct {
+	mu       sync.Mutex
+	seconds  map[string]map[string]int64 // userKey -> 日期 -> 在线秒数
+	lastSeen map[string]time.Time
+	names    map[string]string // userKey -> 最后使用的显示名
+}
+
+// presenceInfo /presence 返回的统计结果
+type presenceInfo struct {
+	Name         string    `json:"name"`
+	Online       bool      `json:"online"`
+	OnlineSince  time.Time `json:"onlineSince,omitzero"`
+	TodaySeconds int64     `json:"todaySeconds"`
+	TotalSeconds int64     `json:"totalSeconds"`
+	LastSeen     time.Time `json:"lastSeen,omitzero"`
+}
+
+// initPresenceTable 创建在线时长统计表：每个用户每天一行
+func initPresenceTable(db *sql.DB) error {
+	_, err := db.Exec(`
+		CREATE TABLE IF NOT EXISTS presence_stats (
+			user_key TEXT NOT NULL,
+			day TEXT NOT NULL,
+			name TEXT NOT NULL DEFAULT '',
+			seconds INTEGER NOT NULL DEFAULT 0,
+			last_seen DATETIME,
+			PRIMARY KEY (user_key, day)
+		);
+	`)
+	return err
+}
+
+// splitByDay 将 [start, end) 按本地自然日切分，返回 日期 -> 秒数
+func splitByDay(start, end time.Time) map[string]int64 {
+	days := make(map[string]int64)
+	for start.Before(end) {
+		y, m, d := start.Date()
+		next := time.Date(y, m, d+1, 0, 0, 0, 0, start.Location())
+		if next.After(end) {
+			next = end
+		}
+		days[start.Format(presenceDayFormat)] += int64(next.Sub(start) / time.Second)
+		start = next
+	}
+	return days
+}
+
+// recordOnlineSession 累计 peer 从 OnlineSince 到 end 的在线时长
+func (node *P2PNode) recordOnlineSession(peer *Peer, end time.Time) {
+	node.PeersMutex.RLock()
+	key, name, since := peer.UserKey(), peer.Name, peer.OnlineSince
+	node.PeersMutex.RUnlock()
+	if key == "" || since.IsZero() {
+		return
+	}
+	days := splitByDay(since, end)
+
+	if node.DB == nil {
+		s := &node.presenceStats
+		s.mu.Lock()
+		if s.seconds == nil {
+			s.seconds = make(map[string]map[string]int64)
+			s.lastSeen = make(map[string]time.Time)
+			s.names = make(map[string]string)
+		}
+		if s.seconds[key] == nil {
+			s.seconds[key] = make(map[string]int64)
+		}
+		for day, secs := range days {
+			s.seconds[key][day] += secs
+		}
+		s.lastSeen[key] = end
+		s.names[key] = name
+		s.mu.Unlock()
+		return
+	}
+
+	if len(days) == 0 {
+		// 不足一秒的连接也记录最后在线时间
+		days[end.Format(presenceDayFormat)] = 0
+	}
+	for day, secs := range days {
+		if _, err := node.DB.Exec(`
+			INSERT INTO presence_stats (user_key, day, name, seconds, last_seen) VALUES (?, ?, ?, ?, ?)
+			ON CONFLICT(user_key, day) DO UPDATE SET
+				name = excluded.name,
+				seconds = seconds + excluded.seconds,
+				last_seen = excluded.last_seen`, key, day, name, secs, end); err != nil {
+			Log.Warn("保存在线时长失败", "peer", name, "error", err)
+		}
+	}
+	Log.Debug("已记录在线时长", "peer", name, "since", since, "duration", end.Sub(since))
+}
+
+// inheritOnlineSinceLocked 对端以新节点ID重连时新旧连接短暂并存，旧连接断开不算下线：
+// 把旧连接的上线时间交给仍活跃的同名连接，避免这段时间丢失或重复计算。调用方需持有 PeersMutex
+func (node *P2PNode) inheritOnlineSinceLocked(old *Peer) {
+	for _, peer := range node.Peers {
+		if peer != old && peer.IsActive && peer.Name == old.Name {
+			if !old.OnlineSince.IsZero() && (peer.OnlineSince.IsZero() || old.OnlineSince.Before(peer.OnlineSince)) {
+				peer.OnlineSince = old.OnlineSince
+			}
+			return
+		}
+	}
+}
+
+// recordActiveSessions 退出时累计所有在线 peer 的在线时长
+func (node *P2PNode) recordActiveSessions() {
+	var active []*Peer
+	node.PeersMutex.RLock()
+	for _, peer := range node.Peers {
+		if peer.IsActive {
+			active = append(active, peer)
+		}
+	}
+	node.PeersMutex.RUnlock()
+
+	now := time.Now()
+	for _, peer := range active {
+		node.recordOnlineSession(peer, now)
+	}
+}
+
+// presenceKeyFor 按用户名查找统计用的用户标识：先查统计表中的显示名，再按历史记录解析
+func (node *P2PNode) presenceKeyFor(name string) string {
+	if node.DB != nil {
+		var key string
+		node.DB.QueryRow("SELECT user_key FROM presence_stats WHERE name = ? ORDER BY last_seen DESC LIMIT 1", name).Scan(&key)
+		if key != "" {
+			return key
+		}
+	} else {
+		s := &node.presenceStats
+		s.mu.Lock()
+		var key string
+		for k, n := range s.names {
+			if n == name && (key == "" || s.lastSeen[k].After(s.lastSeen[key])) {
+				key = k
+			}
+		}
+		s.mu.Unlock()
+		if key != "" {
+			return key
+		}
+	}
+	return node.resolveUserKey(name)
+}
+
+// storedPresence 读取已累计的今日/总在线秒数和最后在线时间
+func (node *P2PNode) storedPresence(key string, today string) (todaySecs, totalSecs int64, lastSeen time.Time) {
+	if node.DB == nil {
+		s := &node.presenceStats
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		for day, secs := range s.seconds[key] {
+			totalSecs += secs
+			if day == today {
+				todaySecs += secs
+			}
+		}
+		return todaySecs, totalSecs, s.lastSeen[key]
+	}
+
+	rows, err := node.DB.Query("SELECT day, seconds, last_seen FROM presence_stats WHERE user_key = ?", key)
+	if err != nil {
+		Log.Error("查询在线时长失败", "key", key, "error", err)
+		return
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var day string
+		var secs int64
+		var seen sql.NullTime
+		if rows.Scan(&day, &secs, &seen) != nil {
+			continue
+		}
+		totalSecs += secs
+		if day == today {
+			todaySecs += secs
+		}
+		if seen.Valid && seen.Time.After(lastSeen) {
+			lastSeen = seen.Time
+		}
+	}
+	return todaySecs, totalSecs, lastSeen
+}
+
+// presenceFor 返回用户的在线时长统计，在线用户加上本次上线以来的时长；没有任何记录时 ok 为 false
+func (node *P2PNode) presenceFor(name string) (info presenceInfo, ok bool) {
+	now := time.Now()
+	today := now.Format(presenceDayFormat)
+	info.Name = name
+
+	var key string
+	if peer := node.findPeer(name); peer != nil {
+		node.PeersMutex.RLock()
+		key = peer.UserKey()
+		info.Name = peer.Name
+		info.Online = true
+		info.OnlineSince = peer.OnlineSince
+		info.LastSeen = peer.LastSeen
+		node.PeersMutex.RUnlock()
+	} else {
+		key = node.presenceKeyFor(name)
+	}
+	if key == "" {
+		return info, false
+	}
+
+	todaySecs, totalSecs, lastSeen := node.storedPresence(key, today)
+	if info.Online && !info.OnlineSince.IsZero() {
+		for day, secs := range splitByDay(info.OnlineSince, now) {
+			totalSecs += secs
+			if day == today {
+				todaySecs += secs
+			}
+		}
+	} else {
+		info.LastSeen = lastSeen
+	}
+	info.TodaySeconds, info.TotalSeconds = todaySecs, totalSecs
+	return info, info.Online || !lastSeen.IsZero()
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// uploadWaitStep 限速等待的最长单次休眠，保证速率调整和取消能及时生效
+const uploadWaitStep = 100 * time.Millisecond
+
+// uploadLimiter 文件发送的令牌桶限速器，所有传输共享同一速率。
+// 只在 sendFile 把文件块交给发送队列之前等待，聊天等小消息不经过限速器，
+// 发送队列中每个传输最多只有一个待发文件块，因此不会被限速拖慢。零值表示不限速。
+type uploadLimiter struct {
+	rate atomic.Int64 // 字节/秒，0 = 不限速
+
+	mu     sync.Mutex
+	tokens float64 // 可用字节数，发送大于余额的块时可为负（欠账，后续等待补足）
+	last   time.Time
+}
+
+// SetRate 设置发送速率（字节/秒），<= 0 表示不限速；传输进行中调用会在下一个文件块生效
+func (l *uploadLimiter) SetRate(bytesPerSec int) {
+	if bytesPerSec < 0 {
+		bytesPerSec = 0
+	}
+	l.rate.Store(int64(bytesPerSec))
+}
+
+// Rate 返回当前速率限制，0 表示不限速
+func (l *uploadLimiter) Rate() int {
+	return int(l.rate.Load())
+}
+
+// Wait 为即将发送的 n 字节申请令牌，余额不足时分段休眠等待。
+// cancelled 返回 true 时立即返回 false（传输已取消）
+func (l *uploadLimiter) Wait(n int, cancelled func() bool) bool {
+	for {
+		if cancelled != nil && cancelled() {
+			return false
+		}
+		wait, ok := l.take(n, time.Now())
+		if ok {
+			return true
+		}
+		if wait > uploadWaitStep {
+			wait = uploadWaitStep
+		}
+		time.Sleep(wait)
+	}
+}
+
+// take 按当前速率补充令牌；余额非负时扣除 n 字节并返回 true，否则返回还需等待的时间
+func (l *uploadLimiter) take(n int, now time.Time) (time.Duration, bool) {
+	rate := float64(l.rate.Load())
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if rate <= 0 {
+		l.tokens = 0
+		l.last = now
+		return 0, true
+	}
+	if !l.last.IsZero() {
+		l.tokens += now.Sub(l.last).Seconds() * rate
+	}
+	l.last = now
+	// 最多积累1秒的令牌，避免空闲后突发占满带宽
+	if l.tokens > rate {
+		l.tokens = rate
+	}
+	if l.tokens < 0 {
+		return time.Duration(-l.tokens / rate * float64(time.Second)), false
+	}
+	l.tokens -= float64(n)
+	return 0, true
+}
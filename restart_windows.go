@@ -27,11 +27,11 @@ func setDetachedProcess(cmd *exec.Cmd) {
 }
 
 // launchRestartHelper creates a batch script that waits for the current process
-// to fully terminate, cleans up the .old file, then starts the new exe.
+// to fully terminate, then starts the new exe. The .old file is kept until the
+// new version confirms a successful startup (see checkUpdateRollback).
 // This is more reliable than direct child process launch on Windows because
 // WebView2 may spawn child processes that keep the mutex alive after os.Exit.
 func launchRestartHelper(targetPath string) error {
-	oldPath := targetPath + ".old"
 	scriptPath := filepath.Join(filepath.Dir(targetPath), "_lanshare_restart.bat")
 	pid := os.Getpid()
 
@@ -44,10 +44,9 @@ func launchRestartHelper(targetPath string) error {
 		"    goto wait\r\n"+
 		")\r\n"+
 		"timeout /t 2 /nobreak >NUL\r\n"+
-		"if exist \"%s\" del /F /Q \"%s\"\r\n"+
 		"start \"\" \"%s\"\r\n"+
 		"del \"%%~f0\"\r\n",
-		pid, pid, oldPath, oldPath, targetPath)
+		pid, pid, targetPath)
 
 	if err := os.WriteFile(scriptPath, []byte(script), 0755); err != nil {
 		return fmt.Errorf("创建重启脚本失败: %v", err)
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+// 发送失败重试队列参数
+const (
+	pendingSendLimit = 100             // 每个peer最多暂存的待发送消息数
+	pendingSendTTL   = 5 * time.Minute // 待发送消息的最长等待时间，超时标记为发送失败
+)
+
+// pendingSend 发送失败、等待重连后重发的聊天消息
+type pendingSend struct {
+	Msg      Message
+	QueuedAt time.Time
+}
+
+// pendingSendKey 待发送队列的索引：对方的用户UUID（跨重启不变），旧版本没有UUID时用节点ID。
+// 对方重启后以新节点ID重连，仍能取回之前暂存的消息。UUID 在握手响应时写入，调用方需持有 PeersMutex
+func pendingSendKey(peer *Peer) string {
+	if peer.UUID != "" {
+		return peer.UUID
+	}
+	return peer.ID
+}
+
+// enqueuePendingSend 将发送失败的chat消息加入该peer的待发送队列（按MessageID去重）。
+// 队列不挂在peer对象上，因此重连后peer对象被替换也不会丢失。
+func (node *P2PNode) enqueuePendingSend(peer *Peer, msg Message) {
+	node.PeersMutex.RLock()
+	key := pendingSendKey(peer)
+	node.PeersMutex.RUnlock()
+	node.PendingSendsMutex.Lock()
+	defer node.PendingSendsMutex.Unlock()
+
+	if node.PendingSends == nil {
+		node.PendingSends = make(map[string][]pendingSend)
+	}
+	queue := node.PendingSends[key]
+	for _, p := range queue {
+		if p.Msg.MessageID == msg.MessageID {
+			return
+		}
+	}
+	if len(queue) >= pendingSendLimit {
+		// 队列已满，丢弃最旧的一条并反馈发送失败
+		dropped := queue[0]
+		queue = queue[1:]
+		go node.markMessageFailed(dropped.Msg.MessageID)
+	}
+	node.PendingSends[key] = append(queue, pendingSend{Msg: msg, QueuedAt: time.Now()})
+	Log.Warn("消息发送失败，已加入重试队列", "peer", peer.Name, "messageId", msg.MessageID, "queued", len(node.PendingSends[key]))
+}
+
+// dropPendingSend 从重试队列中移除指定消息（已由其他机制接管投递）
+func (node *P2PNode) dropPendingSend(peer *Peer, messageID string) {
+	node.PeersMutex.RLock()
+	key := pendingSendKey(peer)
+	node.PeersMutex.RUnlock()
+	node.PendingSendsMutex.Lock()
+	defer node.PendingSendsMutex.Unlock()
+
+	queue := node.PendingSends[key]
+	for i, p := range queue {
+		if p.Msg.MessageID == messageID {
+			node.PendingSends[key] = append(queue[:i], queue[i+1:]...)
+			return
+		}
+	}
+}
+
+// flushPendingSends 在peer重新建立加密连接后按序重发队列中的消息
+func (node *P2PNode) flushPendingSends(peerID string) {
+	node.PeersMutex.RLock()
+	peer, exists := node.Peers[peerID]
+	var key string
+	if exists {
+		key = pendingSendKey(peer)
+	}
+	node.PeersMutex.RUnlock()
+	if !exists {
+		// 队列保留在原处，等待下次连接
+		return
+	}
+
+	// 握手完成前（尚不知道UUID时）失败的消息记在节点ID下，一并取出
+	node.PendingSendsMutex.Lock()
+	queue := node.PendingSends[key]
+	delete(node.PendingSends, key)
+	if key != peerID {
+		queue = append(queue, node.PendingSends[peerID]...)
+		delete(node.PendingSends, peerID)
+	}
+	node.PendingSendsMutex.Unlock()
+
+	if len(queue) == 0 {
+		return
+	}
+
+	Log.Info("重发待发送消息", "peer", peer.Name, "count", len(queue))
+	for _, p := range queue {
+		if time.Since(p.QueuedAt) > pendingSendTTL {
+			node.markMessageFailed(p.Msg.MessageID)
+			continue
+		}
+		// 对方重启后节点ID会变化，私聊消息按当前连接重新设置接收方
+		if p.Msg.To != "" && p.Msg.To != "all" {
+			p.Msg.To = peer.ID
+		}
+		// 发送失败时 sendMessageToPeer 会重新入队
+		node.sendMessageToPeer(peer, p.Msg)
+	}
+}
+
+// expirePendingSends 清理超过TTL的待发送消息，并标记为发送失败
+func (node *P2PNode) expirePendingSends() {
+	var expired []string
+	node.PendingSendsMutex.Lock()
+	for peerID, queue := range node.PendingSends {
+		kept := queue[:0]
+		for _, p := range queue {
+			if time.Since(p.QueuedAt) > pendingSendTTL {
+				expired = append(expired, p.Msg.MessageID)
+			} else {
+				kept = append(kept, p)
+			}
+		}
+		if len(kept) == 0 {
+			delete(node.PendingSends, peerID)
+		} else {
+			node.PendingSends[peerID] = kept
+		}
+	}
+	node.PendingSendsMutex.Unlock()
+
+	for _, id := range expired {
+		node.markMessageFailed(id)
+	}
+}
+
+// markMessageFailed 将消息标记为发送失败并通知UI
+func (node *P2PNode) markMessageFailed(messageID string) {
+	if messageID == "" {
+		return
+	}
+	node.MessagesMutex.Lock()
+	for i := range node.Messages {
+		if node.Messages[i].MessageID == messageID {
+			node.Messages[i].Failed = true
+			if node.Messages[i].IsOwn && node.Messages[i].IsPrivate {
+				node.Messages[i].DeliveryStatus = DeliveryFailed
+			}
+			node.MessagesRevision++
+			break
+		}
+	}
+	node.MessagesMutex.Unlock()
+
+	fmt.Printf("消息发送失败: %s\n", messageID)
+	Log.Warn("消息重试超时，标记为发送失败", "messageId", messageID)
+	node.emitMessageFailed(messageID)
+}
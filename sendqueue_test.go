@@ -0,0 +1,48 @@
+package main
+
+import (
+	"encoding/json"
+	"net"
+	"testing"
+	"time"
+)
+
+// 对方重启后以新节点ID重连：按UUID暂存的消息应发给新连接，且接收方改为新节点ID
+func TestFlushPendingSendsAfterReconnect(t *testing.T) {
+	node := &P2PNode{Peers: make(map[string]*Peer)}
+
+	oldPeer := &Peer{ID: "old-id", Name: "对方", UUID: "user-1"}
+	node.enqueuePendingSend(oldPeer, Message{Type: "chat", MessageID: "m1", To: "old-id", Content: "你好"})
+	// 握手完成前失败的消息只知道节点ID
+	node.enqueuePendingSend(&Peer{ID: "new-id", Name: "对方"}, Message{Type: "chat", MessageID: "m2", To: "new-id", Content: "在吗"})
+
+	local, remote := net.Pipe()
+	defer remote.Close()
+	newPeer := &Peer{ID: "new-id", Name: "对方", UUID: "user-1", Conn: local, IsActive: true}
+	node.Peers[newPeer.ID] = newPeer
+	defer node.closeOutbox(newPeer)
+
+	go node.flushPendingSends(newPeer.ID)
+
+	remote.SetReadDeadline(time.Now().Add(5 * time.Second))
+	decoder := json.NewDecoder(remote)
+	for _, want := range []string{"m1", "m2"} {
+		var msg Message
+		if err := decoder.Decode(&msg); err != nil {
+			t.Fatalf("读取重发消息失败: %v", err)
+		}
+		if msg.MessageID != want {
+			t.Fatalf("重发消息 = %q，期望 %q", msg.MessageID, want)
+		}
+		if msg.To != newPeer.ID {
+			t.Fatalf("消息 %s 的接收方 = %q，期望新节点ID %q", want, msg.To, newPeer.ID)
+		}
+	}
+
+	node.PendingSendsMutex.Lock()
+	left := len(node.PendingSends)
+	node.PendingSendsMutex.Unlock()
+	if left != 0 {
+		t.Fatalf("重发后仍有 %d 个待发送队列", left)
+	}
+}
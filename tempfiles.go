@@ -0,0 +1,92 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// 发送前需要先落盘的中转文件放在数据目录下的以下子目录：
+// temp（桌面端拖放/粘贴的文件数据）、tmp（发送文件夹时压缩的 zip）、uploads（浏览器上传的文件）。
+// 这些文件只在传输期间需要：发送完成、被拒绝、取消或超时后删除对应副本（releaseTempFile）；
+// 其他结束方式由 cleanupMemory 定期清理，退出时（Stop）再清理一次。
+// 仍被未结束的发送任务引用的文件始终保留
+var tempFileDirs = []string{"temp", "tmp", "uploads"}
+
+// tempFileMaxAge 定期清理时，未被任何传输记录引用的中转文件保留的时间
+// （传输记录本身在结束10分钟后被清理，之后只能按文件时间判断）
+const tempFileMaxAge = 30 * time.Minute
+
+// isTempFilePath 判断路径是否位于中转目录中
+func isTempFilePath(path string) bool {
+	for _, dir := range tempFileDirs {
+		rel, err := filepath.Rel(DataPath(dir), path)
+		if err == nil && rel != "." && !strings.HasPrefix(rel, "..") && !filepath.IsAbs(rel) {
+			return true
+		}
+	}
+	return false
+}
+
+// tempFileUsage 返回发送任务引用的中转文件：true 表示仍有未结束的任务使用，false 表示引用它的任务都已结束
+func (node *P2PNode) tempFileUsage() map[string]bool {
+	node.FileTransfersMutex.RLock()
+	defer node.FileTransfersMutex.RUnlock()
+	usage := make(map[string]bool)
+	for _, transfer := range node.FileTransfers {
+		if transfer.Direction != "send" || !isTempFilePath(transfer.FilePath) {
+			continue
+		}
+		inUse := transfer.Status == "pending" || transfer.isActive()
+		usage[transfer.FilePath] = usage[transfer.FilePath] || inUse
+	}
+	return usage
+}
+
+// releaseTempFile 发送任务结束后删除其中转副本；不是中转文件或仍有其他任务在发送同一文件时保留
+func (node *P2PNode) releaseTempFile(path string) {
+	if path == "" || !isTempFilePath(path) || node.tempFileUsage()[path] {
+		return
+	}
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		Log.Warn("删除中转文件失败", "path", path, "error", err)
+		return
+	}
+	Log.Debug("已删除中转文件", "path", path)
+}
+
+// cleanupTempFiles 清理中转目录：删除引用它的任务都已结束的文件，以及未被引用且超过 maxAge 的文件。
+// maxAge 为 0 时删除所有未在使用的文件（退出时）
+func (node *P2PNode) cleanupTempFiles(maxAge time.Duration) {
+	usage := node.tempFileUsage()
+	now := time.Now()
+	removed := 0
+	for _, dir := range tempFileDirs {
+		entries, err := os.ReadDir(DataPath(dir))
+		if err != nil {
+			continue
+		}
+		for _, entry := range entries {
+			path := DataPath(dir, entry.Name())
+			inUse, referenced := usage[path]
+			if inUse {
+				continue
+			}
+			if !referenced && maxAge > 0 {
+				info, err := entry.Info()
+				if err != nil || now.Sub(info.ModTime()) < maxAge {
+					continue
+				}
+			}
+			if err := os.RemoveAll(path); err != nil {
+				Log.Warn("删除中转文件失败", "path", path, "error", err)
+				continue
+			}
+			removed++
+		}
+	}
+	if removed > 0 {
+		Log.Info("已清理中转文件", "count", removed)
+	}
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"time"
+)
+
+// 文件传输卡死检测：超过超时时间无进度标记为 stalled，再过同样时长仍无进度判定为 failed
+const (
+	defaultTransferStallTimeout = 60 * time.Second
+	transferWatchInterval       = 5 * time.Second
+)
+
+// transferStallTimeout 返回配置的卡死判定时间
+func (node *P2PNode) transferStallTimeout() time.Duration {
+	if node.Config == nil {
+		return defaultTransferStallTimeout
+	}
+	return node.Config.GetTransferStallTimeout()
+}
+
+// watchFileTransfers 定期检查进行中的文件传输，处理长时间无进度的传输
+func (node *P2PNode) watchFileTransfers() {
+	ticker := time.NewTicker(transferWatchInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			node.checkStalledTransfers(time.Now())
+		case <-node.StopCh:
+			return
+		}
+	}
+}
+
+// checkStalledTransfers 标记卡住的传输；超时两倍仍无进度的判定失败，清理部分文件并通知对方
+func (node *P2PNode) checkStalledTransfers(now time.Time) {
+	timeout := node.transferStallTimeout()
+
+	var failed []*FileTransferStatus
+	var resend []string
+	node.FileTransfersMutex.Lock()
+	for _, t := range node.FileTransfers {
+		// 只检查进行中的传输，pending/completed/cancelled/failed 不参与
+		if t.Status != "transferring" && t.Status != "stalled" {
+			continue
+		}
+		// 发送方已发出全部数据块、等待接收方确认，此时没有进度属正常
+		if t.Direction == "send" && t.Progress >= t.FileSize {
+			continue
+		}
+		if t.LastProgressTime.IsZero() {
+			t.LastProgressTime = now
+			continue
+		}
+
+		idle := now.Sub(t.LastProgressTime)
+		switch {
+		case idle >= 2*timeout:
+			t.Status = "failed"
+			t.EndTime = now
+			failed = append(failed, t)
+		case idle >= timeout && t.Status == "transferring":
+			t.Status = "stalled"
+			t.Speed = 0
+			t.ETA = -1
+			fmt.Printf("文件传输长时间无进度: %s\n", t.FileName)
+			Log.Warn("文件传输卡住", "fileID", t.FileID, "fileName", t.FileName,
+				"direction", t.Direction, "idle", idle.Round(time.Second))
+			if t.Direction == "receive" {
+				resend = append(resend, t.FileID)
+			}
+		}
+	}
+	node.FileTransfersMutex.Unlock()
+
+	// 接收卡住时可能是数据块丢失，请求发送方重传缺失部分
+	for _, fileID := range resend {
+		go node.requestMissingChunks(fileID)
+	}
+
+	for _, t := range failed {
+		fmt.Printf("文件传输超时失败: %s\n", t.FileName)
+		Log.Error("文件传输超时失败", "fileID", t.FileID, "fileName", t.FileName,
+			"direction", t.Direction, "peer", t.PeerName)
+		if t.Direction == "receive" {
+			t.removePartialFile()
+		}
+		node.notifyTransferFailed(t.FileID, t.PeerID)
+	}
+}
+
+// notifyTransferFailed 通知对方传输已失败，让其停止发送或清理部分文件
+func (node *P2PNode) notifyTransferFailed(fileID, peerID string) {
+	node.PeersMutex.RLock()
+	peer, exists := node.Peers[peerID]
+	node.PeersMutex.RUnlock()
+	if !exists {
+		return
+	}
+
+	msg := Message{
+		Type:      "file_failed",
+		From:      node.ID,
+		To:        peerID,
+		Timestamp: time.Now(),
+		Content:   fileID,
+	}
+	node.sendMessageToPeer(peer, msg)
+}
+
+// handleFileTransferFailed 处理对方发来的传输失败通知
+func (node *P2PNode) handleFileTransferFailed(fileID string) {
+	node.FileTransfersMutex.Lock()
+	transfer, exists := node.FileTransfers[fileID]
+	if !exists || (transfer.Status != "transferring" && transfer.Status != "stalled") {
+		node.FileTransfersMutex.Unlock()
+		return
+	}
+	transfer.Status = "failed"
+	transfer.EndTime = time.Now()
+	fileName, direction := transfer.FileName, transfer.Direction
+	node.FileTransfersMutex.Unlock()
+
+	fmt.Printf("对方判定文件传输失败: %s\n", fileName)
+	Log.Warn("对方判定文件传输失败", "fileID", fileID, "fileName", fileName)
+	if direction == "receive" {
+		transfer.removePartialFile()
+	}
+}
+
+// removePartialFile 删除未接收完整的文件（尚未收到数据块时 ReceivePath 为空）。
+// 调用前状态已置为失败，持有 writeMu 等待进行中的写入结束，之后不会再有写入
+func (t *FileTransferStatus) removePartialFile() {
+	t.writeMu.Lock()
+	defer t.writeMu.Unlock()
+
+	path := t.ReceivePath
+	if path == "" {
+		return
+	}
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		Log.Warn("删除未完成的接收文件失败", "path", path, "error", err)
+	}
+}
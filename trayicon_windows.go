@@ -92,7 +92,7 @@ func callSetWindowLongPtr(hwnd, index, newLong uintptr) uintptr {
 }
 
 // isAppWindowVisible checks if the main LANShare window is visible and not minimized.
-// Uses Windows API so it reflects the actual window state (including HideWindowOnClose).
+// Uses Windows API so it reflects the actual window state (including close-to-tray hiding).
 func isAppWindowVisible() (visible bool, minimized bool) {
 	title, _ := windows.UTF16PtrFromString("LS Messager")
 	hwnd, _, _ := pFindWindowW.Call(0, uintptr(unsafe.Pointer(title)))
@@ -5,6 +5,7 @@ import (
 	"net"
 	"net/http"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/hashicorp/mdns"
@@ -18,33 +19,55 @@ type P2PNode struct {
 	Name      string
 	ID        string
 	Address   string // 新增：本地地址 "IP:port"
+	UUID      string // 持久用户标识（AppConfig.UserUUID），跨重启不变
 
 	Listener   net.Listener
 	Peers      map[string]*Peer
 	PeersMutex sync.RWMutex
 
-	MessageChan chan Message
+	MessageChan chan Message  // 从不关闭，消费方通过 StopCh 退出
 	StopCh      chan struct{} // Closed on shutdown to signal all goroutines
-	Running     bool
+	stopOnce    sync.Once
+	Running     atomic.Bool // 各后台协程并发读取，Start/Stop 写入
 
 	DiscoveryPort int
 	BroadcastConn *net.UDPConn
 	BroadcastAddr string
 	MdnsServer    *mdns.Server
+	mdnsMutex     sync.Mutex // 保护 MdnsServer：服务在后台协程中注册，可能与 Stop 并发
 
 	// Web GUI相关
 	WebPort      int
-	Messages     []ChatMessage
+	Messages     []ChatMessage // 最近消息的有界缓存（上限见 memoryMessageCap），命令行与 Web 共用
 	MessagesMutex sync.RWMutex
+	MessagesRevision uint64 // Messages 被原地修改（删除、改名、标记失败）时递增，增量轮询据此回退全量
+	pendingDeliveries map[string]string // 消息入列表前已产生的发送状态（MessagesMutex 保护）
 	WebEnabled   bool
 	WebServer    *http.Server
+	APIToken     string // 启动时生成，本机UI调用写操作端点时携带
+
+	// 各会话未读数（按会话ID索引，持久化在 chat_state 表）
+	ChatUnread      map[string]int
+	ChatUnreadMutex sync.RWMutex
+
+	// 按链接接收、尚未拉取到本地的公聊图片（按本地文件名索引）
+	RemoteImages      map[string]remoteImage
+	RemoteImagesMutex sync.Mutex
 
 	// 文件传输相关
 	FileTransfers     map[string]*FileTransferStatus
 	FileTransfersMutex sync.RWMutex
+	UploadLimiter     uploadLimiter // 文件发送限速（AppConfig.MaxUploadBytesPerSec）
+
+	// 发送失败重试队列（按对方用户UUID索引，无UUID时按peer ID；重连后按序重发）
+	PendingSends      map[string][]pendingSend
+	PendingSendsMutex sync.Mutex
+
 	ACLs              map[string]map[string]bool
 	ACLMutex          sync.RWMutex
 	DB                *sql.DB
+	MessageWriter     *messageWriter // 聊天消息异步批量入库
+	DBCorruptBackup   string         // 启动时发现数据库损坏，损坏文件的备份路径
 	LocalDBKey        [32]byte
 
 	// Node-level ECDH keys (persistent for node lifetime)
@@ -54,11 +77,33 @@ type P2PNode struct {
 	// 内存管理
 	lastCleanupTime   time.Time
 
+	// 主动连接的重试与冷却（见 connectretry.go）
+	connects connectAttempts
+
+	// 种子节点 peer_exchange 限速（按请求者IP记录上次交换时间）
+	lastPeerExchange   map[string]time.Time
+	peerExchangeMutex  sync.Mutex
+
 	// Desktop mode (Wails)
 	DesktopMode       bool
 	OnNewMessage      func(ChatMessage)
-	OnUserOnline      func(string)
-	OnUserOffline     func(string)
+	OnUserOnline      func(name string, seq uint64)
+	OnUserOffline     func(name string, seq uint64)
+	presenceSeq       uint64 // 上下线事件序号，见 nextPresenceSeq
+	presence          presenceDebounce // 上下线事件去抖，见 events.go
+	seenMessages      seenMessages     // 已处理的聊天消息ID，去重见 msgdedup.go
+	autoAccept        autoAcceptLimiter // 自动接受文件的总量与频率限制，见 autoaccept.go
+	presenceStats     presenceStats     // 数据库不可用时的在线时长统计，见 presence.go
+	autoReply         autoReplyLimiter  // 自动回复的冷却记录，见 autoreply.go
+	pinnedMessages    pinnedMessageStore // 数据库不可用时的置顶消息，见 pinmsg.go
+	undoableSends     undoableSendStore  // 撤销窗口内暂存的消息，见 web.go queueUndoableSend
+	messageHooks      []func(*Message) bool // 消息处理钩子链，见 hooks.go
+	messageHooksMutex sync.RWMutex
+	OnMessageFailed   func(string) // messageID
+	OnMessageStatus   func(messageID, status string)
+	OnNameConflict    func(name, displayName string)
+	OnHistoryChanged  func(chatID string) // 会话记录被删除（整会话或时间段），前端需重新加载
+	OnPinnedMessagesChanged func(chatID string) // 会话的置顶消息有变化
 	OnUpdateAvailable func(updateSource)
 	OnBeforeRestart   func() // Called before restart to clean up desktop resources
 	OnQuitApp         func() // Called to properly quit the app (triggers Wails shutdown)
@@ -67,20 +112,28 @@ type P2PNode struct {
 	AvailableUpdate *updateSource
 	UpdateStatus    string // "", "downloading", "completed", "failed"
 	UpdateError     string
+	UpdateProgress  UpdateProgress
+	UpdateMutex     sync.RWMutex // 保护 UpdateStatus/UpdateError/UpdateProgress
 
 	// Config reference for runtime settings
-	Config *AppConfig
+	Config      *AppConfig
+	ConfigMutex sync.RWMutex // 保护运行中修改的 Config 字段：HTTP 处理器、消息接收协程和配置导入会并发访问
+	// 导入的配置修改了Web端口（重启后生效），退出时不再用当前端口覆盖
+	WebPortChangePending bool
 }
 
 // Peer结构体 - 对等节点结构
 type Peer struct {
 	ID            string
-	Name          string
+	Name          string    // 显示名：与其他用户重名时带区分后缀，本机按此名查找和保存会话
+	BaseName      string    // 对端自报的用户名
 	Address       string
 	Conn          net.Conn
 	WriteMutex    sync.Mutex // 保护TCP连接写入，防止并发写入破坏JSON流
+	Outbox        peerOutbox // 串行发送队列，保证同一peer的消息按调用顺序发出
 	IsActive      bool
 	LastSeen      time.Time
+	OnlineSince   time.Time // 本次上线时间，下线时累计在线时长（见 presence.go）
 	SharedKey     []byte    // 共享密钥 (derived from node private + peer public)
 	PublicKey     [32]byte  // 对端公钥 (remote peer's public key)
 	ReconnectAttempts int   // 重连尝试次数
@@ -88,6 +141,19 @@ type Peer struct {
 	IP            string    // IP地址
 	Port          int       // 端口号
 	WebPort       int       // HTTP端口号（用于更新检查等）
+	UUID          string    // 对端持久用户标识（旧版本为空）
+	Capabilities  []string  // 对端在握手中声明的能力（见 capabilities.go），旧版本为空
+	AvatarHash    string    // 对端自定义头像的哈希，未设置时为空（见 avatar.go）
+	Outbound      bool      // 连接由本机主动发起
+	Latency       peerLatency // 心跳RTT与丢包统计
+}
+
+// UserKey 返回对端的稳定用户标识：优先UUID，旧版本节点回退到用户名
+func (p *Peer) UserKey() string {
+	if p.UUID != "" {
+		return p.UUID
+	}
+	return p.Name
 }
 
 // Message结构体 - 通用消息结构
@@ -115,6 +181,15 @@ type Message struct {
 	FileURL        string `json:"fileUrl,omitempty"`        // 文件URL
 	FileData       string `json:"fileData,omitempty"`       // 文件base64数据（用于图片等小文件）
 	FileID         string `json:"fileId,omitempty"`         // 文件传输ID（关联FileTransferStatus）
+	ForwardedFrom  string `json:"forwardedFrom,omitempty"`  // 转发消息的原发送者
+	ContentFormat  string `json:"contentFormat,omitempty"`  // 文字内容格式: plain/markdown，空 = plain（旧版本）
+	DisplayName    string `json:"displayName,omitempty"`    // 发送者本条消息使用的临时显示名，不影响身份与会话归属
+	AutoReply      bool   `json:"autoReply,omitempty"`      // 自动回复的消息，接收方不再自动回复（见 autoreply.go）
+
+	// 位置消息（MessageTypeLocation）
+	Latitude     float64 `json:"latitude,omitempty"`     // 纬度
+	Longitude    float64 `json:"longitude,omitempty"`    // 经度
+	LocationName string  `json:"locationName,omitempty"` // 地点名称或房间号
 }
 
 // DiscoveryMessage结构体 - 服务发现消息结构
@@ -127,6 +202,28 @@ type DiscoveryMessage struct {
 	WebPort int    `json:"webPort,omitempty"` // HTTP port for LAN sharing
 	Version string `json:"version,omitempty"` // App version for auto-update
 	PubKey  []byte `json:"pubKey,omitempty"`  // Node public key for ECDH
+	UUID    string `json:"uuid,omitempty"`    // Persistent user identity
+
+	Capabilities []string `json:"capabilities,omitempty"` // 本机支持的能力，见 capabilities.go
+
+	// 跨子网发现（种子节点）
+	Relay bool       `json:"relay,omitempty"` // 单播announce请求种子节点交换peer列表
+	Peers []PeerInfo `json:"peers,omitempty"` // peer_exchange 携带的节点列表
+
+	// 用网络密钥加密的完整发现消息（此时其他字段只有 Type、ID），见 discovery.go
+	Sealed    []byte `json:"sealed,omitempty"`
+	SealNonce []byte `json:"sealNonce,omitempty"`
+	sealed    bool   // 收到的消息经网络密钥解密（对方持有同一密钥）
+}
+
+// PeerInfo结构体 - peer_exchange 中交换的节点信息
+type PeerInfo struct {
+	ID      string `json:"id"`
+	Name    string `json:"name"`
+	IP      string `json:"ip"`
+	Port    int    `json:"port"`
+	WebPort int    `json:"webPort,omitempty"`
+	UUID    string `json:"uuid,omitempty"`
 }
 
 // ChatMessage结构体 - 聊天消息结构
@@ -149,6 +246,20 @@ type ChatMessage struct {
 	FileType       string `json:"fileType,omitempty"`       // 文件类型
 	FileURL        string `json:"fileUrl,omitempty"`        // 文件URL（用于Web界面）
 	FileID         string `json:"fileId,omitempty"`         // 文件传输ID（关联FileTransferStatus）
+	Failed         bool   `json:"failed,omitempty"`         // 重试超时仍未发送成功
+	DeliveryStatus string `json:"deliveryStatus,omitempty"` // 自己发出的私聊消息的发送状态（仅内存，见 delivery.go）
+	PeerUUID       string `json:"peerUuid,omitempty"`       // 会话对方的持久标识
+	ForwardedFrom  string `json:"forwardedFrom,omitempty"`  // 转发消息的原发送者
+	ContentFormat  string `json:"contentFormat,omitempty"`  // 文字内容格式，前端按此渲染 Markdown
+	DisplayName    string `json:"displayName,omitempty"`    // 发送者的临时显示名，仅用于展示，Sender 仍为真实用户名
+	Mentioned      bool   `json:"mentioned,omitempty"`      // 消息 @ 了本机用户（仅实时事件，不入库）
+	Muted          bool   `json:"muted,omitempty"`          // 所属会话已开启免打扰（仅实时事件，不入库）
+	AvatarColor    string `json:"avatarColor,omitempty"`    // 发送者的头像颜色，按其稳定标识确定（不入库，见 avatar.go）
+
+	// 位置消息（MessageTypeLocation）
+	Latitude     float64 `json:"latitude,omitempty"`
+	Longitude    float64 `json:"longitude,omitempty"`
+	LocationName string  `json:"locationName,omitempty"`
 }
 
 // FileTransferRequest结构体 - 文件传输请求
@@ -157,6 +268,8 @@ type FileTransferRequest struct {
 	FileID      string    `json:"fileId"`
 	FileName    string    `json:"fileName"`
 	FileSize    int64     `json:"fileSize"`
+	FileType    string    `json:"fileType,omitempty"` // 由扩展名推断的MIME类型（旧版本为空）
+	FileIcon    string    `json:"fileIcon,omitempty"` // 图标提示，见 fileIconHint
 	From        string    `json:"from"`
 	To          string    `json:"to"`
 	Timestamp   time.Time `json:"timestamp"`
@@ -176,7 +289,8 @@ type FileChunk struct {
 	Type        string    `json:"type"`
 	FileID      string    `json:"fileId"`
 	ChunkNum    int       `json:"chunkNum"`
-	TotalChunks int       `json:"totalChunks"`
+	TotalChunks int       `json:"totalChunks"`           // 块大小自适应，发送方按当前块大小估算；结束于文件末尾的块上准确
+	Offset      *int64    `json:"offset,omitempty"`      // 本块在文件中的起始位置，旧版本发送方没有此字段
 	Data        []byte    `json:"data,omitempty"`
 	Timestamp   time.Time `json:"timestamp"`
 	Encrypted   bool      `json:"encrypted"`
@@ -195,6 +309,8 @@ type FileTransferStatus struct {
 	FileName       string    `json:"fileName"`
 	FilePath       string    `json:"-"` // 发送方的文件完整路径，不进行json序列化
 	FileSize       int64     `json:"fileSize"`
+	FileType       string    `json:"fileType,omitempty"` // MIME类型，见 fileTypeFor
+	FileIcon       string    `json:"fileIcon,omitempty"` // 图标提示，见 fileIconHint
 	Progress       int64     `json:"progress"`
 	Status         string    `json:"status"` // pending, transferring, completed, failed
 	Direction      string    `json:"direction"` // send, receive
@@ -206,7 +322,17 @@ type FileTransferStatus struct {
 	Speed          float64   `json:"speed"`          // 传输速度 (bytes/second)
 	ETA            int64     `json:"eta"`            // 预计剩余时间 (seconds)
 	LastUpdateTime time.Time `json:"-"`              // 上次更新时间，用于计算速度
+	LastProgressTime time.Time `json:"-"`            // 开始传输或最近一次收发数据块的时间，用于卡死检测
 	SavePath       string    `json:"savePath,omitempty"` // 接收文件保存路径
+	ReceivePath    string    `json:"-"`                  // 接收中的写入路径，收到首个数据块时按整理设置确定，完成后写入 SavePath
+	IsExecutable   bool      `json:"isExecutable,omitempty"` // 可执行文件类型（.exe/.bat等），UI需提示风险
+
+	// 以下由 FileTransfersMutex 保护
+	chunks       chunkBitmap // 接收方已写入的块
+	resendRounds int         // 接收方已请求重传的轮数
+	sentChunks   []sentChunk // 发送方已发出的块（按块序号），用于重传
+
+	writeMu sync.Mutex // 串行化接收文件的写入与部分文件清理
 }
 
 // 应用版本
@@ -228,9 +354,25 @@ const (
 	MessageTypeText  = "text"
 	MessageTypeImage = "image"
 	MessageTypeFile  = "file"
-	MessageTypeReply = "reply"
+	MessageTypeReply    = "reply"
+	MessageTypeForward  = "forward"  // 转发消息，实际内容类型由文件字段推断（见 forwardedKind）
+	MessageTypeLocation = "location" // 位置坐标，见 Latitude/Longitude/LocationName
+)
+
+// 文字消息的内容格式。存储时保留原始标记，由前端按白名单渲染
+const (
+	ContentFormatPlain    = "plain"
+	ContentFormatMarkdown = "markdown" // 有限的 Markdown：粗体、斜体、代码、链接
 )
 
+// normalizeContentFormat 只接受已知格式，其余（含旧版本的空值）按纯文本处理
+func normalizeContentFormat(format string) string {
+	if format == ContentFormatMarkdown {
+		return ContentFormatMarkdown
+	}
+	return ContentFormatPlain
+}
+
 // ImageMessage结构体 - 图片消息
 type ImageMessage struct {
 	FileName   string `json:"fileName"`
@@ -1,6 +1,7 @@
 package main
 
 import (
+	_ "embed"
 	"encoding/json"
 	"fmt"
 	"io"
@@ -14,6 +15,38 @@ import (
 	"time"
 )
 
+//go:embed CHANGELOG.md
+var changelogMarkdown string
+
+// maxChangelogLen caps the changelog shared over /version.
+const maxChangelogLen = 4096
+
+// currentChangelog returns the CHANGELOG.md section for the running version
+// (matched by full version or base semver), or "" if there is none.
+func currentChangelog() string {
+	var section []string
+	inSection := false
+	for _, line := range strings.Split(changelogMarkdown, "\n") {
+		line = strings.TrimRight(line, "\r")
+		if strings.HasPrefix(line, "## ") {
+			if inSection {
+				break
+			}
+			v := strings.TrimSpace(strings.TrimPrefix(line, "## "))
+			inSection = v == AppVersion || v == versionBase(AppVersion)
+			continue
+		}
+		if inSection {
+			section = append(section, line)
+		}
+	}
+	text := strings.TrimSpace(strings.Join(section, "\n"))
+	if len(text) > maxChangelogLen {
+		text = strings.ToValidUTF8(text[:maxChangelogLen], "")
+	}
+	return text
+}
+
 // versionBase extracts the base semver (e.g., "1.0.1" from "1.0.1-beta").
 func versionBase(v string) string {
 	if idx := strings.Index(v, "-"); idx != -1 {
@@ -30,9 +63,12 @@ func versionChannel(v string) string {
 	return "stable"
 }
 
-// compareVersions compares two semver strings (ignoring pre-release labels).
+// compareVersions compares two semver strings. For the same base version a
+// stable release is newer than any pre-release, and pre-releases are ordered
+// by their labels (e.g., "1.2.0-rc1" < "1.2.0-rc2" < "1.2.0-rc10").
 // Returns: 1 if a > b, -1 if a < b, 0 if equal.
 func compareVersions(a, b string) int {
+	a, b = trimVersionPrefix(a), trimVersionPrefix(b)
 	aBase := versionBase(a)
 	bBase := versionBase(b)
 
@@ -69,10 +105,104 @@ func compareVersions(a, b string) int {
 	if aCh == "test" && bCh == "stable" {
 		return -1
 	}
+	if aCh == "test" && bCh == "test" {
+		return comparePreRelease(versionPreRelease(a), versionPreRelease(b))
+	}
+
+	return 0
+}
+
+// trimVersionPrefix strips surrounding spaces and a leading "v" ("v1.2.0" -> "1.2.0"),
+// as used by release tags.
+func trimVersionPrefix(v string) string {
+	v = strings.TrimSpace(v)
+	if len(v) > 1 && (v[0] == 'v' || v[0] == 'V') && isDigit(v[1]) {
+		return v[1:]
+	}
+	return v
+}
 
+// versionPreRelease returns the pre-release label ("rc1" from "1.2.0-rc1"), or "" for stable versions.
+func versionPreRelease(v string) string {
+	if idx := strings.Index(v, "-"); idx != -1 {
+		return v[idx+1:]
+	}
+	return ""
+}
+
+// comparePreRelease compares dot-separated pre-release labels identifier by
+// identifier. Digit runs compare numerically so "rc10" > "rc9"; when all shared
+// identifiers are equal, the label with more identifiers is newer (semver rule).
+func comparePreRelease(a, b string) int {
+	aIDs := strings.Split(a, ".")
+	bIDs := strings.Split(b, ".")
+	for i := 0; i < len(aIDs) && i < len(bIDs); i++ {
+		if c := compareNatural(aIDs[i], bIDs[i]); c != 0 {
+			return c
+		}
+	}
+	switch {
+	case len(aIDs) > len(bIDs):
+		return 1
+	case len(aIDs) < len(bIDs):
+		return -1
+	}
 	return 0
 }
 
+// compareNatural compares two strings treating runs of digits as numbers
+// ("beta2" < "beta10"); other characters compare byte-wise.
+func compareNatural(a, b string) int {
+	for a != "" && b != "" {
+		aDigits, bDigits := isDigit(a[0]), isDigit(b[0])
+		if aDigits && bDigits {
+			aRun, aRest := splitDigitRun(a)
+			bRun, bRest := splitDigitRun(b)
+			aRun = strings.TrimLeft(aRun, "0")
+			bRun = strings.TrimLeft(bRun, "0")
+			if len(aRun) != len(bRun) {
+				if len(aRun) > len(bRun) {
+					return 1
+				}
+				return -1
+			}
+			if c := strings.Compare(aRun, bRun); c != 0 {
+				return c
+			}
+			a, b = aRest, bRest
+			continue
+		}
+		// Semver: numeric identifiers sort before alphanumeric ones
+		if aDigits != bDigits {
+			if aDigits {
+				return -1
+			}
+			return 1
+		}
+		if a[0] != b[0] {
+			if a[0] > b[0] {
+				return 1
+			}
+			return -1
+		}
+		a, b = a[1:], b[1:]
+	}
+	return strings.Compare(a, b)
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+// splitDigitRun splits s into its leading run of digits and the remainder.
+func splitDigitRun(s string) (string, string) {
+	i := 0
+	for i < len(s) && isDigit(s[i]) {
+		i++
+	}
+	return s[:i], s[i:]
+}
+
 // updateSource holds info about a peer that has a newer version.
 type updateSource struct {
 	IP      string `json:"ip"`
@@ -80,6 +210,9 @@ type updateSource struct {
 	Version string `json:"version"`
 	Channel string `json:"channel"`
 	WebPort int    `json:"webPort"`
+	// Signature is the source's signed release manifest (see updateManifest).
+	Signature string `json:"signature,omitempty"`
+	Changelog string `json:"changelog,omitempty"`
 }
 
 // isNewer checks if source version is newer (any channel).
@@ -92,15 +225,32 @@ func isCrossChannel(sourceVersion string) bool {
 	return versionChannel(sourceVersion) != AppChannel()
 }
 
+// acceptsUpdate reports whether a version should be offered as an update:
+// it must be newer and match the configured update channel.
+func (node *P2PNode) acceptsUpdate(version string) bool {
+	if !isNewer(version) {
+		return false
+	}
+	channel := AppChannel()
+	if node.Config != nil {
+		channel = node.Config.GetUpdateChannel()
+	}
+	return channel == "any" || versionChannel(version) == channel
+}
+
 // checkForUpdates scans LAN peers for newer versions.
 // Called after the P2P node starts, runs periodically in background.
 func (node *P2PNode) checkForUpdates() {
 	// Wait a few seconds for discovery to find peers
-	time.Sleep(8 * time.Second)
-
+	delay := 8 * time.Second
 	for {
+		select {
+		case <-node.StopCh:
+			return
+		case <-time.After(delay):
+		}
 		node.checkForUpdatesOnce()
-		time.Sleep(60 * time.Second)
+		delay = 60 * time.Second
 	}
 }
 
@@ -118,7 +268,7 @@ func (node *P2PNode) checkForUpdatesOnce() {
 			wp = node.WebPort // fallback to local port if peer's not known
 		}
 		source := checkPeerVersion(peer.IP, wp, peer.Name)
-		if source != nil && isNewer(source.Version) {
+		if source != nil && node.acceptsUpdate(source.Version) {
 			if newestSource == nil || compareVersions(source.Version, newestSource.Version) > 0 {
 				newestSource = source
 			}
@@ -145,8 +295,7 @@ func (node *P2PNode) checkForUpdatesOnce() {
 			fmt.Printf("╚═══════════════════════════════════════════╝\n\n")
 
 			// Reset update status so the new version can be downloaded
-			node.UpdateStatus = ""
-			node.UpdateError = ""
+			node.setUpdateStatus("", "")
 
 			// Emit Wails event for desktop UI
 			node.emitUpdateAvailable(*newestSource)
@@ -173,27 +322,31 @@ func checkPeerVersion(ip string, webPort int, name string) *updateSource {
 	}
 
 	var info struct {
-		Version string `json:"version"`
-		Channel string `json:"channel"`
-		Name    string `json:"name"`
+		Version   string `json:"version"`
+		Channel   string `json:"channel"`
+		Name      string `json:"name"`
+		Signature string `json:"signature"`
+		Changelog string `json:"changelog"`
 	}
 	if json.NewDecoder(resp.Body).Decode(&info) != nil {
 		return nil
 	}
 
 	return &updateSource{
-		IP:      ip,
-		Name:    info.Name,
-		Version: info.Version,
-		Channel: info.Channel,
-		WebPort: webPort,
+		IP:        ip,
+		Name:      info.Name,
+		Version:   info.Version,
+		Channel:   info.Channel,
+		WebPort:   webPort,
+		Signature: info.Signature,
+		Changelog: info.Changelog,
 	}
 }
 
 // performUpdate downloads the latest version from a peer and replaces the current exe.
-func (node *P2PNode) performUpdate() {
-	node.UpdateStatus = "downloading"
-	node.UpdateError = ""
+// Updates to a different release channel require confirmCrossChannel.
+func (node *P2PNode) performUpdate(confirmCrossChannel bool) {
+	node.setUpdateStatus("downloading", "")
 
 	node.PeersMutex.RLock()
 	source := node.AvailableUpdate
@@ -202,13 +355,18 @@ func (node *P2PNode) performUpdate() {
 	if source == nil {
 		source = findUpdateSource(node)
 		if source == nil {
-			node.UpdateStatus = "failed"
-			node.UpdateError = "当前没有可用的更新"
+			node.setUpdateStatus("failed", "当前没有可用的更新")
 			fmt.Println("当前没有可用的更新")
 			return
 		}
 	}
 
+	if isCrossChannel(source.Version) && !confirmCrossChannel {
+		node.setUpdateStatus("failed", "跨渠道更新需要确认")
+		fmt.Printf("%s 属于其他发布渠道，确认更新请使用 /update confirm\n", source.Version)
+		return
+	}
+
 	channelLabel := "稳定版"
 	if source.Channel == "test" {
 		channelLabel = "测试版"
@@ -219,8 +377,7 @@ func (node *P2PNode) performUpdate() {
 	client := &http.Client{Timeout: 10 * time.Minute}
 	resp, err := client.Get(url)
 	if err != nil {
-		node.UpdateStatus = "failed"
-		node.UpdateError = fmt.Sprintf("下载失败: %v", err)
+		node.setUpdateStatus("failed", fmt.Sprintf("下载失败: %v", err))
 		fmt.Printf("下载失败: %v\n", err)
 		Log.Error("更新下载失败", "url", url, "error", err)
 		return
@@ -228,16 +385,14 @@ func (node *P2PNode) performUpdate() {
 	defer resp.Body.Close()
 
 	if resp.StatusCode != 200 {
-		node.UpdateStatus = "failed"
-		node.UpdateError = fmt.Sprintf("下载失败: HTTP %d", resp.StatusCode)
+		node.setUpdateStatus("failed", fmt.Sprintf("下载失败: HTTP %d", resp.StatusCode))
 		fmt.Printf("下载失败: HTTP %d\n", resp.StatusCode)
 		return
 	}
 
 	exePath, err := os.Executable()
 	if err != nil {
-		node.UpdateStatus = "failed"
-		node.UpdateError = "获取程序路径失败"
+		node.setUpdateStatus("failed", "获取程序路径失败")
 		return
 	}
 	exePath, _ = filepath.EvalSymlinks(exePath)
@@ -245,15 +400,15 @@ func (node *P2PNode) performUpdate() {
 	newPath := exePath + ".new"
 	tmpFile, err := os.Create(newPath)
 	if err != nil {
-		node.UpdateStatus = "failed"
-		node.UpdateError = "创建临时文件失败"
+		node.setUpdateStatus("failed", "创建临时文件失败")
 		return
 	}
 
 	totalSize := resp.ContentLength
-	var downloaded int64
+	var downloaded, lastDownloaded int64
 	buf := make([]byte, 64*1024)
 	lastPrint := time.Now()
+	node.setUpdateProgress(0, totalSize, 0)
 
 	for {
 		n, readErr := resp.Body.Read(buf)
@@ -261,13 +416,15 @@ func (node *P2PNode) performUpdate() {
 			if _, writeErr := tmpFile.Write(buf[:n]); writeErr != nil {
 				tmpFile.Close()
 				os.Remove(newPath)
-				node.UpdateStatus = "failed"
-				node.UpdateError = "写入文件失败"
+				node.setUpdateStatus("failed", "写入文件失败")
 				return
 			}
 			downloaded += int64(n)
 
-			if time.Since(lastPrint) > 500*time.Millisecond {
+			if elapsed := time.Since(lastPrint); elapsed > 500*time.Millisecond {
+				speed := float64(downloaded-lastDownloaded) / elapsed.Seconds()
+				node.setUpdateProgress(downloaded, totalSize, speed)
+				lastDownloaded = downloaded
 				if totalSize > 0 {
 					pct := float64(downloaded) / float64(totalSize) * 100
 					fmt.Printf("\r  下载中: %.1f MB / %.1f MB (%.0f%%)    ",
@@ -284,36 +441,184 @@ func (node *P2PNode) performUpdate() {
 		if readErr != nil {
 			tmpFile.Close()
 			os.Remove(newPath)
-			node.UpdateStatus = "failed"
-			node.UpdateError = "下载中断"
+			node.setUpdateStatus("failed", "下载中断")
 			return
 		}
 	}
 	tmpFile.Close()
 	fmt.Printf("\r  下载完成: %.1f MB                              \n", float64(downloaded)/1024/1024)
 
+	// 替换前校验发布签名，防止恶意节点伪造 /version 和 /update 推送任意程序
+	if err := verifyUpdateSignature(newPath, source.Signature, source.Version); err != nil {
+		os.Remove(newPath)
+		node.setUpdateStatus("failed", fmt.Sprintf("更新包签名校验失败: %v", err))
+		fmt.Printf("更新包签名校验失败: %v，已中止更新\n", err)
+		Log.Error("更新包签名校验失败", "source", source.Name, "ip", source.IP, "error", err)
+		return
+	}
+
 	oldPath := exePath + ".old"
 	os.Remove(oldPath)
 
 	if err := os.Rename(exePath, oldPath); err != nil {
 		Log.Error("重命名当前程序失败", "error", err)
 		os.Remove(newPath)
-		node.UpdateStatus = "failed"
-		node.UpdateError = "替换程序文件失败"
+		node.setUpdateStatus("failed", "替换程序文件失败")
 		return
 	}
 
 	if err := os.Rename(newPath, exePath); err != nil {
 		Log.Error("安装新版本失败", "error", err)
 		os.Rename(oldPath, exePath)
-		node.UpdateStatus = "failed"
-		node.UpdateError = "安装新版本失败"
+		node.setUpdateStatus("failed", "安装新版本失败")
 		return
 	}
 
+	// 标记新版本待确认：新版本启动成功前保留 .old，崩溃则下次启动时回滚
+	if err := os.WriteFile(exePath+updatePendingSuffix, []byte(updateStateInstalled), 0644); err != nil {
+		Log.Warn("写入更新待确认标记失败", "error", err)
+	}
+
+	// 保存签名，使本机也能继续向其他节点提供该版本
+	if err := os.WriteFile(exePath+updateSignatureSuffix, []byte(source.Signature), 0644); err != nil {
+		Log.Warn("保存更新包签名失败", "error", err)
+	}
+
 	fmt.Printf("\n更新成功! %s → %s\n", AppVersion, source.Version)
 	Log.Info("更新成功", "oldVersion", AppVersion, "newVersion", source.Version)
-	node.UpdateStatus = "completed"
+	node.setUpdateStatus("completed", "")
+}
+
+// UpdateProgress 更新包下载进度，由 /update-status 上报给前端
+type UpdateProgress struct {
+	Downloaded int64   `json:"downloaded"` // 已下载字节
+	Total      int64   `json:"total"`      // 总字节，未知时为 0
+	Percent    float64 `json:"percent"`
+	Speed      float64 `json:"speed"` // 字节/秒
+}
+
+// setUpdateStatus 更新下载状态；完成或失败时清零进度
+func (node *P2PNode) setUpdateStatus(status, errMsg string) {
+	node.UpdateMutex.Lock()
+	defer node.UpdateMutex.Unlock()
+	node.UpdateStatus = status
+	node.UpdateError = errMsg
+	if status != "downloading" {
+		node.UpdateProgress = UpdateProgress{}
+	}
+}
+
+// setUpdateProgress 记录下载进度
+func (node *P2PNode) setUpdateProgress(downloaded, total int64, speed float64) {
+	node.UpdateMutex.Lock()
+	defer node.UpdateMutex.Unlock()
+	node.UpdateProgress = UpdateProgress{Downloaded: downloaded, Total: total, Speed: speed}
+	if total > 0 {
+		node.UpdateProgress.Percent = float64(downloaded) / float64(total) * 100
+	}
+}
+
+// getUpdateState 返回当前下载状态、错误信息和进度的快照
+func (node *P2PNode) getUpdateState() (string, string, UpdateProgress) {
+	node.UpdateMutex.RLock()
+	defer node.UpdateMutex.RUnlock()
+	return node.UpdateStatus, node.UpdateError, node.UpdateProgress
+}
+
+// Update rollback markers, stored next to the executable.
+// <exe>.update-pending exists while a freshly installed version is unconfirmed;
+// its content records whether that version has been launched yet.
+// <exe>.startup-ok is written once the new version's node has started.
+const (
+	updatePendingSuffix  = ".update-pending"
+	startupOKSuffix      = ".startup-ok"
+	updateStateInstalled = "installed"
+	updateStateLaunched  = "launched"
+	rolledBackSuffix     = ".bad"
+)
+
+// checkUpdateRollback runs early in main. If the previous launch of a freshly
+// installed version never reached markStartupSuccess (crashed), it restores the
+// .old executable, starts it and returns true so the caller exits.
+// Otherwise it cleans up leftovers from previous updates and returns false.
+func checkUpdateRollback() bool {
+	exePath, err := os.Executable()
+	if err != nil {
+		return false
+	}
+	exePath, _ = filepath.EvalSymlinks(exePath)
+	pendingPath := exePath + updatePendingSuffix
+	okPath := exePath + startupOKSuffix
+
+	state, err := os.ReadFile(pendingPath)
+	if err != nil {
+		// 没有待确认的更新
+		os.Remove(okPath)
+		cleanupOldExecutable()
+		return false
+	}
+
+	if _, err := os.Stat(okPath); err == nil {
+		// 新版本已成功启动过，更新确认完成
+		os.Remove(pendingPath)
+		os.Remove(okPath)
+		cleanupOldExecutable()
+		return false
+	}
+
+	if strings.TrimSpace(string(state)) != updateStateLaunched {
+		// 新版本首次启动：记录已启动，保留 .old 直到启动成功
+		os.WriteFile(pendingPath, []byte(updateStateLaunched), 0644)
+		return false
+	}
+
+	// 上次启动新版本未能成功，回滚到 .old
+	oldPath := exePath + ".old"
+	if _, err := os.Stat(oldPath); err != nil {
+		fmt.Println("新版本上次启动失败，但旧版本文件不存在，无法回滚")
+		os.Remove(pendingPath)
+		return false
+	}
+	fmt.Println("检测到新版本上次启动失败，正在回滚到旧版本...")
+	badPath := exePath + rolledBackSuffix
+	os.Remove(badPath)
+	if err := os.Rename(exePath, badPath); err != nil {
+		fmt.Printf("回滚失败: %v\n", err)
+		return false
+	}
+	if err := os.Rename(oldPath, exePath); err != nil {
+		fmt.Printf("回滚失败: %v\n", err)
+		os.Rename(badPath, exePath)
+		return false
+	}
+	os.Remove(pendingPath)
+
+	cmd := exec.Command(exePath, "-restart-delay", "10")
+	cmd.Dir = filepath.Dir(exePath)
+	setDetachedProcess(cmd)
+	if err := cmd.Start(); err != nil {
+		fmt.Printf("已回滚到旧版本，但启动失败，请手动重新打开程序: %v\n", err)
+		return true
+	}
+	fmt.Println("已回滚到旧版本并重新启动")
+	return true
+}
+
+// markStartupSuccess confirms a pending update once the node has started.
+func markStartupSuccess() {
+	exePath, err := os.Executable()
+	if err != nil {
+		return
+	}
+	exePath, _ = filepath.EvalSymlinks(exePath)
+	if _, err := os.Stat(exePath + updatePendingSuffix); err != nil {
+		return
+	}
+	if err := os.WriteFile(exePath+startupOKSuffix, []byte(AppVersion), 0644); err != nil {
+		Log.Warn("写入启动成功标记失败", "error", err)
+		return
+	}
+	Log.Info("新版本启动成功，更新已确认", "version", AppVersion)
 }
 
 // cleanupOldExecutable removes leftover .old files and restart scripts from previous updates.
@@ -328,6 +633,9 @@ func cleanupOldExecutable() {
 	scriptPath := filepath.Join(filepath.Dir(exePath), "_lanshare_restart.bat")
 	os.Remove(scriptPath)
 
+	// Clean up executable left behind by a rollback
+	os.Remove(exePath + rolledBackSuffix)
+
 	// Clean up .old file with retries (may still be locked briefly on Windows)
 	oldPath := exePath + ".old"
 	if _, err := os.Stat(oldPath); err != nil {
@@ -382,7 +690,7 @@ func startNewProcess() (int, error) {
 
 // restartApplication starts the new exe and force-exits the current process.
 // On Windows, uses a helper batch script to wait for this process to fully die
-// (including WebView2 children), clean up .old files, then launch the new exe.
+// (including WebView2 children), then launch the new exe.
 // On other platforms, falls back to direct child process launch.
 func restartApplication(node *P2PNode) error {
 	exePath, err := os.Executable()
@@ -402,7 +710,11 @@ func restartApplication(node *P2PNode) error {
 
 	// Save config before exiting
 	if node != nil && node.Config != nil {
-		SaveConfig(node.Config)
+		node.saveConfig()
+	}
+	// 写入尚在批处理队列中的消息，os.Exit 不会执行 Stop
+	if node != nil {
+		node.closeMessageWriter()
 	}
 
 	// Clean up desktop resources (sharing server, etc.)
@@ -443,7 +755,7 @@ func findUpdateSource(node *P2PNode) *updateSource {
 			wp = node.WebPort
 		}
 		source := checkPeerVersion(peer.IP, wp, peer.Name)
-		if source != nil && isNewer(source.Version) {
+		if source != nil && node.acceptsUpdate(source.Version) {
 			if best == nil || compareVersions(source.Version, best.Version) > 0 {
 				best = source
 			}
@@ -460,7 +772,7 @@ func findUpdateSource(node *P2PNode) *updateSource {
 	peers := discoverPeersForUpdate(node.LocalIP, node.WebPort)
 	for _, peer := range peers {
 		source := checkPeerVersion(peer.IP, peer.WebPort, peer.Name)
-		if source != nil && isNewer(source.Version) {
+		if source != nil && node.acceptsUpdate(source.Version) {
 			if best == nil || compareVersions(source.Version, best.Version) > 0 {
 				best = source
 			}
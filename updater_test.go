@@ -0,0 +1,155 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestCompareVersions(t *testing.T) {
+	tests := []struct {
+		a, b string
+		want int
+	}{
+		// 数字段按数值比较
+		{"1.0.10", "1.0.9", 1},
+		{"1.0.9", "1.0.10", -1},
+		{"1.2.0", "1.10.0", -1},
+		{"2.0.0", "1.99.99", 1},
+		{"1.0.0", "1.0.0", 0},
+		{"1.0", "1.0.0", 0},
+		{"1.0.1", "1.0", 1},
+		// 预发布标签
+		{"1.2.0-rc1", "1.2.0-rc2", -1},
+		{"1.2.0-rc2", "1.2.0-rc10", -1},
+		{"1.2.0-rc10", "1.2.0-rc9", 1},
+		{"1.2.0-beta", "1.2.0-rc1", -1},
+		{"1.2.0-rc.2", "1.2.0-rc.10", -1},
+		{"1.2.0-rc", "1.2.0-rc.1", -1},
+		// 稳定版高于同版本号的预发布版，低于更高版本号的预发布版
+		{"1.2.0", "1.2.0-rc10", 1},
+		{"1.2.0-beta", "1.2.0", -1},
+		{"1.2.1-beta", "1.2.0", 1},
+		// "v" 前缀
+		{"v1.0.10", "1.0.9", 1},
+		{"1.0.9", "v1.0.10", -1},
+		{"v1.2.0-rc1", "V1.2.0-rc1", 0},
+		{" v1.2.0 ", "1.2.0", 0},
+		// 格式错误的输入不 panic，无法解析的部分按 0 处理
+		{"", "", 0},
+		{"", "1.0.0", -1},
+		{"abc", "0.0.1", -1},
+		{"1.x.0", "1.0.0", 0},
+		{"1..2", "1.0.2", 0},
+		{"v", "1.0.0", -1},
+		{"1.0.0-", "1.0.0", -1},
+	}
+	for _, tt := range tests {
+		if got := compareVersions(tt.a, tt.b); got != tt.want {
+			t.Errorf("compareVersions(%q, %q) = %d, want %d", tt.a, tt.b, got, tt.want)
+		}
+	}
+}
+
+func TestComparePreRelease(t *testing.T) {
+	tests := []struct {
+		a, b string
+		want int
+	}{
+		{"rc1", "rc2", -1},
+		{"rc2", "rc10", -1},
+		{"rc10", "rc1", 1},
+		{"rc1", "rc1", 0},
+		{"alpha", "beta", -1},
+		{"beta.2", "beta.11", -1},
+		{"beta", "beta.1", -1},
+		{"1", "alpha", -1}, // 数字标识符排在字母标识符之前
+		{"", "", 0},
+	}
+	for _, tt := range tests {
+		if got := comparePreRelease(tt.a, tt.b); got != tt.want {
+			t.Errorf("comparePreRelease(%q, %q) = %d, want %d", tt.a, tt.b, got, tt.want)
+		}
+	}
+}
+
+func TestCompareNatural(t *testing.T) {
+	tests := []struct {
+		a, b string
+		want int
+	}{
+		{"beta2", "beta10", -1},
+		{"beta10", "beta2", 1},
+		{"rc01", "rc1", 0}, // 前导零不影响数值
+		{"rc007", "rc10", -1},
+		{"a", "b", -1},
+		{"rc", "rc1", -1},
+		{"1a", "a1", -1},
+		{"", "", 0},
+		{"", "1", -1},
+	}
+	for _, tt := range tests {
+		if got := compareNatural(tt.a, tt.b); got != tt.want {
+			t.Errorf("compareNatural(%q, %q) = %d, want %d", tt.a, tt.b, got, tt.want)
+		}
+	}
+}
+
+// 签名清单绑定版本：旧的正版程序冒充新版本、版本不比当前新、程序被替换都应被拒绝
+func TestVerifyUpdateSignature(t *testing.T) {
+	pub, priv, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	oldKey := updatePublicKey
+	updatePublicKey = base64.StdEncoding.EncodeToString(pub)
+	defer func() { updatePublicKey = oldKey }()
+
+	dir := t.TempDir()
+	writeRelease := func(name string, data []byte, version string) (string, string) {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, data, 0644); err != nil {
+			t.Fatal(err)
+		}
+		sum := sha256.Sum256(data)
+		m := updateManifest{Version: version, Channel: versionChannel(version), SHA256: hex.EncodeToString(sum[:])}
+		m.Signature = base64.StdEncoding.EncodeToString(ed25519.Sign(priv, m.signedBytes()))
+		raw, err := json.Marshal(m)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return path, string(raw)
+	}
+
+	newer := "99.0.0"
+	newPath, newSig := writeRelease("new.exe", []byte("new release"), newer)
+	if err := verifyUpdateSignature(newPath, newSig, newer); err != nil {
+		t.Fatalf("合法的新版本被拒绝: %v", err)
+	}
+
+	// 旧版本的正版程序和签名，被声明为新版本
+	oldPath, oldSig := writeRelease("old.exe", []byte("old release"), "0.1.0")
+	if err := verifyUpdateSignature(oldPath, oldSig, newer); err == nil {
+		t.Fatal("旧版本冒充新版本应被拒绝")
+	}
+	if err := verifyUpdateSignature(oldPath, oldSig, "0.1.0"); err == nil {
+		t.Fatal("不比当前版本新的签名应被拒绝")
+	}
+
+	// 新版本的签名清单配上其他程序文件
+	if err := verifyUpdateSignature(oldPath, newSig, newer); err == nil {
+		t.Fatal("程序与清单的 SHA-256 不符应被拒绝")
+	}
+
+	// 篡改清单中的版本号
+	tampered := strings.Replace(newSig, newer, "99.0.1", 1)
+	if err := verifyUpdateSignature(newPath, tampered, "99.0.1"); err == nil {
+		t.Fatal("篡改过的清单应被拒绝")
+	}
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// updatePublicKey 发布签名公钥（Ed25519，base64），构建时通过
+// -ldflags "-X main.updatePublicKey=..." 注入，见 build.sh。
+// 为空表示未签名的开发构建，此时拒绝自动更新。
+var updatePublicKey = ""
+
+// 签名文件与可执行文件同目录，文件名为 <exe>.sig，内容为 JSON 格式的签名清单（updateManifest）
+const updateSignatureSuffix = ".sig"
+
+// updateManifestContext 签名内容的前缀，与 build.sh 的 sign_binary 保持一致
+const updateManifestContext = "LANShare update manifest v1\n"
+
+// updateManifest 发布签名清单。签名同时覆盖版本、渠道和程序的 SHA-256：只签程序本身时，
+// 恶意节点可以把旧的正版程序连同其真实签名声明为新版本推送，使对方降级到有漏洞的版本
+type updateManifest struct {
+	Version   string `json:"version"`
+	Channel   string `json:"channel"`
+	SHA256    string `json:"sha256"`    // 程序文件的 SHA-256（十六进制）
+	Signature string `json:"signature"` // 对 signedBytes 的 Ed25519 签名（base64）
+}
+
+// signedBytes 返回被签名的内容
+func (m updateManifest) signedBytes() []byte {
+	return []byte(updateManifestContext +
+		"version=" + m.Version + "\n" +
+		"channel=" + m.Channel + "\n" +
+		"sha256=" + m.SHA256 + "\n")
+}
+
+// localUpdateSignature 读取本机程序的发布签名，供 /version 下发给其他节点
+func localUpdateSignature() string {
+	exePath, err := os.Executable()
+	if err != nil {
+		return ""
+	}
+	exePath, _ = filepath.EvalSymlinks(exePath)
+	data, err := os.ReadFile(exePath + updateSignatureSuffix)
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(data))
+}
+
+// verifyUpdateSignature 使用内嵌公钥校验签名清单，并确认清单中的版本即更新源声明的 version、
+// 比当前版本新，且下载的更新包与清单中的 SHA-256 一致
+func verifyUpdateSignature(path, signature, version string) error {
+	if updatePublicKey == "" {
+		return fmt.Errorf("当前版本未内嵌发布公钥，无法校验更新包")
+	}
+	if signature == "" {
+		return fmt.Errorf("更新源未提供签名")
+	}
+	pub, err := base64.StdEncoding.DecodeString(updatePublicKey)
+	if err != nil || len(pub) != ed25519.PublicKeySize {
+		return fmt.Errorf("发布公钥无效")
+	}
+	var manifest updateManifest
+	if err := json.Unmarshal([]byte(signature), &manifest); err != nil {
+		return fmt.Errorf("签名格式无效")
+	}
+	sig, err := base64.StdEncoding.DecodeString(manifest.Signature)
+	if err != nil || len(sig) != ed25519.SignatureSize {
+		return fmt.Errorf("签名格式无效")
+	}
+	if !ed25519.Verify(ed25519.PublicKey(pub), manifest.signedBytes(), sig) {
+		return fmt.Errorf("签名不匹配")
+	}
+	if manifest.Version != version {
+		return fmt.Errorf("签名版本 %s 与更新源声明的版本 %s 不一致", manifest.Version, version)
+	}
+	if manifest.Channel != versionChannel(manifest.Version) {
+		return fmt.Errorf("签名渠道与版本不一致")
+	}
+	if compareVersions(manifest.Version, AppVersion) <= 0 {
+		return fmt.Errorf("签名版本 %s 不比当前版本 %s 新", manifest.Version, AppVersion)
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("读取更新包失败: %v", err)
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return fmt.Errorf("读取更新包失败: %v", err)
+	}
+	if !strings.EqualFold(hex.EncodeToString(h.Sum(nil)), manifest.SHA256) {
+		return fmt.Errorf("更新包与签名清单不符")
+	}
+	return nil
+}
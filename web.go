@@ -2,7 +2,7 @@ package main
 
 import (
 	"context"
-	"database/sql"
+	"crypto/subtle"
 	"embed"
 	"encoding/base64"
 	"encoding/json"
@@ -11,20 +11,76 @@ import (
 	"io"
 	"io/fs"
 	"log"
+	"mime"
 	"net"
 	"net/http"
 	"os"
 	"os/exec"
 	"path/filepath"
 	"runtime"
+	"slices"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
+	"unicode"
+	"unicode/utf8"
+
+	qrcode "github.com/skip2/go-qrcode"
 )
 
 //go:embed all:web emoji_gifs.json
 var webFS embed.FS
 
+// API 令牌：本机UI通过 header 或 cookie 携带
+const (
+	apiTokenHeader = "X-LANShare-Token"
+	apiTokenCookie = "lanshare_token"
+)
+
+// 无需令牌的端点（供其他节点发现、更新检查和 WebView2 引导）
+var apiTokenExempt = map[string]bool{
+	"/version":          true,
+	"/webview2runtime": true,
+}
+
+// isLocalRequest 判断请求是否来自本机：回环地址，或 Wails AssetServer 的进程内请求（无 RemoteAddr）
+func isLocalRequest(r *http.Request) bool {
+	if r.RemoteAddr == "" {
+		return true
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// requireAPIToken 中间件：写操作端点（非 GET/HEAD）必须携带正确的令牌
+func (node *P2PNode) requireAPIToken(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// /api/ 端点自行校验令牌（requireScriptToken），另支持 Authorization: Bearer
+		if r.Method == http.MethodGet || r.Method == http.MethodHead || apiTokenExempt[r.URL.Path] ||
+			strings.HasPrefix(r.URL.Path, "/api/") {
+			next.ServeHTTP(w, r)
+			return
+		}
+		token := r.Header.Get(apiTokenHeader)
+		if token == "" {
+			if c, err := r.Cookie(apiTokenCookie); err == nil {
+				token = c.Value
+			}
+		}
+		if token == "" || subtle.ConstantTimeCompare([]byte(token), []byte(node.APIToken)) != 1 {
+			Log.Warn("拒绝未授权的API请求", "path", r.URL.Path, "remote", r.RemoteAddr)
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
 // 创建HTTP请求处理器（供Web服务器和Wails AssetHandler共用）
 func (node *P2PNode) createHTTPHandler() http.Handler {
 	// 创建新的路由器
@@ -44,7 +100,22 @@ func (node *P2PNode) createHTTPHandler() http.Handler {
 
 	// 主页处理器
 	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
-		if err := tmpl.Execute(w, node); err != nil {
+		// 令牌只下发给本机（Wails 界面或本机浏览器），局域网访问者拿不到
+		data := struct {
+			*P2PNode
+			Token string
+		}{P2PNode: node}
+		if isLocalRequest(r) {
+			data.Token = node.APIToken
+			http.SetCookie(w, &http.Cookie{
+				Name:     apiTokenCookie,
+				Value:    node.APIToken,
+				Path:     "/",
+				HttpOnly: true,
+				SameSite: http.SameSiteStrictMode,
+			})
+		}
+		if err := tmpl.Execute(w, data); err != nil {
 			log.Printf("执行模板失败: %v", err)
 			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
 		}
@@ -56,184 +127,229 @@ func (node *P2PNode) createHTTPHandler() http.Handler {
 	mux.Handle("/static/", http.StripPrefix("/static/", staticServer))
 
 	// GIF 表情文件服务器
-	// 请求 /emoji-gifs/heart.gif -> 从 ~/.lanshare/assets/emoji-gifs/heart.gif 服务
-	emojiGifServer := http.FileServer(http.Dir(DataPath("assets", "emoji-gifs")))
-	mux.Handle("/emoji-gifs/", http.StripPrefix("/emoji-gifs/", emojiGifServer))
+	// 请求 /emoji-gifs/heart.gif -> 从 ~/.lanshare/assets/emoji-gifs/heart.gif 服务，本地缺失时从局域网同步
+	mux.HandleFunc("/emoji-gifs/", node.handleEmojiGif)
+	// 按ID获取表情（本地缺失时从局域网同步）；CLI 模式下 Web 服务即对外端口，也供其他节点同步
+	mux.HandleFunc("/emoji-asset/", node.handleEmojiAsset)
+	// 供其他节点拉取本机发到公聊的图片（按链接发送时）
+	mux.HandleFunc("/shared-images/", node.handleSharedImage)
+	// 供脚本调用的API，见 api.go
+	node.registerScriptAPI(mux)
 
 	// 图片文件服务器
 	// 请求 /images/filename.jpg -> 从 ~/.lanshare/images/ 服务
 	imageServer := http.FileServer(http.Dir(DataPath("images")))
 	mux.Handle("/images/", http.StripPrefix("/images/", imageServer))
 
-	// 获取 GIF 表情列表处理器
+	// 获取 GIF 表情列表处理器（内置 emoji_gifs.json + 用户自定义表情）
 	mux.HandleFunc("/emoji-gifs-list", func(w http.ResponseWriter, r *http.Request) {
-		// 读取嵌入的 emoji_gifs.json 文件
-		data, err := webFS.Open("emoji_gifs.json")
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(allEmojis())
+	})
+
+	// 上传自定义表情
+	// 头像：/avatar/{hash} 按哈希返回头像图片，本地没有时从声明该头像的节点拉取
+	mux.HandleFunc("/avatar/", node.handleAvatar)
+
+	// 上传自定义头像（JSON base64 或 multipart），remove=true 时清除
+	mux.HandleFunc("/upload-avatar", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		var data []byte
+		if r.URL.Query().Get("remove") != "true" {
+			if strings.HasPrefix(r.Header.Get("Content-Type"), "application/json") {
+				var req struct {
+					File string `json:"file"` // base64
+				}
+				if err := json.NewDecoder(io.LimitReader(r.Body, avatarMaxSize*2)).Decode(&req); err != nil {
+					http.Error(w, "请求格式错误", http.StatusBadRequest)
+					return
+				}
+				var err error
+				if data, err = base64.StdEncoding.DecodeString(req.File); err != nil {
+					http.Error(w, "文件数据解码失败", http.StatusBadRequest)
+					return
+				}
+			} else {
+				r.Body = http.MaxBytesReader(w, r.Body, avatarMaxSize+1<<20)
+				file, _, err := r.FormFile("file")
+				if err != nil {
+					http.Error(w, "头像文件过大或格式错误", http.StatusBadRequest)
+					return
+				}
+				defer file.Close()
+				if data, err = io.ReadAll(io.LimitReader(file, avatarMaxSize+1)); err != nil {
+					http.Error(w, "读取文件失败", http.StatusBadRequest)
+					return
+				}
+			}
+			if len(data) == 0 {
+				http.Error(w, "头像文件为空", http.StatusBadRequest)
+				return
+			}
+		}
+
+		hash, err := node.setAvatar(data)
 		if err != nil {
-			// 如果文件不存在，返回空列表
-			w.Header().Set("Content-Type", "application/json")
-			json.NewEncoder(w).Encode([]interface{}{})
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]string{"avatarHash": hash})
+	})
+
+	mux.HandleFunc("/upload-emoji", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 			return
 		}
-		defer data.Close()
 
-		// 直接转发文件内容
+		var data []byte
+		var name string
+		// Support both JSON (Wails) and multipart form (browser)
+		if strings.HasPrefix(r.Header.Get("Content-Type"), "application/json") {
+			var req struct {
+				File string `json:"file"` // base64
+				Name string `json:"name"`
+			}
+			if err := json.NewDecoder(io.LimitReader(r.Body, emojiAssetMaxSize*2)).Decode(&req); err != nil {
+				http.Error(w, "请求格式错误", http.StatusBadRequest)
+				return
+			}
+			var err error
+			if data, err = base64.StdEncoding.DecodeString(req.File); err != nil {
+				http.Error(w, "文件数据解码失败", http.StatusBadRequest)
+				return
+			}
+			name = req.Name
+		} else {
+			r.Body = http.MaxBytesReader(w, r.Body, emojiAssetMaxSize+1<<20)
+			file, _, err := r.FormFile("file")
+			if err != nil {
+				http.Error(w, "表情文件过大或格式错误", http.StatusBadRequest)
+				return
+			}
+			defer file.Close()
+			if data, err = io.ReadAll(io.LimitReader(file, emojiAssetMaxSize+1)); err != nil {
+				http.Error(w, "读取文件失败", http.StatusBadRequest)
+				return
+			}
+			name = r.FormValue("name")
+		}
+
+		entry, err := addCustomEmoji(strings.TrimSpace(name), data)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
 		w.Header().Set("Content-Type", "application/json")
-		io.Copy(w, data)
+		json.NewEncoder(w).Encode(entry)
 	})
 
 	// 获取所有历史聊天伙伴（用于聊天列表显示离线用户）
 	mux.HandleFunc("/chatpartners", func(w http.ResponseWriter, r *http.Request) {
-		partners := []string{}
-		if node.DB != nil {
-			rows, err := node.DB.Query(`
-				SELECT DISTINCT CASE
-					WHEN is_own = TRUE THEN recipient
-					ELSE sender
-				END AS partner
-				FROM messages
-				WHERE is_private = TRUE AND partner != 'all'
-			`)
-			if err == nil {
-				defer rows.Close()
-				for rows.Next() {
-					var p string
-					if rows.Scan(&p) == nil && p != "" && p != node.Name {
-						partners = append(partners, p)
-					}
-				}
-			}
+		w.Header().Set("Content-Type", "application/json")
+		partners := node.withoutArchived(node.chatPartners()) // 归档会话由 /archived 单独返回
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"partners":      partners,
+			"chats":         node.chatActivities(partners), // 置顶标记、最近活跃时间与未读数，含公聊 "all"
+			"pinned":        node.pinnedChats(),
+			"archivedCount": len(node.archivedChats()),
+		})
+	})
+
+	// 按ID取单条消息（解密后），供前端展开回复的引用链。
+	// 原消息已被删除（清空会话、超出保留期）时 found 为 false，message 为占位内容
+	mux.HandleFunc("/message/", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		messageID := strings.TrimPrefix(r.URL.Path, "/message/")
+		if messageID == "" {
+			http.Error(w, "Invalid request", http.StatusBadRequest)
+			return
 		}
 		w.Header().Set("Content-Type", "application/json")
-		json.NewEncoder(w).Encode(map[string]interface{}{"partners": partners})
+		cm, ok := node.findChatMessage(messageID)
+		if !ok {
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"found":   false,
+				"message": ChatMessage{MessageID: messageID, Content: "原消息已删除"},
+			})
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"found": true, "message": cm})
 	})
 
-	// 加载历史消息处理器 (for web frontend)
-	mux.HandleFunc("/loadhistory", func(w http.ResponseWriter, r *http.Request) {
-		if node.DB == nil {
-			http.Error(w, "Database not available", http.StatusInternalServerError)
+	// 在线时长统计：今日/总在线秒数，离线用户返回最后在线时间
+	mux.HandleFunc("/presence", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 			return
 		}
+		name := strings.TrimSpace(r.URL.Query().Get("name"))
+		if name == "" {
+			http.Error(w, "Invalid request", http.StatusBadRequest)
+			return
+		}
+		info, ok := node.presenceFor(name)
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{"found": ok, "presence": info})
+	})
 
+	// 加载历史消息处理器 (for web frontend)
+	mux.HandleFunc("/loadhistory", func(w http.ResponseWriter, r *http.Request) {
 		chatId := r.URL.Query().Get("chatId")
 		if chatId == "" {
 			chatId = "all"
 		}
+		// 未指定条数（首次打开会话）时按配置的初始加载条数
 		limitStr := r.URL.Query().Get("limit")
-		limit := 20
+		limit := node.initialHistoryLimit()
 		if l, err := strconv.Atoi(limitStr); err == nil && l > 0 {
 			limit = l
 		}
-		offsetStr := r.URL.Query().Get("offset")
-		offset := 0
-		if o, err := strconv.Atoi(offsetStr); err == nil {
-			offset = o
+		// 游标分页：beforeId 为上一页返回的 nextBeforeId，缺省从最新消息开始
+		var beforeID int64
+		if b, err := strconv.ParseInt(r.URL.Query().Get("beforeId"), 10, 64); err == nil && b > 0 {
+			beforeID = b
 		}
 
-		var rows *sql.Rows
-		var err error
-		var query string
-		var args []interface{}
-
-		if chatId == "all" {
-			query = `
-				SELECT sender, recipient, content, nonce, is_private, is_own, timestamp,
-					   message_type, message_id, reply_to_id, reply_to_content, reply_to_sender,
-					   file_name, file_size, file_type, file_url, file_data, COALESCE(file_id, '')
-				FROM messages
-				WHERE recipient = 'all' AND is_private = FALSE
-				ORDER BY timestamp ASC
-				LIMIT ? OFFSET ?
-			`
-			args = []interface{}{limit, offset}
-		} else {
-			query = `
-				SELECT sender, recipient, content, nonce, is_private, is_own, timestamp,
-					   message_type, message_id, reply_to_id, reply_to_content, reply_to_sender,
-					   file_name, file_size, file_type, file_url, file_data, COALESCE(file_id, '')
-				FROM messages
-				WHERE is_private = TRUE AND (
-					(sender = ? AND recipient = ?) OR
-					(sender = ? AND recipient = ?)
-				)
-				ORDER BY timestamp ASC
-				LIMIT ? OFFSET ?
-			`
-			args = []interface{}{node.Name, chatId, chatId, node.Name, limit, offset}
-		}
-
-		rows, err = node.DB.Query(query, args...)
+		msgs, nextBeforeID, err := node.queryHistoryPage(chatId, beforeID, limit)
 		if err != nil {
 			http.Error(w, "Query failed", http.StatusInternalServerError)
 			return
 		}
-		defer rows.Close()
 
 		type HistoryMsg struct {
 			ChatMessage
-			SenderName string `json:"senderName"`
+			SenderName  string `json:"senderName"`
+			DisplayTime string `json:"displayTime"`
 		}
 
-		var history []HistoryMsg
-		for rows.Next() {
-			var sender, recipient string
-			var content, nonce []byte
-			var isPrivate, isOwn bool
-			var tsStr string
-			var messageType, messageID, replyToID, replyToContent, replyToSender, fileName, fileType, fileURL, fileData, fileID string
-			var fileSize int64
-
-			err = rows.Scan(&sender, &recipient, &content, &nonce, &isPrivate, &isOwn, &tsStr,
-				&messageType, &messageID, &replyToID, &replyToContent, &replyToSender,
-				&fileName, &fileSize, &fileType, &fileURL, &fileData, &fileID)
-			if err != nil {
-				continue
-			}
-
-			plaintext, err := decryptMessage(node.LocalDBKey, content, nonce)
-			if err != nil {
-				fmt.Printf("解密历史消息失败: %v\n", err)
-				Log.Error("解密历史消息失败", "error", err)
-				continue
-			}
-
-			ts, err := time.Parse("2006-01-02 15:04:05", tsStr)
-			if err != nil {
-				ts = time.Now()
-			}
-
-			senderName := sender
-			if sender == node.Name {
+		now := time.Now()
+		history := []HistoryMsg{}
+		for _, cm := range msgs {
+			senderName := cm.Sender
+			if cm.Sender == node.Name {
 				senderName = "我"
 			}
-
-			hm := HistoryMsg{
-				ChatMessage: ChatMessage{
-					Sender:        sender,
-					Recipient:     recipient,
-					Content:       string(plaintext),
-					Timestamp:     ts,
-					IsOwn:         isOwn,
-					IsPrivate:     isPrivate,
-					MessageType:   messageType,
-					MessageID:     messageID,
-					ReplyToID:     replyToID,
-					ReplyToContent: replyToContent,
-					ReplyToSender: replyToSender,
-					FileName:      fileName,
-					FileSize:      fileSize,
-					FileType:      fileType,
-					FileURL:       fileURL,
-				FileID:        fileID,
-				},
-				SenderName: senderName,
-			}
-			history = append(history, hm)
+			history = append(history, HistoryMsg{
+				ChatMessage: cm,
+				SenderName:  senderName,
+				DisplayTime: formatMessageTime(cm.Timestamp, now),
+			})
 		}
 
 		w.Header().Set("Content-Type", "application/json")
 		json.NewEncoder(w).Encode(map[string]interface{}{
-			"messages": history,
+			"messages":     history,
+			"nextBeforeId": nextBeforeID,
+			"hasMore":      nextBeforeID > 0,
 		})
 	})
 
@@ -251,7 +367,10 @@ func (node *P2PNode) createHTTPHandler() http.Handler {
 		}
 
 		var req struct {
-			Message string `json:"message"`
+			Message    string `json:"message"`
+			TargetName string `json:"targetName,omitempty"` // 私聊对象，为空（或 "all"）时为公聊/命令
+			AsName     string `json:"asName,omitempty"`     // 本条消息的临时显示名，不修改用户名（命令忽略）
+			Undoable   bool   `json:"undoable,omitempty"`   // 暂存 undoSendWindow 后再发出，期间可撤销（命令忽略）
 		}
 
 		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
@@ -259,75 +378,200 @@ func (node *P2PNode) createHTTPHandler() http.Handler {
 			return
 		}
 
-		node.handleWebMessage(req.Message)
+		if req.Undoable && strings.TrimSpace(req.Message) != "" && !strings.HasPrefix(req.Message, "/") {
+			messageID, err := node.queueUndoableSend(req.TargetName, req.Message, req.AsName)
+			if err != nil {
+				status := http.StatusNotFound
+				if err == errPrivateTargetBlocked {
+					status = http.StatusForbidden
+				}
+				http.Error(w, err.Error(), status)
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"messageId":    messageID,
+				"undoWindowMs": undoSendWindow.Milliseconds(),
+			})
+			return
+		}
+
+		if req.TargetName != "" && req.TargetName != "all" {
+			if strings.TrimSpace(req.Message) == "" {
+				http.Error(w, "消息不能为空", http.StatusBadRequest)
+				return
+			}
+			if _, err := node.sendPrivateText(req.TargetName, req.Message, req.AsName); err != nil {
+				status := http.StatusNotFound
+				if err == errPrivateTargetBlocked {
+					status = http.StatusForbidden
+				}
+				http.Error(w, err.Error(), status)
+				return
+			}
+			w.WriteHeader(http.StatusOK)
+			return
+		}
+
+		node.handleWebMessage(req.Message, req.AsName)
+		w.WriteHeader(http.StatusOK)
+	})
+
+	// 撤销发送：丢弃撤销窗口内的暂存消息，已发出时返回 409
+	mux.HandleFunc("/undo-send", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		messageID := r.URL.Query().Get("messageId")
+		if messageID == "" {
+			http.Error(w, "缺少消息ID", http.StatusBadRequest)
+			return
+		}
+		if !node.undoSend(messageID) {
+			http.Error(w, "消息已发出，无法撤销", http.StatusConflict)
+			return
+		}
 		w.WriteHeader(http.StatusOK)
 	})
 
 	// 获取消息处理器
+	// since=<上次收到的最后一条消息ID>&rev=<上次返回的revision> 时只返回之后的新消息；
+	// 找不到该消息（已滚出内存窗口）或列表被原地修改过时返回全量，full=true
 	mux.HandleFunc("/messages", func(w http.ResponseWriter, r *http.Request) {
+		since := r.URL.Query().Get("since")
+		rev := r.URL.Query().Get("rev")
+
 		node.MessagesMutex.RLock()
-		messages := make([]ChatMessage, len(node.Messages))
-		copy(messages, node.Messages)
+		revision := node.MessagesRevision
+		start, full := 0, true
+		if since != "" && rev == strconv.FormatUint(revision, 10) {
+			for i := len(node.Messages) - 1; i >= 0; i-- {
+				if node.Messages[i].MessageID == since {
+					start, full = i+1, false
+					break
+				}
+			}
+		}
+		messages := make([]ChatMessage, len(node.Messages)-start)
+		copy(messages, node.Messages[start:])
 		node.MessagesMutex.RUnlock()
 
 		w.Header().Set("Content-Type", "application/json")
 		json.NewEncoder(w).Encode(map[string]interface{}{
 			"messages": messages,
+			"full":     full,
+			"revision": revision,
 		})
 	})
 
 	// 获取用户列表处理器
 	mux.HandleFunc("/users", func(w http.ResponseWriter, r *http.Request) {
-		users := []string{node.Name + " (自己)"}
-		
+		userList := node.userInfos()
+		// 默认不返回已归档会话的用户，includeArchived=true 时返回全部
+		if r.URL.Query().Get("includeArchived") != "true" {
+			userList = slices.DeleteFunc(userList, func(u UserInfo) bool {
+				return !u.IsSelf && node.isChatArchived(u.Name)
+			})
+		}
+
+		// users: 旧格式（名称拼接 "(自己)"/"(屏蔽)" 后缀，仅在线用户），保留给旧前端
+		users := []string{}
+		for _, u := range userList {
+			switch {
+			case u.IsSelf:
+				users = append(users, u.Name+" (自己)")
+			case !u.IsOnline:
+			case u.IsBlocked:
+				users = append(users, u.Name+" (屏蔽)")
+			default:
+				users = append(users, u.Name)
+			}
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"users":    users,
+			"userList": userList,
+		})
+	})
+
+	// 在线节点的连接质量（心跳RTT滑动平均与丢包率）
+	mux.HandleFunc("/peers", func(w http.ResponseWriter, r *http.Request) {
+		type peerInfo struct {
+			Name     string  `json:"name"`
+			UUID     string  `json:"uuid,omitempty"`
+			IP       string  `json:"ip"`
+			RTTMs    float64 `json:"rttMs"`
+			LossRate float64 `json:"lossRate"`
+			Samples  int     `json:"samples"`
+			Quality  string  `json:"quality"` // good/fair/poor/unknown
+		}
+		peers := []peerInfo{}
 		node.PeersMutex.RLock()
 		for _, peer := range node.Peers {
-			if peer.IsActive {
-				status := ""
-				if node.isBlocked(peer.Address) {
-					status = " (屏蔽)"
-				}
-				users = append(users, peer.Name + status)
+			if !peer.IsActive {
+				continue
 			}
+			stats := peer.Latency.Stats()
+			peers = append(peers, peerInfo{
+				Name:     peer.Name,
+				UUID:     peer.UUID,
+				IP:       peer.IP,
+				RTTMs:    float64(stats.RTT.Microseconds()) / 1000,
+				LossRate: stats.LossRate,
+				Samples:  stats.Samples,
+				Quality:  stats.Quality(),
+			})
 		}
 		node.PeersMutex.RUnlock()
 
 		w.Header().Set("Content-Type", "application/json")
 		json.NewEncoder(w).Encode(map[string]interface{}{
-			"users": users,
+			"peers": peers,
 		})
 	})
 
 	// 获取屏蔽列表处理器
 	mux.HandleFunc("/acl", func(w http.ResponseWriter, r *http.Request) {
-		node.ACLMutex.RLock()
-		defer node.ACLMutex.RUnlock()
-		
-		blocked := []string{}
-		if acl, exists := node.ACLs[node.Address]; exists {
-			for addr, allowed := range acl {
-				if !allowed {
-					// 查找用户名
-					displayName := addr
-					node.PeersMutex.RLock()
-					for _, peer := range node.Peers {
-						if peer.Address == addr {
-							displayName = peer.Name
-							break
-						}
-					}
-					node.PeersMutex.RUnlock()
-					blocked = append(blocked, displayName)
-				}
-			}
-		}
-		
 		w.Header().Set("Content-Type", "application/json")
 		json.NewEncoder(w).Encode(map[string]interface{}{
-			"blocked": blocked,
+			"blocked": node.blockedUserNames(),
 		})
 	})
 
+	// 屏蔽/解除屏蔽用户：target 为用户名或节点ID，离线用户按历史记录中的用户名查找
+	handleBlock := func(block bool) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			if r.Method != "POST" {
+				http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+				return
+			}
+			var req struct {
+				Target string `json:"target"`
+			}
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil || strings.TrimSpace(req.Target) == "" {
+				http.Error(w, "请指定用户", http.StatusBadRequest)
+				return
+			}
+			target := strings.TrimSpace(req.Target)
+			if block {
+				node.blockUser(node.resolveUserKey(target))
+			} else {
+				node.unblockUser(node.blockedUserKeyFor(target))
+			}
+			node.saveBlockedUsers()
+
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"status":  "ok",
+				"blocked": node.blockedUserNames(),
+			})
+		}
+	}
+	mux.HandleFunc("/block", handleBlock(true))
+	mux.HandleFunc("/unblock", handleBlock(false))
+
 	// 发送文件处理器
 	mux.HandleFunc("/sendfile", func(w http.ResponseWriter, r *http.Request) {
 		if r.Method != "POST" {
@@ -514,33 +758,31 @@ func (node *P2PNode) createHTTPHandler() http.Handler {
 
 		if targetName == "all" {
 			imageMsg.To = "all"
-			node.broadcastMessage(imageMsg)
+			node.broadcastImage(imageMsg)
 		} else {
 			var targetID string
-			node.PeersMutex.RLock()
-			for id, peer := range node.Peers {
-				if peer.Name == targetName && peer.IsActive {
-					targetID = id
-					break
-				}
+			if peer := node.findPeer(targetName); peer != nil {
+				targetID = peer.ID
 			}
-			node.PeersMutex.RUnlock()
 
 			if targetID == "" {
-				http.Error(w, "目标用户不在线", http.StatusBadRequest)
-				return
-			}
-
-			imageMsg.To = targetID
-			if peer, exists := node.Peers[targetID]; exists {
-				node.sendMessageToPeer(peer, imageMsg)
+				// 对方离线：暂存，待其上线后投递
+				if err := node.queueOfflineMessage(targetName, imageMsg); err != nil {
+					http.Error(w, "目标用户不在线", http.StatusBadRequest)
+					return
+				}
+			} else {
+				imageMsg.To = targetID
+				if peer, exists := node.Peers[targetID]; exists {
+					node.sendMessageToPeer(peer, imageMsg)
+				}
 			}
 		}
 
 		isPrivate := targetName != "all"
 		node.addChatMessageWithType(
 			node.Name, targetName, imageMsg.Content, true, isPrivate,
-			MessageTypeImage, messageID, "", "", "", fileName, fileSize, contentType, imageURL, "",
+			MessageTypeImage, messageID, "", "", "", fileName, fileSize, contentType, imageURL, "", "",
 		)
 
 		w.WriteHeader(http.StatusOK)
@@ -578,14 +820,9 @@ func (node *P2PNode) createHTTPHandler() http.Handler {
 
 		// 查找目标用户ID
 		var targetID string
-		node.PeersMutex.RLock()
-		for id, peer := range node.Peers {
-			if peer.Name == req.TargetName && peer.IsActive {
-				targetID = id
-				break
-			}
+		if peer := node.findPeer(req.TargetName); peer != nil {
+			targetID = peer.ID
 		}
-		node.PeersMutex.RUnlock()
 
 		if targetID == "" {
 			http.Error(w, "目标用户不在线", http.StatusBadRequest)
@@ -619,7 +856,7 @@ func (node *P2PNode) createHTTPHandler() http.Handler {
 		isPrivate := targetID != "all"
 		node.addChatMessageWithType(
 			node.Name, req.TargetName, content, true, isPrivate,
-			MessageTypeFile, messageID, "", "", "", req.FileName, req.FileSize, req.FileType, "", req.FileID,
+			MessageTypeFile, messageID, "", "", "", req.FileName, req.FileSize, req.FileType, "", req.FileID, "",
 		)
 
 		w.WriteHeader(http.StatusOK)
@@ -656,18 +893,8 @@ func (node *P2PNode) createHTTPHandler() http.Handler {
 
 		// 查找目标用户ID
 		var targetID string
-		node.PeersMutex.RLock()
-		for id, peer := range node.Peers {
-			if peer.Name == req.TargetName && peer.IsActive {
-				targetID = id
-				break
-			}
-		}
-		node.PeersMutex.RUnlock()
-
-		if targetID == "" {
-			http.Error(w, "目标用户不在线", http.StatusBadRequest)
-			return
+		if peer := node.findPeer(req.TargetName); peer != nil {
+			targetID = peer.ID
 		}
 
 		messageID := generateMessageID()
@@ -685,20 +912,34 @@ func (node *P2PNode) createHTTPHandler() http.Handler {
 			ReplyToID:       req.OriginalMsgID,
 			ReplyToContent:  req.OriginalContent,
 			ReplyToSender:   req.OriginalSender,
+			ContentFormat:   ContentFormatMarkdown,
 		}
 
-		// 发送消息
-		if peer, exists := node.Peers[targetID]; exists {
+		// 发送消息（对方离线时暂存，待其上线后投递）
+		if targetID == "" {
+			if err := node.queueOfflineMessage(req.TargetName, replyMsg); err != nil {
+				http.Error(w, "目标用户不在线", http.StatusBadRequest)
+				return
+			}
+		} else if peer, exists := node.Peers[targetID]; exists {
 			node.sendMessageToPeer(peer, replyMsg)
 		}
 
 		// 添加到本地消息列表
 		isPrivate := targetID != "all"
-		node.addChatMessageWithType(
-			node.Name, req.TargetName, content, true, isPrivate,
-			MessageTypeReply, messageID, req.OriginalMsgID, req.OriginalContent, req.OriginalSender,
-			"", 0, "", "", "",
-		)
+		node.recordChatMessage(ChatMessage{
+			Sender:         node.Name,
+			Recipient:      req.TargetName,
+			Content:        content,
+			IsOwn:          true,
+			IsPrivate:      isPrivate,
+			MessageType:    MessageTypeReply,
+			MessageID:      messageID,
+			ReplyToID:      req.OriginalMsgID,
+			ReplyToContent: req.OriginalContent,
+			ReplyToSender:  req.OriginalSender,
+			ContentFormat:  ContentFormatMarkdown,
+		})
 
 		w.WriteHeader(http.StatusOK)
 		json.NewEncoder(w).Encode(map[string]string{
@@ -707,54 +948,139 @@ func (node *P2PNode) createHTTPHandler() http.Handler {
 		})
 	})
 
-	// 获取文件传输列表处理器
-	mux.HandleFunc("/filetransfers", func(w http.ResponseWriter, r *http.Request) {
-		node.FileTransfersMutex.RLock()
-		transfers := make([]*FileTransferStatus, 0, len(node.FileTransfers))
-		for _, transfer := range node.FileTransfers {
-			transfers = append(transfers, transfer)
-		}
-		node.FileTransfersMutex.RUnlock()
-
-		w.Header().Set("Content-Type", "application/json")
-		json.NewEncoder(w).Encode(map[string]interface{}{
-			"transfers": transfers,
-		})
-	})
-
-	// 处理文件传输响应处理器
-	mux.HandleFunc("/fileresponse", func(w http.ResponseWriter, r *http.Request) {
+	// 发送位置消息处理器
+	mux.HandleFunc("/sendlocation", func(w http.ResponseWriter, r *http.Request) {
 		if r.Method != "POST" {
 			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 			return
 		}
 
 		var req struct {
-			FileID   string `json:"fileId"`
-			Accepted bool   `json:"accepted"`
+			TargetName   string  `json:"targetName"`
+			Latitude     float64 `json:"latitude"`
+			Longitude    float64 `json:"longitude"`
+			LocationName string  `json:"locationName"`
 		}
-
 		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
 			http.Error(w, "Invalid JSON", http.StatusBadRequest)
 			return
 		}
+		if req.TargetName == "" {
+			http.Error(w, "缺少必要参数", http.StatusBadRequest)
+			return
+		}
 
-		// 调用核心逻辑来处理响应
-		node.respondToFileTransfer(req.FileID, req.Accepted)
-
-		w.WriteHeader(http.StatusOK)
-		json.NewEncoder(w).Encode(map[string]string{"status": "ok"})
+		messageID, err := node.sendLocation(req.TargetName, req.Latitude, req.Longitude, req.LocationName)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]string{
+			"status":    "success",
+			"messageId": messageID,
+		})
 	})
 
-	// 取消文件传输处理器
-	mux.HandleFunc("/filecancel", func(w http.ResponseWriter, r *http.Request) {
+	// 转发消息处理器
+	mux.HandleFunc("/forward", func(w http.ResponseWriter, r *http.Request) {
 		if r.Method != "POST" {
 			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 			return
 		}
 
 		var req struct {
-			FileID string `json:"fileId"`
+			MessageID  string `json:"messageId"`
+			TargetName string `json:"targetName"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid JSON", http.StatusBadRequest)
+			return
+		}
+		if req.MessageID == "" || req.TargetName == "" {
+			http.Error(w, "缺少必要参数", http.StatusBadRequest)
+			return
+		}
+
+		messageID, err := node.forwardMessage(req.MessageID, req.TargetName)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]string{
+			"status":    "success",
+			"messageId": messageID,
+		})
+	})
+
+	// 获取文件传输列表处理器
+	mux.HandleFunc("/filetransfers", func(w http.ResponseWriter, r *http.Request) {
+		node.FileTransfersMutex.RLock()
+		transfers := make([]*FileTransferStatus, 0, len(node.FileTransfers))
+		for _, transfer := range node.FileTransfers {
+			transfers = append(transfers, transfer)
+		}
+		node.FileTransfersMutex.RUnlock()
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"transfers": transfers,
+		})
+	})
+
+	// 处理文件传输响应处理器
+	mux.HandleFunc("/fileresponse", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		var req struct {
+			FileID   string `json:"fileId"`
+			Accepted bool   `json:"accepted"`
+		}
+
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid JSON", http.StatusBadRequest)
+			return
+		}
+
+		// 调用核心逻辑来处理响应
+		node.respondToFileTransfer(req.FileID, req.Accepted, "")
+
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(map[string]string{"status": "ok"})
+	})
+
+	// 下载已接收完成的文件：浏览器模式无法选择保存位置，文件存到默认目录后经此链接下载到浏览器所在设备
+	mux.HandleFunc("/received-file", func(w http.ResponseWriter, r *http.Request) {
+		fileID := r.URL.Query().Get("id")
+		node.FileTransfersMutex.RLock()
+		transfer, exists := node.FileTransfers[fileID]
+		var path, fileName string
+		if exists && transfer.Direction == "receive" && transfer.Status == "completed" {
+			path, fileName = transfer.SavePath, transfer.FileName
+		}
+		node.FileTransfersMutex.RUnlock()
+		if path == "" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": fileName}))
+		http.ServeFile(w, r, path)
+	})
+
+	// 取消文件传输处理器
+	mux.HandleFunc("/filecancel", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		var req struct {
+			FileID string `json:"fileId"`
 		}
 
 		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
@@ -775,8 +1101,8 @@ func (node *P2PNode) createHTTPHandler() http.Handler {
 			return
 		}
 
-		// 简单的身份验证 - 只允许本地访问
-		if r.RemoteAddr != "127.0.0.1" && !strings.HasPrefix(r.RemoteAddr, "[::1]") {
+		// 只允许本地访问
+		if !isLocalRequest(r) {
 			http.Error(w, "Forbidden", http.StatusForbidden)
 			return
 		}
@@ -789,16 +1115,7 @@ func (node *P2PNode) createHTTPHandler() http.Handler {
 	})
 
 	// 版本信息 - 供其他节点检查更新
-	mux.HandleFunc("/version", func(w http.ResponseWriter, r *http.Request) {
-		w.Header().Set("Content-Type", "application/json")
-		json.NewEncoder(w).Encode(map[string]interface{}{
-			"version":     AppVersion,
-			"channel":     AppChannel(),
-			"name":        node.Name,
-			"logLevel":    GetLogLevel(),
-			"saveHistory": node.Config.IsSaveHistory(),
-		})
-	})
+	mux.HandleFunc("/version", node.handleVersion)
 
 	// 修改日志级别处理器
 	mux.HandleFunc("/loglevel", func(w http.ResponseWriter, r *http.Request) {
@@ -826,8 +1143,10 @@ func (node *P2PNode) createHTTPHandler() http.Handler {
 
 		// Persist to config
 		if node.Config != nil {
+			node.ConfigMutex.Lock()
 			node.Config.LogLevel = level
-			SaveConfig(node.Config)
+			node.ConfigMutex.Unlock()
+			node.saveConfig()
 		}
 
 		w.Header().Set("Content-Type", "application/json")
@@ -877,259 +1196,1054 @@ func (node *P2PNode) createHTTPHandler() http.Handler {
 			http.Error(w, "Invalid request", http.StatusBadRequest)
 			return
 		}
+		node.ConfigMutex.Lock()
 		node.Config.SaveHistory = &req.SaveHistory
-		SaveConfig(node.Config)
+		node.ConfigMutex.Unlock()
+		node.saveConfig()
 		json.NewEncoder(w).Encode(map[string]string{"status": "ok"})
 	})
 
-	// 删除指定聊天的历史记录
-	mux.HandleFunc("/delete-chat-history", func(w http.ResponseWriter, r *http.Request) {
+	// 公聊图片只发送链接（接收方从本机拉取），减少广播时重复传输的数据
+	mux.HandleFunc("/image-by-url", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if r.Method == "GET" {
+			json.NewEncoder(w).Encode(map[string]bool{"enabled": node.Config.PublicImageByURL})
+			return
+		}
 		if r.Method != "POST" {
 			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 			return
 		}
 		var req struct {
-			ChatID string `json:"chatId"` // "all" for public chat, or peer name
+			Enabled bool `json:"enabled"`
 		}
 		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
 			http.Error(w, "Invalid request", http.StatusBadRequest)
 			return
 		}
-
-		// Delete from in-memory messages
-		node.MessagesMutex.Lock()
-		filtered := make([]ChatMessage, 0, len(node.Messages))
-		for _, msg := range node.Messages {
-			keep := true
-			if req.ChatID == "all" {
-				if !msg.IsPrivate {
-					keep = false
-				}
-			} else {
-				if msg.IsPrivate && (msg.Sender == req.ChatID || msg.Recipient == req.ChatID) {
-					keep = false
-				}
-			}
-			if keep {
-				filtered = append(filtered, msg)
-			}
-		}
-		node.Messages = filtered
-		node.MessagesMutex.Unlock()
-
-		// Delete from SQLite
-		if node.DB != nil {
-			if req.ChatID == "all" {
-				node.DB.Exec("DELETE FROM messages WHERE is_private = 0")
-			} else {
-				node.DB.Exec("DELETE FROM messages WHERE is_private = 1 AND (sender = ? OR recipient = ?)", req.ChatID, req.ChatID)
-			}
-		}
-
-		w.Header().Set("Content-Type", "application/json")
+		node.ConfigMutex.Lock()
+		node.Config.PublicImageByURL = req.Enabled
+		node.ConfigMutex.Unlock()
+		node.saveConfig()
 		json.NewEncoder(w).Encode(map[string]string{"status": "ok"})
 	})
 
-	// 打开文件（使用默认应用）
-	mux.HandleFunc("/open-file", func(w http.ResponseWriter, r *http.Request) {
+	// 自动回复：GET 返回当前设置，POST 设置开关和内容
+	mux.HandleFunc("/auto-reply", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if r.Method == "GET" {
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"enabled":     node.Config.AutoReplyEnabled,
+				"text":        node.Config.AutoReply,
+				"defaultText": defaultAutoReply,
+			})
+			return
+		}
 		if r.Method != "POST" {
 			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 			return
 		}
 		var req struct {
-			Path string `json:"path"`
+			Enabled bool   `json:"enabled"`
+			Text    string `json:"text"`
 		}
-		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Path == "" {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
 			http.Error(w, "Invalid request", http.StatusBadRequest)
 			return
 		}
-		var err error
-		switch runtime.GOOS {
-		case "windows":
-			err = exec.Command("cmd", "/c", "start", "", req.Path).Start()
-		case "darwin":
-			err = exec.Command("open", req.Path).Start()
-		case "linux":
-			err = exec.Command("xdg-open", req.Path).Start()
-		}
-		if err != nil {
-			http.Error(w, "无法打开文件", http.StatusInternalServerError)
+		if err := node.setAutoReply(req.Enabled, req.Text); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
 			return
 		}
-		w.Header().Set("Content-Type", "application/json")
 		json.NewEncoder(w).Encode(map[string]string{"status": "ok"})
 	})
 
-	// 在文件管理器中显示文件
-	mux.HandleFunc("/open-folder", func(w http.ResponseWriter, r *http.Request) {
+	// 更新渠道设置
+	mux.HandleFunc("/update-channel", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if r.Method == "GET" {
+			json.NewEncoder(w).Encode(map[string]string{"updateChannel": node.Config.GetUpdateChannel()})
+			return
+		}
 		if r.Method != "POST" {
 			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 			return
 		}
 		var req struct {
-			Path string `json:"path"`
+			UpdateChannel string `json:"updateChannel"`
 		}
-		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Path == "" {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
 			http.Error(w, "Invalid request", http.StatusBadRequest)
 			return
 		}
-		var err error
-		switch runtime.GOOS {
-		case "windows":
-			err = exec.Command("explorer", "/select,", req.Path).Start()
-		case "darwin":
-			err = exec.Command("open", "-R", req.Path).Start()
-		case "linux":
-			err = exec.Command("xdg-open", filepath.Dir(req.Path)).Start()
-		}
-		if err != nil {
-			http.Error(w, "无法打开文件夹", http.StatusInternalServerError)
+		if req.UpdateChannel != "stable" && req.UpdateChannel != "test" && req.UpdateChannel != "any" {
+			http.Error(w, "Invalid channel. Use: stable, test, any", http.StatusBadRequest)
 			return
 		}
-		w.Header().Set("Content-Type", "application/json")
-		json.NewEncoder(w).Encode(map[string]string{"status": "ok"})
-	})
+		node.ConfigMutex.Lock()
+		node.Config.UpdateChannel = req.UpdateChannel
+		node.ConfigMutex.Unlock()
+		node.saveConfig()
 
-	// 程序更新下载 - 供其他节点获取最新版本
-	mux.HandleFunc("/update", func(w http.ResponseWriter, r *http.Request) {
-		exePath, err := os.Executable()
-		if err != nil {
-			http.Error(w, "Internal error", http.StatusInternalServerError)
-			return
+		// 渠道变更后清除不再符合条件的更新提示
+		node.PeersMutex.Lock()
+		if node.AvailableUpdate != nil && !node.acceptsUpdate(node.AvailableUpdate.Version) {
+			node.AvailableUpdate = nil
 		}
-		exePath, _ = filepath.EvalSymlinks(exePath)
-		http.ServeFile(w, r, exePath)
+		node.PeersMutex.Unlock()
+		json.NewEncoder(w).Encode(map[string]string{"status": "ok"})
 	})
 
-	// 更新检查状态 - 供Web前端查询
-	mux.HandleFunc("/check-update", func(w http.ResponseWriter, r *http.Request) {
+	// 文件发送限速：GET 返回当前值，POST 修改并立即作用于进行中的传输
+	mux.HandleFunc("/set-ratelimit", func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Content-Type", "application/json")
-		node.PeersMutex.RLock()
-		update := node.AvailableUpdate
-		node.PeersMutex.RUnlock()
-		if update != nil {
-			json.NewEncoder(w).Encode(map[string]interface{}{
-				"available":    true,
-				"version":      update.Version,
-				"channel":      update.Channel,
-				"source":       update.Name,
-				"crossChannel": isCrossChannel(update.Version),
-			})
-		} else {
-			json.NewEncoder(w).Encode(map[string]interface{}{
-				"available": false,
-				"version":   AppVersion,
-				"channel":   AppChannel(),
-			})
+		if r.Method == "GET" {
+			json.NewEncoder(w).Encode(map[string]int{"maxUploadBytesPerSec": node.UploadLimiter.Rate()})
+			return
 		}
-	})
-
-	// 执行更新处理器 - 供Web前端触发自动更新
-	mux.HandleFunc("/perform-update", func(w http.ResponseWriter, r *http.Request) {
 		if r.Method != "POST" {
 			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 			return
 		}
-		node.PeersMutex.RLock()
-		update := node.AvailableUpdate
-		node.PeersMutex.RUnlock()
-		if update == nil {
-			w.Header().Set("Content-Type", "application/json")
-			json.NewEncoder(w).Encode(map[string]string{"status": "error", "message": "没有可用更新"})
+		var req struct {
+			MaxUploadBytesPerSec int `json:"maxUploadBytesPerSec"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid request", http.StatusBadRequest)
 			return
 		}
-		w.Header().Set("Content-Type", "application/json")
-		json.NewEncoder(w).Encode(map[string]string{"status": "updating", "version": update.Version})
-		go node.performUpdate()
+		if req.MaxUploadBytesPerSec < 0 {
+			http.Error(w, "maxUploadBytesPerSec must be >= 0 (0 = unlimited)", http.StatusBadRequest)
+			return
+		}
+		node.UploadLimiter.SetRate(req.MaxUploadBytesPerSec)
+		node.ConfigMutex.Lock()
+		node.Config.MaxUploadBytesPerSec = req.MaxUploadBytesPerSec
+		node.ConfigMutex.Unlock()
+		node.saveConfig()
+		Log.Info("文件发送限速已更新", "bytesPerSec", req.MaxUploadBytesPerSec)
+		json.NewEncoder(w).Encode(map[string]string{"status": "ok"})
 	})
 
-	// 更新进度状态
-	mux.HandleFunc("/update-status", func(w http.ResponseWriter, r *http.Request) {
+	// 会话免打扰：GET 返回列表，POST 开启
+	mux.HandleFunc("/mute", func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Content-Type", "application/json")
-		json.NewEncoder(w).Encode(map[string]string{
-			"status": node.UpdateStatus,
-			"error":  node.UpdateError,
-		})
-	})
-
-	// 重启应用
-	mux.HandleFunc("/restart", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "GET" {
+			json.NewEncoder(w).Encode(map[string]interface{}{"muted": node.mutedChats()})
+			return
+		}
 		if r.Method != "POST" {
 			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 			return
 		}
-		w.Header().Set("Content-Type", "application/json")
-		json.NewEncoder(w).Encode(map[string]string{"status": "restarting"})
-		go func() {
-			time.Sleep(500 * time.Millisecond)
-			// restartApplication starts the new process, saves config, then os.Exit(0).
-			// No need to call node.Stop() — os.Exit terminates everything and
-			// Windows releases the mutex handle automatically.
-			if err := restartApplication(node); err != nil {
-				Log.Error("重启失败", "error", err)
-			}
-		}()
+		var req struct {
+			ChatID string `json:"chatId"` // "all" for public chat, or peer name
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.ChatID == "" {
+			http.Error(w, "Invalid request", http.StatusBadRequest)
+			return
+		}
+		if err := node.setChatMuted(req.ChatID, true); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]string{"status": "ok"})
 	})
 
-	// WebView2 运行时分享 - 供局域网内其他节点下载（支持本地文件夹和系统安装）
-	mux.HandleFunc("/webview2runtime", serveWebView2Runtime)
-
-	// 手动连接到指定节点
-	mux.HandleFunc("/connect", func(w http.ResponseWriter, r *http.Request) {
+	// 消息过滤规则：GET 返回规则列表，POST 整体替换
+	mux.HandleFunc("/filters", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if r.Method == "GET" {
+			json.NewEncoder(w).Encode(map[string]interface{}{"filters": node.messageFilterRules()})
+			return
+		}
 		if r.Method != "POST" {
 			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 			return
 		}
-
 		var req struct {
-			Address string `json:"address"`
+			Filters []string `json:"filters"`
 		}
-
 		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-			http.Error(w, "Invalid JSON", http.StatusBadRequest)
+			http.Error(w, "Invalid request", http.StatusBadRequest)
 			return
 		}
-
-		if req.Address == "" {
-			http.Error(w, "地址不能为空", http.StatusBadRequest)
+		invalid, err := node.setMessageFilters(req.Filters)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"status":      "ok",
+			"filters":     node.messageFilterRules(),
+			"keywordOnly": invalid, // 不是有效正则、按关键词匹配的规则
+		})
+	})
 
-		host, portStr, err := net.SplitHostPort(req.Address)
-		if err != nil {
-			w.Header().Set("Content-Type", "application/json")
-			w.WriteHeader(http.StatusBadRequest)
-			json.NewEncoder(w).Encode(map[string]string{
-				"status":  "error",
-				"message": fmt.Sprintf("无效的地址格式: %s (应为 IP:端口)", req.Address),
+	// 自动接受文件的信任列表：GET 返回列表和单文件上限；
+	// POST {"target": 用户, "trusted": true/false} 加入/移出，{"maxSize": 字节} 修改上限（0 = 默认）
+	mux.HandleFunc("/auto-accept", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if r.Method == "GET" {
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"users":   node.autoAcceptUserNames(),
+				"maxSize": node.Config.GetAutoAcceptMaxSize(),
 			})
 			return
 		}
-
-		port, err := strconv.Atoi(portStr)
-		if err != nil || port <= 0 || port > 65535 {
-			w.Header().Set("Content-Type", "application/json")
-			w.WriteHeader(http.StatusBadRequest)
-			json.NewEncoder(w).Encode(map[string]string{
-				"status":  "error",
-				"message": fmt.Sprintf("无效的端口号: %s", portStr),
-			})
+		if r.Method != "POST" {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 			return
 		}
-
+		var req struct {
+			Target  string `json:"target"`
+			Trusted bool   `json:"trusted"`
+			MaxSize *int64 `json:"maxSize"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid request", http.StatusBadRequest)
+			return
+		}
+		if target := strings.TrimSpace(req.Target); target != "" {
+			if err := node.setAutoAcceptUser(target, req.Trusted); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+		if req.MaxSize != nil {
+			if err := node.setAutoAcceptMaxSize(*req.MaxSize); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"status":  "ok",
+			"users":   node.autoAcceptUserNames(),
+			"maxSize": node.Config.GetAutoAcceptMaxSize(),
+		})
+	})
+
+	// 预共享网络密钥：GET 只返回是否已设置，POST 设置（空 = 关闭发现消息加密）
+	mux.HandleFunc("/network-key", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if r.Method == "GET" {
+			node.ConfigMutex.RLock()
+			enabled := node.Config.NetworkKey != ""
+			node.ConfigMutex.RUnlock()
+			json.NewEncoder(w).Encode(map[string]bool{"enabled": enabled})
+			return
+		}
+		if r.Method != "POST" {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		var req struct {
+			Key string `json:"key"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid request", http.StatusBadRequest)
+			return
+		}
+		key := strings.TrimSpace(req.Key)
+		node.ConfigMutex.Lock()
+		node.Config.NetworkKey = key
+		node.ConfigMutex.Unlock()
+		if err := node.saveConfig(); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		Log.Info("网络密钥已更新", "enabled", key != "")
+		json.NewEncoder(w).Encode(map[string]string{"status": "ok"})
+	})
+
+	// 本机连接信息（lanshare:// 链接），供其他设备扫码或粘贴后手动添加
+	mux.HandleFunc("/connect-info", func(w http.ResponseWriter, r *http.Request) {
+		info := node.localConnectInfo()
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{"link": info.link(), "info": info})
+	})
+
+	// 连接信息二维码（PNG），size 为边长像素，默认 256
+	mux.HandleFunc("/qrcode", func(w http.ResponseWriter, r *http.Request) {
+		size := 256
+		if s, err := strconv.Atoi(r.URL.Query().Get("size")); err == nil && s >= 128 && s <= 1024 {
+			size = s
+		}
+		png, err := qrcode.Encode(node.localConnectInfo().link(), qrcode.Medium, size)
+		if err != nil {
+			Log.Error("生成二维码失败", "error", err)
+			http.Error(w, "生成二维码失败", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "image/png")
+		w.Header().Set("Cache-Control", "no-cache")
+		w.Write(png)
+	})
+
+	// 手动添加节点：link 为 lanshare:// 连接信息，或 "IP[:发现端口]"
+	mux.HandleFunc("/add-peer", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		var req struct {
+			Link string `json:"link"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid request", http.StatusBadRequest)
+			return
+		}
+		info, err := parseConnectLink(req.Link, node.DiscoveryPort)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		peer, err := node.addPeerByInfo(info)
+		w.Header().Set("Content-Type", "application/json")
+		switch {
+		case err == errPeerFingerprintMismatch:
+			w.WriteHeader(http.StatusConflict)
+			json.NewEncoder(w).Encode(map[string]interface{}{"status": "mismatch", "name": peer.Name, "error": err.Error()})
+		case err != nil:
+			http.Error(w, err.Error(), http.StatusBadRequest)
+		case peer == nil:
+			// 对方可能稍后才响应，连接建立后照常出现在用户列表
+			json.NewEncoder(w).Encode(map[string]interface{}{"status": "pending"})
+		default:
+			json.NewEncoder(w).Encode(map[string]interface{}{"status": "connected", "name": peer.Name})
+		}
+	})
+
+	// 备注名：GET 返回所有备注（用户名 -> 备注），POST 设置或清除（alias 为空）某个用户的备注
+	mux.HandleFunc("/set-alias", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if r.Method == "GET" {
+			json.NewEncoder(w).Encode(map[string]interface{}{"aliases": node.peerAliasList()})
+			return
+		}
+		if r.Method != "POST" {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		var req struct {
+			Target string `json:"target"`
+			Alias  string `json:"alias"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || strings.TrimSpace(req.Target) == "" {
+			http.Error(w, "Invalid request", http.StatusBadRequest)
+			return
+		}
+		if err := node.setPeerAlias(strings.TrimSpace(req.Target), req.Alias); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"status": "ok", "aliases": node.peerAliasList()})
+	})
+
+	mux.HandleFunc("/unmute", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		var req struct {
+			ChatID string `json:"chatId"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.ChatID == "" {
+			http.Error(w, "Invalid request", http.StatusBadRequest)
+			return
+		}
+		if err := node.setChatMuted(req.ChatID, false); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]string{"status": "ok"})
+	})
+
+	// 会话置顶：GET 返回列表，POST 置顶
+	mux.HandleFunc("/pin-chat", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if r.Method == "GET" {
+			json.NewEncoder(w).Encode(map[string]interface{}{"pinned": node.pinnedChats()})
+			return
+		}
+		if r.Method != "POST" {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		var req struct {
+			ChatID string `json:"chatId"` // "all" for public chat, or peer name
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.ChatID == "" {
+			http.Error(w, "Invalid request", http.StatusBadRequest)
+			return
+		}
+		if err := node.setChatPinned(req.ChatID, true); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]string{"status": "ok"})
+	})
+
+	// 通知设置：GET 返回开关与免打扰时段（silenced 表示此刻是否静默），POST 保存
+	mux.HandleFunc("/notification-settings", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if r.Method == "GET" {
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"settings": node.notificationSettings(),
+				"silenced": node.notificationsSilenced(time.Now()),
+			})
+			return
+		}
+		if r.Method != "POST" {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		var req notificationSettings
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid request", http.StatusBadRequest)
+			return
+		}
+		if err := node.setNotificationSettings(req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]string{"status": "ok"})
+	})
+
+	// 会话归档：GET 返回归档会话及设置，POST 设置收到新消息时是否保持归档
+	mux.HandleFunc("/archived", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if r.Method == "GET" {
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"chats":         node.archivedActivities(),
+				"keepOnMessage": node.Config != nil && node.Config.KeepArchivedOnMessage,
+			})
+			return
+		}
+		if r.Method != "POST" {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		var req struct {
+			KeepOnMessage bool `json:"keepOnMessage"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid request", http.StatusBadRequest)
+			return
+		}
+		if err := node.setKeepArchivedOnMessage(req.KeepOnMessage); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]string{"status": "ok"})
+	})
+
+	handleArchive := func(archived bool) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			if r.Method != "POST" {
+				http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+				return
+			}
+			var req struct {
+				ChatID string `json:"chatId"` // peer name
+			}
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.ChatID == "" {
+				http.Error(w, "Invalid request", http.StatusBadRequest)
+				return
+			}
+			if err := node.setChatArchived(req.ChatID, archived); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(map[string]string{"status": "ok"})
+		}
+	}
+	mux.HandleFunc("/archive-chat", handleArchive(true))
+	mux.HandleFunc("/unarchive-chat", handleArchive(false))
+
+	mux.HandleFunc("/unpin-chat", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		var req struct {
+			ChatID string `json:"chatId"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.ChatID == "" {
+			http.Error(w, "Invalid request", http.StatusBadRequest)
+			return
+		}
+		if err := node.setChatPinned(req.ChatID, false); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]string{"status": "ok"})
+	})
+
+	// 消息置顶：GET ?chatId= 返回会话的置顶消息，POST 置顶一条消息并通知会话成员
+	mux.HandleFunc("/pin-message", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if r.Method == "GET" {
+			chatID := r.URL.Query().Get("chatId")
+			if chatID == "" {
+				http.Error(w, "chatId required", http.StatusBadRequest)
+				return
+			}
+			json.NewEncoder(w).Encode(map[string]interface{}{"pins": node.pinnedMessagesFor(chatID)})
+			return
+		}
+		if r.Method != "POST" {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		var req struct {
+			ChatID    string `json:"chatId"`
+			MessageID string `json:"messageId"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.ChatID == "" || req.MessageID == "" {
+			http.Error(w, "Invalid request", http.StatusBadRequest)
+			return
+		}
+		if err := node.pinMessage(req.ChatID, req.MessageID, true); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]string{"status": "ok"})
+	})
+
+	mux.HandleFunc("/unpin-message", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		var req struct {
+			ChatID    string `json:"chatId"`
+			MessageID string `json:"messageId"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.ChatID == "" || req.MessageID == "" {
+			http.Error(w, "Invalid request", http.StatusBadRequest)
+			return
+		}
+		if err := node.pinMessage(req.ChatID, req.MessageID, false); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]string{"status": "ok"})
+	})
+
+	// 会话草稿：GET ?chatId= 读取，POST 保存（content 为空时删除）
+	mux.HandleFunc("/draft", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if r.Method == "GET" {
+			chatID := r.URL.Query().Get("chatId")
+			if chatID == "" {
+				http.Error(w, "chatId required", http.StatusBadRequest)
+				return
+			}
+			content, err := node.loadDraft(chatID)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			json.NewEncoder(w).Encode(map[string]string{"chatId": chatID, "content": content})
+			return
+		}
+		if r.Method != "POST" {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		var req struct {
+			ChatID  string `json:"chatId"`
+			Content string `json:"content"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.ChatID == "" {
+			http.Error(w, "Invalid request", http.StatusBadRequest)
+			return
+		}
+		if utf8.RuneCountInString(req.Content) > maxDraftRunes {
+			http.Error(w, fmt.Sprintf("Draft too long (max %d characters)", maxDraftRunes), http.StatusRequestEntityTooLarge)
+			return
+		}
+		if err := node.saveDraft(req.ChatID, req.Content); err != nil {
+			Log.Error("保存草稿失败", "chatId", req.ChatID, "error", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]string{"status": "ok"})
+	})
+
+	// 标记会话已读：清零未读数，lastMessageId 为当前看到的最后一条消息（可省略）
+	mux.HandleFunc("/mark-read", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		var req struct {
+			ChatID        string `json:"chatId"`
+			LastMessageID string `json:"lastMessageId"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.ChatID == "" {
+			http.Error(w, "Invalid request", http.StatusBadRequest)
+			return
+		}
+		if err := node.markChatRead(req.ChatID, req.LastMessageID); err != nil {
+			Log.Error("保存会话已读状态失败", "chatId", req.ChatID, "error", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]string{"status": "ok"})
+	})
+
+	// 导出设置（不含用户标识等设备相关项），仅限本机
+	mux.HandleFunc("/export-config", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if !isLocalRequest(r) {
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+		data, err := node.exportCurrentConfig()
+		if err != nil {
+			http.Error(w, "导出失败", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Content-Disposition", `attachment; filename="lanshare-config.json"`)
+		w.Write(data)
+	})
+
+	// 导入设置：校验后合并到当前配置，返回变更项和需要重启才生效的设置
+	mux.HandleFunc("/import-config", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		data, err := io.ReadAll(io.LimitReader(r.Body, 1<<20))
+		if err != nil {
+			http.Error(w, "Invalid request", http.StatusBadRequest)
+			return
+		}
+		result, err := node.importConfig(data)
+		if err != nil {
+			Log.Warn("导入配置失败", "error", err)
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(result)
+	})
+
+	// 导出消息数据库副本（在线备份，不影响正常收发）
+	mux.HandleFunc("/backup-db", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		dir := DataPath("backups")
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			http.Error(w, "创建备份目录失败", http.StatusInternalServerError)
+			return
+		}
+		dst := filepath.Join(dir, "message-"+time.Now().Format("20060102-150405")+".db")
+		if err := node.backupMessageDB(dst); err != nil {
+			Log.Error("备份数据库失败", "path", dst, "error", err)
+			http.Error(w, "备份失败: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		Log.Info("数据库已备份", "path", dst)
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]string{"status": "ok", "path": dst})
+	})
+
+	// 删除指定聊天的历史记录
+	mux.HandleFunc("/delete-chat-history", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		var req struct {
+			ChatID string `json:"chatId"`           // "all" for public chat, or peer name
+			After  string `json:"after,omitempty"`  // 只删除该时间之后（含）的记录
+			Before string `json:"before,omitempty"` // 只删除该时间之前的记录
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid request", http.StatusBadRequest)
+			return
+		}
+		after, err := parseHistoryTime(req.After)
+		if err != nil {
+			http.Error(w, "after 时间格式无效", http.StatusBadRequest)
+			return
+		}
+		before, err := parseHistoryTime(req.Before)
+		if err != nil {
+			http.Error(w, "before 时间格式无效", http.StatusBadRequest)
+			return
+		}
+		if !after.IsZero() && !before.IsZero() && !after.Before(before) {
+			http.Error(w, "after 必须早于 before", http.StatusBadRequest)
+			return
+		}
+
+		removed := node.deleteChatHistory(req.ChatID, after, before)
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{"status": "ok", "removed": removed})
+	})
+
+	// 打开文件（使用默认应用）
+	mux.HandleFunc("/open-file", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		var req struct {
+			Path      string `json:"path"`
+			Confirmed bool   `json:"confirmed"` // 用户已确认打开可执行文件
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Path == "" {
+			http.Error(w, "Invalid request", http.StatusBadRequest)
+			return
+		}
+		path, err := node.resolveOpenableFile(req.Path)
+		if err != nil {
+			Log.Warn("拒绝打开文件", "path", req.Path, "error", err)
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return
+		}
+		if isExecutableFile(path) && !req.Confirmed {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusConflict)
+			json.NewEncoder(w).Encode(map[string]string{"error": openConfirmRequired})
+			return
+		}
+		if err := openWithDefaultApp(path); err != nil {
+			http.Error(w, "无法打开文件", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]string{"status": "ok"})
+	})
+
+	// 在文件管理器中显示文件
+	mux.HandleFunc("/open-folder", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		var req struct {
+			Path string `json:"path"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Path == "" {
+			http.Error(w, "Invalid request", http.StatusBadRequest)
+			return
+		}
+		path, err := node.resolveOpenableFile(req.Path)
+		if err != nil {
+			Log.Warn("拒绝打开文件夹", "path", req.Path, "error", err)
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return
+		}
+		if err := revealInFileManager(path); err != nil {
+			http.Error(w, "无法打开文件夹", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]string{"status": "ok"})
+	})
+
+	// 程序更新下载 - 供其他节点获取最新版本
+	mux.HandleFunc("/update", node.handleUpdateDownload)
+
+	// 更新检查状态 - 供Web前端查询
+	mux.HandleFunc("/check-update", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		node.PeersMutex.RLock()
+		update := node.AvailableUpdate
+		node.PeersMutex.RUnlock()
+		if update != nil {
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"available":    true,
+				"version":      update.Version,
+				"channel":      update.Channel,
+				"source":       update.Name,
+				"crossChannel": isCrossChannel(update.Version),
+				"changelog":    update.Changelog,
+			})
+		} else {
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"available": false,
+				"version":   AppVersion,
+				"channel":   AppChannel(),
+			})
+		}
+	})
+
+	// 执行更新处理器 - 供Web前端触发自动更新
+	mux.HandleFunc("/perform-update", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		var req struct {
+			ConfirmCrossChannel bool `json:"confirmCrossChannel"`
+		}
+		json.NewDecoder(r.Body).Decode(&req) // 请求体可选
+		node.PeersMutex.RLock()
+		update := node.AvailableUpdate
+		node.PeersMutex.RUnlock()
+		if update == nil {
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(map[string]string{"status": "error", "message": "没有可用更新"})
+			return
+		}
+		if isCrossChannel(update.Version) && !req.ConfirmCrossChannel {
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(map[string]string{"status": "error", "message": "跨渠道更新需要确认"})
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]string{"status": "updating", "version": update.Version})
+		go node.performUpdate(req.ConfirmCrossChannel)
+	})
+
+	// 更新进度状态
+	mux.HandleFunc("/update-status", func(w http.ResponseWriter, r *http.Request) {
+		status, errMsg, progress := node.getUpdateState()
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"status":     status,
+			"error":      errMsg,
+			"downloaded": progress.Downloaded,
+			"total":      progress.Total,
+			"percent":    progress.Percent,
+			"speed":      progress.Speed,
+		})
+	})
+
+	// 重启应用
+	mux.HandleFunc("/restart", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]string{"status": "restarting"})
+		go func() {
+			time.Sleep(500 * time.Millisecond)
+			// restartApplication starts the new process, saves config, then os.Exit(0).
+			// No need to call node.Stop() — os.Exit terminates everything and
+			// Windows releases the mutex handle automatically.
+			if err := restartApplication(node); err != nil {
+				Log.Error("重启失败", "error", err)
+			}
+		}()
+	})
+
+	// WebView2 运行时分享 - 供局域网内其他节点下载（支持本地文件夹和系统安装）
+	mux.HandleFunc("/webview2runtime", serveWebView2Runtime)
+
+	// 手动连接到指定节点
+	mux.HandleFunc("/connect", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		var req struct {
+			Address string `json:"address"`
+		}
+
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid JSON", http.StatusBadRequest)
+			return
+		}
+
+		if req.Address == "" {
+			http.Error(w, "地址不能为空", http.StatusBadRequest)
+			return
+		}
+
+		host, portStr, err := net.SplitHostPort(req.Address)
+		if err != nil {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{
+				"status":  "error",
+				"message": fmt.Sprintf("无效的地址格式: %s (应为 IP:端口)", req.Address),
+			})
+			return
+		}
+
+		port, err := strconv.Atoi(portStr)
+		if err != nil || port <= 0 || port > 65535 {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{
+				"status":  "error",
+				"message": fmt.Sprintf("无效的端口号: %s", portStr),
+			})
+			return
+		}
+
+		node.connects.clearCooldown(net.JoinHostPort(host, strconv.Itoa(port)))
 		tempID := fmt.Sprintf("manual_%s_%d", host, time.Now().Unix())
 		go node.connectToPeer(host, port, tempID, "unknown", 0)
 
-		w.Header().Set("Content-Type", "application/json")
-		json.NewEncoder(w).Encode(map[string]string{
-			"status":  "ok",
-			"message": fmt.Sprintf("正在尝试连接到 %s", req.Address),
-		})
-	})
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]string{
+			"status":  "ok",
+			"message": fmt.Sprintf("正在尝试连接到 %s", req.Address),
+		})
+	})
+
+	return node.requireAPIToken(mux)
+}
+
+// resolveOpenableFile 在 resolveOpenablePath 的基础上，额外允许文件传输记录中的保存路径
+// （下载目录或"另存为"的位置可能不在数据目录下）。
+func (node *P2PNode) resolveOpenableFile(p string) (string, error) {
+	abs, err := resolveOpenablePath(p)
+	if err == nil {
+		return abs, nil
+	}
+	if !filepath.IsAbs(p) || strings.HasPrefix(p, `\\`) || strings.HasPrefix(p, "//") {
+		return "", err
+	}
+	clean := filepath.Clean(p)
+	node.FileTransfersMutex.RLock()
+	recorded := false
+	for _, t := range node.FileTransfers {
+		if t.SavePath != "" && filepath.Clean(t.SavePath) == clean {
+			recorded = true
+			break
+		}
+	}
+	node.FileTransfersMutex.RUnlock()
+	if !recorded {
+		return "", err
+	}
+	if _, statErr := os.Stat(clean); statErr != nil {
+		return "", fmt.Errorf("文件不存在")
+	}
+	return clean, nil
+}
+
+// openWithDefaultApp 用系统关联程序打开已校验过的文件
+func openWithDefaultApp(path string) error {
+	switch runtime.GOOS {
+	case "windows":
+		// 不经过 cmd 解释（start 会把 & | ^ 等当作命令分隔符），直接交给 shell 关联程序打开
+		return exec.Command("rundll32", "url.dll,FileProtocolHandler", path).Start()
+	case "darwin":
+		return exec.Command("open", path).Start()
+	case "linux":
+		return exec.Command("xdg-open", path).Start()
+	default:
+		return fmt.Errorf("unsupported OS: %s", runtime.GOOS)
+	}
+}
+
+// revealInFileManager 在文件管理器中定位已校验过的文件
+func revealInFileManager(path string) error {
+	switch runtime.GOOS {
+	case "windows":
+		return exec.Command("explorer", "/select,", path).Start()
+	case "darwin":
+		return exec.Command("open", "-R", path).Start()
+	case "linux":
+		return exec.Command("xdg-open", filepath.Dir(path)).Start()
+	default:
+		return fmt.Errorf("unsupported OS: %s", runtime.GOOS)
+	}
+}
+
+// resolveOpenablePath 校验 /open-file 和 /open-folder 的路径：只允许数据目录
+// （images、downloads、uploads 等）之下已存在的文件，拒绝 UNC 路径和 .. / 符号链接逃逸。
+func resolveOpenablePath(p string) (string, error) {
+	if strings.HasPrefix(p, `\\`) || strings.HasPrefix(p, "//") {
+		return "", fmt.Errorf("不允许打开网络路径")
+	}
+	if !filepath.IsAbs(p) {
+		p = filepath.Join(AppDataDir(), p)
+	}
+	abs, err := filepath.Abs(filepath.Clean(p))
+	if err != nil {
+		return "", fmt.Errorf("无效路径")
+	}
+	root, err := filepath.Abs(AppDataDir())
+	if err != nil {
+		return "", fmt.Errorf("无效数据目录")
+	}
+	if resolved, err := filepath.EvalSymlinks(abs); err == nil {
+		abs = resolved
+	}
+	if resolved, err := filepath.EvalSymlinks(root); err == nil {
+		root = resolved
+	}
+	if !isSubPath(root, abs) {
+		return "", fmt.Errorf("只能打开数据目录中的文件")
+	}
+	if _, err := os.Stat(abs); err != nil {
+		return "", fmt.Errorf("文件不存在")
+	}
+	return abs, nil
+}
 
+// createLANHandler 创建LAN共享服务器的处理器，只暴露对局域网安全的端点：
+// 版本查询、程序更新下载、WebView2 运行时分发、表情和头像资源同步，以及需要令牌的脚本API（/api/）。
+// 聊天及本机操作端点只在本机UI的完整 handler 中提供。
+func (node *P2PNode) createLANHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/version", node.handleVersion)
+	mux.HandleFunc("/update", node.handleUpdateDownload)
+	mux.HandleFunc("/webview2runtime", serveWebView2Runtime)
+	mux.HandleFunc("/emoji-asset/", func(w http.ResponseWriter, r *http.Request) {
+		// 局域网请求只返回本地已有的资源，不再转查其他节点
+		r.Header.Set(emojiPeerRequestHeader, "1")
+		node.handleEmojiAsset(w, r)
+	})
+	mux.HandleFunc("/shared-images/", node.handleSharedImage)
+	mux.HandleFunc("/avatar/", func(w http.ResponseWriter, r *http.Request) {
+		r.Header.Set(avatarPeerRequestHeader, "1")
+		node.handleAvatar(w, r)
+	})
+	node.registerScriptAPI(mux)
 	return mux
 }
 
+// 版本信息 - 供其他节点检查更新，本机UI也用于读取设置
+func (node *P2PNode) handleVersion(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"version":     AppVersion,
+		"channel":     AppChannel(),
+		"name":        node.Name,
+		"logLevel":    GetLogLevel(),
+		"saveHistory": node.Config.IsSaveHistory(),
+		"signature":   localUpdateSignature(),
+		"changelog":   currentChangelog(),
+	})
+}
+
+// 程序更新下载 - 供其他节点获取最新版本
+func (node *P2PNode) handleUpdateDownload(w http.ResponseWriter, r *http.Request) {
+	exePath, err := os.Executable()
+	if err != nil {
+		http.Error(w, "Internal error", http.StatusInternalServerError)
+		return
+	}
+	exePath, _ = filepath.EvalSymlinks(exePath)
+	http.ServeFile(w, r, exePath)
+}
+
 // 启动Web GUI服务器
 func (node *P2PNode) startWebGUI() {
 	if !node.WebEnabled {
@@ -1198,65 +2312,841 @@ func openBrowser(url string) {
 }
 
 // 处理Web消息
-func (node *P2PNode) handleWebMessage(text string) {
+func (node *P2PNode) handleWebMessage(text, asName string) {
 	if strings.HasPrefix(text, "/") {
 		node.handleCommand(text)
 	} else {
 		// 公聊消息
-		msg := Message{
-			Type:      "chat",
-			From:      node.ID,
-			To:        "all",
-			Content:   text,
-			Timestamp: time.Now(),
-		}
-		node.broadcastMessage(msg)
-		node.addChatMessage("我", "all", text, true, false)
+		node.sendPublicText(text, asName)
 	}
 }
 
-// renamePeerInMessages updates all in-memory and DB messages from oldName to newName.
-// Called when a peer renames so conversations merge under the new name.
-func (node *P2PNode) renamePeerInMessages(oldName, newName string) {
+// renamePeerInMessages updates all in-memory and DB messages of a peer to newName.
+// Peers with a UUID are matched by UUID, which also merges renames made while offline;
+// legacy peers without UUID fall back to matching oldName.
+func (node *P2PNode) renamePeerInMessages(peerUUID, oldName, newName string) {
 	// Update in-memory messages
 	node.MessagesMutex.Lock()
 	for i := range node.Messages {
-		if node.Messages[i].Sender == oldName {
-			node.Messages[i].Sender = newName
+		m := &node.Messages[i]
+		if peerUUID != "" && m.PeerUUID == peerUUID {
+			if !m.IsOwn {
+				m.Sender = newName
+			} else if m.IsPrivate {
+				m.Recipient = newName
+			}
+			continue
+		}
+		if oldName == "" {
+			continue
+		}
+		if m.Sender == oldName {
+			m.Sender = newName
 		}
-		if node.Messages[i].Recipient == oldName {
-			node.Messages[i].Recipient = newName
+		if m.Recipient == oldName {
+			m.Recipient = newName
 		}
 	}
+	node.MessagesRevision++
 	node.MessagesMutex.Unlock()
 
 	// Update SQLite
 	if node.DB != nil {
-		node.DB.Exec("UPDATE messages SET sender = ? WHERE sender = ?", newName, oldName)
-		node.DB.Exec("UPDATE messages SET recipient = ? WHERE recipient = ?", newName, oldName)
+		node.flushMessageWrites()
+		if peerUUID != "" {
+			node.DB.Exec("UPDATE messages SET sender = ? WHERE peer_uuid = ? AND is_own = 0", newName, peerUUID)
+			node.DB.Exec("UPDATE messages SET recipient = ? WHERE peer_uuid = ? AND is_own = 1 AND is_private = 1", newName, peerUUID)
+		}
+		if oldName != "" {
+			node.DB.Exec("UPDATE messages SET sender = ? WHERE sender = ?", newName, oldName)
+			node.DB.Exec("UPDATE messages SET recipient = ? WHERE recipient = ?", newName, oldName)
+		}
 	}
-	Log.Info("已合并聊天记录", "from", oldName, "to", newName)
+	node.renamePinnedChat(oldName, newName)
+	node.renameChatState(oldName, newName)
+	Log.Info("已合并聊天记录", "uuid", peerUUID, "from", oldName, "to", newName)
 }
 
-// 添加聊天消息（扩展版）
-func (node *P2PNode) addChatMessage(sender, recipient, content string, isOwn, isPrivate bool) {
-	node.addChatMessageWithType(sender, recipient, content, isOwn, isPrivate, MessageTypeText, "", "", "", "", "", 0, "", "", "")
+// syncPeerIdentity 握手完成后按UUID合并历史：对方离线期间改名的记录归到当前名称下
+func (node *P2PNode) syncPeerIdentity(peerID string) {
+	node.PeersMutex.RLock()
+	peer, exists := node.Peers[peerID]
+	var peerUUID, name string
+	if exists {
+		peerUUID, name = peer.UUID, peer.Name
+	}
+	node.PeersMutex.RUnlock()
+	if peerUUID == "" || node.DB == nil {
+		return
+	}
+
+	var stale int
+	node.DB.QueryRow(`SELECT COUNT(*) FROM messages WHERE peer_uuid = ? AND
+		((is_own = 0 AND sender != ?) OR (is_own = 1 AND is_private = 1 AND recipient != ?))`,
+		peerUUID, name, name).Scan(&stale)
+	if stale > 0 {
+		node.renamePeerInMessages(peerUUID, "", name)
+	}
 }
 
-// 添加聊天消息（完整版）
-func (node *P2PNode) addChatMessageWithType(sender, recipient, content string, isOwn, isPrivate bool,
-	messageType, messageID, replyToID, replyToContent, replyToSender, fileName string, fileSize int64, fileType, fileURL, fileID string) {
+// UserInfo /users 返回的结构化用户信息
+type UserInfo struct {
+	Name        string `json:"name"`
+	ID          string `json:"id"` // 节点ID（离线用户为空）
+	UUID        string `json:"uuid,omitempty"`
+	Address     string `json:"address"` // "IP:port"（离线用户为空）
+	IsSelf      bool   `json:"isSelf"`
+	IsBlocked   bool   `json:"isBlocked"`
+	IsOnline    bool   `json:"isOnline"`
+	WebPort     int    `json:"webPort,omitempty"`
+	Pinned      bool   `json:"pinned,omitempty"`     // 会话已置顶
+	LastActive  int64  `json:"lastActive,omitempty"` // 最后一条私聊消息时间（Unix毫秒）
+	Unread      int    `json:"unread,omitempty"`     // 会话未读数
+	BaseName    string `json:"baseName,omitempty"`   // 与他人重名时为对方自报的用户名，Name 为带区分后缀的显示名
+	Alias       string `json:"alias,omitempty"`      // 本机设置的备注名（只在本机显示）
+	AvatarColor string `json:"avatarColor"`          // 按用户稳定标识确定的头像颜色
+	AvatarHash  string `json:"avatarHash,omitempty"` // 自定义头像哈希（/avatar/{hash}），离线用户为空
+}
 
-	// 生成消息ID（如果未提供）
-	if messageID == "" {
-		messageID = generateMessageID()
+// userInfos 返回本机、在线用户以及有私聊历史的离线用户
+func (node *P2PNode) userInfos() []UserInfo {
+	users := []UserInfo{{
+		Name:        node.Name,
+		ID:          node.ID,
+		UUID:        node.UUID,
+		Address:     node.Address,
+		IsSelf:      true,
+		IsOnline:    true,
+		WebPort:     node.WebPort,
+		AvatarColor: avatarColorFor(node.selfUserKey()),
+		AvatarHash:  node.selfAvatarHash(),
+	}}
+	online := map[string]bool{node.Name: true}
+	active := node.chatLastActive()
+
+	node.PeersMutex.RLock()
+	for _, peer := range node.Peers {
+		if !peer.IsActive {
+			continue
+		}
+		online[peer.Name] = true
+		info := UserInfo{
+			Name:        peer.Name,
+			ID:          peer.ID,
+			UUID:        peer.UUID,
+			Address:     peer.Address,
+			IsBlocked:   node.isPeerBlocked(peer),
+			IsOnline:    true,
+			WebPort:     peer.WebPort,
+			Pinned:      node.isChatPinned(peer.Name),
+			LastActive:  active[peer.Name],
+			Unread:      node.unreadCount(peer.Name),
+			Alias:       node.aliasForKey(peer.UserKey()),
+			AvatarColor: avatarColorFor(peer.UserKey()),
+			AvatarHash:  peer.AvatarHash,
+		}
+		if peer.BaseName != "" && peer.BaseName != peer.Name {
+			info.BaseName = peer.BaseName
+		}
+		users = append(users, info)
+	}
+	node.PeersMutex.RUnlock()
+
+	for _, name := range node.chatPartners() {
+		if online[name] {
+			continue
+		}
+		online[name] = true
+		key := node.lookupUserKey(name)
+		info := UserInfo{Name: name, IsBlocked: node.isBlocked(key), Pinned: node.isChatPinned(name), LastActive: active[name], Unread: node.unreadCount(name), Alias: node.aliasForKey(key), AvatarColor: avatarColorFor(key)}
+		if key != name {
+			info.UUID = key
+		}
+		users = append(users, info)
+	}
+	return users
+}
+
+// chatPartners 返回数据库中有私聊记录的会话对方（不含本机）
+func (node *P2PNode) chatPartners() []string {
+	partners := []string{}
+	if node.DB == nil {
+		return partners
+	}
+	node.flushMessageWrites()
+	rows, err := node.DB.Query(`
+		SELECT DISTINCT CASE
+			WHEN is_own = TRUE THEN recipient
+			ELSE sender
+		END AS partner
+		FROM messages
+		WHERE is_private = TRUE AND partner != 'all'
+	`)
+	if err != nil {
+		return partners
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var p string
+		if rows.Scan(&p) == nil && p != "" && p != node.Name {
+			partners = append(partners, p)
+		}
+	}
+	return partners
+}
+
+// peerUUIDByName 按当前在线用户名查找其UUID（旧版本节点或不在线时返回空）
+func (node *P2PNode) peerUUIDByName(name string) string {
+	node.PeersMutex.RLock()
+	defer node.PeersMutex.RUnlock()
+	for _, peer := range node.Peers {
+		if peer.Name == name && peer.UUID != "" {
+			return peer.UUID
+		}
+	}
+	return ""
+}
+
+// lookupUserKey 返回用户名对应的稳定标识：在线时取UUID，否则从历史记录中查找，均无则回退到用户名
+func (node *P2PNode) lookupUserKey(name string) string {
+	if key := node.knownUserKey(name); key != "" {
+		return key
+	}
+	return name
+}
+
+// knownUserKey 同 lookupUserKey，但只认节点表或历史记录中出现过的用户：
+// 没有UUID的旧版本用户以用户名为标识，从未联系过的用户名（拼写错误等）返回空
+func (node *P2PNode) knownUserKey(name string) string {
+	if name == "" {
+		return ""
+	}
+	if uuid := node.peerUUIDByName(name); uuid != "" {
+		return uuid
+	}
+	if node.DB != nil {
+		node.flushMessageWrites()
+		var uuid string
+		node.DB.QueryRow(`SELECT peer_uuid FROM messages
+			WHERE peer_uuid != '' AND ((is_own = 0 AND sender = ?) OR (is_own = 1 AND is_private = 1 AND recipient = ?))
+			ORDER BY timestamp DESC LIMIT 1`, name, name).Scan(&uuid)
+		if uuid != "" {
+			return uuid
+		}
+	}
+	node.PeersMutex.RLock()
+	for _, peer := range node.Peers {
+		if peer.Name == name {
+			node.PeersMutex.RUnlock()
+			return peer.UserKey()
+		}
+	}
+	node.PeersMutex.RUnlock()
+	if node.DB != nil {
+		var found int
+		if node.DB.QueryRow(`SELECT 1 FROM messages
+			WHERE (is_own = 0 AND sender = ?) OR (is_own = 1 AND is_private = 1 AND recipient = ?)
+			LIMIT 1`, name, name).Scan(&found) == nil {
+			return name
+		}
+	}
+	return ""
+}
+
+// blockedUserNames 返回屏蔽列表中各用户的显示名称
+func (node *P2PNode) blockedUserNames() []string {
+	blocked := []string{}
+	for _, key := range node.blockedUserKeys() {
+		blocked = append(blocked, node.nameForUserKey(key))
+	}
+	return blocked
+}
+
+// historyTimeLayouts 删除记录时间范围参数接受的格式；不带时区的按本地时间解析
+var historyTimeLayouts = []string{time.RFC3339, "2006-01-02 15:04:05", "2006-01-02 15:04", "2006-01-02T15:04", "2006-01-02"}
+
+// parseHistoryTime 解析时间范围参数，空字符串返回零值（不限制）
+func parseHistoryTime(s string) (time.Time, error) {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return time.Time{}, nil
+	}
+	for _, layout := range historyTimeLayouts {
+		if t, err := time.ParseInLocation(layout, s, time.Local); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("无法解析时间: %s", s)
+}
+
+// maxDisplayNameOverride 临时显示名的最大长度（字符数）
+const maxDisplayNameOverride = 32
+
+// normalizeDisplayNameOverride 清理一次性显示名：去掉控制字符和首尾空白，超长截断。
+// 收发两端都会调用，对端发来的显示名同样不可信
+func normalizeDisplayNameOverride(name string) string {
+	name = strings.TrimSpace(strings.Map(func(r rune) rune {
+		if unicode.IsControl(r) {
+			return -1
+		}
+		return r
+	}, name))
+	if runes := []rune(name); len(runes) > maxDisplayNameOverride {
+		name = strings.TrimSpace(string(runes[:maxDisplayNameOverride]))
+	}
+	return name
+}
+
+// displayNameOverride 返回本条消息要使用的临时显示名，与本机用户名相同时视为未设置
+func (node *P2PNode) displayNameOverride(asName string) string {
+	asName = normalizeDisplayNameOverride(asName)
+	if asName == node.Name {
+		return ""
+	}
+	return asName
+}
+
+// sendPublicText 广播一条公聊文字消息（Markdown 格式）并保存，返回消息ID。
+// asName 非空时作为本条消息的临时显示名（见 Message.DisplayName），不修改 node.Name
+func (node *P2PNode) sendPublicText(text, asName string) string {
+	return node.sendPublicTextWithID(generateMessageID(), text, asName)
+}
+
+// sendPublicTextWithID 同 sendPublicText，使用预先分配的消息ID（撤销发送的暂存消息，见 queueUndoableSend）
+func (node *P2PNode) sendPublicTextWithID(messageID, text, asName string) string {
+	if node.isLongText(text) {
+		if messageID, ok := node.sendLongText("all", text, asName); ok {
+			return messageID
+		}
+	}
+	msg := Message{
+		Type:          "chat",
+		From:          node.ID,
+		To:            "all",
+		Content:       text,
+		Timestamp:     time.Now(),
+		MessageID:     messageID,
+		ContentFormat: ContentFormatMarkdown,
+		DisplayName:   node.displayNameOverride(asName),
+	}
+	node.broadcastMessage(msg)
+	node.recordChatMessage(ChatMessage{
+		Sender:        "我",
+		Recipient:     "all",
+		Content:       text,
+		IsOwn:         true,
+		MessageType:   MessageTypeText,
+		MessageID:     msg.MessageID,
+		ContentFormat: ContentFormatMarkdown,
+		DisplayName:   msg.DisplayName,
+	})
+	return msg.MessageID
+}
+
+// 撤销发送：网页端发送的文字消息先放入暂存区，undoSendWindow 内可撤销（/undo-send），
+// 期满后才真正广播/私发并保存。撤销的消息从未离开本机，也没有入列表和落库，
+// 因此不会产生发送状态、送达回执或未读计数，任何一端都不留痕迹。退出时暂存的消息立即发出
+const undoSendWindow = 5 * time.Second
+
+// undoableSend 暂存区中等待发出的消息
+type undoableSend struct {
+	timer *time.Timer
+	send  func()
+}
+
+// undoableSendStore 撤销窗口内的消息（消息ID -> 暂存项）
+type undoableSendStore struct {
+	mu    sync.Mutex
+	items map[string]*undoableSend
+}
+
+// take 取出暂存项，已发出或已撤销时返回 nil
+func (s *undoableSendStore) take(messageID string) *undoableSend {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	p := s.items[messageID]
+	delete(s.items, messageID)
+	return p
+}
+
+// queueUndoableSend 暂存一条文字消息（targetName 为空或 "all" 时为公聊），undoSendWindow 后发出，返回消息ID。
+// 私聊对象已被屏蔽或不存在时立即返回错误；窗口期间对方下线的按 sendPrivateText 暂存待投递
+func (node *P2PNode) queueUndoableSend(targetName, text, asName string) (string, error) {
+	messageID := generateMessageID()
+	send := func() { node.sendPublicTextWithID(messageID, text, asName) }
+	if targetName != "" && targetName != "all" {
+		if peer := node.findPeer(targetName); peer != nil {
+			if node.isPeerBlocked(peer) {
+				return "", errPrivateTargetBlocked
+			}
+		} else if node.knownUserKey(targetName) == "" {
+			return "", errPrivateTargetNotFound
+		}
+		send = func() {
+			if _, err := node.sendPrivateTextWithID(messageID, targetName, text, asName); err != nil {
+				Log.Warn("撤销窗口结束后发送私聊失败", "target", targetName, "messageId", messageID, "error", err)
+			}
+		}
+	}
+
+	p := &undoableSend{send: send}
+	s := &node.undoableSends
+	s.mu.Lock()
+	if s.items == nil {
+		s.items = make(map[string]*undoableSend)
+	}
+	s.items[messageID] = p
+	p.timer = time.AfterFunc(undoSendWindow, func() {
+		if s.take(messageID) != nil {
+			p.send()
+		}
+	})
+	s.mu.Unlock()
+	Log.Debug("消息已暂存，等待撤销窗口结束", "messageId", messageID, "target", targetName)
+	return messageID, nil
+}
+
+// undoSend 撤销暂存区中的消息；已发出或不存在时返回 false
+func (node *P2PNode) undoSend(messageID string) bool {
+	p := node.undoableSends.take(messageID)
+	if p == nil {
+		return false
+	}
+	p.timer.Stop()
+	Log.Info("已撤销发送", "messageId", messageID)
+	return true
+}
+
+// flushUndoableSends 立即发出暂存区中的所有消息（退出时）
+func (node *P2PNode) flushUndoableSends() {
+	s := &node.undoableSends
+	s.mu.Lock()
+	items := s.items
+	s.items = nil
+	s.mu.Unlock()
+	for _, p := range items {
+		p.timer.Stop()
+		p.send()
+	}
+}
+
+// sendPrivateText 的错误：目标用户不存在（离线且无法暂存）或已被屏蔽
+var (
+	errPrivateTargetNotFound = fmt.Errorf("用户不在线或不存在")
+	errPrivateTargetBlocked  = fmt.Errorf("用户已被屏蔽，无法发送私聊")
+)
+
+// sendPrivateText 向 targetName 发送私聊文字消息（Markdown 格式）并保存，返回消息ID；对方离线时暂存，待其上线后投递。
+// asName 同 sendPublicText
+func (node *P2PNode) sendPrivateText(targetName, text, asName string) (string, error) {
+	return node.sendPrivateTextWithID(generateMessageID(), targetName, text, asName)
+}
+
+// sendPrivateTextWithID 同 sendPrivateText，使用预先分配的消息ID
+func (node *P2PNode) sendPrivateTextWithID(messageID, targetName, text, asName string) (string, error) {
+	msg := Message{
+		Type:          "chat",
+		From:          node.ID,
+		Content:       text,
+		Timestamp:     time.Now(),
+		MessageID:     messageID,
+		ContentFormat: ContentFormatMarkdown,
+		DisplayName:   node.displayNameOverride(asName),
+	}
+
+	if peer := node.findPeer(targetName); peer != nil {
+		if node.isPeerBlocked(peer) {
+			return "", errPrivateTargetBlocked
+		}
+		if node.isLongText(text) {
+			if messageID, ok := node.sendLongText(targetName, text, asName); ok {
+				return messageID, nil
+			}
+		}
+		msg.To = peer.ID
+		node.sendMessageToPeer(peer, msg)
+	} else if err := node.queueOfflineMessage(targetName, msg); err != nil {
+		return "", errPrivateTargetNotFound
+	}
+
+	node.recordChatMessage(ChatMessage{
+		Sender:        node.Name,
+		Recipient:     targetName,
+		Content:       text,
+		IsOwn:         true,
+		IsPrivate:     true,
+		MessageType:   MessageTypeText,
+		MessageID:     msg.MessageID,
+		ContentFormat: ContentFormatMarkdown,
+		DisplayName:   msg.DisplayName,
+	})
+	return msg.MessageID, nil
+}
+
+// 长文本消息：超过阈值（AppConfig.LongTextThreshold）的文字消息保存为 .txt 文件，走文件传输发送，
+// 聊天中是一条以 longTextPrefix 开头、附带开头预览的文件消息。接收方按普通文件处理，旧版本同样兼容。
+// 对方离线（私聊）或没有在线用户（公聊）时无法传输文件，仍按普通文字发送
+const (
+	longTextPrefix       = "[长文本]"
+	longTextPreviewRunes = 80
+)
+
+// isLongText 判断文字消息是否需要转为文件发送
+func (node *P2PNode) isLongText(text string) bool {
+	threshold := defaultLongTextThreshold
+	if node.Config != nil {
+		threshold = node.Config.GetLongTextThreshold()
+	}
+	return threshold > 0 && len(text) > threshold
+}
+
+// longTextPreview 长文本消息在聊天中显示的内容：前缀加第一段文字（折叠为单行）
+func longTextPreview(text string) string {
+	preview := []rune(strings.Join(strings.Fields(text), " "))
+	if len(preview) > longTextPreviewRunes {
+		return longTextPrefix + " " + string(preview[:longTextPreviewRunes]) + "…"
+	}
+	return longTextPrefix + " " + string(preview)
+}
+
+// sendLongText 将长文本保存为中转目录下的 .txt 文件并发起文件传输（targetName 为 "all" 时向每个在线用户分别发起），
+// 同时发送一条文件消息作为聊天中的 [长文本] 卡片。无法传输时 ok 为 false，由调用方按普通文字发送
+func (node *P2PNode) sendLongText(targetName, text, asName string) (messageID string, ok bool) {
+	var targets []string
+	if targetName == "all" {
+		node.PeersMutex.RLock()
+		for _, peer := range node.Peers {
+			if peer.IsActive {
+				targets = append(targets, peer.Name)
+			}
+		}
+		node.PeersMutex.RUnlock()
+	} else {
+		targets = []string{targetName}
+	}
+	if len(targets) == 0 {
+		return "", false
+	}
+
+	dir := DataPath("temp")
+	os.MkdirAll(dir, 0755)
+	fileName := fmt.Sprintf("长文本_%s_%s.txt", time.Now().Format("20060102_150405"), generateMessageID()[:6])
+	filePath := filepath.Join(dir, fileName)
+	if err := os.WriteFile(filePath, []byte(text), 0644); err != nil {
+		Log.Error("保存长文本文件失败", "path", filePath, "error", err)
+		return "", false
+	}
+
+	msg := Message{
+		Type:        "chat",
+		From:        node.ID,
+		To:          "all",
+		Content:     longTextPreview(text),
+		Timestamp:   time.Now(),
+		MessageType: MessageTypeFile,
+		MessageID:   generateMessageID(),
+		FileName:    fileName,
+		FileSize:    int64(len(text)),
+		FileType:    fileTypeFor(fileName),
+		DisplayName: node.displayNameOverride(asName),
+	}
+	sent := 0
+	for _, name := range targets {
+		peer := node.findPeer(name)
+		if peer == nil || node.isPeerBlocked(peer) {
+			continue
+		}
+		fileID := node.sendFileTransferRequest(filePath, name)
+		if fileID == "" {
+			continue
+		}
+		// 每个接收方的传输ID不同，文件消息逐个发送；公聊消息 To 仍为 "all"
+		peerMsg := msg
+		peerMsg.FileID = fileID
+		if targetName != "all" {
+			peerMsg.To = peer.ID
+			msg.FileID = fileID
+		}
+		node.sendMessageToPeer(peer, peerMsg)
+		sent++
+	}
+	if sent == 0 {
+		os.Remove(filePath)
+		return "", false
+	}
+
+	sender, isPrivate := "我", false
+	if targetName != "all" {
+		sender, isPrivate = node.Name, true
+	}
+	node.recordChatMessage(ChatMessage{
+		Sender:      sender,
+		Recipient:   targetName,
+		Content:     msg.Content,
+		IsOwn:       true,
+		IsPrivate:   isPrivate,
+		MessageType: MessageTypeFile,
+		MessageID:   msg.MessageID,
+		FileName:    fileName,
+		FileSize:    msg.FileSize,
+		FileType:    msg.FileType,
+		FileID:      msg.FileID,
+		DisplayName: msg.DisplayName,
+	})
+	Log.Info("长文本已转为文件发送", "target", targetName, "fileName", fileName, "size", msg.FileSize, "receivers", sent)
+	return msg.MessageID, true
+}
+
+// addReceivedMessage 保存收到的聊天消息；content 为解密后的内容，fileURL 为图片保存到本地后的地址
+func (node *P2PNode) addReceivedMessage(sender, recipient, content string, isPrivate bool, msg Message, fileURL string) {
+	var format string
+	if forwardedKind(msg.MessageType, msg.FileType, msg.FileName) == MessageTypeText {
+		format = normalizeContentFormat(msg.ContentFormat)
+	}
+	node.recordChatMessage(ChatMessage{
+		Sender:         sender,
+		Recipient:      recipient,
+		Content:        content,
+		IsPrivate:      isPrivate,
+		MessageType:    msg.MessageType,
+		MessageID:      msg.MessageID,
+		ReplyToID:      msg.ReplyToID,
+		ReplyToContent: msg.ReplyToContent,
+		ReplyToSender:  msg.ReplyToSender,
+		FileName:       msg.FileName,
+		FileSize:       msg.FileSize,
+		FileType:       msg.FileType,
+		FileURL:        fileURL,
+		FileID:         msg.FileID,
+		ForwardedFrom:  msg.ForwardedFrom,
+		ContentFormat:  format,
+		DisplayName:    normalizeDisplayNameOverride(msg.DisplayName),
+	})
+}
+
+// mentionsUser 判断消息内容是否 @ 了指定用户名。
+// 用户名可能包含空格、点号等特殊字符，因此按字面量查找而不是拼正则；
+// 匹配要求 @ 前不是字母数字（排除邮箱地址），用户名后为结尾、空白或标点（避免 @Bob 命中 @Bobby）。
+func mentionsUser(content, name string) bool {
+	if name == "" {
+		return false
+	}
+	token := "@" + name
+	for offset := 0; offset < len(content); {
+		idx := strings.Index(content[offset:], token)
+		if idx < 0 {
+			return false
+		}
+		start := offset + idx
+		end := start + len(token)
+		before, _ := utf8.DecodeLastRuneInString(content[:start])
+		after, _ := utf8.DecodeRuneInString(content[end:])
+		if (start == 0 || !isMentionNameRune(before)) && (end == len(content) || !isMentionNameRune(after)) {
+			return true
+		}
+		offset = start + 1
+	}
+	return false
+}
+
+func isMentionNameRune(r rune) bool {
+	return unicode.IsLetter(r) || unicode.IsDigit(r) || r == '_'
+}
+
+// forwardedKind 返回消息的实际内容类型（text/image/file）。
+// 转发消息的 MessageType 为 forward，按文件字段推断原类型；回复按文本处理。
+func forwardedKind(messageType, fileType, fileName string) string {
+	switch messageType {
+	case MessageTypeImage, MessageTypeFile:
+		return messageType
+	case MessageTypeForward:
+		if strings.HasPrefix(fileType, "image/") {
+			return MessageTypeImage
+		}
+		if fileName != "" {
+			return MessageTypeFile
+		}
+	}
+	return MessageTypeText
+}
+
+// findChatMessage 按消息ID查找消息：先查内存，再查数据库
+func (node *P2PNode) findChatMessage(messageID string) (ChatMessage, bool) {
+	node.MessagesMutex.RLock()
+	for _, m := range node.Messages {
+		if m.MessageID == messageID {
+			node.MessagesMutex.RUnlock()
+			return m, true
+		}
+	}
+	node.MessagesMutex.RUnlock()
+
+	if node.DB == nil {
+		return ChatMessage{}, false
+	}
+	node.flushMessageWrites()
+	var cm ChatMessage
+	var content, nonce []byte
+	err := node.DB.QueryRow(`
+		SELECT sender, recipient, content, nonce, is_private, is_own, timestamp, message_type,
+			   reply_to_id, reply_to_content, reply_to_sender,
+			   file_name, file_size, file_type, file_url, COALESCE(file_id, ''), COALESCE(forwarded_from, ''),
+			   COALESCE(latitude, 0), COALESCE(longitude, 0), COALESCE(location_name, ''),
+			   COALESCE(content_format, ''), COALESCE(display_name, '')
+		FROM messages WHERE message_id = ? LIMIT 1`, messageID).Scan(
+		&cm.Sender, &cm.Recipient, &content, &nonce, &cm.IsPrivate, &cm.IsOwn, &cm.Timestamp, &cm.MessageType,
+		&cm.ReplyToID, &cm.ReplyToContent, &cm.ReplyToSender,
+		&cm.FileName, &cm.FileSize, &cm.FileType, &cm.FileURL, &cm.FileID, &cm.ForwardedFrom,
+		&cm.Latitude, &cm.Longitude, &cm.LocationName, &cm.ContentFormat, &cm.DisplayName)
+	if err != nil {
+		return ChatMessage{}, false
+	}
+	plaintext, err := decryptMessage(node.LocalDBKey, content, nonce)
+	if err != nil {
+		Log.Error("解密消息失败", "messageId", messageID, "error", err)
+		return ChatMessage{}, false
+	}
+	cm.Content = string(plaintext)
+	cm.MessageID = messageID
+	cm.Timestamp = cm.Timestamp.Local()
+	return cm, true
+}
+
+// forwardedFilePath 查找文件消息在本机的副本：发送方的原文件或接收方已保存的文件
+func (node *P2PNode) forwardedFilePath(cm ChatMessage) string {
+	node.FileTransfersMutex.RLock()
+	transfer, exists := node.FileTransfers[cm.FileID]
+	node.FileTransfersMutex.RUnlock()
+	if exists {
+		for _, p := range []string{transfer.FilePath, transfer.SavePath} {
+			if p == "" {
+				continue
+			}
+			if _, err := os.Stat(p); err == nil {
+				return p
+			}
+		}
+	}
+	// 传输记录只在内存中，重启后按当前整理设置的目录和默认下载目录查找
+	if cm.FileName != "" {
+		name := filepath.Base(cm.FileName)
+		for _, p := range []string{filepath.Join(node.downloadDirFor(cm.Sender, name), name), DataPath("downloads", name)} {
+			if _, err := os.Stat(p); err == nil {
+				return p
+			}
+		}
+	}
+	return ""
+}
+
+// forwardMessage 将已有消息转发给 targetName（用户名或 "all"），返回新消息ID。
+// 图片和文件复用本机已保存的副本，不需要重新上传。
+func (node *P2PNode) forwardMessage(messageID, targetName string) (string, error) {
+	orig, ok := node.findChatMessage(messageID)
+	if !ok {
+		return "", fmt.Errorf("原消息不存在")
+	}
+
+	// 多次转发时保留最初的发送者
+	origin := orig.ForwardedFrom
+	if origin == "" {
+		origin = orig.Sender
+		if orig.IsOwn {
+			origin = node.Name
+		}
+	}
+
+	var target *Peer
+	if targetName != "all" {
+		target = node.findPeer(targetName)
+	}
+
+	msg := Message{
+		Type:          "chat",
+		From:          node.ID,
+		Content:       orig.Content,
+		Timestamp:     time.Now(),
+		MessageType:   MessageTypeForward,
+		MessageID:     generateMessageID(),
+		ForwardedFrom: origin,
+		ContentFormat: orig.ContentFormat, // 文字消息保留原格式
+	}
+	localURL := ""
+
+	switch forwardedKind(orig.MessageType, orig.FileType, orig.FileName) {
+	case MessageTypeImage:
+		imageData, err := os.ReadFile(DataPath("images", filepath.Base(orig.FileURL)))
+		if orig.FileURL == "" || err != nil {
+			return "", fmt.Errorf("原图片已不存在，无法转发")
+		}
+		msg.FileName = orig.FileName
+		msg.FileSize = orig.FileSize
+		msg.FileType = orig.FileType
+		if !strings.HasPrefix(msg.FileType, "image/") {
+			// 接收方据此识别为图片（见 forwardedKind）
+			msg.FileType = "image/" + strings.TrimPrefix(filepath.Ext(orig.FileName), ".")
+		}
+		msg.FileData = base64.StdEncoding.EncodeToString(imageData)
+		msg.FileURL = orig.FileURL // 公聊按链接发送时接收方据此拉取
+		localURL = orig.FileURL
+	case MessageTypeFile:
+		if targetName == "all" {
+			return "", fmt.Errorf("文件转发需要在私聊中使用")
+		}
+		if target == nil {
+			return "", fmt.Errorf("对方不在线，无法转发文件")
+		}
+		filePath := node.forwardedFilePath(orig)
+		if filePath == "" {
+			return "", fmt.Errorf("原文件已不存在，无法转发")
+		}
+		fileID := node.sendFileTransferRequest(filePath, targetName)
+		if fileID == "" {
+			return "", fmt.Errorf("发起文件传输失败")
+		}
+		msg.FileName = orig.FileName
+		msg.FileSize = orig.FileSize
+		msg.FileType = orig.FileType
+		msg.FileID = fileID
+	}
+
+	if targetName == "all" {
+		msg.To = "all"
+		node.broadcastImage(msg)
+	} else if target != nil {
+		msg.To = target.ID
+		node.sendMessageToPeer(target, msg)
+	} else if err := node.queueOfflineMessage(targetName, msg); err != nil {
+		return "", fmt.Errorf("目标用户不在线")
 	}
 
-	msg := ChatMessage{
+	node.recordChatMessage(ChatMessage{
+		Sender:        node.Name,
+		Recipient:     targetName,
+		Content:       msg.Content,
+		IsOwn:         true,
+		IsPrivate:     targetName != "all",
+		MessageType:   MessageTypeForward,
+		MessageID:     msg.MessageID,
+		FileName:      msg.FileName,
+		FileSize:      msg.FileSize,
+		FileType:      msg.FileType,
+		FileURL:       localURL,
+		FileID:        msg.FileID,
+		ForwardedFrom: origin,
+		ContentFormat: msg.ContentFormat,
+	})
+	Log.Info("转发消息", "original", messageID, "target", targetName, "from", origin)
+	return msg.MessageID, nil
+}
+
+// 添加聊天消息（完整版）
+func (node *P2PNode) addChatMessageWithType(sender, recipient, content string, isOwn, isPrivate bool,
+	messageType, messageID, replyToID, replyToContent, replyToSender, fileName string, fileSize int64, fileType, fileURL, fileID, forwardedFrom string) {
+	node.recordChatMessage(ChatMessage{
 		Sender:         sender,
 		Recipient:      recipient,
 		Content:        content,
-		Timestamp:      time.Now(),
 		IsOwn:          isOwn,
 		IsPrivate:      isPrivate,
 		MessageType:    messageType,
@@ -1269,37 +3159,68 @@ func (node *P2PNode) addChatMessageWithType(sender, recipient, content string, i
 		FileType:       fileType,
 		FileURL:        fileURL,
 		FileID:         fileID,
+		ForwardedFrom:  forwardedFrom,
+	})
+}
+
+// recordChatMessage 保存一条聊天消息（内存列表、数据库、命令行显示并通知前端），
+// 补全消息ID、时间戳和会话对方标识
+func (node *P2PNode) recordChatMessage(msg ChatMessage) {
+	sender, recipient, content := msg.Sender, msg.Recipient, msg.Content
+	isOwn, isPrivate := msg.IsOwn, msg.IsPrivate
+
+	// 生成消息ID（如果未提供）
+	if msg.MessageID == "" {
+		msg.MessageID = generateMessageID()
 	}
+	msg.Timestamp = time.Now()
 
-	if node.WebEnabled {
-		node.MessagesMutex.Lock()
-		node.Messages = append(node.Messages, msg)
-		if len(node.Messages) > 500 {
-			node.Messages = node.Messages[1:]
-		}
-		node.MessagesMutex.Unlock()
+	// 会话对方：收到的消息为发送方，自己发出的私聊为接收方
+	if !isOwn {
+		msg.PeerUUID = node.peerUUIDByName(sender)
+	} else if isPrivate {
+		msg.PeerUUID = node.peerUUIDByName(recipient)
 	}
 
-	// 保存到数据库（会话中始终写入，退出时按设置决定是否清空）
-	if node.DB != nil {
+	// 收到的文字消息 @ 了本机用户时标记，桌面端据此弹出系统通知
+	if !isOwn && forwardedKind(msg.MessageType, msg.FileType, msg.FileName) == MessageTypeText {
+		msg.Mentioned = mentionsUser(content, node.Name)
+	}
+	// 免打扰会话照常入库展示，只是不弹通知
+	chatID := chatIDForMessage(sender, recipient, isOwn, isPrivate)
+	msg.Muted = node.isChatMuted(chatID)
+	msg.AvatarColor = node.messageAvatarColor(msg)
+	// 收到的消息计入会话未读数，自己发出的不计；归档会话按设置自动取消归档
+	if !isOwn {
+		node.incrementUnread(chatID)
+		node.unarchiveOnMessage(chatID)
+	}
+
+	// 内存列表是最近消息的有界缓存，与是否启用 Web 界面无关：命令行、Web 和桌面端读取同一份数据
+	// （送达回执校验、发送状态、数据库不可用时的历史查询都依赖它）
+	node.MessagesMutex.Lock()
+	if isOwn && isPrivate && msg.DeliveryStatus == "" {
+		msg.DeliveryStatus = node.takePendingDeliveryLocked(msg.MessageID)
+	}
+	node.Messages = append(node.Messages, msg)
+	// 超出上限时丢弃最早的消息，它们仍在数据库中，可通过 /loadhistory 分页读取
+	if limit := node.memoryMessageCap(); len(node.Messages) > limit {
+		node.Messages = node.Messages[len(node.Messages)-limit:]
+	}
+	node.MessagesMutex.Unlock()
+
+	// 保存到数据库（会话中始终写入，退出时按设置决定是否清空）；由 messageWriter 异步批量写入
+	if node.DB != nil && node.MessageWriter != nil {
 		ciphertext, nonce, err := encryptMessage(node.LocalDBKey, []byte(content))
 		if err != nil {
 			fmt.Printf("加密消息失败: %v\n", err)
 			Log.Error("加密消息失败", "error", err)
 		} else {
-			_, err = node.DB.Exec(`
-				INSERT INTO messages (
-					sender, recipient, content, nonce, is_private, is_own,
-					message_type, message_id, reply_to_id, reply_to_content,
-					reply_to_sender, file_name, file_size, file_type, file_url, file_data, file_id
-				) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+			node.MessageWriter.Enqueue(
 				sender, recipient, ciphertext, nonce, isPrivate, isOwn,
-				messageType, messageID, replyToID, replyToContent,
-				replyToSender, fileName, fileSize, fileType, fileURL, "", fileID)
-			if err != nil {
-				fmt.Printf("保存消息到数据库失败: %v\n", err)
-				Log.Error("保存消息到数据库失败", "sender", sender, "error", err)
-			}
+				msg.MessageType, msg.MessageID, msg.ReplyToID, msg.ReplyToContent,
+				msg.ReplyToSender, msg.FileName, msg.FileSize, msg.FileType, msg.FileURL, "", msg.FileID, msg.PeerUUID,
+				msg.ForwardedFrom, msg.Latitude, msg.Longitude, msg.LocationName, msg.ContentFormat, msg.DisplayName)
 		}
 	}
 
@@ -1314,28 +3235,25 @@ func (node *P2PNode) addChatMessageWithType(sender, recipient, content string, i
 		displayContent = "[发送了表情]"
 		
 		// 从 emoji_gifs.json 查找表情名称
-		data, err := webFS.Open("emoji_gifs.json")
-		if err == nil {
-			defer data.Close()
-			type EmojiEntry struct {
-				ID   string `json:"id"`
-				Name string `json:"name"`
-			}
-			var entries []EmojiEntry
-			if json.NewDecoder(data).Decode(&entries) == nil {
-				for _, e := range entries {
-					if e.ID == emojiId {
-						displayContent = fmt.Sprintf("[emoji: %s]", e.Name)
-						break
-					}
-				}
-			}
+		if e, ok := findEmoji(emojiId); ok {
+			displayContent = fmt.Sprintf("[emoji: %s]", e.Name)
 		}
 	}
+	if msg.ForwardedFrom != "" {
+		displayContent = fmt.Sprintf("[转发自 %s] %s", msg.ForwardedFrom, displayContent)
+	}
+	if msg.Mentioned {
+		displayContent = "[有人@你] " + displayContent
+	}
+	if msg.DisplayName != "" {
+		sender = fmt.Sprintf("%s (%s)", msg.DisplayName, sender)
+	} else if !isOwn {
+		sender = node.labelForName(sender)
+	}
 	if isPrivate {
-		fmt.Printf("[%s] %s (私聊): %s\n", timestamp, sender, displayContent)
+		cliPrintf("[%s] %s (私聊): %s\n", timestamp, sender, displayContent)
 	} else {
-		fmt.Printf("[%s] %s: %s\n", timestamp, sender, displayContent)
+		cliPrintf("[%s] %s: %s\n", timestamp, sender, displayContent)
 	}
 
 	// Emit event for desktop app
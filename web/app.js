@@ -12,14 +12,30 @@ const AppState = {
     isFirstUserLoad: true,    // skip online notifications on first load
     isWails: false,           // Wails desktop mode flag
     blockedUsers: new Set(),
+    mutedChats: new Set(),    // chats with notifications muted ('all' = public)
+    pinnedChats: [],          // pinned chat ids in pin order ('all' = public)
+    chatLastActive: {},       // chatId -> last message time (ms) from DB history
+    serverUnread: {},         // chatId -> unread count persisted on the server (/chatpartners)
+    readMarks: {},            // chatId -> last messageId reported to /mark-read
+    drafts: {},               // chatId -> unsent input text (cached copy of /draft)
+    peerLatency: {},          // name -> { rttMs, lossRate, quality } from /peers
+    peerAliases: {},          // name -> local alias (only shown on this machine), from /users
+    peerAvatars: {},          // name -> { color, hash } (colour from the stable user ID, custom avatar hash), from /users
+    pinnedMessages: [],       // pinned messages of the current chat in pin order, from /pin-message
+    pendingSends: [],         // own text messages still in the undo window (held by the server, see /undo-send)
     fileTransfers: [],
     replyingTo: null,
     searchQuery: '',
     isMobile: window.innerWidth <= 768,
     showConversation: false,
     gifEmojis: [],
+    customEmojis: [],         // user-uploaded stickers from /emoji-gifs-list
     allEmojis: [],
-    historyOffset: 0,
+    historyBeforeId: 0,       // cursor for the next (older) history page; 0 = newest
+    historyHasMore: true,
+    historyLoading: false,
+    messagesSinceId: '',      // last messageId from /messages, for incremental polling
+    messagesRevision: null,   // /messages revision; changes when messages are edited in place
     shownPendingTransfers: new Set(),
     shownFailedTransfers: new Set(),
     shownCompletedTransfers: new Set(),
@@ -28,6 +44,7 @@ const AppState = {
     mentionActive: false,
     mentionStartPos: -1,
     mentionIndex: 0,
+    mentionedChats: new Set(), // chats with an unread @ mention
     titleFlashInterval: null,
     originalTitle: 'LS Messager',
     // Settings (loaded from localStorage)
@@ -37,6 +54,7 @@ const AppState = {
         onlineNotify: true,
         badgeCount: true,
         skin: 'telegram',
+        accentColor: '',    // '#rrggbb' overrides the skin's accent; '' = skin default
         sendMode: 'enter',  // 'enter' or 'ctrlenter'
     },
 };
@@ -51,12 +69,29 @@ const AVATAR_COLORS = [
 
 const HISTORY_LIMIT = 50;
 
+// =================================
+// API Token
+// =================================
+// Write endpoints require the token issued with the page (cookie + header).
+// Wrap fetch once so every same-origin request carries it.
+function installApiToken() {
+    const token = APP_DATA.apiToken;
+    if (!token) return;
+    const origFetch = window.fetch.bind(window);
+    window.fetch = (input, init = {}) => {
+        const headers = new Headers(init.headers || {});
+        headers.set('X-LANShare-Token', token);
+        return origFetch(input, { ...init, headers });
+    };
+}
+
 // =================================
 // Initialization
 // =================================
 async function init() {
     AppState.localUsername = APP_DATA.name;
     AppState.originalTitle = document.title;
+    installApiToken();
 
     // Load emoji list
     await loadGifEmojis();
@@ -65,6 +100,7 @@ async function init() {
 
     // Initial data load
     await loadBlockedUsers();
+    loadMutedChats();
     loadUsers();
     loadChatPartners();
     loadHistory();
@@ -90,33 +126,38 @@ async function init() {
             } else {
                 loadMessages();
             }
+            // @ mentions are notified by the Go side; just flag the chat here
+            if (msg.mentioned && !msg.muted) {
+                const mentionChatId = msg.isPrivate ? msg.sender : 'all';
+                if (mentionChatId !== AppState.currentChatId || !document.hasFocus()) {
+                    AppState.mentionedChats.add(mentionChatId);
+                    renderChatList();
+                }
+            }
             // System notification via Go binding for non-own messages
-            if (!msg.isOwn && AppState.settings.msgNotify) {
+            if (!msg.isOwn && !msg.mentioned && !msg.muted && AppState.settings.msgNotify) {
                 const chatId = msg.isPrivate ? msg.sender : 'all';
                 if (chatId !== AppState.currentChatId || !document.hasFocus()) {
                     const preview = (msg.content || '').substring(0, 100);
                     window.go.main.DesktopApp.ShowNotification(
-                        'LS Messager - ' + (msg.sender || ''),
+                        'LS Messager - ' + (msg.displayName || peerLabel(msg.sender || '')),
                         preview,
                         chatId
                     );
                 }
             }
-            // @ mention notification in public chat
-            if (!msg.isOwn && !msg.isPrivate && msg.content &&
-                msg.content.includes('@' + AppState.localUsername)) {
-                const mentionChatId = 'all';
-                if (mentionChatId !== AppState.currentChatId || !document.hasFocus()) {
-                    window.go.main.DesktopApp.ShowNotification(
-                        '你被提到了 - ' + (msg.sender || ''),
-                        (msg.content || '').substring(0, 100),
-                        mentionChatId
-                    );
-                }
-            }
         });
         const _recentOnlineEvents = {};
-        window.runtime.EventsOn("user-online", (name) => {
+        // Online/offline callbacks may arrive out of order; drop events older than the last one for that user
+        const _presenceSeq = {};
+        const isStalePresence = (name, seq) => {
+            if (seq === undefined) return false;
+            if ((_presenceSeq[name] || 0) > seq) return true;
+            _presenceSeq[name] = seq;
+            return false;
+        };
+        window.runtime.EventsOn("user-online", (name, seq) => {
+            if (isStalePresence(name, seq)) return;
             loadUsers();
             // Skip self and deduplicate within 5 seconds
             if (name === AppState.localUsername) return;
@@ -128,19 +169,60 @@ async function init() {
                 showToast(name + ' 已上线', 'info');
             }
         });
-        window.runtime.EventsOn("user-offline", (name) => {
+        window.runtime.EventsOn("user-offline", (name, seq) => {
+            if (isStalePresence(name, seq)) return;
             loadUsers();
             if (name === AppState.localUsername) return;
             delete _recentOnlineEvents[name];
             insertSystemMessage(name + ' 已离线');
         });
+        window.runtime.EventsOn("message-failed", (messageId) => {
+            const msg = AppState.allMessages.find(m => m.messageId === messageId);
+            if (msg) {
+                msg.failed = true;
+                if (msg.isPrivate) msg.deliveryStatus = 'failed';
+                displayMessages();
+            }
+            showToast('消息发送失败，对方长时间未重新连接', 'error');
+        });
+        // Private message moved to sending / sent / delivered
+        window.runtime.EventsOn("message-status", (messageId, status) => {
+            const msg = AppState.allMessages.find(m => m.messageId === messageId);
+            if (msg && msg.deliveryStatus !== status) {
+                msg.deliveryStatus = status;
+                displayMessages();
+            }
+        });
+        // Stored history of a chat was deleted (whole chat or a time range): reload from the backend
+        window.runtime.EventsOn("history-changed", () => {
+            AppState.messagesSinceId = '';
+            AppState.messagesRevision = null;
+            loadMessages();
+            loadPinnedMessages();
+        });
+        // Someone pinned or unpinned a message in a chat
+        window.runtime.EventsOn("pinned-messages-changed", (chatId) => {
+            if (chatId === AppState.currentChatId) loadPinnedMessages();
+        });
+        // Another user already has this name; the peer is shown with a distinguishing suffix
+        window.runtime.EventsOn("name-conflict", (name, displayName) => {
+            insertSystemMessage(`有多位用户名为「${name}」，新上线的用户显示为「${displayName}」`);
+            showToast(`用户名「${name}」重复，已显示为「${displayName}」`, 'warning');
+            loadUsers();
+        });
         // When window gains focus, check if there's a pending notification chat to switch to.
         // This handles: systray double-click, Alt-Tab, taskbar click, etc.
         window.addEventListener('focus', () => {
+            window.go.main.DesktopApp.ClearTrayUnread();
+            window.go.main.DesktopApp.SetActiveChat(AppState.currentChatId || '');
             window.go.main.DesktopApp.GetAndClearLastNotifiedChat().then(chatId => {
                 if (chatId) selectChat(chatId);
             });
         });
+        // Messages arriving while unfocused count toward the tray unread badge
+        window.addEventListener('blur', () => {
+            window.go.main.DesktopApp.SetActiveChat('');
+        });
         window.runtime.EventsOn("update-available", (source) => {
             const banner = document.getElementById('updateBanner');
             const text = document.getElementById('updateBannerText');
@@ -150,6 +232,7 @@ async function init() {
                 text.textContent = `新版本 v${source.version} [${label}] (来自 ${source.name})`;
                 banner.style.display = 'flex';
                 _lastUpdateCrossChannel = (source.channel !== _localChannel);
+                _lastUpdateChangelog = source.changelog || '';
                 if (_lastUpdateVersion !== source.version) {
                     _lastUpdateVersion = source.version;
                     btn.disabled = false;
@@ -164,7 +247,21 @@ async function init() {
 
         // Wails built-in file drop — gives file paths directly (same speed as paperclip)
         // Supports both files and folders (folders are auto-zipped by Go side).
-        window.runtime.OnFileDrop((x, y, paths) => {
+        // Windows: paths arrive here via runtime.OnFileDrop. macOS/Linux: the Go side
+        // registers OnFileDrop (dragdrop_other.go) and re-emits "files-dropped"; the JS
+        // registration is still needed there for the drop overlay and to block navigation.
+        window.runtime.Environment().then(env => {
+            const goHandlesDrop = env.platform !== 'windows';
+            window.runtime.OnFileDrop((x, y, paths) => {
+                if (!goHandlesDrop) handleDroppedPaths(paths);
+            }, true);
+            if (goHandlesDrop) {
+                window.runtime.EventsOn('files-dropped', (x, y, paths) => {
+                    if (isWailsDropTarget(x, y)) handleDroppedPaths(paths);
+                });
+            }
+        });
+        function handleDroppedPaths(paths) {
             if (!paths || paths.length === 0) return;
             if (!AppState.currentChatId) {
                 showToast('请先选择一个聊天', 'warning');
@@ -172,6 +269,7 @@ async function init() {
             }
             const target = AppState.currentChatId;
             const IMAGE_EXTS = ['jpg', 'jpeg', 'png', 'gif', 'bmp', 'webp'];
+            const filePaths = [];
             for (const filePath of paths) {
                 const ext = filePath.split('.').pop().toLowerCase();
                 // Only treat as image if path has a dot (not a folder) and ext matches
@@ -180,33 +278,59 @@ async function init() {
                         .then(r => { if (r && r.status === 'success') { showToast('图片发送成功', 'success'); loadMessages(); } })
                         .catch(err => showToast('图片发送失败: ' + err, 'error'));
                 } else {
-                    if (target === 'all') { showToast('文件传输需要在私聊中使用', 'warning'); continue; }
-                    if (!AppState.onlineUsers.includes(target)) { showToast('对方不在线', 'warning'); continue; }
-                    showToast('正在处理...', 'info');
-                    window.go.main.DesktopApp.SendFilePath(filePath, target)
-                        .then(r => { if (r && r.fileId) postFileMsgAfterSend(target, r.fileName, parseInt(r.fileSize) || 0, '', r.fileId); })
-                        .catch(err => showToast('发送失败: ' + err, 'error'));
+                    filePaths.push(filePath);
                 }
             }
-        }, true);
+            if (filePaths.length === 0) return;
+            if (target === 'all') { showToast('文件传输需要在私聊中使用', 'warning'); return; }
+            if (!AppState.onlineUsers.includes(target)) { showToast('对方不在线', 'warning'); return; }
+            showToast(filePaths.length > 1 ? `正在处理 ${filePaths.length} 个文件...` : '正在处理...', 'info');
+            window.go.main.DesktopApp.SendMultipleFilePaths(filePaths, target)
+                .then(results => reportFileSendResults(target, results))
+                .catch(err => showToast('发送失败: ' + err, 'error'));
+        }
 
-        // Paste handler: images → Go binding, files → JSON POST
+        // Post file messages for started transfers and list the failures
+        function reportFileSendResults(target, results) {
+            const failed = [];
+            for (const r of results || []) {
+                if (r.status === 'success' && r.fileId) {
+                    postFileMsgAfterSend(target, r.fileName, parseInt(r.fileSize) || 0, '', r.fileId);
+                } else {
+                    failed.push(`${r.path.split(/[\\/]/).pop()}: ${r.error || '未知错误'}`);
+                }
+            }
+            if (failed.length > 0) showToast('部分文件发送失败\n' + failed.join('\n'), 'error');
+        }
+
+        // Paste handler: pasted images → Go binding; copied files (e.g. from
+        // Explorer) are read from the native clipboard by path so large files
+        // never pass through WebView2, falling back to JSON POST if unavailable
         document.addEventListener('paste', (e) => {
             const files = e.clipboardData && e.clipboardData.files;
             if (!files || files.length === 0) return;
             e.preventDefault();
             if (!AppState.currentChatId) { showToast('请先选择一个聊天', 'warning'); return; }
-            for (const file of files) {
-                if (isImageFile(file)) {
-                    sendImage(file);
-                } else {
-                    sendDroppedFile(file);
-                }
+            const others = Array.from(files).filter(f => !isImageFile(f));
+            if (others.length === 0) {
+                for (const file of files) sendImage(file);
+                return;
             }
+            const target = AppState.currentChatId;
+            if (target === 'all') { showToast('文件传输需要在私聊中使用', 'warning'); return; }
+            if (!AppState.onlineUsers.includes(target)) { showToast('对方不在线', 'warning'); return; }
+            window.go.main.DesktopApp.SendClipboardFiles(target)
+                .then(results => reportFileSendResults(target, results))
+                .catch(() => {
+                    for (const file of files) {
+                        if (isImageFile(file)) sendImage(file);
+                        else sendDroppedFile(file);
+                    }
+                });
         });
 
         // Save window size on resize (config save can't rely on shutdown alone
-        // because HideWindowOnClose hides the window without triggering shutdown)
+        // because close-to-tray hides the window without triggering shutdown)
         let _resizeSaveTimer = null;
         window.addEventListener('resize', () => {
             clearTimeout(_resizeSaveTimer);
@@ -229,6 +353,7 @@ async function init() {
         setInterval(() => {
             loadBlockedUsers();
             loadUsers();
+            loadPinnedMessages();
         }, 3000);
         startFileTransferPolling();
         setInterval(checkConnection, 5000);
@@ -272,9 +397,24 @@ function hashCode(str) {
 }
 
 function getAvatarColor(name) {
+    // Server colour is derived from the stable user ID, so it survives renames
+    const avatar = AppState.peerAvatars[name];
+    if (avatar && avatar.color) return avatar.color;
     return AVATAR_COLORS[hashCode(name) % AVATAR_COLORS.length];
 }
 
+// Shows the user's custom avatar (if any) over the colour + initial fallback
+function applyAvatarImage(el, name) {
+    const avatar = AppState.peerAvatars[name];
+    if (avatar && avatar.hash) {
+        el.classList.add('tg-avatar-image');
+        el.style.backgroundImage = `url(/avatar/${avatar.hash})`;
+    } else {
+        el.classList.remove('tg-avatar-image');
+        el.style.backgroundImage = '';
+    }
+}
+
 function getAvatarLetter(name) {
     if (!name) return '?';
     return name.charAt(0).toUpperCase();
@@ -306,6 +446,17 @@ function formatChatTime(date) {
     return date.toLocaleDateString('zh-CN', { month: 'numeric', day: 'numeric' });
 }
 
+// isWailsDropTarget mirrors Wails' useDropTarget check for drops delivered from Go:
+// only accept drops on an element (or ancestor) styled with --wails-drop-target: drop.
+function isWailsDropTarget(x, y) {
+    let el = document.elementFromPoint(x, y);
+    while (el) {
+        if (getComputedStyle(el).getPropertyValue('--wails-drop-target').trim() === 'drop') return true;
+        el = el.parentElement;
+    }
+    return false;
+}
+
 function formatBytes(bytes, decimals = 1) {
     if (bytes === 0) return '0 B';
     const k = 1024;
@@ -334,7 +485,19 @@ function scrollToBottom(el) {
     el.scrollTop = el.scrollHeight;
 }
 
-function getFileIcon(fileType) {
+// Icons for the backend's file icon hint (fileIconHint in filetransfer.go)
+const FILE_ICON_HINTS = {
+    image: '🖼️',
+    video: '🎥',
+    audio: '🎵',
+    pdf: '📄',
+    archive: '📦',
+    document: '📝',
+    executable: '⚙️',
+};
+
+function getFileIcon(fileType, iconHint) {
+    if (iconHint && FILE_ICON_HINTS[iconHint]) return FILE_ICON_HINTS[iconHint];
     if (!fileType) return '📎';
     if (fileType.startsWith('image/')) return '🖼️';
     if (fileType.startsWith('video/')) return '🎥';
@@ -345,6 +508,19 @@ function getFileIcon(fileType) {
     return '📎';
 }
 
+// Ticks next to the time of own private messages
+const DELIVERY_TICKS = {
+    sending: { icon: '🕓', title: '发送中' },
+    sent: { icon: '✓', title: '已发送' },
+    delivered: { icon: '✓✓', title: '已送达' },
+};
+
+function deliveryTickHtml(msg) {
+    const tick = msg.isOwn && msg.isPrivate && DELIVERY_TICKS[msg.deliveryStatus];
+    if (!tick) return '';
+    return `<span class="tg-msg-status ${msg.deliveryStatus}" title="${tick.title}">${tick.icon}</span>`;
+}
+
 function escapeHtml(str) {
     const div = document.createElement('div');
     div.textContent = str;
@@ -354,23 +530,51 @@ function escapeHtml(str) {
 // =================================
 // Unread Count Management
 // =================================
+function isMessageInChat(msg, chatId) {
+    if (chatId === 'all') return !msg.isPrivate;
+    return msg.isPrivate &&
+        (msg.sender === chatId || msg.recipient === chatId);
+}
+
 function getUnreadCount(chatId) {
     const lastRead = parseInt(localStorage.getItem(`lastRead_${chatId}`) || '0', 10);
-    return AppState.allMessages.filter(msg => {
+    const local = AppState.allMessages.filter(msg => {
         const ts = new Date(msg.timestamp).getTime();
         if (ts <= lastRead) return false;
         if (msg.isOwn) return false;
-        if (chatId === 'all') return !msg.isPrivate;
-        return msg.isPrivate &&
-            (msg.sender === chatId || msg.recipient === chatId);
+        return isMessageInChat(msg, chatId);
     }).length;
+    // The server count survives restarts and covers messages not loaded in memory
+    return Math.max(local, AppState.serverUnread[chatId] || 0);
 }
 
 function markChatAsRead(chatId) {
     localStorage.setItem(`lastRead_${chatId}`, Date.now().toString());
+    AppState.mentionedChats.delete(chatId);
+    delete AppState.serverUnread[chatId];
+    reportChatRead(chatId);
     updateTitleBadge();
 }
 
+// Persist the read state on the server; only when a new message has been seen
+function reportChatRead(chatId) {
+    let lastMessageId = '';
+    for (let i = AppState.allMessages.length - 1; i >= 0; i--) {
+        const msg = AppState.allMessages[i];
+        if (isMessageInChat(msg, chatId)) {
+            lastMessageId = msg.messageId || '';
+            break;
+        }
+    }
+    if (chatId in AppState.readMarks && AppState.readMarks[chatId] === lastMessageId) return;
+    AppState.readMarks[chatId] = lastMessageId;
+    fetch('/mark-read', {
+        method: 'POST',
+        headers: { 'Content-Type': 'application/json' },
+        body: JSON.stringify({ chatId, lastMessageId }),
+    }).catch(e => console.error('标记已读失败:', e));
+}
+
 function getTotalUnread() {
     let total = getUnreadCount('all');
     AppState.onlineUsers.forEach(u => {
@@ -381,6 +585,10 @@ function getTotalUnread() {
     AppState.allMessages.forEach(msg => {
         if (msg.isPrivate && !msg.isOwn && msg.sender) chatUsers.add(msg.sender);
     });
+    // Offline chats with unread messages from earlier sessions
+    Object.keys(AppState.serverUnread).forEach(c => {
+        if (c !== 'all') chatUsers.add(c);
+    });
     chatUsers.forEach(u => {
         if (!AppState.onlineUsers.includes(u)) {
             total += getUnreadCount(u);
@@ -481,30 +689,64 @@ function buildChatList() {
 
         chats.push({
             id: partner,
-            name: partner,
+            name: peerLabel(partner),
             type: 'private',
             avatarColor: getAvatarColor(partner),
             avatarLetter: getAvatarLetter(partner),
             lastMessage: lastMsg ? getMessagePreview(lastMsg) : (isOnline ? '在线' : ''),
             lastSender: lastMsg && lastMsg.isOwn ? '我' : '',
-            lastTimestamp: lastMsg ? new Date(lastMsg.timestamp) : new Date(0),
+            // Older history may not be loaded; fall back to the DB's last message time
+            lastTimestamp: new Date(Math.max(lastMsg ? new Date(lastMsg.timestamp).getTime() : 0,
+                AppState.chatLastActive[partner] || 0)),
             unreadCount: getUnreadCount(partner),
             isOnline,
             isBlocked,
         });
     });
 
-    // Sort by lastTimestamp descending (most recent conversation first)
-    chats.sort((a, b) => b.lastTimestamp - a.lastTimestamp);
+    // Pinned chats first (in pin order), the rest by lastTimestamp descending
+    const pinRank = id => {
+        const i = AppState.pinnedChats.indexOf(id);
+        return i === -1 ? Infinity : i;
+    };
+    chats.forEach(c => { c.isPinned = AppState.pinnedChats.includes(c.id); });
+    chats.sort((a, b) => {
+        const ra = pinRank(a.id), rb = pinRank(b.id);
+        if (ra !== rb) return ra < rb ? -1 : 1;
+        return b.lastTimestamp - a.lastTimestamp;
+    });
 
     return chats;
 }
 
+// Forwarded messages carry messageType 'forward'; the real content kind is
+// inferred from the file fields (mirrors forwardedKind in web.go).
+function forwardedKind(msg) {
+    if (msg.messageType !== 'forward') return msg.messageType;
+    if ((msg.fileType || '').startsWith('image/')) return 'image';
+    if (msg.fileName) return 'file';
+    return 'text';
+}
+
+// Long text sent as a .txt file: content is "[长文本] <first line preview>"
+const LONG_TEXT_PREFIX = '[长文本]';
+function isLongTextMessage(msg) {
+    return msg.messageType === 'file' && (msg.content || '').startsWith(LONG_TEXT_PREFIX);
+}
+
+// Name shown for a user: the local alias if one is set, otherwise the user name
+function peerLabel(name) {
+    return AppState.peerAliases[name] || name;
+}
+
 function getMessagePreview(msg) {
     if (!msg) return '';
+    if (msg.messageType === 'forward') msg = { ...msg, messageType: forwardedKind(msg) };
     if (msg.content && msg.content.startsWith('emoji:')) return '[表情]';
     if (msg.messageType === 'image') return '📷 图片';
+    if (msg.messageType === 'file' && isLongTextMessage(msg)) return msg.content;
     if (msg.messageType === 'file') return `📎 ${msg.fileName || '文件'}`;
+    if (msg.messageType === 'location') return `📍 ${msg.locationName || '位置'}`;
     if (msg.messageType === 'reply') return msg.content || '';
     return msg.content || '';
 }
@@ -519,7 +761,7 @@ function renderChatList() {
 
     // Filter by search
     const filtered = query
-        ? chats.filter(c => c.name.toLowerCase().includes(query))
+        ? chats.filter(c => c.name.toLowerCase().includes(query) || c.id.toLowerCase().includes(query))
         : chats;
 
     chatList.innerHTML = '';
@@ -529,6 +771,7 @@ function renderChatList() {
         item.className = 'tg-chat-item';
         if (chat.id === AppState.currentChatId) item.classList.add('active');
         if (chat.isBlocked) item.classList.add('blocked');
+        if (chat.isPinned) item.classList.add('pinned');
         item.dataset.chatId = chat.id;
 
         // Avatar wrapper (for online dot positioning)
@@ -543,6 +786,7 @@ function renderChatList() {
         } else {
             avatar.style.background = chat.avatarColor;
             avatar.textContent = chat.avatarLetter;
+            applyAvatarImage(avatar, chat.id);
         }
         avatarWrap.appendChild(avatar);
 
@@ -564,6 +808,28 @@ function renderChatList() {
         const nameEl = document.createElement('div');
         nameEl.className = 'tg-chat-name';
         nameEl.textContent = chat.name;
+        const latency = chat.isOnline && chat.type === 'private' ? AppState.peerLatency[chat.id] : null;
+        if (latency && SIGNAL_BARS[latency.quality]) {
+            const signal = document.createElement('span');
+            signal.className = 'tg-chat-signal ' + latency.quality;
+            signal.textContent = ' ' + SIGNAL_BARS[latency.quality];
+            signal.title = `延迟 ${Math.round(latency.rttMs)} ms，丢包 ${Math.round(latency.lossRate * 100)}%`;
+            nameEl.appendChild(signal);
+        }
+        if (AppState.mutedChats.has(chat.id)) {
+            const muteIcon = document.createElement('span');
+            muteIcon.className = 'tg-chat-muted';
+            muteIcon.textContent = ' 🔕';
+            muteIcon.title = '免打扰';
+            nameEl.appendChild(muteIcon);
+        }
+        if (chat.isPinned) {
+            const pinIcon = document.createElement('span');
+            pinIcon.className = 'tg-chat-pinned';
+            pinIcon.textContent = ' 📌';
+            pinIcon.title = '已置顶';
+            nameEl.appendChild(pinIcon);
+        }
 
         const timeEl = document.createElement('div');
         timeEl.className = 'tg-chat-time';
@@ -590,6 +856,13 @@ function renderChatList() {
             if (!chat.isOnline) preview.classList.add('offline');
         }
 
+        if (AppState.mentionedChats.has(chat.id)) {
+            const mention = document.createElement('span');
+            mention.className = 'tg-chat-mention';
+            mention.textContent = '[有人@你] ';
+            preview.prepend(mention);
+        }
+
         bottom.appendChild(preview);
 
         if (chat.unreadCount > 0) {
@@ -628,6 +901,35 @@ function showChatContextMenu(e, chat) {
     const menu = document.createElement('div');
     menu.className = 'tg-context-menu';
 
+    const muteBtn = document.createElement('div');
+    muteBtn.className = 'tg-context-menu-item';
+    muteBtn.textContent = AppState.mutedChats.has(chat.id) ? '取消免打扰' : '消息免打扰';
+    muteBtn.onclick = () => {
+        menu.remove();
+        toggleMuteChat(chat.id);
+    };
+    menu.appendChild(muteBtn);
+
+    const pinBtn = document.createElement('div');
+    pinBtn.className = 'tg-context-menu-item';
+    pinBtn.textContent = chat.isPinned ? '取消置顶' : '置顶聊天';
+    pinBtn.onclick = () => {
+        menu.remove();
+        togglePinChat(chat.id);
+    };
+    menu.appendChild(pinBtn);
+
+    if (chat.type === 'private') {
+        const aliasBtn = document.createElement('div');
+        aliasBtn.className = 'tg-context-menu-item';
+        aliasBtn.textContent = '设置备注名';
+        aliasBtn.onclick = () => {
+            menu.remove();
+            editPeerAlias(chat.id);
+        };
+        menu.appendChild(aliasBtn);
+    }
+
     const deleteBtn = document.createElement('div');
     deleteBtn.className = 'tg-context-menu-item danger';
     deleteBtn.textContent = '删除聊天记录';
@@ -661,6 +963,27 @@ function showChatContextMenu(e, chat) {
     setTimeout(() => document.addEventListener('click', closeMenu), 0);
 }
 
+// Set or clear (empty input) the local alias of a user; aliases are never sent to others
+async function editPeerAlias(name) {
+    const alias = await showPrompt(`给「${name}」设置备注名（只在本机显示，留空清除）`, AppState.peerAliases[name] || '');
+    if (alias === null) return;
+    fetch('/set-alias', {
+        method: 'POST',
+        headers: { 'Content-Type': 'application/json' },
+        body: JSON.stringify({ target: name, alias: alias.trim() })
+    })
+    .then(r => {
+        if (!r.ok) return r.text().then(t => { throw new Error(t.trim() || '设置备注名失败'); });
+        if (alias.trim()) AppState.peerAliases[name] = alias.trim();
+        else delete AppState.peerAliases[name];
+        renderChatList();
+        updateConversationHeader();
+        displayMessages();
+        showToast(alias.trim() ? '备注名已保存' : '备注名已清除', 'success');
+    })
+    .catch(err => showToast(err.message || '设置备注名失败', 'error'));
+}
+
 async function deleteChatHistory(chatId, chatName) {
     const label = chatId === 'all' ? '公共聊天' : chatName;
     const ok = await showConfirm(`确定要删除与「${label}」的所有聊天记录吗？`);
@@ -696,11 +1019,73 @@ async function deleteChatHistory(chatId, chatName) {
 // =================================
 // Chat Selection
 // =================================
+// Tell Go which chat is on screen so the tray unread count skips it
+function reportActiveChat() {
+    if (AppState.isWails && document.hasFocus()) {
+        window.go.main.DesktopApp.SetActiveChat(AppState.currentChatId || '');
+    }
+}
+
+// =================================
+// Drafts
+// =================================
+const MAX_DRAFT_LENGTH = 5000; // matches maxDraftRunes in draft.go
+let _draftSaveTimer = null;
+
+// Save the input text of a chat (empty text deletes the draft)
+function saveDraft(chatId, text) {
+    clearTimeout(_draftSaveTimer);
+    if (!chatId) return;
+    text = Array.from(text || '').slice(0, MAX_DRAFT_LENGTH).join('');
+    if ((AppState.drafts[chatId] || '') === text) return;
+    if (text) AppState.drafts[chatId] = text;
+    else delete AppState.drafts[chatId];
+    fetch('/draft', {
+        method: 'POST',
+        headers: { 'Content-Type': 'application/json' },
+        body: JSON.stringify({ chatId, content: text })
+    }).catch(() => {});
+}
+
+function clearDraft(chatId) {
+    saveDraft(chatId, '');
+}
+
+// Fill the input with the chat's draft; fetched from the backend when not cached
+function restoreDraft(chatId) {
+    const input = document.getElementById('messageInput');
+    const apply = text => {
+        if (AppState.currentChatId !== chatId || input.value) return;
+        input.value = text;
+        autoResizeInput();
+    };
+    if (chatId in AppState.drafts) {
+        apply(AppState.drafts[chatId]);
+        return;
+    }
+    fetch('/draft?chatId=' + encodeURIComponent(chatId))
+        .then(r => r.ok ? r.json() : null)
+        .then(data => {
+            if (!data || !data.content) return;
+            AppState.drafts[chatId] = data.content;
+            apply(data.content);
+        })
+        .catch(() => {});
+}
+
 function selectChat(chatId) {
+    const input = document.getElementById('messageInput');
+    if (AppState.currentChatId) saveDraft(AppState.currentChatId, input.value);
     AppState.currentChatId = chatId;
+    reportActiveChat();
     AppState.showConversation = true;
-    AppState.historyOffset = 0;
+    AppState.historyBeforeId = 0;
+    AppState.historyHasMore = true;
+    AppState.historyLoading = false;
     cancelReply();
+    AppState.pinnedMessages = [];
+    renderPinnedBar();
+    loadPinnedMessages();
 
     // Mark as read
     markChatAsRead(chatId);
@@ -717,9 +1102,10 @@ function selectChat(chatId) {
         document.querySelector('.tg-sidebar').classList.add('hidden');
     }
 
-    // Update input placeholder
-    const input = document.getElementById('messageInput');
+    // Update input placeholder and restore the chat's draft
     input.value = '';
+    input.style.height = 'auto';
+    restoreDraft(chatId);
     input.placeholder = chatId === 'all' ? '输入公共消息...' : `给 ${chatId} 发消息...`;
     input.focus();
 
@@ -747,7 +1133,9 @@ function updateConversationHeader() {
     if (chatId === 'all') {
         avatar.style.background = getAccentColor();
         avatar.textContent = AppState.settings.skin === 'wisetalk' ? '💬' : '🌐';
+        applyAvatarImage(avatar, '');
         nameEl.textContent = '公共聊天';
+        nameEl.title = '';
         const count = AppState.onlineUsers.length;
         statusEl.textContent = `${count} 位在线成员`;
         statusEl.className = 'tg-conv-status';
@@ -756,10 +1144,17 @@ function updateConversationHeader() {
         const color = getAvatarColor(chatId);
         avatar.style.background = color;
         avatar.textContent = getAvatarLetter(chatId);
-        nameEl.textContent = chatId;
+        applyAvatarImage(avatar, chatId);
+        nameEl.textContent = peerLabel(chatId);
+        nameEl.title = AppState.peerAliases[chatId] ? chatId : '';
         const isOnline = AppState.onlineUsers.includes(chatId);
         peerOffline = !isOnline;
         statusEl.textContent = isOnline ? '在线' : '离线';
+        const latency = AppState.peerLatency[chatId];
+        if (isOnline && latency && latency.quality !== 'unknown') {
+            statusEl.textContent += ` · ${Math.round(latency.rttMs)} ms`;
+            if (latency.lossRate > 0) statusEl.textContent += ` · 丢包 ${Math.round(latency.lossRate * 100)}%`;
+        }
         statusEl.className = 'tg-conv-status' + (isOnline ? ' online' : '');
         blockBtn.style.display = '';
         const isBlocked = AppState.blockedUsers.has(chatId);
@@ -788,8 +1183,10 @@ function updateConversationHeader() {
 function initChatSwitching() {
     // Back button for mobile
     document.getElementById('backBtn').addEventListener('click', () => {
+        saveDraft(AppState.currentChatId, document.getElementById('messageInput').value);
         AppState.showConversation = false;
         AppState.currentChatId = null;
+        reportActiveChat();
         document.getElementById('conversation').style.display = 'none';
         document.getElementById('mainEmpty').style.display = 'flex';
         if (AppState.isMobile) {
@@ -805,6 +1202,11 @@ function initChatSwitching() {
         }
     });
 
+    // Load older history when scrolled to the top
+    document.getElementById('messages').addEventListener('scroll', (e) => {
+        if (e.target.scrollTop < 40) loadHistory();
+    });
+
     // File transfers panel removed — all transfers shown inline in conversation
 }
 
@@ -820,6 +1222,12 @@ function autoResizeInput() {
 function initInputHandlers() {
     const input = document.getElementById('messageInput');
     input.addEventListener('input', autoResizeInput);
+    // Persist the draft shortly after typing stops so it survives a restart
+    input.addEventListener('input', () => {
+        clearTimeout(_draftSaveTimer);
+        const chatId = AppState.currentChatId;
+        _draftSaveTimer = setTimeout(() => saveDraft(chatId, input.value), 1000);
+    });
     input.addEventListener('keypress', (e) => {
         if (e.key === 'Enter') {
             if (AppState.mentionActive && !e.shiftKey) {
@@ -960,6 +1368,31 @@ function renderMentions(escapedHtml) {
     });
 }
 
+// Limited Markdown for contentFormat === 'markdown': ```code blocks```, `code`,
+// **bold**, *italic* / _italic_, [text](url) and bare http(s) links.
+// Input is already escaped, so only the tags produced here can appear (whitelist).
+function renderMarkdown(escapedHtml) {
+    const slots = [];
+    const hold = html => `\u0000${slots.push(html) - 1}\u0000`;
+    const safeUrl = url => url.replace(/"/g, '&quot;').replace(/'/g, '&#39;');
+    const link = (url, label) =>
+        hold(`<a class="tg-md-link" href="${safeUrl(url)}" data-url="${safeUrl(url)}">${label}</a>`);
+
+    let html = escapedHtml
+        .replace(/```(?:[\w+-]*\n)?([\s\S]*?)```/g, (m, code) =>
+            hold(`<pre class="tg-md-pre"><code>${code.replace(/^\n+|\n+$/g, '')}</code></pre>`))
+        .replace(/`([^`\n]+)`/g, (m, code) => hold(`<code class="tg-md-code">${code}</code>`))
+        .replace(/\[([^\]\n]+)\]\((https?:\/\/[^\s)]+)\)/g, (m, label, url) => link(url, label))
+        .replace(/https?:\/\/[^\s<\u0000]+/g, url => link(url, url));
+
+    html = renderMentions(html)
+        .replace(/\*\*(?=\S)([^*\n]*?\S)\*\*/g, '<strong>$1</strong>')
+        .replace(/(^|[^*\w])\*(?=\S)([^*\n]*?\S)\*(?![*\w])/g, '$1<em>$2</em>')
+        .replace(/(^|[^\w])_(?=\S)([^_\n]*?\S)_(?!\w)/g, '$1<em>$2</em>');
+
+    return html.replace(/\u0000(\d+)\u0000/g, (m, i) => slots[Number(i)]);
+}
+
 // Wrap emoji characters in <span class="emoji"> for larger rendering
 function wrapEmoji(html) {
     // Match emoji sequences: emoji presentation, keycap, flags, ZWJ sequences, modifiers
@@ -972,7 +1405,7 @@ function wrapEmoji(html) {
 // =================================
 function sendMessage() {
     const input = document.getElementById('messageInput');
-    let message = input.value.trim();
+    const message = input.value.trim();
 
     if (message === '') {
         input.style.animation = 'shake 0.3s ease-in-out';
@@ -991,44 +1424,122 @@ function sendMessage() {
         return;
     }
 
-    // Private chat: prepend /to command
-    if (AppState.currentChatId !== 'all') {
-        if (AppState.blockedUsers.has(AppState.currentChatId)) {
-            showToast(`请先解除对 ${AppState.currentChatId} 的屏蔽`, 'warning');
-            return;
-        }
-        message = `/to ${AppState.currentChatId} ${message}`;
+    // Private chat: send with targetName
+    const chatId = AppState.currentChatId;
+    if (chatId !== 'all' && AppState.blockedUsers.has(chatId)) {
+        showToast(`请先解除对 ${chatId} 的屏蔽`, 'warning');
+        return;
     }
 
+    // Text messages are held by the server for a short undo window; commands are sent immediately
     fetch('/send', {
         method: 'POST',
         headers: { 'Content-Type': 'application/json' },
-        body: JSON.stringify({ message })
+        body: JSON.stringify({ message, targetName: chatId === 'all' ? '' : chatId, undoable: true })
     })
     .then(response => {
-        if (response.ok) {
-            input.value = '';
-            input.style.height = 'auto';
-            cancelReply();
-            input.focus();
-            loadMessages(); // Immediately refresh to show sent message
+        if (!response.ok) throw new Error('发送失败');
+        clearDraft(chatId);
+        input.value = '';
+        input.style.height = 'auto';
+        cancelReply();
+        input.focus();
+        const isJson = (response.headers.get('Content-Type') || '').includes('application/json');
+        return isJson ? response.json() : null;
+    })
+    .then(data => {
+        if (data && data.messageId) {
+            addPendingSend(data.messageId, chatId, message, data.undoWindowMs || 5000);
         } else {
-            throw new Error('发送失败');
+            loadMessages(); // Immediately refresh to show sent message
         }
     })
     .catch(() => showToast('发送消息失败', 'error'));
 }
 
+// Shows a held message with an undo button until the server sends it (same messageId)
+function addPendingSend(messageId, chatId, content, windowMs) {
+    AppState.pendingSends.push({
+        pendingId: messageId,
+        chatId,
+        isOwn: true,
+        isPrivate: chatId !== 'all',
+        sender: AppState.localUsername,
+        recipient: chatId,
+        content,
+        contentFormat: 'markdown',
+        messageType: 'text',
+        timestamp: new Date().toISOString()
+    });
+    displayMessages();
+    setTimeout(() => {
+        // Sent by now: drop the placeholder and pick up the real message
+        AppState.pendingSends = AppState.pendingSends.filter(p => p.pendingId !== messageId);
+        loadMessages();
+        displayMessages();
+    }, windowMs + 1000);
+}
+
+function undoPendingSend(messageId) {
+    fetch(`/undo-send?messageId=${encodeURIComponent(messageId)}`, { method: 'POST' })
+        .then(r => {
+            if (r.status === 409) {
+                showToast('消息已发出，无法撤销', 'warning');
+                return;
+            }
+            if (!r.ok) throw new Error();
+            const pending = AppState.pendingSends.find(p => p.pendingId === messageId);
+            AppState.pendingSends = AppState.pendingSends.filter(p => p.pendingId !== messageId);
+            displayMessages();
+            // Put the text back so it can be edited and resent
+            const input = document.getElementById('messageInput');
+            if (pending && pending.chatId === AppState.currentChatId && input && input.value.trim() === '') {
+                input.value = pending.content;
+                input.focus();
+            }
+            showToast('已撤销发送', 'info');
+        })
+        .catch(() => showToast('撤销失败', 'error'));
+}
+
 function loadMessages() {
-    fetch('/messages')
+    const url = new URL('/messages', window.location.origin);
+    if (AppState.messagesSinceId && AppState.messagesRevision !== null) {
+        url.searchParams.append('since', AppState.messagesSinceId);
+        url.searchParams.append('rev', AppState.messagesRevision);
+    }
+    fetch(url)
         .then(r => r.json())
         .then(data => {
             const msgs = data.messages || [];
-            // Robust change detection: compare both length and last messageId
+            const revisionChanged = AppState.messagesRevision !== data.revision;
+            AppState.messagesRevision = data.revision;
+            if (msgs.length > 0) {
+                AppState.messagesSinceId = msgs[msgs.length - 1].messageId || '';
+            } else if (data.full) {
+                AppState.messagesSinceId = '';
+            }
+
+            if (data.full === false) {
+                // Incremental: append only messages not already pushed by events
+                const existingIds = new Set(AppState.allMessages.map(m => m.messageId).filter(Boolean));
+                const newMsgs = msgs.filter(m => !m.messageId || !existingIds.has(m.messageId));
+                if (newMsgs.length === 0) return;
+                AppState.allMessages.push(...newMsgs);
+                displayMessages();
+                renderChatList();
+                updateTitleBadge();
+                newMsgs.forEach(msg => {
+                    if (!msg.isOwn) notifyNewMessage(msg);
+                });
+                return;
+            }
+
+            // Full refresh. Robust change detection: compare both length and last messageId
             // (length alone fails when buffer is at capacity — add+trim keeps count equal)
             const newLastId = msgs.length > 0 ? msgs[msgs.length - 1].messageId : '';
             const oldLastId = AppState.allMessages.length > 0 ? AppState.allMessages[AppState.allMessages.length - 1].messageId : '';
-            if (msgs.length !== AppState.allMessages.length || newLastId !== oldLastId) {
+            if (revisionChanged || msgs.length !== AppState.allMessages.length || newLastId !== oldLastId) {
                 const oldLen = AppState.allMessages.length;
                 AppState.allMessages = msgs;
                 displayMessages();
@@ -1050,18 +1561,28 @@ function loadMessages() {
 }
 
 function loadHistory() {
-    if (!AppState.currentChatId) return;
+    if (!AppState.currentChatId || !AppState.historyHasMore || AppState.historyLoading) return;
 
+    const chatId = AppState.currentChatId;
+    const isInitialLoad = AppState.historyBeforeId === 0;
     const url = new URL('/loadhistory', window.location.origin);
-    url.searchParams.append('chatId', AppState.currentChatId);
-    url.searchParams.append('limit', HISTORY_LIMIT);
-    url.searchParams.append('offset', AppState.historyOffset);
+    url.searchParams.append('chatId', chatId);
+    // The first page uses the server's configured initialHistoryLimit
+    if (!isInitialLoad) {
+        url.searchParams.append('limit', HISTORY_LIMIT);
+        url.searchParams.append('beforeId', AppState.historyBeforeId);
+    }
 
+    AppState.historyLoading = true;
     fetch(url)
         .then(r => r.json())
         .then(data => {
+            // Chat switched while the request was in flight
+            if (chatId !== AppState.currentChatId) return;
+            AppState.historyBeforeId = data.nextBeforeId || 0;
+            AppState.historyHasMore = !!data.hasMore;
+
             if (data.messages && data.messages.length > 0) {
-                const isInitialLoad = AppState.historyOffset === 0;
                 // Deduplicate: only prepend history messages not already in allMessages
                 const existingIds = new Set(
                     AppState.allMessages.map(m => m.messageId).filter(Boolean)
@@ -1070,18 +1591,23 @@ function loadHistory() {
                     m => !m.messageId || !existingIds.has(m.messageId)
                 );
                 if (newMsgs.length > 0) {
+                    const container = document.getElementById('messages');
+                    const prevHeight = container.scrollHeight;
                     AppState.allMessages = newMsgs.concat(AppState.allMessages);
                     displayMessages();
                     renderChatList();
                     if (isInitialLoad) {
                         // Defer to ensure DOM is fully rendered after history prepend
-                        setTimeout(() => scrollToBottom(document.getElementById('messages')), 50);
+                        setTimeout(() => scrollToBottom(container), 50);
+                    } else {
+                        // Keep the viewport on the message that was at the top
+                        container.scrollTop += container.scrollHeight - prevHeight;
                     }
                 }
-                AppState.historyOffset += data.messages.length;
             }
         })
-        .catch(e => console.error('加载历史失败:', e));
+        .catch(e => console.error('加载历史失败:', e))
+        .finally(() => { AppState.historyLoading = false; });
 }
 
 function displayMessages() {
@@ -1097,9 +1623,14 @@ function displayMessages() {
              (msg.isOwn && msg.recipient === AppState.currentChatId));
     });
 
+    // Held messages already sent by the server are shown from allMessages instead
+    const sentIds = new Set(AppState.allMessages.map(m => m.messageId).filter(Boolean));
+    AppState.pendingSends = AppState.pendingSends.filter(p => !sentIds.has(p.pendingId));
+    const pending = AppState.pendingSends.filter(p => p.chatId === AppState.currentChatId);
+
     container.innerHTML = '';
 
-    if (filtered.length === 0) {
+    if (filtered.length === 0 && pending.length === 0) {
         const placeholder = document.createElement('div');
         placeholder.className = 'tg-msg-placeholder';
         placeholder.textContent = AppState.currentChatId === 'all'
@@ -1120,6 +1651,7 @@ function displayMessages() {
             }
             container.appendChild(createMessageElement(msg));
         });
+        pending.forEach(msg => container.appendChild(createMessageElement(msg)));
     }
 
     // Re-insert file transfer cards for this chat
@@ -1137,6 +1669,10 @@ function displayMessages() {
 }
 
 function createMessageElement(msg) {
+    const forwardedFrom = msg.messageType === 'forward' ? msg.forwardedFrom : '';
+    if (forwardedFrom !== '' || msg.messageType === 'forward') {
+        msg = { ...msg, messageType: forwardedKind(msg) };
+    }
     const row = document.createElement('div');
     row.className = `tg-msg-row ${msg.isOwn ? 'own' : 'other'}`;
     row.dataset.messageId = msg.messageId || '';
@@ -1147,14 +1683,16 @@ function createMessageElement(msg) {
     const inlineAvatar = document.createElement('div');
     inlineAvatar.className = 'tg-msg-avatar';
     const senderName = msg.isOwn ? AppState.localUsername : (msg.sender || '?');
-    inlineAvatar.style.background = isWisetalk ? '#0089ff' : getAvatarColor(senderName);
+    inlineAvatar.style.background = isWisetalk ? '#0089ff' : (msg.avatarColor || getAvatarColor(senderName));
     inlineAvatar.textContent = getAvatarLetter(senderName);
+    applyAvatarImage(inlineAvatar, senderName);
 
     // WiseTalk: name + time header above bubble
     const msgHeader = document.createElement('div');
     msgHeader.className = 'tg-msg-header';
     const ts = new Date(msg.timestamp);
-    const headerName = msg.isOwn ? AppState.localUsername : (msg.sender || '');
+    // displayName 为发送者本条消息的临时显示名，只影响展示；头像颜色与会话归属仍按真实用户名
+    const headerName = msg.displayName || (msg.isOwn ? AppState.localUsername : peerLabel(msg.sender || ''));
     const headerTime = `${ts.getMonth()+1}/${ts.getDate()} ${formatTime(ts)}`;
     if (msg.isOwn) {
         msgHeader.innerHTML = `<span class="tg-msg-header-time">${headerTime}</span> <span class="tg-msg-header-name">${escapeHtml(headerName)}</span>`;
@@ -1176,10 +1714,19 @@ function createMessageElement(msg) {
         const senderEl = document.createElement('div');
         senderEl.className = 'tg-msg-sender';
         senderEl.style.color = getAvatarColor(msg.sender);
-        senderEl.textContent = msg.sender;
+        senderEl.textContent = msg.displayName || peerLabel(msg.sender);
+        if (msg.displayName) senderEl.title = `临时显示名，实际用户: ${msg.sender}`;
         bubble.appendChild(senderEl);
     }
 
+    // Forwarded label
+    if (forwardedFrom) {
+        const fwd = document.createElement('div');
+        fwd.className = 'tg-msg-forwarded';
+        fwd.textContent = `转发自 ${forwardedFrom}`;
+        bubble.appendChild(fwd);
+    }
+
     // Reply quote
     if (msg.messageType === 'reply' && msg.replyToSender && msg.replyToContent) {
         const quote = document.createElement('div');
@@ -1188,6 +1735,7 @@ function createMessageElement(msg) {
             <div class="tg-reply-quote-name">${escapeHtml(msg.replyToSender)}</div>
             <div class="tg-reply-quote-text">${escapeHtml(msg.replyToContent.substring(0, 80))}${msg.replyToContent.length > 80 ? '...' : ''}</div>
         `;
+        bindReplyQuote(quote, msg.replyToId);
         bubble.appendChild(quote);
     }
 
@@ -1200,6 +1748,13 @@ function createMessageElement(msg) {
         img.alt = msg.fileName || '图片';
         img.loading = 'lazy';
         img.onclick = () => openImageModal(imageUrl);
+        // Link-only public images are downloaded from the sender; shown once available
+        img.onerror = () => {
+            const missing = document.createElement('div');
+            missing.className = 'tg-msg-image-missing';
+            missing.textContent = '🖼 图片暂不可用';
+            img.replaceWith(missing);
+        };
         bubble.appendChild(img);
         if (msg.content && !msg.content.startsWith('发送了图片')) {
             const cap = document.createElement('div');
@@ -1218,6 +1773,17 @@ function createMessageElement(msg) {
             </div>
         `;
         bubble.appendChild(fileDiv);
+        if (isLongTextMessage(msg)) {
+            fileDiv.classList.add('tg-msg-longtext');
+            const preview = document.createElement('div');
+            preview.className = 'tg-msg-longtext-preview';
+            preview.textContent = msg.content.substring(LONG_TEXT_PREFIX.length).trim();
+            const badge = document.createElement('span');
+            badge.className = 'tg-msg-longtext-badge';
+            badge.textContent = LONG_TEXT_PREFIX;
+            preview.prepend(badge);
+            bubble.appendChild(preview);
+        }
         // Inline file transfer actions (if fileId is available)
         if (msg.fileId) {
             const actionsDiv = document.createElement('div');
@@ -1231,6 +1797,15 @@ function createMessageElement(msg) {
             }
             bubble.appendChild(actionsDiv);
         }
+    } else if (msg.messageType === 'location') {
+        bubble.appendChild(createLocationCard(msg));
+    } else if (msg.content && msg.content.startsWith('emoji:gif-')) {
+        // GIF / custom sticker: served by id, synced from LAN peers if missing locally
+        const img = document.createElement('img');
+        img.className = 'tg-msg-sticker';
+        img.src = '/emoji-asset/' + encodeURIComponent(msg.content.substring('emoji:gif-'.length));
+        img.alt = '[表情]';
+        bubble.appendChild(img);
     } else if (msg.content && msg.content.startsWith('emoji:')) {
         // Legacy emoji:xxx format - show as [表情] text
         const text = document.createElement('div');
@@ -1241,25 +1816,56 @@ function createMessageElement(msg) {
         const text = document.createElement('div');
         text.className = 'tg-msg-text';
         const cleanContent = (msg.content || '').replace(/[\r\n\s]+$/, '');
-        text.innerHTML = wrapEmoji(renderMentions(escapeHtml(cleanContent)));
+        const escaped = escapeHtml(cleanContent);
+        text.innerHTML = wrapEmoji(msg.contentFormat === 'markdown' ? renderMarkdown(escaped) : renderMentions(escaped));
+        text.querySelectorAll('a.tg-md-link').forEach(a => {
+            a.addEventListener('click', (e) => {
+                e.preventDefault();
+                openExternalUrl(a.dataset.url);
+            });
+        });
         // Time span appended inside the block div — naturally inline, no display hacks
         const metaEl = document.createElement('span');
         metaEl.className = 'tg-msg-meta';
-        metaEl.innerHTML = `<span class="tg-msg-time">${formatTime(new Date(msg.timestamp))}</span>`;
+        metaEl.innerHTML = `<span class="tg-msg-time">${formatTime(new Date(msg.timestamp))}</span>${deliveryTickHtml(msg)}`;
         text.appendChild(metaEl);
         bubble.appendChild(text);
     }
 
     // Add time for non-text messages
-    if (msg.messageType === 'image' || msg.messageType === 'file' || isEmojiOnly) {
+    if (msg.messageType === 'image' || msg.messageType === 'file' || msg.messageType === 'location' || isEmojiOnly) {
         const timeEl = document.createElement('div');
         timeEl.style.cssText = 'text-align:right;margin-top:2px;';
-        timeEl.innerHTML = `<span class="tg-msg-time">${formatTime(new Date(msg.timestamp))}</span>`;
+        timeEl.innerHTML = `<span class="tg-msg-time">${formatTime(new Date(msg.timestamp))}</span>${deliveryTickHtml(msg)}`;
         bubble.appendChild(timeEl);
     }
 
     bubbleGroup.appendChild(bubble);
 
+    // Send failure marker (retry queue expired)
+    if (msg.isOwn && msg.failed) {
+        const failedEl = document.createElement('div');
+        failedEl.className = 'tg-msg-failed';
+        failedEl.textContent = '发送失败';
+        bubbleGroup.appendChild(failedEl);
+    }
+
+    // Held in the undo window (no messageId yet, so no reply/forward/pin buttons)
+    if (msg.pendingId) {
+        row.classList.add('pending');
+        const undoEl = document.createElement('div');
+        undoEl.className = 'tg-msg-undo';
+        undoEl.innerHTML = '<span>即将发送</span>';
+        const undoBtn = document.createElement('button');
+        undoBtn.textContent = '撤销';
+        undoBtn.onclick = (e) => {
+            e.stopPropagation();
+            undoPendingSend(msg.pendingId);
+        };
+        undoEl.appendChild(undoBtn);
+        bubbleGroup.appendChild(undoEl);
+    }
+
     // Assemble row: [avatar] [bubbleGroup] or [bubbleGroup] [avatar]
     if (msg.isOwn) {
         row.appendChild(bubbleGroup);
@@ -1282,12 +1888,230 @@ function createMessageElement(msg) {
         row.appendChild(replyBtn);
     }
 
+    // Forward button (on hover)
+    if (msg.messageId) {
+        const forwardBtn = document.createElement('button');
+        forwardBtn.className = 'tg-msg-reply-btn tg-msg-forward-btn';
+        forwardBtn.textContent = '↪';
+        forwardBtn.title = '转发';
+        forwardBtn.onclick = (e) => {
+            e.stopPropagation();
+            showForwardPicker(msg);
+        };
+        row.appendChild(forwardBtn);
+    }
+
+    // Pin button (on hover)
+    if (msg.messageId) {
+        const pinBtn = document.createElement('button');
+        pinBtn.className = 'tg-msg-reply-btn tg-msg-pin-btn';
+        pinBtn.textContent = '📌';
+        pinBtn.title = '置顶/取消置顶';
+        pinBtn.onclick = (e) => {
+            e.stopPropagation();
+            togglePinMessage(msg.messageId);
+        };
+        row.appendChild(pinBtn);
+    }
+
     return row;
 }
 
+// =================================
+// Pinned Messages
+// =================================
+function loadPinnedMessages() {
+    const chatId = AppState.currentChatId;
+    if (!chatId) return;
+    fetch(`/pin-message?chatId=${encodeURIComponent(chatId)}`)
+        .then(r => r.json())
+        .then(data => {
+            if (chatId !== AppState.currentChatId) return;
+            AppState.pinnedMessages = data.pins || [];
+            renderPinnedBar();
+        })
+        .catch(() => {});
+}
+
+function isMessagePinned(messageId) {
+    return AppState.pinnedMessages.some(p => p.messageId === messageId);
+}
+
+function renderPinnedBar() {
+    const bar = document.getElementById('pinnedBar');
+    const pins = AppState.pinnedMessages;
+    bar.innerHTML = '';
+    bar.style.display = pins.length > 0 ? '' : 'none';
+    // Most recently pinned first
+    pins.slice().reverse().forEach(pin => {
+        const m = pin.message || {};
+        const item = document.createElement('div');
+        item.className = 'tg-pinned-item';
+        item.title = `${peerLabel(pin.pinnedBy)} 置顶`;
+        const text = document.createElement('span');
+        text.className = 'tg-pinned-text';
+        const sender = m.isOwn ? '我' : (m.displayName || peerLabel(m.sender || ''));
+        text.textContent = `📌 ${sender}: ${getMessagePreview(m)}`;
+        text.onclick = () => {
+            if (!flashMessageRow(pin.messageId)) showToast('该消息不在已加载的记录中', 'info');
+        };
+        const unpinBtn = document.createElement('button');
+        unpinBtn.className = 'tg-pinned-close';
+        unpinBtn.textContent = '✕';
+        unpinBtn.title = '取消置顶';
+        unpinBtn.onclick = (e) => {
+            e.stopPropagation();
+            togglePinMessage(pin.messageId);
+        };
+        item.appendChild(text);
+        item.appendChild(unpinBtn);
+        bar.appendChild(item);
+    });
+}
+
+function togglePinMessage(messageId) {
+    const chatId = AppState.currentChatId;
+    const pinned = isMessagePinned(messageId);
+    fetch(pinned ? '/unpin-message' : '/pin-message', {
+        method: 'POST',
+        headers: { 'Content-Type': 'application/json' },
+        body: JSON.stringify({ chatId, messageId })
+    })
+    .then(async r => {
+        if (!r.ok) throw new Error((await r.text()).trim());
+        loadPinnedMessages();
+        showToast(pinned ? '已取消置顶' : '已置顶消息', 'success');
+    })
+    .catch(err => showToast(err.message || '置顶失败', 'error'));
+}
+
+// =================================
+// Forward
+// =================================
+function showForwardPicker(msg) {
+    const targets = ['all', ...new Set([...AppState.onlineUsers, ...AppState.knownPartners])]
+        .filter(t => t && t !== AppState.localUsername);
+
+    const overlay = document.createElement('div');
+    overlay.className = 'tg-dialog-overlay';
+    overlay.style.display = 'flex';
+    const box = document.createElement('div');
+    box.className = 'tg-dialog-box';
+    const title = document.createElement('div');
+    title.className = 'tg-alert-message';
+    title.textContent = '转发给';
+    box.appendChild(title);
+
+    const list = document.createElement('div');
+    list.className = 'tg-forward-list';
+    const hide = () => {
+        overlay.classList.remove('visible');
+        setTimeout(() => overlay.remove(), 200);
+    };
+    targets.forEach(target => {
+        const item = document.createElement('button');
+        item.className = 'tg-forward-item';
+        const online = target === 'all' || AppState.onlineUsers.includes(target);
+        item.textContent = target === 'all' ? '公共聊天' : target + (online ? '' : '（离线）');
+        item.onclick = () => {
+            hide();
+            forwardMessage(msg.messageId, target);
+        };
+        list.appendChild(item);
+    });
+    box.appendChild(list);
+
+    const buttons = document.createElement('div');
+    buttons.className = 'tg-dialog-buttons';
+    const cancel = document.createElement('button');
+    cancel.className = 'tg-dialog-btn reject';
+    cancel.textContent = '取消';
+    cancel.onclick = hide;
+    buttons.appendChild(cancel);
+    box.appendChild(buttons);
+
+    overlay.appendChild(box);
+    overlay.onclick = (e) => { if (e.target === overlay) hide(); };
+    document.body.appendChild(overlay);
+    setTimeout(() => overlay.classList.add('visible'), 10);
+}
+
+function forwardMessage(messageId, targetName) {
+    fetch('/forward', {
+        method: 'POST',
+        headers: { 'Content-Type': 'application/json' },
+        body: JSON.stringify({ messageId, targetName })
+    })
+    .then(async r => {
+        if (!r.ok) throw new Error((await r.text()).trim() || '转发失败');
+        showToast('已转发', 'success');
+        loadMessages();
+    })
+    .catch(err => showToast(err.message || '转发失败', 'error'));
+}
+
 // =================================
 // Reply
 // =================================
+// Reply quote click: scroll to the original message when it is loaded in the chat,
+// otherwise fetch it (GET /message/{id}) and expand it below the quote. An expanded
+// original that is itself a reply shows its own quote, so the chain can be followed.
+function bindReplyQuote(quote, replyToId) {
+    if (!replyToId) return;
+    quote.title = '查看原消息';
+    quote.onclick = (e) => {
+        e.stopPropagation();
+        if (flashMessageRow(replyToId)) return;
+        expandReplyChain(quote, replyToId);
+    };
+}
+
+// Scroll to a rendered message and highlight it; false if it is not in the list
+function flashMessageRow(messageId) {
+    const row = document.querySelector(`.tg-msg-row[data-message-id="${CSS.escape(messageId)}"]`);
+    if (!row) return false;
+    row.scrollIntoView({ block: 'center', behavior: 'smooth' });
+    row.classList.add('tg-msg-flash');
+    setTimeout(() => row.classList.remove('tg-msg-flash'), 1500);
+    return true;
+}
+
+function expandReplyChain(quote, messageId) {
+    // Second click collapses
+    const next = quote.nextElementSibling;
+    if (next && next.classList.contains('tg-reply-chain')) {
+        next.remove();
+        return;
+    }
+    fetch('/message/' + encodeURIComponent(messageId))
+        .then(r => r.json())
+        .then(data => {
+            const m = data.message || {};
+            const item = document.createElement('div');
+            item.className = 'tg-reply-chain' + (data.found ? '' : ' deleted');
+            if (!data.found) {
+                item.innerHTML = `<div class="tg-reply-chain-text">${escapeHtml(m.content || '原消息已删除')}</div>`;
+            } else {
+                item.innerHTML = `
+                    <div class="tg-reply-quote-name">${escapeHtml(m.sender || '')}</div>
+                    <div class="tg-reply-chain-text">${escapeHtml(getMessagePreview(m))}</div>
+                `;
+                if (m.messageType === 'reply' && m.replyToId && m.replyToSender) {
+                    const inner = document.createElement('div');
+                    inner.className = 'tg-reply-quote';
+                    inner.innerHTML = `
+                        <div class="tg-reply-quote-name">${escapeHtml(m.replyToSender)}</div>
+                        <div class="tg-reply-quote-text">${escapeHtml((m.replyToContent || '').substring(0, 80))}</div>
+                    `;
+                    bindReplyQuote(inner, m.replyToId);
+                    item.insertBefore(inner, item.firstChild);
+                }
+            }
+            quote.after(item);
+        })
+        .catch(err => console.error('Load quoted message failed:', err));
+}
+
 function replyToMessage(msg) {
     AppState.replyingTo = {
         id: msg.messageId,
@@ -1311,7 +2135,8 @@ function cancelReply() {
 function sendReplyMessage(replyContent) {
     if (!AppState.replyingTo) return;
 
-    const targetName = AppState.currentChatId === 'all' ? 'all' : AppState.currentChatId;
+    const chatId = AppState.currentChatId;
+    const targetName = chatId === 'all' ? 'all' : chatId;
 
     fetch('/sendreply', {
         method: 'POST',
@@ -1326,6 +2151,7 @@ function sendReplyMessage(replyContent) {
     })
     .then(r => {
         if (r.ok) {
+            clearDraft(chatId);
             document.getElementById('messageInput').value = '';
             cancelReply();
         } else {
@@ -1342,15 +2168,23 @@ function loadUsers() {
     fetch('/users')
         .then(r => r.json())
         .then(data => {
-            const users = data.users || [];
-            const selfUser = users.find(u => u.includes('(自己)'));
+            const users = data.userList || [];
+            const selfUser = users.find(u => u.isSelf);
             if (selfUser) {
-                AppState.localUsername = selfUser.replace(' (自己)', '').trim();
+                AppState.localUsername = selfUser.name;
             }
 
             const onlineNames = users
-                .filter(u => !u.includes('(自己)'))
-                .map(u => u.split(' ')[0]);
+                .filter(u => !u.isSelf && u.isOnline)
+                .map(u => u.name);
+            users.forEach(u => { if (u.lastActive) AppState.chatLastActive[u.name] = u.lastActive; });
+            AppState.peerAliases = {};
+            users.forEach(u => { if (u.alias) AppState.peerAliases[u.name] = u.alias; });
+            users.forEach(u => {
+                // Offline users have no avatar hash; keep the last one seen this session
+                const prev = AppState.peerAvatars[u.name];
+                AppState.peerAvatars[u.name] = { color: u.avatarColor, hash: u.avatarHash || (!u.isOnline && prev ? prev.hash : '') };
+            });
 
             // Detect online/offline changes (browser mode only; Wails uses events)
             if (!AppState.isWails && !AppState.isFirstUserLoad) {
@@ -1378,15 +2212,40 @@ function loadUsers() {
 
             renderChatList();
             updateUserSelect();
+            loadPeerLatency();
         })
         .catch(e => console.error('加载用户失败:', e));
 }
 
+function loadPeerLatency() {
+    fetch('/peers')
+        .then(r => r.json())
+        .then(data => {
+            const latency = {};
+            (data.peers || []).forEach(p => { latency[p.name] = p; });
+            AppState.peerLatency = latency;
+            renderChatList();
+            if (AppState.currentChatId) updateConversationHeader();
+        })
+        .catch(() => {});
+}
+
+// Signal bars for a peer's connection quality (good/fair/poor)
+const SIGNAL_BARS = { good: '▂▄▆', fair: '▂▄', poor: '▂' };
+
 function loadChatPartners() {
     fetch('/chatpartners')
         .then(r => r.json())
         .then(data => {
             AppState.knownPartners = data.partners || [];
+            AppState.pinnedChats = data.pinned || [];
+            AppState.serverUnread = {};
+            (data.chats || []).forEach(c => {
+                if (c.lastActive) AppState.chatLastActive[c.chatId] = c.lastActive;
+                if (c.unread && c.chatId !== AppState.currentChatId) {
+                    AppState.serverUnread[c.chatId] = c.unread;
+                }
+            });
             renderChatList();
         })
         .catch(e => console.error('加载聊天伙伴失败:', e));
@@ -1433,26 +2292,68 @@ async function loadBlockedUsers() {
     }
 }
 
+async function loadMutedChats() {
+    try {
+        const r = await fetch('/mute');
+        const data = await r.json();
+        AppState.mutedChats = new Set(data.muted || []);
+    } catch {
+        AppState.mutedChats = new Set();
+    }
+}
+
+function toggleMuteChat(chatId) {
+    const isMuted = AppState.mutedChats.has(chatId);
+    fetch(isMuted ? '/unmute' : '/mute', {
+        method: 'POST',
+        headers: { 'Content-Type': 'application/json' },
+        body: JSON.stringify({ chatId })
+    })
+    .then(r => {
+        if (!r.ok) throw new Error();
+        if (isMuted) AppState.mutedChats.delete(chatId);
+        else AppState.mutedChats.add(chatId);
+        renderChatList();
+        showToast(isMuted ? '已取消免打扰' : '已开启免打扰', 'success');
+    })
+    .catch(() => showToast('设置免打扰失败', 'error'));
+}
+
+function togglePinChat(chatId) {
+    const isPinned = AppState.pinnedChats.includes(chatId);
+    fetch(isPinned ? '/unpin-chat' : '/pin-chat', {
+        method: 'POST',
+        headers: { 'Content-Type': 'application/json' },
+        body: JSON.stringify({ chatId })
+    })
+    .then(r => {
+        if (!r.ok) throw new Error();
+        if (isPinned) AppState.pinnedChats = AppState.pinnedChats.filter(id => id !== chatId);
+        else AppState.pinnedChats.push(chatId);
+        renderChatList();
+        showToast(isPinned ? '已取消置顶' : '已置顶', 'success');
+    })
+    .catch(() => showToast('设置置顶失败', 'error'));
+}
+
 function blockUser(username) {
     const isBlocked = AppState.blockedUsers.has(username);
-    const command = isBlocked ? `/unblock ${username}` : `/block ${username}`;
     const action = isBlocked ? '解除屏蔽' : '屏蔽';
 
-    fetch('/send', {
+    fetch(isBlocked ? '/unblock' : '/block', {
         method: 'POST',
         headers: { 'Content-Type': 'application/json' },
-        body: JSON.stringify({ message: command })
+        body: JSON.stringify({ target: username })
     })
     .then(r => {
-        if (r.ok) {
-            loadBlockedUsers().then(() => {
-                loadUsers();
-                updateConversationHeader();
-                showToast(`${action} ${username} 成功`, 'success');
-            });
-        } else {
-            throw new Error(`${action}失败`);
-        }
+        if (!r.ok) throw new Error(`${action}失败`);
+        return r.json();
+    })
+    .then(data => {
+        AppState.blockedUsers = new Set(data.blocked || []);
+        loadUsers();
+        updateConversationHeader();
+        showToast(`${action} ${username} 成功`, 'success');
     })
     .catch(() => showToast(`${action}失败`, 'error'));
 }
@@ -1464,11 +2365,12 @@ function notifyNewMessage(msg) {
     if (!AppState.settings.msgNotify) return;
 
     const chatId = msg.isPrivate ? msg.sender : 'all';
+    if (AppState.mutedChats.has(chatId)) return;
 
     // Don't notify for current active chat
     if (chatId === AppState.currentChatId && document.hasFocus()) return;
 
-    const senderName = msg.sender || '未知';
+    const senderName = msg.displayName || peerLabel(msg.sender || '') || '未知';
     const preview = getMessagePreview(msg).substring(0, 60);
 
     // Browser notification
@@ -1755,7 +2657,14 @@ function loadGifEmojis() {
             AppState.gifEmojis.push({ char: ch, name: cat.name, type: 'native' });
         });
     });
-    return Promise.resolve();
+    return loadCustomEmojis();
+}
+
+function loadCustomEmojis() {
+    return fetch('/emoji-gifs-list')
+        .then(r => r.json())
+        .then(list => { AppState.customEmojis = (list || []).filter(e => e.custom); })
+        .catch(() => { AppState.customEmojis = []; });
 }
 
 function createEmojiGrid() {
@@ -1777,6 +2686,17 @@ function createEmojiGrid() {
         });
         tabs.appendChild(tab);
     });
+    // Custom stickers tab (last)
+    const customTab = document.createElement('button');
+    customTab.className = 'tg-emoji-tab';
+    customTab.textContent = '⭐';
+    customTab.title = '自定义表情';
+    customTab.addEventListener('click', () => {
+        tabs.querySelectorAll('.tg-emoji-tab').forEach(t => t.classList.remove('active'));
+        customTab.classList.add('active');
+        showCustomEmojis();
+    });
+    tabs.appendChild(customTab);
     picker.appendChild(tabs);
 
     // Grid container
@@ -1814,6 +2734,82 @@ function showEmojiCategory(catIdx) {
 
 // sendEmojiMessage is no longer used - native emoji chars are inserted directly into the input field
 
+function showCustomEmojis() {
+    const grid = document.getElementById('emojiGrid');
+    if (!grid) return;
+    grid.innerHTML = '';
+    AppState.customEmojis.forEach(e => {
+        const item = document.createElement('div');
+        item.className = 'tg-emoji-item tg-emoji-custom';
+        item.title = e.name;
+        const img = document.createElement('img');
+        img.src = '/emoji-asset/' + encodeURIComponent(e.id);
+        img.alt = e.name;
+        item.appendChild(img);
+        item.addEventListener('click', () => {
+            document.getElementById('emojiPicker').style.display = 'none';
+            sendCustomEmoji(e.id);
+        });
+        grid.appendChild(item);
+    });
+
+    const add = document.createElement('div');
+    add.className = 'tg-emoji-item tg-emoji-custom add';
+    add.textContent = '+';
+    add.title = '添加表情（GIF/PNG/JPG/WebP，不超过 2 MB）';
+    add.addEventListener('click', () => {
+        const input = document.createElement('input');
+        input.type = 'file';
+        input.accept = 'image/gif,image/png,image/jpeg,image/webp';
+        input.onchange = () => { if (input.files[0]) uploadCustomEmoji(input.files[0]); };
+        input.click();
+    });
+    grid.appendChild(add);
+}
+
+function uploadCustomEmoji(file) {
+    const reader = new FileReader();
+    reader.onload = () => {
+        fetch('/upload-emoji', {
+            method: 'POST',
+            headers: { 'Content-Type': 'application/json' },
+            body: JSON.stringify({
+                file: reader.result.split(',')[1],
+                name: file.name.replace(/\.[^.]+$/, '')
+            })
+        })
+        .then(async r => {
+            if (!r.ok) throw new Error((await r.text()).trim() || '添加表情失败');
+            AppState.customEmojis.push(await r.json());
+            showCustomEmojis();
+        })
+        .catch(err => showToast(err.message || '添加表情失败', 'error'));
+    };
+    reader.readAsDataURL(file);
+}
+
+function sendCustomEmoji(id) {
+    if (!AppState.currentChatId) {
+        showToast('请先选择一个聊天', 'warning');
+        return;
+    }
+    const chatId = AppState.currentChatId;
+    if (chatId !== 'all' && AppState.blockedUsers.has(chatId)) {
+        showToast(`请先解除对 ${chatId} 的屏蔽`, 'warning');
+        return;
+    }
+    fetch('/send', {
+        method: 'POST',
+        headers: { 'Content-Type': 'application/json' },
+        body: JSON.stringify({ message: 'emoji:gif-' + id, targetName: chatId === 'all' ? '' : chatId })
+    })
+    .then(r => {
+        if (!r.ok) throw new Error();
+        loadMessages();
+    })
+    .catch(() => showToast('发送表情失败', 'error'));
+}
+
 function showEmojiAlert(message) {
     const dialog = document.getElementById('emoji-alert-dialog');
     document.getElementById('alert-message').textContent = message;
@@ -1849,6 +2845,33 @@ function showConfirm(message) {
     });
 }
 
+// In-app prompt dialog (replaces browser prompt()); resolves with the text, or null when cancelled
+function showPrompt(message, value = '') {
+    return new Promise((resolve) => {
+        const dialog = document.getElementById('promptDialog');
+        const input = document.getElementById('promptInput');
+        document.getElementById('promptMessage').textContent = message;
+        input.value = value;
+        dialog.style.display = 'flex';
+        setTimeout(() => { dialog.classList.add('visible'); input.focus(); input.select(); }, 10);
+
+        const hide = (result) => {
+            dialog.classList.remove('visible');
+            setTimeout(() => dialog.style.display = 'none', 200);
+            input.onkeydown = null;
+            resolve(result);
+        };
+
+        document.getElementById('promptOkBtn').onclick = () => hide(input.value);
+        document.getElementById('promptCancelBtn').onclick = () => hide(null);
+        input.onkeydown = (e) => {
+            if (e.key === 'Enter') hide(input.value);
+            else if (e.key === 'Escape') hide(null);
+        };
+        dialog.onclick = (e) => { if (e.target === dialog) hide(null); };
+    });
+}
+
 // =================================
 // File Transfer
 // =================================
@@ -1924,6 +2947,12 @@ function initAttachMenu() {
         }
     });
 
+    document.getElementById('attachLocationBtn').addEventListener('click', () => {
+        menu.style.display = 'none';
+        if (!AppState.currentChatId) return;
+        sendLocation(AppState.currentChatId);
+    });
+
     document.addEventListener('click', (e) => {
         if (!menu.contains(e.target) && !attachBtn.contains(e.target)) {
             menu.style.display = 'none';
@@ -1931,6 +2960,85 @@ function initAttachMenu() {
     });
 }
 
+// =================================
+// Location Messages
+// =================================
+function locationMapUrl(lat, lon) {
+    return `https://www.openstreetmap.org/?mlat=${lat}&mlon=${lon}#map=17/${lat}/${lon}`;
+}
+
+function openExternalUrl(url) {
+    if (AppState.isWails && window.runtime) {
+        window.runtime.BrowserOpenURL(url);
+    } else {
+        window.open(url, '_blank', 'noopener');
+    }
+}
+
+// Clickable card for a location message; opens the coordinates on a map
+function createLocationCard(msg) {
+    const lat = Number(msg.latitude) || 0;
+    const lon = Number(msg.longitude) || 0;
+    const card = document.createElement('div');
+    card.className = 'tg-msg-location';
+    card.title = '在地图中打开';
+    card.innerHTML = `
+        <div class="tg-msg-location-icon">📍</div>
+        <div class="tg-msg-location-info">
+            <div class="tg-msg-location-name">${escapeHtml(msg.locationName || '位置')}</div>
+            <div class="tg-msg-location-coords">${lat.toFixed(6)}, ${lon.toFixed(6)}</div>
+        </div>
+    `;
+    card.onclick = () => openExternalUrl(locationMapUrl(lat, lon));
+    return card;
+}
+
+// Ask for a place name and coordinates; resolves null when cancelled
+function showLocationDialog() {
+    return new Promise((resolve) => {
+        const dialog = document.getElementById('locationDialog');
+        const nameInput = document.getElementById('locationName');
+        const latInput = document.getElementById('locationLat');
+        const lonInput = document.getElementById('locationLon');
+        nameInput.value = '';
+        latInput.value = '';
+        lonInput.value = '';
+        dialog.style.display = 'flex';
+        setTimeout(() => { dialog.classList.add('visible'); nameInput.focus(); }, 10);
+
+        const hide = (result) => {
+            dialog.classList.remove('visible');
+            setTimeout(() => dialog.style.display = 'none', 200);
+            resolve(result);
+        };
+
+        document.getElementById('locationOkBtn').onclick = () => {
+            const lat = parseFloat(latInput.value);
+            const lon = parseFloat(lonInput.value);
+            if (isNaN(lat) || lat < -90 || lat > 90 || isNaN(lon) || lon < -180 || lon > 180) {
+                showToast('请输入有效的经纬度', 'warning');
+                return;
+            }
+            hide({ latitude: lat, longitude: lon, locationName: nameInput.value.trim() });
+        };
+        document.getElementById('locationCancelBtn').onclick = () => hide(null);
+        dialog.onclick = (e) => { if (e.target === dialog) hide(null); };
+    });
+}
+
+function sendLocation(targetName) {
+    showLocationDialog().then(loc => {
+        if (!loc) return;
+        return fetch('/sendlocation', {
+            method: 'POST',
+            headers: { 'Content-Type': 'application/json' },
+            body: JSON.stringify({ targetName, ...loc })
+        }).then(async r => {
+            if (!r.ok) throw new Error((await r.text()).trim() || '发送失败');
+        });
+    }).catch(err => showToast('位置发送失败: ' + err.message, 'error'));
+}
+
 function updateUserSelect() {
     const select = document.getElementById('fileTargetUser');
     const current = select.value;
@@ -2020,7 +3128,7 @@ let _fileTransferPollTimer = null;
 function startFileTransferPolling() {
     // Adaptive polling: 500ms during active transfers, 3s otherwise
     const hasActive = AppState.fileTransfers.some(t =>
-        t.status === 'transferring' || t.status === 'pending');
+        t.status === 'transferring' || t.status === 'stalled' || t.status === 'pending');
     const interval = hasActive ? 500 : 3000;
 
     clearTimeout(_fileTransferPollTimer);
@@ -2052,6 +3160,14 @@ function loadFileTransfers() {
                 }
             });
 
+            // Request not answered in time (sender side)
+            transfers.filter(t => t.status === 'timeout' && t.direction === 'send').forEach(t => {
+                if (!AppState.shownFailedTransfers.has(t.fileId)) {
+                    insertSystemMessage(`对方未响应文件传输请求: ${t.fileName}`, t.peerName);
+                    AppState.shownFailedTransfers.add(t.fileId);
+                }
+            });
+
             // Completed → tracked for inline button updates
             transfers.filter(t => t.status === 'completed').forEach(t => {
                 if (!AppState.shownCompletedTransfers.has(t.fileId)) {
@@ -2102,7 +3218,7 @@ function renderFileTransferCards() {
                         <span class="tg-file-card-title">文件接收中</span>
                     </div>
                     <div class="tg-file-card-body">
-                        <div class="tg-file-card-name">${escapeHtml(t.fileName)}</div>
+                        <div class="tg-file-card-name"><span class="tg-file-card-type" title="${escapeHtml(t.fileType || '')}">${getFileIcon(t.fileType, t.fileIcon)}</span>${escapeHtml(t.fileName)}</div>
                         <div class="tg-file-card-size">${formatBytes(t.fileSize)}</div>
                     </div>
                     <div class="tg-file-card-actions">
@@ -2120,7 +3236,7 @@ function renderFileTransferCards() {
                         <span class="tg-file-card-title">文件传输失败</span>
                     </div>
                     <div class="tg-file-card-body">
-                        <div class="tg-file-card-name">${escapeHtml(t.fileName)}</div>
+                        <div class="tg-file-card-name"><span class="tg-file-card-type" title="${escapeHtml(t.fileType || '')}">${getFileIcon(t.fileType, t.fileIcon)}</span>${escapeHtml(t.fileName)}</div>
                         <div class="tg-file-card-size">${formatBytes(t.fileSize)}</div>
                     </div>
                     <div class="tg-file-card-actions">
@@ -2153,7 +3269,7 @@ function renderFileTransferCards() {
                     <span class="tg-file-card-title">${title}</span>
                 </div>
                 <div class="tg-file-card-body">
-                    <div class="tg-file-card-name">${escapeHtml(t.fileName)}</div>
+                    <div class="tg-file-card-name"><span class="tg-file-card-type" title="${escapeHtml(t.fileType || '')}">${getFileIcon(t.fileType, t.fileIcon)}</span>${escapeHtml(t.fileName)}</div>
                     <div class="tg-file-card-size">${formatBytes(t.fileSize)}</div>
                 </div>
                 <div class="tg-file-card-actions">${statusHtml}</div>
@@ -2185,8 +3301,9 @@ function insertFileRequestCard(transfer) {
             <span class="tg-file-card-title">文件接收请求</span>
         </div>
         <div class="tg-file-card-body">
-            <div class="tg-file-card-name">${escapeHtml(transfer.fileName)}</div>
-            <div class="tg-file-card-size">${formatBytes(transfer.fileSize)}</div>
+            <div class="tg-file-card-name"><span class="tg-file-card-type" title="${escapeHtml(transfer.fileType || '')}">${getFileIcon(transfer.fileType, transfer.fileIcon)}</span>${escapeHtml(transfer.fileName)}</div>
+            <div class="tg-file-card-size">${formatBytes(transfer.fileSize)}${transfer.fileType ? ' · ' + escapeHtml(transfer.fileType) : ''}</div>
+            ${transfer.isExecutable ? EXEC_WARNING_HTML : ''}
         </div>
         <div class="tg-file-card-actions" data-file-id="${transfer.fileId}">
             <button class="tg-file-card-btn reject">拒绝</button>
@@ -2195,7 +3312,8 @@ function insertFileRequestCard(transfer) {
     `;
 
     // Bind buttons
-    card.querySelector('.tg-file-card-btn.accept').onclick = () => respondToFileCard(transfer.fileId, true);
+    card.querySelector('.tg-file-card-btn.accept').onclick = () => confirmExecutableAccept(transfer)
+        .then(ok => { if (ok) respondToFileCard(transfer.fileId, true); });
     card.querySelector('.tg-file-card-btn.reject').onclick = () => respondToFileCard(transfer.fileId, false);
 
     container.appendChild(card);
@@ -2253,6 +3371,8 @@ function renderFileCardUpdates(transfers) {
             const pct = transfer.fileSize > 0 ? (transfer.progress / transfer.fileSize * 100) : 0;
             const progressText = `${pct.toFixed(0)}% · ${formatBytes(transfer.progress)}/${formatBytes(transfer.fileSize)}${transfer.speed > 0 ? ' · ' + formatSpeed(transfer.speed) : ''}`;
             actions.innerHTML = `<span class="tg-file-card-status transferring">${progressText}</span>`;
+        } else if (transfer.status === 'stalled') {
+            actions.innerHTML = `<span class="tg-file-card-status stalled">${stalledText(transfer)}</span>`;
         } else if (transfer.status === 'completed' && !card.classList.contains('completed')) {
             card.classList.add('completed');
             card.querySelector('.tg-file-card-icon').textContent = '✅';
@@ -2266,6 +3386,7 @@ function renderFileCardUpdates(transfers) {
                     body.appendChild(pathEl);
                 }
                 actions.innerHTML = `
+                    ${receivedFileLinkHtml(fileId, 'tg-file-card-btn')}
                     <button class="tg-file-card-btn open-file">打开文件</button>
                     <button class="tg-file-card-btn open-folder">打开文件夹</button>
                 `;
@@ -2279,31 +3400,31 @@ function renderFileCardUpdates(transfers) {
             card.querySelector('.tg-file-card-icon').textContent = '❌';
             card.querySelector('.tg-file-card-title').textContent = '文件传输失败';
             actions.innerHTML = '<span class="tg-file-card-status failed">传输失败</span>';
+        } else if (transfer.status === 'timeout') {
+            actions.innerHTML = '<span class="tg-file-card-status rejected">请求已过期</span>';
         }
     });
 }
 
 function respondToFileCard(fileId, accepted) {
-    const card = document.querySelector(`.tg-file-card[data-file-id="${fileId}"]`);
-    if (card) {
-        const actions = card.querySelector('.tg-file-card-actions');
-        actions.innerHTML = `<span class="tg-file-card-status ${accepted ? 'transferring' : 'rejected'}">${accepted ? '已接受，等待传输...' : '已拒绝'}</span>`;
-    }
-
-    fetch('/fileresponse', {
-        method: 'POST',
-        headers: { 'Content-Type': 'application/json' },
-        body: JSON.stringify({ fileId, accepted })
-    })
-    .then(r => {
-        if (!r.ok) throw new Error();
-    })
-    .catch(() => showToast('发送响应失败', 'error'));
+    inlineRespondToFileTransfer(fileId, accepted);
 }
 
 // =================================
 // Inline File Transfer Actions
 // =================================
+// Browser mode saves received files to the default folder on the host; offer a download link
+function receivedFileLinkHtml(fileId, cls) {
+    if (AppState.isWails) return '';
+    return `<a class="${cls}" href="/received-file?id=${encodeURIComponent(fileId)}" download>下载</a>`;
+}
+
+// Transfer with no progress for a while; the backend fails it if it doesn't recover
+function stalledText(transfer) {
+    const pct = transfer.fileSize > 0 ? (transfer.progress / transfer.fileSize * 100) : 0;
+    return `${pct.toFixed(0)}% · 传输停滞，等待恢复...`;
+}
+
 function renderSenderFileActions(container, transfer, fileId) {
     if (!transfer || transfer.status === 'pending') {
         container.innerHTML = `
@@ -2318,32 +3439,45 @@ function renderSenderFileActions(container, transfer, fileId) {
             <button class="tg-msg-file-btn cancel">取消</button>
         `;
         container.querySelector('.cancel').onclick = () => inlineCancelFileTransfer(fileId);
+    } else if (transfer.status === 'stalled') {
+        container.innerHTML = `
+            <span class="tg-msg-file-status stalled">${stalledText(transfer)}</span>
+            <button class="tg-msg-file-btn cancel">取消</button>
+        `;
+        container.querySelector('.cancel').onclick = () => inlineCancelFileTransfer(fileId);
     } else if (transfer.status === 'completed') {
         container.innerHTML = `<span class="tg-msg-file-status completed">已发送</span>`;
     } else if (transfer.status === 'cancelled') {
         container.innerHTML = `<span class="tg-msg-file-status cancelled">已取消</span>`;
     } else if (transfer.status === 'failed') {
         container.innerHTML = `<span class="tg-msg-file-status failed">发送失败</span>`;
+    } else if (transfer.status === 'timeout') {
+        container.innerHTML = `<span class="tg-msg-file-status cancelled">对方未响应</span>`;
     }
 }
 
 function renderReceiverFileActions(container, transfer, fileId) {
     if (!transfer || transfer.status === 'pending') {
         container.innerHTML = `
+            ${transfer && transfer.isExecutable ? EXEC_WARNING_HTML : ''}
             <button class="tg-msg-file-btn accept">接受</button>
             <button class="tg-msg-file-btn reject">拒绝</button>
         `;
-        container.querySelector('.accept').onclick = () => inlineRespondToFileTransfer(fileId, true);
+        container.querySelector('.accept').onclick = () => confirmExecutableAccept(transfer)
+            .then(ok => { if (ok) inlineRespondToFileTransfer(fileId, true); });
         container.querySelector('.reject').onclick = () => inlineRespondToFileTransfer(fileId, false);
     } else if (transfer.status === 'transferring') {
         const pct = transfer.fileSize > 0 ? (transfer.progress / transfer.fileSize * 100) : 0;
         container.innerHTML = `<span class="tg-msg-file-status transferring">${pct.toFixed(0)}% · ${formatBytes(transfer.progress)}/${formatBytes(transfer.fileSize)}${transfer.speed > 0 ? ' · ' + formatSpeed(transfer.speed) : ''}</span>`;
+    } else if (transfer.status === 'stalled') {
+        container.innerHTML = `<span class="tg-msg-file-status stalled">${stalledText(transfer)}</span>`;
     } else if (transfer.status === 'completed') {
         if (transfer.savePath) {
             container.innerHTML = `
                 <div class="tg-msg-file-path">${escapeHtml(transfer.savePath)}</div>
                 <div class="tg-msg-file-actions-row">
                     <span class="tg-msg-file-status completed">已接收</span>
+                    ${receivedFileLinkHtml(fileId, 'tg-msg-file-btn')}
                     <button class="tg-msg-file-btn open-file">打开</button>
                     <button class="tg-msg-file-btn open-folder">文件夹</button>
                 </div>
@@ -2357,6 +3491,8 @@ function renderReceiverFileActions(container, transfer, fileId) {
         container.innerHTML = `<span class="tg-msg-file-status cancelled">对方已取消</span>`;
     } else if (transfer.status === 'failed') {
         container.innerHTML = `<span class="tg-msg-file-status failed">传输失败</span>`;
+    } else if (transfer.status === 'timeout') {
+        container.innerHTML = `<span class="tg-msg-file-status cancelled">请求已过期</span>`;
     }
 }
 
@@ -2377,7 +3513,33 @@ function inlineCancelFileTransfer(fileId) {
 }
 
 function inlineRespondToFileTransfer(fileId, accepted) {
-    // Immediately update inline UI
+    // Desktop: choose where to save first; cancelling the dialog keeps the request pending
+    if (accepted && AppState.isWails) {
+        window.go.main.DesktopApp.AcceptFileTransfer(fileId)
+            .then(ok => {
+                if (!ok) return;
+                showFileResponded(fileId, true);
+                loadFileTransfers();
+            })
+            .catch(() => showToast('接收文件失败', 'error'));
+        return;
+    }
+
+    showFileResponded(fileId, accepted);
+    fetch('/fileresponse', {
+        method: 'POST',
+        headers: { 'Content-Type': 'application/json' },
+        body: JSON.stringify({ fileId, accepted })
+    })
+    .then(r => {
+        if (!r.ok) throw new Error();
+        loadFileTransfers();
+    })
+    .catch(() => showToast('发送响应失败', 'error'));
+}
+
+// Replace accept/reject buttons with the response, before the next transfer poll
+function showFileResponded(fileId, accepted) {
     const el = document.querySelector(`.tg-msg-file-actions[data-file-id="${fileId}"]`);
     if (el) {
         el.innerHTML = `<span class="tg-msg-file-status ${accepted ? 'transferring' : 'cancelled'}">${accepted ? '已接受，等待传输...' : '已拒绝'}</span>`;
@@ -2391,17 +3553,6 @@ function inlineRespondToFileTransfer(fileId, accepted) {
             actions.innerHTML = `<span class="tg-file-card-status ${accepted ? 'transferring' : 'rejected'}">${accepted ? '已接受，等待传输...' : '已拒绝'}</span>`;
         }
     }
-
-    fetch('/fileresponse', {
-        method: 'POST',
-        headers: { 'Content-Type': 'application/json' },
-        body: JSON.stringify({ fileId, accepted })
-    })
-    .then(r => {
-        if (!r.ok) throw new Error();
-        loadFileTransfers();
-    })
-    .catch(() => showToast('发送响应失败', 'error'));
 }
 
 function updateInlineFileActions() {
@@ -2418,20 +3569,39 @@ function updateInlineFileActions() {
     });
 }
 
-function openFilePath(filePath) {
+// Executables are refused with "confirm_required" until the user confirms a second time
+function openFilePath(filePath, confirmed = false) {
+    const askConfirm = () => {
+        showConfirm('该文件是可执行程序，打开后会直接运行，可能危害电脑安全。确定要打开吗？')
+            .then(ok => { if (ok) openFilePath(filePath, true); });
+    };
     if (AppState.isWails) {
-        window.go.main.DesktopApp.OpenFile(filePath).catch(() => {
-            showToast('无法打开文件', 'error');
+        window.go.main.DesktopApp.OpenFile(filePath, confirmed).catch(err => {
+            if (String(err).includes('confirm_required')) askConfirm();
+            else showToast('无法打开文件', 'error');
         });
     } else {
         fetch('/open-file', {
             method: 'POST',
             headers: { 'Content-Type': 'application/json' },
-            body: JSON.stringify({ path: filePath })
-        }).catch(() => showToast('无法打开文件', 'error'));
+            body: JSON.stringify({ path: filePath, confirmed })
+        })
+        .then(r => {
+            if (r.status === 409) askConfirm();
+            else if (!r.ok) throw new Error();
+        })
+        .catch(() => showToast('无法打开文件', 'error'));
     }
 }
 
+// Accepting an executable needs an explicit confirmation
+function confirmExecutableAccept(transfer) {
+    if (!transfer || !transfer.isExecutable) return Promise.resolve(true);
+    return showConfirm(`「${transfer.fileName}」是可执行文件，可能包含恶意程序。请确认发送方可信后再接受。`);
+}
+
+const EXEC_WARNING_HTML = '<div class="tg-file-exec-warning">⚠ 可执行文件，请确认来源可信</div>';
+
 function openFolderPath(filePath) {
     if (AppState.isWails) {
         window.go.main.DesktopApp.RevealInExplorer(filePath).catch(() => {
@@ -2905,12 +4075,51 @@ function loadSettings() {
     } catch { /* ignore */ }
     applyFontSize(AppState.settings.fontSize);
     applySkin(AppState.settings.skin);
+    applyAccentColor(AppState.settings.accentColor);
+
+    // Desktop: the theme saved in config.json wins over localStorage (WebView data may be reset)
+    if (typeof window.go !== 'undefined' && window.go.main && window.go.main.DesktopApp) {
+        window.go.main.DesktopApp.GetAppInfo().then(info => {
+            if (!info.theme) return;
+            if (info.theme !== AppState.settings.skin) applySkin(info.theme);
+            if ((info.accentColor || '') !== AppState.settings.accentColor) applyAccentColor(info.accentColor);
+            localStorage.setItem('lanshare_settings', JSON.stringify(AppState.settings));
+        }).catch(() => {});
+    }
 }
 
 function saveSettings() {
     localStorage.setItem('lanshare_settings', JSON.stringify(AppState.settings));
 }
 
+// Persist skin + accent color to config.json so they survive restarts (title bar color applies next launch)
+function saveThemeSettings() {
+    saveSettings();
+    if (typeof window.go !== 'undefined' && window.go.main && window.go.main.DesktopApp) {
+        window.go.main.DesktopApp.SetTheme(AppState.settings.skin, AppState.settings.accentColor || '')
+            .catch(() => showToast('保存主题失败', 'error'));
+    }
+}
+
+// Override --tg-accent with a custom color; empty restores the skin default
+function applyAccentColor(color) {
+    const root = document.documentElement.style;
+    if (color && /^#[0-9a-fA-F]{6}$/.test(color)) {
+        AppState.settings.accentColor = color.toLowerCase();
+        root.setProperty('--tg-accent', color);
+        root.setProperty('--tg-accent-hover', color);
+    } else {
+        AppState.settings.accentColor = '';
+        root.removeProperty('--tg-accent');
+        root.removeProperty('--tg-accent-hover');
+    }
+    const input = document.getElementById('settingAccentColor');
+    if (input) {
+        input.value = AppState.settings.accentColor ||
+            getComputedStyle(document.documentElement).getPropertyValue('--tg-accent').trim() || '#2ca5e0';
+    }
+}
+
 function applyFontSize(size) {
     AppState.settings.fontSize = size;
     document.documentElement.style.setProperty('--tg-font-size', size + 'px');
@@ -3051,13 +4260,70 @@ function initSettings() {
     const onlineNotify = document.getElementById('settingOnlineNotify');
     const badgeCount = document.getElementById('settingBadgeCount');
     const saveHistoryToggle = document.getElementById('settingSaveHistory');
+    const imageByUrlToggle = document.getElementById('settingImageByUrl');
+    const autoReplyToggle = document.getElementById('settingAutoReply');
+    const autoReplyText = document.getElementById('settingAutoReplyText');
+    const closeToTrayRow = document.getElementById('closeToTrayRow');
+    const closeToTrayToggle = document.getElementById('settingCloseToTray');
+    const autoStartRow = document.getElementById('autoStartRow');
+    const autoStartToggle = document.getElementById('settingAutoStart');
     const logLevelSelect = document.getElementById('settingLogLevel');
+    const updateChannelSelect = document.getElementById('settingUpdateChannel');
     const openLogDirBtn = document.getElementById('openLogDirBtn');
+    const exportConfigBtn = document.getElementById('exportConfigBtn');
+    const importConfigBtn = document.getElementById('importConfigBtn');
+    const importConfigInput = document.getElementById('importConfigInput');
     const versionEl = document.getElementById('settingsVersion');
+    const connectQrImg = document.getElementById('connectQrImg');
+    const connectLinkText = document.getElementById('connectLinkText');
+    const copyConnectLinkBtn = document.getElementById('copyConnectLinkBtn');
+    const addPeerInput = document.getElementById('addPeerInput');
+    const addPeerBtn = document.getElementById('addPeerBtn');
+    const networkKeyInput = document.getElementById('networkKeyInput');
+    const saveNetworkKeyBtn = document.getElementById('saveNetworkKeyBtn');
+    const avatarPreview = document.getElementById('settingAvatarPreview');
+    const uploadAvatarBtn = document.getElementById('uploadAvatarBtn');
+    const uploadAvatarInput = document.getElementById('uploadAvatarInput');
+    const removeAvatarBtn = document.getElementById('removeAvatarBtn');
+
+    function renderAvatarPreview() {
+        const name = AppState.localUsername;
+        avatarPreview.style.background = getAvatarColor(name);
+        avatarPreview.textContent = getAvatarLetter(name);
+        applyAvatarImage(avatarPreview, name);
+    }
+
+    function saveAvatar(body, query) {
+        fetch('/upload-avatar' + query, { method: 'POST', body })
+            .then(async r => {
+                if (!r.ok) throw new Error((await r.text()).trim());
+                return r.json();
+            })
+            .then(data => {
+                const name = AppState.localUsername;
+                AppState.peerAvatars[name] = { ...(AppState.peerAvatars[name] || {}), hash: data.avatarHash || '' };
+                renderAvatarPreview();
+                displayMessages();
+                showToast(data.avatarHash ? '头像已更新' : '已恢复默认头像', 'success');
+            })
+            .catch(err => showToast('设置头像失败: ' + err.message, 'error'));
+    }
+
+    uploadAvatarBtn.addEventListener('click', () => uploadAvatarInput.click());
+    uploadAvatarInput.addEventListener('change', () => {
+        const file = uploadAvatarInput.files[0];
+        uploadAvatarInput.value = '';
+        if (!file) return;
+        const form = new FormData();
+        form.append('file', file);
+        saveAvatar(form, '');
+    });
+    removeAvatarBtn.addEventListener('click', () => saveAvatar(null, '?remove=true'));
 
     function openSettings() {
         // Populate current values
         usernameInput.value = AppState.localUsername;
+        renderAvatarPreview();
         fontDisplay.textContent = AppState.settings.fontSize;
         msgNotify.checked = AppState.settings.msgNotify;
         onlineNotify.checked = AppState.settings.onlineNotify;
@@ -3082,6 +4348,10 @@ function initSettings() {
             window.go.main.DesktopApp.GetAppInfo().then(info => {
                 const channelLabel = info.channel === 'stable' ? '稳定版' : '测试版';
                 versionEl.textContent = `LANShare Messager v${info.version} [${channelLabel}]`;
+                closeToTrayRow.style.display = '';
+                closeToTrayToggle.checked = info.closeToTray !== false;
+                autoStartRow.style.display = '';
+                autoStartToggle.checked = !!info.autoStart;
             }).catch(() => {});
         }
         fetch('/version')
@@ -3102,6 +4372,38 @@ function initSettings() {
                 }
             })
             .catch(() => {});
+        fetch('/update-channel')
+            .then(r => r.json())
+            .then(data => {
+                if (data.updateChannel) {
+                    updateChannelSelect.value = data.updateChannel;
+                }
+            })
+            .catch(() => {});
+        fetch('/image-by-url')
+            .then(r => r.json())
+            .then(data => { imageByUrlToggle.checked = !!data.enabled; })
+            .catch(() => {});
+        fetch('/network-key')
+            .then(r => r.json())
+            .then(data => {
+                networkKeyInput.value = '';
+                networkKeyInput.placeholder = data.enabled ? '已设置网络密钥（输入新密钥替换）' : '网络密钥（可选）';
+            })
+            .catch(() => {});
+        fetch('/auto-reply')
+            .then(r => r.json())
+            .then(data => {
+                autoReplyToggle.checked = !!data.enabled;
+                autoReplyText.value = data.text || '';
+                autoReplyText.placeholder = data.defaultText || '';
+            })
+            .catch(() => {});
+        fetch('/connect-info')
+            .then(r => r.json())
+            .then(data => { connectLinkText.value = data.link || ''; })
+            .catch(() => {});
+        connectQrImg.src = '/qrcode?t=' + Date.now();
     }
 
     openBtn.addEventListener('click', openSettings);
@@ -3115,7 +4417,20 @@ function initSettings() {
             if (!option) return;
             const skin = option.dataset.skin;
             applySkin(skin);
-            saveSettings();
+            saveThemeSettings();
+        });
+    }
+
+    // Accent color
+    const accentInput = document.getElementById('settingAccentColor');
+    if (accentInput) {
+        accentInput.addEventListener('change', () => {
+            applyAccentColor(accentInput.value);
+            saveThemeSettings();
+        });
+        document.getElementById('resetAccentBtn').addEventListener('click', () => {
+            applyAccentColor('');
+            saveThemeSettings();
         });
     }
 
@@ -3191,6 +4506,103 @@ function initSettings() {
         .catch(() => showToast('设置失败', 'error'));
     });
 
+    // Public images: broadcast a link, peers download from this machine
+    imageByUrlToggle.addEventListener('change', () => {
+        const enabled = imageByUrlToggle.checked;
+        fetch('/image-by-url', {
+            method: 'POST',
+            headers: { 'Content-Type': 'application/json' },
+            body: JSON.stringify({ enabled })
+        })
+        .then(r => {
+            if (!r.ok) throw new Error();
+            showToast(enabled ? '公聊图片将只发送链接' : '公聊图片将发送完整数据', 'success');
+        })
+        .catch(() => {
+            imageByUrlToggle.checked = !enabled;
+            showToast('设置失败', 'error');
+        });
+    });
+
+    // Pre-shared network key for encrypted discovery
+    saveNetworkKeyBtn.addEventListener('click', async () => {
+        const key = networkKeyInput.value.trim();
+        if (!key && !(await showConfirm('清空网络密钥后，发现消息将明文广播。确定吗？'))) return;
+        fetch('/network-key', {
+            method: 'POST',
+            headers: { 'Content-Type': 'application/json' },
+            body: JSON.stringify({ key })
+        })
+        .then(r => {
+            if (!r.ok) throw new Error();
+            networkKeyInput.value = '';
+            networkKeyInput.placeholder = key ? '已设置网络密钥（输入新密钥替换）' : '网络密钥（可选）';
+            showToast(key ? '网络密钥已保存，没有相同密钥的设备将无法通过广播发现本机' : '已关闭发现加密', 'success');
+        })
+        .catch(() => showToast('设置失败', 'error'));
+    });
+
+    // Auto reply to private messages while away
+    function saveAutoReply() {
+        const enabled = autoReplyToggle.checked;
+        return fetch('/auto-reply', {
+            method: 'POST',
+            headers: { 'Content-Type': 'application/json' },
+            body: JSON.stringify({ enabled, text: autoReplyText.value.trim() })
+        })
+        .then(r => {
+            if (!r.ok) return r.text().then(t => { throw new Error(t.trim()); });
+        });
+    }
+    autoReplyToggle.addEventListener('change', () => {
+        const enabled = autoReplyToggle.checked;
+        saveAutoReply()
+            .then(() => showToast(enabled ? '已开启自动回复' : '已关闭自动回复', 'success'))
+            .catch(err => {
+                autoReplyToggle.checked = !enabled;
+                showToast('设置失败' + (err.message ? ': ' + err.message : ''), 'error');
+            });
+    });
+    autoReplyText.addEventListener('change', () => {
+        saveAutoReply()
+            .then(() => showToast('自动回复内容已保存', 'success'))
+            .catch(err => showToast('设置失败' + (err.message ? ': ' + err.message : ''), 'error'));
+    });
+
+    // Close button behavior (desktop only)
+    closeToTrayToggle.addEventListener('change', () => {
+        const enabled = closeToTrayToggle.checked;
+        window.go.main.DesktopApp.SetCloseToTray(enabled)
+            .then(() => showToast(enabled ? '关闭窗口时将最小化到托盘' : '关闭窗口时将退出程序', 'success'))
+            .catch(() => showToast('设置失败', 'error'));
+    });
+
+    // Launch at login (desktop only)
+    autoStartToggle.addEventListener('change', () => {
+        const enabled = autoStartToggle.checked;
+        window.go.main.DesktopApp.SetAutoStart(enabled)
+            .then(() => showToast(enabled ? '已开启开机自动启动' : '已关闭开机自动启动', 'success'))
+            .catch(err => {
+                autoStartToggle.checked = !enabled;
+                showToast('设置开机自启动失败: ' + err, 'error');
+            });
+    });
+
+    // Update channel change
+    updateChannelSelect.addEventListener('change', () => {
+        fetch('/update-channel', {
+            method: 'POST',
+            headers: { 'Content-Type': 'application/json' },
+            body: JSON.stringify({ updateChannel: updateChannelSelect.value })
+        })
+        .then(r => {
+            if (!r.ok) throw new Error();
+            showToast('更新渠道已保存', 'success');
+            checkForUpdate();
+        })
+        .catch(() => showToast('设置失败', 'error'));
+    });
+
     // Log level change
     logLevelSelect.addEventListener('change', () => {
         const level = logLevelSelect.value;
@@ -3209,6 +4621,119 @@ function initSettings() {
         .catch(() => showToast('修改日志级别失败', 'error'));
     });
 
+    // Connect info: share this machine's lanshare:// link / QR code, or add a peer from one
+    copyConnectLinkBtn.addEventListener('click', () => {
+        if (!connectLinkText.value) return;
+        navigator.clipboard.writeText(connectLinkText.value)
+            .then(() => showToast('连接信息已复制', 'success'))
+            .catch(() => { connectLinkText.select(); showToast('请手动复制连接信息', 'warning'); });
+    });
+
+    const addPeer = () => {
+        const link = addPeerInput.value.trim();
+        if (!link) return;
+        addPeerBtn.disabled = true;
+        showToast('正在连接…', 'info');
+        fetch('/add-peer', {
+            method: 'POST',
+            headers: { 'Content-Type': 'application/json' },
+            body: JSON.stringify({ link })
+        })
+        .then(async r => {
+            if (r.status === 409) {
+                const data = await r.json();
+                showToast(`已连接到 ${data.name}，但${data.error}`, 'warning');
+                return;
+            }
+            if (!r.ok) throw new Error((await r.text()).trim() || '添加失败');
+            const data = await r.json();
+            if (data.status === 'connected') {
+                addPeerInput.value = '';
+                showToast(`已连接到 ${data.name}`, 'success');
+                loadUsers();
+            } else {
+                showToast('已发送连接请求，对方响应后会出现在列表中', 'info');
+            }
+        })
+        .catch(err => showToast(err.message || '添加失败', 'error'))
+        .finally(() => { addPeerBtn.disabled = false; });
+    };
+    addPeerBtn.addEventListener('click', addPeer);
+    addPeerInput.addEventListener('keydown', (e) => { if (e.key === 'Enter') addPeer(); });
+
+    // Export / import settings (for moving to another computer)
+    exportConfigBtn.addEventListener('click', () => {
+        const isWails = typeof window.go !== 'undefined';
+        if (isWails) {
+            window.go.main.DesktopApp.ExportConfig()
+                .then(path => { if (path) showToast(`设置已导出: ${path}`, 'success'); })
+                .catch(err => showToast('导出设置失败: ' + err, 'error'));
+        } else {
+            const a = document.createElement('a');
+            a.href = '/export-config';
+            a.download = 'lanshare-config.json';
+            a.click();
+        }
+    });
+
+    importConfigBtn.addEventListener('click', () => {
+        const isWails = typeof window.go !== 'undefined';
+        if (isWails) {
+            window.go.main.DesktopApp.ImportConfig()
+                .then(result => { if (result) onConfigImported(result); })
+                .catch(err => showToast('导入设置失败: ' + err, 'error'));
+        } else {
+            importConfigInput.click();
+        }
+    });
+
+    importConfigInput.addEventListener('change', () => {
+        const file = importConfigInput.files[0];
+        importConfigInput.value = '';
+        if (!file) return;
+        file.text()
+            .then(text => fetch('/import-config', {
+                method: 'POST',
+                headers: { 'Content-Type': 'application/json' },
+                body: text
+            }))
+            .then(async r => {
+                if (!r.ok) throw new Error((await r.text()).trim());
+                return r.json();
+            })
+            .then(onConfigImported)
+            .catch(err => showToast('导入设置失败: ' + err.message, 'error'));
+    });
+
+    function onConfigImported(result) {
+        const applied = result.applied || [];
+        (result.warnings || []).forEach(w => showToast(w, 'warning'));
+        if (applied.length === 0) {
+            showToast('导入的设置与当前一致', 'info');
+            return;
+        }
+        if (result.restartRequired && result.restartRequired.length > 0) {
+            showToast(`设置已导入，以下设置需重启后生效: ${result.restartRequired.join(', ')}`, 'warning');
+        } else {
+            showToast('设置已导入', 'success');
+        }
+        if (applied.includes('name')) {
+            fetch('/version')
+                .then(r => r.json())
+                .then(data => {
+                    if (!data.name) return;
+                    AppState.localUsername = data.name;
+                    usernameInput.value = data.name;
+                    document.querySelector('.tg-user-info').textContent = data.name + ' · ' + APP_DATA.localIP;
+                })
+                .catch(() => {});
+        }
+        if (applied.includes('theme') || applied.includes('accentColor')) {
+            loadSettings();
+        }
+        loadSettingsInfo();
+    }
+
     // Open log directory
     openLogDirBtn.addEventListener('click', () => {
         const isWails = typeof window.go !== 'undefined';
@@ -3234,6 +4759,7 @@ function initSettings() {
 // =================================
 let _lastUpdateVersion = null;
 let _lastUpdateCrossChannel = false;
+let _lastUpdateChangelog = '';
 let _localChannel = 'stable'; // set by /version on init
 function channelLabel(ch) {
     if (ch === 'test') return '测试版';
@@ -3251,6 +4777,7 @@ function checkForUpdate() {
                 text.textContent = `新版本 v${data.version} [${label}] (来自 ${data.source})`;
                 banner.style.display = 'flex';
                 _lastUpdateCrossChannel = !!data.crossChannel;
+                _lastUpdateChangelog = data.changelog || '';
                 // Reset button if a newer version appeared
                 if (_lastUpdateVersion !== data.version) {
                     _lastUpdateVersion = data.version;
@@ -3264,11 +4791,15 @@ function checkForUpdate() {
         .catch(() => {});
 }
 
-function doPerformUpdate() {
+function doPerformUpdate(confirmCrossChannel = false) {
     const btn = document.getElementById('updateBannerBtn');
     btn.disabled = true;
     btn.textContent = '下载中...';
-    fetch('/perform-update', { method: 'POST' })
+    fetch('/perform-update', {
+        method: 'POST',
+        headers: { 'Content-Type': 'application/json' },
+        body: JSON.stringify({ confirmCrossChannel })
+    })
         .then(r => r.json())
         .then(data => {
             if (data.status === 'updating') {
@@ -3289,18 +4820,30 @@ function doPerformUpdate() {
 function initUpdateBanner() {
     const btn = document.getElementById('updateBannerBtn');
     btn.addEventListener('click', () => {
+        if (!_lastUpdateCrossChannel && !_lastUpdateChangelog) {
+            doPerformUpdate();
+            return;
+        }
+        let message = '';
         if (_lastUpdateCrossChannel) {
-            showBanner('当前为正式版，确认要更新到测试版吗？测试版可能不稳定。', 'warning', {
-                id: 'cross-channel-confirm',
-                closable: true,
-                actions: [
-                    { label: '取消', class: 'secondary', onClick: (b, rm) => rm() },
-                    { label: '确认更新', class: 'primary', onClick: (b, rm) => { rm(); doPerformUpdate(); } }
-                ]
-            });
+            message = _localChannel === 'test'
+                ? '当前为测试版，确认要切换到正式版吗？'
+                : '当前为正式版，确认要更新到测试版吗？测试版可能不稳定。';
         } else {
-            doPerformUpdate();
+            message = `确认更新到 v${_lastUpdateVersion}？`;
+        }
+        if (_lastUpdateChangelog) {
+            message += `\n\n更新内容:\n${_lastUpdateChangelog}`;
         }
+        const banner = showBanner(message, _lastUpdateCrossChannel ? 'warning' : 'info', {
+            id: 'update-confirm',
+            closable: true,
+            actions: [
+                { label: '取消', class: 'secondary', onClick: (b, rm) => rm() },
+                { label: '确认更新', class: 'primary', onClick: (b, rm) => { rm(); doPerformUpdate(_lastUpdateCrossChannel); } }
+            ]
+        });
+        banner.querySelector('.tg-banner-text').style.whiteSpace = 'pre-line';
     });
 }
 
@@ -3323,6 +4866,9 @@ function pollUpdateStatus() {
                     showBanner(`更新失败: ${data.error || '未知错误'}`, 'error', { id: 'update-failed', duration: 5000 });
                     btn.disabled = false;
                     btn.textContent = '更新';
+                } else if (data.status === 'downloading' && data.downloaded > 0) {
+                    showBanner(formatUpdateProgress(data), 'info', { id: 'update-progress', closable: false });
+                    if (data.total > 0) btn.textContent = `${Math.floor(data.percent)}%`;
                 }
                 // 'downloading' — keep polling
             })
@@ -3330,6 +4876,20 @@ function pollUpdateStatus() {
     }, 1000);
 }
 
+function formatUpdateProgress(p) {
+    let text = `正在下载更新... ${formatBytes(p.downloaded)}`;
+    if (p.total > 0) {
+        text += ` / ${formatBytes(p.total)} (${p.percent.toFixed(0)}%)`;
+    }
+    if (p.speed > 0) {
+        text += ` · ${formatSpeed(p.speed)}`;
+        if (p.total > 0) {
+            text += ` · 剩余 ${formatETA(Math.ceil((p.total - p.downloaded) / p.speed))}`;
+        }
+    }
+    return text;
+}
+
 function showRestartConfirm() {
     showBanner('新版本已下载完成，是否立即重启？', 'success', {
         id: 'update-restart',
@@ -4,11 +4,19 @@ import {http} from '../models';
 
 export function APIHandler():Promise<http.Handler>;
 
+export function AcceptFileTransfer(arg1:string):Promise<boolean>;
+
+export function ClearTrayUnread():Promise<void>;
+
+export function ExportConfig():Promise<string>;
+
 export function GetAndClearLastNotifiedChat():Promise<string>;
 
 export function GetAppInfo():Promise<Record<string, any>>;
 
-export function OpenFile(arg1:string):Promise<void>;
+export function ImportConfig():Promise<Record<string, any>>;
+
+export function OpenFile(arg1:string,arg2:boolean):Promise<void>;
 
 export function OpenFileDialog():Promise<string>;
 
@@ -22,6 +30,8 @@ export function SaveFileDialog(arg1:string):Promise<string>;
 
 export function SaveWindowSize():Promise<void>;
 
+export function SendClipboardFiles(arg1:string):Promise<Array<Record<string, string>>>;
+
 export function SendFile(arg1:string):Promise<Record<string, string>>;
 
 export function SendFileFromBase64(arg1:string,arg2:string,arg3:string):Promise<Record<string, string>>;
@@ -32,8 +42,18 @@ export function SendImageBase64(arg1:string,arg2:string,arg3:string,arg4:string)
 
 export function SendImagePath(arg1:string,arg2:string):Promise<Record<string, string>>;
 
+export function SendMultipleFilePaths(arg1:Array<string>,arg2:string):Promise<Array<Record<string, string>>>;
+
+export function SetActiveChat(arg1:string):Promise<void>;
+
+export function SetAutoStart(arg1:boolean):Promise<void>;
+
+export function SetCloseToTray(arg1:boolean):Promise<void>;
+
 export function SetNotificationAppName(arg1:string):Promise<void>;
 
+export function SetTheme(arg1:string,arg2:string):Promise<void>;
+
 export function SetWindowIcon(arg1:string):Promise<void>;
 
 export function SetWindowTheme(arg1:string):Promise<void>;
@@ -6,6 +6,18 @@ export function APIHandler() {
   return window['go']['main']['DesktopApp']['APIHandler']();
 }
 
+export function AcceptFileTransfer(arg1) {
+  return window['go']['main']['DesktopApp']['AcceptFileTransfer'](arg1);
+}
+
+export function ClearTrayUnread() {
+  return window['go']['main']['DesktopApp']['ClearTrayUnread']();
+}
+
+export function ExportConfig() {
+  return window['go']['main']['DesktopApp']['ExportConfig']();
+}
+
 export function GetAndClearLastNotifiedChat() {
   return window['go']['main']['DesktopApp']['GetAndClearLastNotifiedChat']();
 }
@@ -14,8 +26,12 @@ export function GetAppInfo() {
   return window['go']['main']['DesktopApp']['GetAppInfo']();
 }
 
-export function OpenFile(arg1) {
-  return window['go']['main']['DesktopApp']['OpenFile'](arg1);
+export function ImportConfig() {
+  return window['go']['main']['DesktopApp']['ImportConfig']();
+}
+
+export function OpenFile(arg1, arg2) {
+  return window['go']['main']['DesktopApp']['OpenFile'](arg1, arg2);
 }
 
 export function OpenFileDialog() {
@@ -42,6 +58,10 @@ export function SaveWindowSize() {
   return window['go']['main']['DesktopApp']['SaveWindowSize']();
 }
 
+export function SendClipboardFiles(arg1) {
+  return window['go']['main']['DesktopApp']['SendClipboardFiles'](arg1);
+}
+
 export function SendFile(arg1) {
   return window['go']['main']['DesktopApp']['SendFile'](arg1);
 }
@@ -62,10 +82,30 @@ export function SendImagePath(arg1, arg2) {
   return window['go']['main']['DesktopApp']['SendImagePath'](arg1, arg2);
 }
 
+export function SendMultipleFilePaths(arg1, arg2) {
+  return window['go']['main']['DesktopApp']['SendMultipleFilePaths'](arg1, arg2);
+}
+
+export function SetActiveChat(arg1) {
+  return window['go']['main']['DesktopApp']['SetActiveChat'](arg1);
+}
+
+export function SetAutoStart(arg1) {
+  return window['go']['main']['DesktopApp']['SetAutoStart'](arg1);
+}
+
+export function SetCloseToTray(arg1) {
+  return window['go']['main']['DesktopApp']['SetCloseToTray'](arg1);
+}
+
 export function SetNotificationAppName(arg1) {
   return window['go']['main']['DesktopApp']['SetNotificationAppName'](arg1);
 }
 
+export function SetTheme(arg1, arg2) {
+  return window['go']['main']['DesktopApp']['SetTheme'](arg1, arg2);
+}
+
 export function SetWindowIcon(arg1) {
   return window['go']['main']['DesktopApp']['SetWindowIcon'](arg1);
 }